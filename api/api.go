@@ -2,12 +2,14 @@ package api
 
 import (
 	"context"
+	stderrors "errors"
 	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/romshark/zipapi/api/config"
 	"github.com/romshark/zipapi/store"
-	storemock "github.com/romshark/zipapi/store/mock"
 
 	"github.com/pkg/errors"
 )
@@ -33,6 +35,21 @@ type server struct {
 	httpSrv     *http.Server
 	tcpListener net.Listener
 	store       store.Store
+
+	// compressionSlots limits the number of entries
+	// compressed concurrently across all requests
+	compressionSlots chan struct{}
+
+	// gcStop stops the garbage collector, gcDone is closed when it stopped.
+	// Both are nil if the garbage collector is disabled
+	gcStop chan struct{}
+	gcDone chan struct{}
+
+	// jobs archives the asynchronous archive jobs in the background
+	jobs *jobRunner
+
+	// uploads keeps the partial files of the resumable uploads
+	uploads *uploadRegistry
 }
 
 // NewServer creates a new API server instance
@@ -43,16 +60,43 @@ func NewServer(conf *config.Config) (Server, error) {
 
 	// Initialize API server instance
 	srv := &server{
-		conf: conf,
+		conf:             conf,
+		store:            conf.Store,
+		compressionSlots: make(chan struct{}, conf.App.CompressionWorkers),
 	}
+	srv.jobs = newJobRunner(srv)
 
 	// Initialize store instance
-	srv.store = new(storemock.Store)
-
 	if err := srv.store.Init(); err != nil {
 		return nil, errors.Wrap(err, "store preparation")
 	}
 
+	// fail releases the resources acquired so far,
+	// the store must be closed to release its locks
+	fail := func(err error) (Server, error) {
+		if srv.tcpListener != nil {
+			srv.tcpListener.Close()
+		}
+		if srv.uploads != nil {
+			srv.uploads.close()
+		}
+		srv.store.Close()
+		return nil, err
+	}
+
+	// Resume the resumable uploads which didn't expire yet
+	uploads, err := openUploadRegistry(conf.App.UploadDir, time.Now())
+	if err != nil {
+		return fail(errors.Wrap(err, "upload registry preparation"))
+	}
+	srv.uploads = uploads
+
+	// Initialize the garbage collector
+	if conf.Retention.Interval > 0 && conf.Retention.Policy().Enabled() {
+		srv.gcStop = make(chan struct{})
+		srv.gcDone = make(chan struct{})
+	}
+
 	// Initialize HTTP server
 	srv.httpSrv = &http.Server{
 		Addr:        conf.TransportHTTP.Host,
@@ -71,11 +115,29 @@ func NewServer(conf *config.Config) (Server, error) {
 	}
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		return nil, errors.Wrap(err, "TCP listener setup")
+		return fail(errors.Wrap(err, "TCP listener setup"))
 	}
 	srv.httpSrv.Addr = listener.Addr().String()
 	srv.tcpListener = listener
 
+	// Resume the unfinished jobs and launch the job workers
+	if err := srv.jobs.start(context.Background()); err != nil {
+		srv.jobs.stop()
+		return fail(errors.Wrap(err, "job workers setup"))
+	}
+
+	// Periodically remove the expired uploads even if no uploads are created
+	purgeInterval := conf.App.UploadExpiration
+	if purgeInterval > maxUploadPurgeInterval {
+		purgeInterval = maxUploadPurgeInterval
+	}
+	srv.uploads.startPurging(purgeInterval)
+
+	// Launch the garbage collector
+	if srv.gcStop != nil {
+		go srv.runGC()
+	}
+
 	return srv, nil
 }
 
@@ -83,6 +145,10 @@ func (srv *server) logErrf(format string, v ...interface{}) {
 	srv.conf.ErrorLog.Printf(format, v...)
 }
 
+func (srv *server) logDebugf(format string, v ...interface{}) {
+	srv.conf.DebugLog.Printf(format, v...)
+}
+
 // Launch implements the Server interface
 func (srv *server) Run() error {
 	// Launch the HTTP server
@@ -109,9 +175,28 @@ func (srv *server) Run() error {
 	return nil
 }
 
-// Shutdown implements the Server interface
+// Shutdown implements the Server interface.
+// All resources are released even if the server
+// doesn't shut down gracefully before the context is done
 func (srv *server) Shutdown(ctx context.Context) error {
-	return srv.httpSrv.Shutdown(ctx)
+	var errs []error
+	if err := srv.httpSrv.Shutdown(ctx); err != nil {
+		// Forcibly close the remaining connections
+		srv.httpSrv.Close()
+		errs = append(errs, err)
+	}
+	srv.jobs.stop()
+	if err := srv.uploads.close(); err != nil {
+		errs = append(errs, errors.Wrap(err, "closing upload registry"))
+	}
+	if srv.gcStop != nil {
+		close(srv.gcStop)
+		<-srv.gcDone
+	}
+	if err := srv.store.Close(); err != nil {
+		errs = append(errs, errors.Wrap(err, "closing store"))
+	}
+	return stderrors.Join(errs...)
 }
 
 // Addr implements the Server interface
@@ -121,31 +206,56 @@ func (srv *server) Addr() string { return srv.httpSrv.Addr }
 func (srv *server) Store() store.Store { return srv.store }
 
 func (srv *server) ServeHTTP(out http.ResponseWriter, in *http.Request) {
-	// Allow POST methods only
-	if in.Method != "POST" {
-		http.Error(
-			out,
-			http.StatusText(http.StatusMethodNotAllowed),
-			http.StatusMethodNotAllowed,
-		)
-		return
-	}
-
 	var handler func(http.ResponseWriter, *http.Request) error
+	var allowedMethods []string
 
-	switch in.URL.Path {
+	switch {
 	// POST /archive
-	case "/archive":
-		fallthrough
-	case "/archive/":
+	case in.URL.Path == "/archive" || in.URL.Path == "/archive/":
+		allowedMethods = []string{http.MethodPost}
 		handler = srv.postArchive
+	// GET /archives
+	case in.URL.Path == "/archives" || in.URL.Path == "/archives/":
+		allowedMethods = []string{http.MethodGet, http.MethodHead}
+		handler = srv.getArchives
+	// GET /archives/{id}
+	case strings.HasPrefix(in.URL.Path, "/archives/"):
+		allowedMethods = []string{http.MethodGet, http.MethodHead}
+		handler = srv.getArchive
+	// OPTIONS, POST /uploads
+	case in.URL.Path == "/uploads" || in.URL.Path == "/uploads/":
+		allowedMethods = []string{http.MethodOptions, http.MethodPost}
+		handler = srv.serveUploads
+	// OPTIONS, HEAD, PATCH, DELETE /uploads/{id}
+	case strings.HasPrefix(in.URL.Path, "/uploads/"):
+		allowedMethods = []string{
+			http.MethodOptions,
+			http.MethodHead,
+			http.MethodPatch,
+			http.MethodDelete,
+		}
+		handler = srv.serveUpload
+	// GET /jobs/{id}
+	case strings.HasPrefix(in.URL.Path, "/jobs/"):
+		allowedMethods = []string{http.MethodGet, http.MethodHead}
+		handler = srv.getJob
 	// 404
 	default:
-		http.Error(
-			out,
-			http.StatusText(http.StatusNotFound),
+		writeProblem(out, newProblem(
 			http.StatusNotFound,
-		)
+			CodeNotFound,
+			"",
+		))
+		return
+	}
+
+	if !methodAllowed(in.Method, allowedMethods) {
+		out.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+		writeProblem(out, newProblem(
+			http.StatusMethodNotAllowed,
+			CodeMethodNotAllowed,
+			"",
+		))
 		return
 	}
 
@@ -157,10 +267,19 @@ func (srv *server) ServeHTTP(out http.ResponseWriter, in *http.Request) {
 			in.Method,
 			err,
 		)
-		http.Error(
-			out,
-			http.StatusText(http.StatusInternalServerError),
+		writeProblem(out, newProblem(
 			http.StatusInternalServerError,
-		)
+			CodeInternal,
+			"",
+		))
+	}
+}
+
+func methodAllowed(method string, allowed []string) bool {
+	for _, m := range allowed {
+		if method == m {
+			return true
+		}
 	}
+	return false
 }
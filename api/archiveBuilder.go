@@ -0,0 +1,463 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/romshark/zipapi/store"
+
+	"github.com/pkg/errors"
+)
+
+// fileTooLargeError is returned when an uploaded file
+// exceeds the maximum file size
+type fileTooLargeError struct {
+	name    string
+	maxSize uint64
+
+	// field names the form field the file was uploaded in
+	field string
+}
+
+func (err fileTooLargeError) Error() string {
+	return fmt.Sprintf(
+		"file '%s' exceeds max file size (%d)",
+		err.name,
+		err.maxSize,
+	)
+}
+
+// fileSizeLimiter reads from r and fails with a fileTooLargeError
+// when more than the maximum file size is read
+type fileSizeLimiter struct {
+	r    io.Reader
+	read uint64
+	err  fileTooLargeError
+}
+
+func (l *fileSizeLimiter) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += uint64(n)
+	if l.read > l.err.maxSize {
+		return n, l.err
+	}
+	return n, err
+}
+
+// responseTracker tracks whether the response body was written to
+type responseTracker struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *responseTracker) Write(p []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the underlying response writer
+// for http.ResponseController
+func (w *responseTracker) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// spooledResponse buffers the archive and the response headers
+// until the archive is complete and sent
+type spooledResponse struct {
+	out    http.ResponseWriter
+	header http.Header
+	body   *spool
+}
+
+func newSpooledResponse(out http.ResponseWriter, limit int64) *spooledResponse {
+	return &spooledResponse{
+		out:    out,
+		header: make(http.Header),
+		body:   newSpool(limit),
+	}
+}
+
+// Header implements the http.ResponseWriter interface
+func (r *spooledResponse) Header() http.Header { return r.header }
+
+// Write implements the http.ResponseWriter interface
+func (r *spooledResponse) Write(p []byte) (int, error) {
+	return r.body.Write(p)
+}
+
+// WriteHeader implements the http.ResponseWriter interface,
+// the status is written by send
+func (r *spooledResponse) WriteHeader(statusCode int) {}
+
+// send sends the buffered archive along with its headers.
+// The values of the declared trailers are sent as headers
+// since they're known by now
+func (r *spooledResponse) send() error {
+	header := r.out.Header()
+	for name, values := range r.header {
+		if name != "Trailer" {
+			header[name] = values
+		}
+	}
+	header.Set("Content-Length", strconv.FormatInt(r.body.Size(), 10))
+	r.out.WriteHeader(http.StatusOK)
+	if _, err := r.body.WriteTo(r.out); err != nil {
+		return errors.Wrap(err, "sending spooled archive")
+	}
+	return nil
+}
+
+// fileSaver streams the data written to it into a new file in the store
+type fileSaver struct {
+	pipe *io.PipeWriter
+	done chan struct{}
+	file store.File
+	err  error
+}
+
+// saveFile starts saving a new file to the store,
+// the file is complete once the saver is closed
+func (srv *server) saveFile(
+	ctx context.Context,
+	file store.File,
+) *fileSaver {
+	r, w := io.Pipe()
+	s := &fileSaver{pipe: w, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		s.file, s.err = srv.store.SaveFile(ctx, file, r)
+		// Unblock the writer in case the store stopped reading early
+		if s.err != nil {
+			r.CloseWithError(s.err)
+		} else {
+			r.CloseWithError(errors.New("file already saved"))
+		}
+	}()
+	return s
+}
+
+// Write implements the io.Writer interface
+func (s *fileSaver) Write(p []byte) (int, error) {
+	return s.pipe.Write(p)
+}
+
+// close completes the file and returns it once it's saved
+func (s *fileSaver) close() (store.File, error) {
+	s.pipe.Close()
+	<-s.done
+	return s.file, s.err
+}
+
+// abort cancels saving the file and removes it if it was already saved
+func (s *fileSaver) abort(srv *server) {
+	s.pipe.CloseWithError(errors.New("aborted"))
+	<-s.done
+	if s.err == nil {
+		srv.deleteFile(s.file)
+	}
+}
+
+// deleteFile removes an uncommitted file from the store
+func (srv *server) deleteFile(file store.File) {
+	if err := srv.store.DeleteFile(
+		context.Background(),
+		file.ID,
+	); err != nil {
+		srv.logErrf("removing uncommitted file %s: %s", file.ID, err)
+	}
+}
+
+// archiveWriter writes the entries of an archive in a specific format
+type archiveWriter interface {
+	// writeFile writes a file entry with the given metadata
+	// reading its contents from r
+	writeFile(name string, meta entryMeta, r io.Reader) error
+
+	// writeDirectory writes an explicit directory entry
+	writeDirectory(dir string) error
+
+	// close finalizes the archive writing the archive comment
+	// if the format supports it
+	close(comment string) error
+
+	// release releases the resources held by the writer
+	release()
+}
+
+// archiveBuilder writes the uploaded files to an archive
+// streaming the files and the archive into the store
+// and records the archive once it's finished
+type archiveBuilder struct {
+	srv         *server
+	ctx         context.Context
+	id          string
+	created     time.Time
+	clientAgent string
+	format      archiveFormat
+	archive     archiveWriter
+	contents    *fileSaver
+	checksum    hash.Hash
+	files       []store.File
+	committed   bool
+
+	// encrypted is true if the archive is password protected,
+	// its files aren't saved to the store then
+	encrypted bool
+
+	// spooled buffers the response in spool mode, it's nil otherwise
+	spooled *spooledResponse
+
+	// checksums defines the checksums entry written on finish,
+	// entries lists the archived files it describes
+	checksums     checksumsEntry
+	entries       []ArchiveManifestEntry
+	deterministic bool
+}
+
+// newArchiveBuilder creates a new archive builder writing the archive
+// to out according to the archive options. The entries are encrypted
+// if the password isn't empty, which requires the zip format.
+// If spool is true nothing is written to out until the archive is finished,
+// otherwise failures are reported in the archive error trailer.
+// The archive is saved under the given ID, a new one is generated if it's empty.
+// The builder must be released by calling release once it's no longer used
+func (srv *server) newArchiveBuilder(
+	ctx context.Context,
+	out http.ResponseWriter,
+	spool bool,
+	id string,
+	created time.Time,
+	clientAgent string,
+	opts archiveOptions,
+) (*archiveBuilder, error) {
+	format := opts.format
+	var err error
+	if id == "" {
+		if id, err = store.NewID(); err != nil {
+			return nil, err
+		}
+	}
+	var spooled *spooledResponse
+	if spool {
+		spooled = newSpooledResponse(
+			out,
+			int64(srv.conf.App.MaxMultipartMembuf),
+		)
+		out = spooled
+	}
+	header := out.Header()
+	header.Add("Trailer", HeaderArchiveError)
+	header.Set(HeaderArchiveID, id)
+	header.Set("Content-Type", format.contentType)
+	header.Set(
+		"Content-Disposition",
+		fmt.Sprintf(`attachment; filename="%s%s"`, id, format.extension),
+	)
+
+	// Init the archive writer saving the archive to the store
+	// and computing its checksum while writing it to the response
+	b := &archiveBuilder{
+		srv:         srv,
+		ctx:         ctx,
+		id:          id,
+		created:     created,
+		clientAgent: clientAgent,
+		format:      format,
+		checksum:    sha256.New(),
+		encrypted:   opts.password != "",
+		spooled:     spooled,
+
+		checksums:     opts.checksums,
+		deterministic: opts.deterministic,
+	}
+	b.contents = srv.saveFile(ctx, store.File{
+		Upload: store.UploadInfo{
+			Time:        created,
+			ClientAgent: clientAgent,
+		},
+		Name: id + format.extension,
+	})
+	dest := io.MultiWriter(out, b.contents, b.checksum)
+	modTime := created
+	if opts.deterministic {
+		modTime = opts.modTime
+	}
+	if format == formatZip {
+		b.archive = srv.newZipWriter(
+			ctx,
+			dest,
+			id,
+			header,
+			opts,
+		)
+	} else if b.encrypted {
+		b.contents.abort(srv)
+		return nil, errors.New("encryption requires the zip format")
+	} else if b.archive, err = srv.newTarWriter(
+		dest,
+		format,
+		modTime,
+		opts.compression,
+	); err != nil {
+		b.contents.abort(srv)
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// addFile reads the file from r and writes it to the archive
+// with the given metadata. Returns a fileTooLargeError
+// if the file exceeds the maximum file size
+func (b *archiveBuilder) addFile(
+	name string,
+	meta entryMeta,
+	r io.Reader,
+) error {
+	limiter := &fileSizeLimiter{
+		r: r,
+		err: fileTooLargeError{
+			name:    name,
+			maxSize: b.srv.conf.App.MaxFileSize,
+		},
+	}
+	digest := newContentDigest()
+	contents := io.TeeReader(limiter, digest)
+
+	// The files of encrypted archives are neither saved nor recorded
+	// since neither their contents nor their plaintext checksums
+	// may be revealed
+	if b.encrypted {
+		if err := b.archive.writeFile(name, meta, contents); err != nil {
+			return err
+		}
+		b.addEntry(name, int64(limiter.read), digest)
+		return nil
+	}
+
+	// Write the file to the archive while saving it to the store
+	saver := b.srv.saveFile(b.ctx, store.File{
+		Upload: store.UploadInfo{
+			Time:        b.created,
+			ClientAgent: b.clientAgent,
+		},
+		Name:    name,
+		ModTime: meta.modTime,
+		Mode:    meta.mode,
+		Comment: meta.comment,
+	})
+	if err := b.archive.writeFile(
+		name,
+		meta,
+		io.TeeReader(contents, saver),
+	); err != nil {
+		saver.abort(b.srv)
+		return err
+	}
+
+	file, err := saver.close()
+	if err != nil {
+		return errors.Wrapf(err, "saving file '%s' to store", name)
+	}
+	file.Checksum = digest.checksum()
+	b.files = append(b.files, file)
+	b.addEntry(name, file.Size, digest)
+
+	return nil
+}
+
+// addEntry records the archived file for the checksums entry
+func (b *archiveBuilder) addEntry(
+	name string,
+	size int64,
+	digest *contentDigest,
+) {
+	// The checksums entry is encrypted along with the other entries
+	entry := ArchiveManifestEntry{
+		Name:        name,
+		Size:        size,
+		SHA256:      digest.checksum(),
+		ContentType: digest.contentType(),
+	}
+	if !b.deterministic {
+		entry.UploadTime = &b.created
+	}
+	b.entries = append(b.entries, entry)
+}
+
+// addDirectory writes an explicit directory entry to the archive
+func (b *archiveBuilder) addDirectory(dir string) error {
+	return b.archive.writeDirectory(dir)
+}
+
+// finish finalizes the archive with the given archive comment
+// and saves it to the store
+func (b *archiveBuilder) finish(comment string) error {
+	if b.checksums != checksumsNone {
+		contents, err := b.checksums.encode(b.entries)
+		if err != nil {
+			return errors.Wrap(err, "encoding checksums")
+		}
+		if err := b.archive.writeFile(
+			b.checksums.name(),
+			entryMeta{},
+			bytes.NewReader(contents),
+		); err != nil {
+			return errors.Wrap(err, "writing checksums")
+		}
+	}
+
+	if err := b.archive.close(comment); err != nil {
+		return err
+	}
+
+	contents, err := b.contents.close()
+	if err != nil {
+		return errors.Wrap(err, "saving archive contents to store")
+	}
+
+	if err := b.srv.store.SaveArchive(b.ctx, store.Archive{
+		ID:          b.id,
+		Created:     b.created,
+		ClientAgent: b.clientAgent,
+		Files:       b.files,
+		ContentsID:  contents.ID,
+		Size:        contents.Size,
+		Checksum:    hex.EncodeToString(b.checksum.Sum(nil)),
+		Format:      b.format.name,
+		Encrypted:   b.encrypted,
+		Comment:     comment,
+	}); err != nil {
+		return errors.Wrap(err, "saving archive to store")
+	}
+	b.committed = true
+
+	if b.spooled != nil {
+		return b.spooled.send()
+	}
+	return nil
+}
+
+// release removes all saved files from the store
+// unless the archive was committed
+func (b *archiveBuilder) release() {
+	b.archive.release()
+	if b.spooled != nil {
+		b.spooled.body.Close()
+	}
+	if b.committed {
+		return
+	}
+	b.contents.abort(b.srv)
+	for _, file := range b.files {
+		b.srv.deleteFile(file)
+	}
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// ParamDeterministic defines the query parameter or form field
+	// enabling the deterministic mode producing identical archives
+	// for identical inputs
+	ParamDeterministic = "deterministic"
+
+	// ParamModTime defines the query parameter or form field
+	// defining the modification time (RFC 3339) of all entries
+	// in deterministic mode
+	ParamModTime = "mtime"
+)
+
+// dosEpoch defines the earliest time representable in zip archives,
+// it's the default modification time of all entries in deterministic mode
+var dosEpoch = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// archiveOptions represents the archive options requested by the client
+type archiveOptions struct {
+	format      archiveFormat
+	compression compression
+
+	// password encrypts the entries if not empty
+	password string
+
+	// checksums defines the checksums entry
+	// written at the end of the archive
+	checksums checksumsEntry
+
+	// deterministic sorts the entries by name
+	// and sets the modification time of all entries to modTime
+	deterministic bool
+	modTime       time.Time
+}
+
+// archiveOptions returns the archive options requested by the client.
+// param returns the value of a request parameter,
+// field returns the value of a form field.
+// Returns a notAcceptableError if no format matches the Accept header
+func (srv *server) archiveOptions(
+	in *http.Request,
+	param func(name string) string,
+	field func(name string) string,
+) (opts archiveOptions, err error) {
+	if opts.compression, err = srv.compressionOptions(param); err != nil {
+		return opts, err
+	}
+	// Asynchronous jobs respond with JSON instead of the archive,
+	// their format is only defined by the format parameter
+	async, _ := strconv.ParseBool(in.URL.Query().Get(ParamAsync))
+	if opts.format, err = negotiateFormat(in, param, !async); err != nil {
+		return opts, err
+	}
+
+	// The password isn't accepted as a query parameter
+	// to keep it out of URLs and access logs
+	opts.password = requestPassword(in, field)
+	if err := checkEncryption(opts.format, opts.password); err != nil {
+		return opts, err
+	}
+
+	if opts.checksums, err = parseChecksumsEntry(param(ParamChecksums)); err != nil {
+		return opts, err
+	}
+
+	if deterministic := param(ParamDeterministic); deterministic != "" {
+		if opts.deterministic, err = strconv.ParseBool(deterministic); err != nil {
+			return opts, invalidParameter(
+				ParamDeterministic,
+				"invalid '%s' parameter, expected boolean",
+				ParamDeterministic,
+			)
+		}
+	}
+	modTime := param(ParamModTime)
+	switch {
+	case !opts.deterministic && modTime != "":
+		return opts, invalidParameter(
+			ParamModTime,
+			"'%s' parameter requires deterministic mode",
+			ParamModTime,
+		)
+	case !opts.deterministic:
+		return opts, nil
+	case opts.password != "":
+		// Encryption requires random salts
+		return opts, invalidParameter(
+			ParamDeterministic,
+			"deterministic mode doesn't support passwords",
+		)
+	case modTime == "":
+		opts.modTime = dosEpoch
+		return opts, nil
+	}
+
+	if opts.modTime, err = parseModTime(modTime); err != nil {
+		return opts, invalidParameter(
+			ParamModTime,
+			"invalid '%s' parameter: %s",
+			ParamModTime,
+			err,
+		)
+	}
+	opts.modTime = opts.modTime.Truncate(2 * time.Second)
+	return opts, nil
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// ParamChecksums defines the query parameter or form field
+	// choosing the checksums entry written at the end of the archive,
+	// either "manifest" (MANIFEST.json) or "sha256sums" (SHA256SUMS)
+	ParamChecksums = "checksums"
+
+	// ManifestEntryName defines the name of the JSON encoded
+	// ArchiveManifest entry
+	ManifestEntryName = "MANIFEST.json"
+
+	// SHA256SumsEntryName defines the name of the checksums entry
+	// in the format of sha256sum
+	SHA256SumsEntryName = "SHA256SUMS"
+)
+
+// ArchiveManifestEntry describes an archived file in the ArchiveManifest
+type ArchiveManifestEntry struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	ContentType string `json:"content_type"`
+
+	// UploadTime is omitted in deterministic mode
+	UploadTime *time.Time `json:"upload_time,omitempty"`
+}
+
+// ArchiveManifest represents the MANIFEST.json archive entry
+// listing the archived files in the order of archivation
+type ArchiveManifest struct {
+	Entries []ArchiveManifestEntry `json:"entries"`
+}
+
+// checksumsEntry represents the kind of checksums entry
+// written at the end of the archive, none if empty
+type checksumsEntry string
+
+const (
+	checksumsNone       checksumsEntry = ""
+	checksumsManifest   checksumsEntry = "manifest"
+	checksumsSHA256Sums checksumsEntry = "sha256sums"
+)
+
+// parseChecksumsEntry parses the checksums entry parameter
+func parseChecksumsEntry(value string) (checksumsEntry, error) {
+	switch entry := checksumsEntry(value); entry {
+	case checksumsNone, checksumsManifest, checksumsSHA256Sums:
+		return entry, nil
+	}
+	return checksumsNone, invalidParameter(
+		ParamChecksums,
+		"invalid '%s' parameter, expected '%s' or '%s'",
+		ParamChecksums,
+		checksumsManifest,
+		checksumsSHA256Sums,
+	)
+}
+
+// name returns the name of the checksums entry
+func (c checksumsEntry) name() string {
+	switch c {
+	case checksumsManifest:
+		return ManifestEntryName
+	case checksumsSHA256Sums:
+		return SHA256SumsEntryName
+	}
+	return ""
+}
+
+// encode returns the contents of the checksums entry
+func (c checksumsEntry) encode(entries []ArchiveManifestEntry) ([]byte, error) {
+	if c == checksumsManifest {
+		if entries == nil {
+			entries = []ArchiveManifestEntry{}
+		}
+		return json.MarshalIndent(ArchiveManifest{Entries: entries}, "", "\t")
+	}
+
+	// Names containing line breaks are escaped like sha256sum does
+	buf := new(bytes.Buffer)
+	for _, entry := range entries {
+		name := entry.Name
+		if strings.ContainsAny(name, "\n\r") {
+			buf.WriteByte('\\')
+			name = strings.NewReplacer("\n", `\n`, "\r", `\r`).Replace(name)
+		}
+		fmt.Fprintf(buf, "%s  %s\n", entry.SHA256, name)
+	}
+	return buf.Bytes(), nil
+}
+
+// contentDigest computes the SHA-256 checksum of the data written to it
+// and sniffs its content type
+type contentDigest struct {
+	hash hash.Hash
+	head []byte
+}
+
+func newContentDigest() *contentDigest {
+	return &contentDigest{hash: sha256.New()}
+}
+
+// Write implements the io.Writer interface
+func (d *contentDigest) Write(p []byte) (int, error) {
+	if missing := sniffLen - len(d.head); missing > 0 {
+		if missing > len(p) {
+			missing = len(p)
+		}
+		d.head = append(d.head, p[:missing]...)
+	}
+	return d.hash.Write(p)
+}
+
+// checksum returns the hex encoded SHA-256 checksum
+func (d *contentDigest) checksum() string {
+	return hex.EncodeToString(d.hash.Sum(nil))
+}
+
+// contentType returns the sniffed content type
+func (d *contentDigest) contentType() string {
+	return http.DetectContentType(d.head)
+}
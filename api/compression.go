@@ -0,0 +1,64 @@
+package api
+
+import (
+	"strconv"
+
+	"github.com/romshark/zipapi/api/config"
+)
+
+const (
+	// ParamCompression defines the query parameter or form field
+	// choosing the compression method ("store", "deflate", "zstd" or "xz")
+	ParamCompression = "compression"
+
+	// ParamLevel defines the query parameter or form field
+	// choosing the compression level (0-9)
+	ParamLevel = "level"
+)
+
+// compression represents the compression options of an archive
+type compression struct {
+	method config.CompressionMethod
+	level  int
+}
+
+// compressionOptions returns the compression options requested
+// by the client falling back to the configured defaults.
+// param returns the value of a request parameter.
+// Returns an error if the client requested options exceeding the limits
+func (srv *server) compressionOptions(
+	param func(name string) string,
+) (compression, error) {
+	conf := srv.conf.App.Compression
+	opts := compression{method: conf.Method, level: conf.Level}
+
+	if method := param(ParamCompression); method != "" {
+		opts.method = config.CompressionMethod(method)
+		if err := opts.method.Validate(); err != nil {
+			return opts, invalidParameter(ParamCompression, "%s", err)
+		}
+		if !conf.Allows(opts.method) {
+			return opts, invalidParameter(
+				ParamCompression,
+				"compression method '%s' not allowed",
+				opts.method,
+			)
+		}
+	}
+
+	if level := param(ParamLevel); level != "" {
+		var err error
+		if opts.level, err = strconv.Atoi(level); err != nil {
+			return opts, invalidParameter(
+				ParamLevel,
+				"invalid compression level '%s'",
+				level,
+			)
+		}
+	}
+	if err := conf.ValidateLevel(opts.method, opts.level); err != nil {
+		return opts, invalidParameter(ParamLevel, "%s", err)
+	}
+
+	return opts, nil
+}
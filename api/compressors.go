@@ -0,0 +1,120 @@
+package api
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"io"
+
+	"github.com/romshark/zipapi/api/config"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	// zipMethodZstd defines the zip compression method ID of Zstandard
+	zipMethodZstd uint16 = 93
+
+	// zipMethodXz defines the zip compression method ID of xz
+	zipMethodXz uint16 = 95
+)
+
+// compressor represents a compression method of zip entries
+type compressor struct {
+	// method defines the zip compression method ID
+	method uint16
+
+	// newWriter creates a new writer compressing the data written to it
+	// into out at the given compression level (0-9)
+	newWriter func(out io.Writer, level int) (io.WriteCloser, error)
+}
+
+// compressors maps the compression methods to their compressors,
+// the store method isn't listed since it doesn't compress
+var compressors = map[config.CompressionMethod]compressor{
+	config.CompressionDeflate: {
+		method: zip.Deflate,
+		newWriter: func(out io.Writer, level int) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		},
+	},
+	config.CompressionZstd: {
+		method: zipMethodZstd,
+		newWriter: func(out io.Writer, level int) (io.WriteCloser, error) {
+			return zstd.NewWriter(
+				out,
+				zstd.WithEncoderLevel(zstdLevel(level)),
+				zstd.WithEncoderConcurrency(1),
+			)
+		},
+	},
+	config.CompressionXz: {
+		method: zipMethodXz,
+		// xz doesn't support compression levels,
+		// only the default level is accepted
+		newWriter: func(out io.Writer, level int) (io.WriteCloser, error) {
+			return &xzWriter{out: out}, nil
+		},
+	},
+}
+
+// xzWriter creates the xz writer on the first write.
+// xz.NewWriter writes the stream header immediately
+// while zip.Writer creates the compressor of an entry
+// before writing the entry's header
+type xzWriter struct {
+	out io.Writer
+	xz  *xz.Writer
+}
+
+func (w *xzWriter) init() (err error) {
+	if w.xz == nil {
+		w.xz, err = xz.NewWriter(w.out)
+	}
+	return err
+}
+
+// Write implements the io.Writer interface
+func (w *xzWriter) Write(p []byte) (int, error) {
+	if err := w.init(); err != nil {
+		return 0, err
+	}
+	return w.xz.Write(p)
+}
+
+// Close implements the io.Closer interface
+func (w *xzWriter) Close() error {
+	if err := w.init(); err != nil {
+		return err
+	}
+	return w.xz.Close()
+}
+
+// zstdLevel maps the compression level (1-9)
+// to the closest Zstandard encoder level,
+// level 0 is rejected since zstd can't store uncompressed
+func zstdLevel(level int) zstd.EncoderLevel {
+	switch {
+	case level < 2:
+		return zstd.SpeedFastest
+	case level < 5:
+		return zstd.SpeedDefault
+	case level < 8:
+		return zstd.SpeedBetterCompression
+	}
+	return zstd.SpeedBestCompression
+}
+
+// registerCompressors registers all compressors with the zip writer
+// compressing at the given compression level
+func registerCompressors(zw *zip.Writer, level int) {
+	for _, c := range compressors {
+		newWriter := c.newWriter
+		zw.RegisterCompressor(
+			c.method,
+			func(out io.Writer) (io.WriteCloser, error) {
+				return newWriter(out, level)
+			},
+		)
+	}
+}
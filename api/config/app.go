@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 // App represents the application configurations
 type App struct {
 	// MaxReqSize defines the maximum request size in bytes
@@ -10,4 +12,46 @@ type App struct {
 
 	// MaxMultipartMembuf defines the maximum multipart/form-data memory buffer
 	MaxMultipartMembuf uint64
+
+	// StreamUploads enables writing the uploaded files to the archive
+	// while they're being received instead of parsing the entire
+	// multipart/form-data request first
+	StreamUploads bool
+
+	// SpoolResponses enables building the entire archive
+	// into a memory buffer or a temporary file before sending it,
+	// which allows responding with an error status if archiving fails
+	// and with the Content-Length of the archive
+	SpoolResponses bool
+
+	// NameCollision defines the default policy for colliding
+	// archive entry names, clients may choose a different one per request
+	NameCollision NameCollision
+
+	// Compression defines the archive compression configurations,
+	// DefaultCompression is used if it's nil
+	Compression *Compression
+
+	// CompressionWorkers defines the maximum number of entries compressed
+	// concurrently across all requests. Entries are compressed one after
+	// another while they're being received if it's 1, otherwise each entry
+	// is buffered and compressed in the background
+	CompressionWorkers int
+
+	// JobWorkers defines the maximum number of asynchronous archive jobs
+	// archived concurrently in the background
+	JobWorkers int
+
+	// MaxQueuedJobs defines the maximum number of asynchronous archive jobs
+	// waiting for a worker, further jobs are rejected until the queue drains
+	MaxQueuedJobs int
+
+	// UploadDir defines the directory the partial files
+	// of resumable uploads are kept in. A temporary directory
+	// removed on shutdown is used if it's empty
+	UploadDir string
+
+	// UploadExpiration defines the duration after which an unfinished
+	// resumable upload expires unless it's resumed
+	UploadExpiration time.Duration
 }
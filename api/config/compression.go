@@ -0,0 +1,148 @@
+package config
+
+import (
+	"compress/flate"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// CompressionMethod defines the compression method of archive entries
+type CompressionMethod string
+
+const (
+	// CompressionStore stores the archive entries uncompressed
+	CompressionStore CompressionMethod = "store"
+
+	// CompressionDeflate compresses the archive entries using deflate
+	CompressionDeflate CompressionMethod = "deflate"
+
+	// CompressionZstd compresses the archive entries using Zstandard
+	// (zip method 93), not all zip readers support it
+	CompressionZstd CompressionMethod = "zstd"
+
+	// CompressionXz compresses the archive entries using xz
+	// (zip method 95), not all zip readers support it
+	CompressionXz CompressionMethod = "xz"
+)
+
+// Validate returns an error if the compression method is unknown
+func (cm CompressionMethod) Validate() error {
+	switch cm {
+	case CompressionStore:
+		fallthrough
+	case CompressionDeflate:
+		fallthrough
+	case CompressionZstd:
+		fallthrough
+	case CompressionXz:
+		return nil
+	}
+	return fmt.Errorf("unknown compression method: '%s'", cm)
+}
+
+// Compression represents the archive compression configurations
+type Compression struct {
+	// Method defines the default compression method
+	Method CompressionMethod
+
+	// Level defines the default compression level (0-9)
+	Level int
+
+	// MaxLevel defines the maximum compression level clients may request
+	MaxLevel int
+
+	// Methods lists the compression methods clients may request,
+	// methods not listed are refused
+	Methods []CompressionMethod
+
+	// SkipCompressed stores the entries of already compressed formats
+	// (such as JPEG, MP4 or zip) uncompressed
+	SkipCompressed bool
+
+	// CompareSizes stores entries uncompressed if compressing them
+	// doesn't reduce their size. This requires buffering each entry
+	CompareSizes bool
+}
+
+// DefaultCompression returns the default compression configurations
+func DefaultCompression() *Compression {
+	return &Compression{
+		Method:   CompressionDeflate,
+		Level:    flate.BestCompression,
+		MaxLevel: flate.BestCompression,
+		Methods:  []CompressionMethod{CompressionStore, CompressionDeflate},
+
+		SkipCompressed: true,
+	}
+}
+
+// Allows returns true if clients may request the given compression method
+func (conf *Compression) Allows(method CompressionMethod) bool {
+	for _, allowed := range conf.Methods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateLevel returns an error if the given compression level
+// is out of range, exceeds the maximum level
+// or isn't supported by the compression method.
+// zstd doesn't support level 0 and xz only supports the default level
+// since it doesn't support compression levels
+func (conf *Compression) ValidateLevel(
+	method CompressionMethod,
+	level int,
+) error {
+	if level < flate.NoCompression || level > flate.BestCompression {
+		return fmt.Errorf(
+			"compression level %d out of range (%d-%d)",
+			level,
+			flate.NoCompression,
+			flate.BestCompression,
+		)
+	}
+	if level > conf.MaxLevel {
+		return fmt.Errorf(
+			"compression level %d exceeds max level (%d)",
+			level,
+			conf.MaxLevel,
+		)
+	}
+	switch {
+	case method == CompressionZstd && level == flate.NoCompression:
+		return fmt.Errorf(
+			"compression level %d not supported by %s",
+			level,
+			method,
+		)
+	case method == CompressionXz && level != conf.Level:
+		return fmt.Errorf("%s doesn't support compression levels", method)
+	}
+	return nil
+}
+
+// Validate returns an error if the configurations are invalid
+func (conf *Compression) Validate() error {
+	for _, method := range conf.Methods {
+		if err := method.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := conf.Method.Validate(); err != nil {
+		return errors.Wrap(err, "default method")
+	}
+	if !conf.Allows(conf.Method) {
+		return fmt.Errorf("default method '%s' not allowed", conf.Method)
+	}
+	if conf.MaxLevel < flate.NoCompression ||
+		conf.MaxLevel > flate.BestCompression {
+		return fmt.Errorf("max level %d out of range", conf.MaxLevel)
+	}
+	if err := conf.ValidateLevel(conf.Method, conf.Level); err != nil {
+		return errors.Wrap(err, "default level")
+	}
+	return nil
+}
@@ -3,6 +3,10 @@ package config
 import (
 	"log"
 	"os"
+	"time"
+
+	"github.com/romshark/zipapi/store"
+	storemock "github.com/romshark/zipapi/store/mock"
 
 	"github.com/pkg/errors"
 )
@@ -14,6 +18,13 @@ type Config struct {
 	DebugLog      *log.Logger
 	ErrorLog      *log.Logger
 	App           App
+
+	// Retention defines the archive retention policy
+	Retention Retention
+
+	// Store defines the store instance the server will initialize and use,
+	// an in-memory mock store is used by default
+	Store store.Store
 }
 
 // Init sets defaults and validates the configurations
@@ -63,8 +74,82 @@ func (conf *Config) Init() error {
 		conf.App.MaxMultipartMembuf = 1024 * 1024
 	}
 
+	// Reject colliding file names by default
+	if conf.App.NameCollision == "" {
+		conf.App.NameCollision = NameCollisionReject
+	}
+
+	// Compress entries one after another by default
+	if conf.App.CompressionWorkers == 0 {
+		conf.App.CompressionWorkers = 1
+	}
+
+	// Archive asynchronous jobs one after another by default
+	if conf.App.JobWorkers == 0 {
+		conf.App.JobWorkers = 1
+	}
+
+	// Queue up to 100 asynchronous jobs by default
+	if conf.App.MaxQueuedJobs == 0 {
+		conf.App.MaxQueuedJobs = 100
+	}
+
+	// Expire unfinished resumable uploads after a day by default
+	if conf.App.UploadExpiration == 0 {
+		conf.App.UploadExpiration = 24 * time.Hour
+	}
+
+	// Use default compression
+	if conf.App.Compression == nil {
+		conf.App.Compression = DefaultCompression()
+	}
+
+	// Use the in-memory mock store by default
+	if conf.Store == nil {
+		conf.Store = new(storemock.Store)
+	}
+
 	// VALIDATE
 
+	if err := conf.App.NameCollision.Validate(); err != nil {
+		return errors.Wrap(err, "app")
+	}
+	if conf.App.CompressionWorkers < 0 {
+		return errors.New("negative number of compression workers")
+	}
+	if conf.App.JobWorkers < 0 {
+		return errors.New("negative number of job workers")
+	}
+	if conf.App.MaxQueuedJobs < 0 {
+		return errors.New("negative max number of queued jobs")
+	}
+	if conf.App.UploadExpiration < 0 {
+		return errors.New("negative upload expiration")
+	}
+	if err := conf.App.Compression.Validate(); err != nil {
+		return errors.Wrap(err, "app.compression")
+	}
+	if conf.App.StreamUploads &&
+		conf.App.NameCollision == NameCollisionOverwrite {
+		return errors.New(
+			"name collision policy 'overwrite' " +
+				"is not supported with streamed uploads",
+		)
+	}
+
+	if conf.Retention.MaxAge < 0 {
+		return errors.New("negative retention max age")
+	}
+	if conf.Retention.MaxCount < 0 {
+		return errors.New("negative retention max count")
+	}
+	if conf.Retention.MaxJobAge < 0 {
+		return errors.New("negative retention max job age")
+	}
+	if conf.Retention.Interval < 0 {
+		return errors.New("negative retention interval")
+	}
+
 	if conf.Mode == ModeProduction {
 		// Ensure TLS is enabled in production
 		if conf.TransportHTTP.TLS == nil {
@@ -9,6 +9,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/romshark/zipapi/store"
+
 	"github.com/BurntSushi/toml"
 	"github.com/c2h5oh/datasize"
 	"github.com/pkg/errors"
@@ -34,10 +36,40 @@ type File struct {
 		} `toml:"tls"`
 	} `toml:"transport-http"`
 	App struct {
-		MaxReqSize         string `toml:"max-req-size"`
-		MaxFileSize        string `toml:"max-file-size"`
-		MaxMultipartMembuf string `toml:"max-multipart-membuf"`
+		MaxReqSize         string        `toml:"max-req-size"`
+		MaxFileSize        string        `toml:"max-file-size"`
+		MaxMultipartMembuf string        `toml:"max-multipart-membuf"`
+		StreamUploads      bool          `toml:"stream-uploads"`
+		SpoolResponses     bool          `toml:"spool-responses"`
+		NameCollision      NameCollision `toml:"name-collision"`
+		CompressionWorkers int           `toml:"compression-workers"`
+		JobWorkers         int           `toml:"job-workers"`
+		MaxQueuedJobs      int           `toml:"max-queued-jobs"`
+		UploadDir          string        `toml:"upload-dir"`
+		UploadExpiration   Duration      `toml:"upload-expiration"`
+		Compression        struct {
+			Method   CompressionMethod   `toml:"method"`
+			Level    *int                `toml:"level"`
+			MaxLevel *int                `toml:"max-level"`
+			Methods  []CompressionMethod `toml:"methods"`
+
+			SkipCompressed *bool `toml:"skip-compressed"`
+			CompareSizes   bool  `toml:"compare-sizes"`
+		} `toml:"compression"`
 	} `toml:"app"`
+	Store struct {
+		Backend   string         `toml:"backend"`
+		Options   toml.Primitive `toml:"options"`
+		Retention struct {
+			MaxAge       Duration `toml:"max-age"`
+			MaxTotalSize string   `toml:"max-total-size"`
+			MaxCount     int      `toml:"max-count"`
+			MaxJobAge    Duration `toml:"max-job-age"`
+			Interval     Duration `toml:"interval"`
+		} `toml:"retention"`
+	} `toml:"store"`
+
+	meta toml.MetaData
 }
 
 func (fl *File) mode(conf *Config) error {
@@ -178,6 +210,76 @@ func (fl *File) app(conf *Config) error {
 		return errors.Wrap(err, "parsing app.max-multipart-membuf")
 	}
 
+	conf.App.StreamUploads = fl.App.StreamUploads
+	conf.App.SpoolResponses = fl.App.SpoolResponses
+	conf.App.NameCollision = fl.App.NameCollision
+	conf.App.CompressionWorkers = fl.App.CompressionWorkers
+	conf.App.JobWorkers = fl.App.JobWorkers
+	conf.App.MaxQueuedJobs = fl.App.MaxQueuedJobs
+	conf.App.UploadDir = fl.App.UploadDir
+	conf.App.UploadExpiration = time.Duration(fl.App.UploadExpiration)
+
+	// Compression, undefined options fall back to the defaults
+	compression := DefaultCompression()
+	if fl.App.Compression.Method != "" {
+		compression.Method = fl.App.Compression.Method
+	}
+	if fl.App.Compression.Level != nil {
+		compression.Level = *fl.App.Compression.Level
+	}
+	if fl.App.Compression.MaxLevel != nil {
+		compression.MaxLevel = *fl.App.Compression.MaxLevel
+		if fl.App.Compression.Level == nil &&
+			compression.Level > compression.MaxLevel {
+			compression.Level = compression.MaxLevel
+		}
+	}
+	if fl.App.Compression.Methods != nil {
+		compression.Methods = fl.App.Compression.Methods
+	}
+	if fl.App.Compression.SkipCompressed != nil {
+		compression.SkipCompressed = *fl.App.Compression.SkipCompressed
+	}
+	compression.CompareSizes = fl.App.Compression.CompareSizes
+	conf.App.Compression = compression
+
+	return nil
+}
+
+func (fl *File) store(conf *Config) error {
+	if fl.Store.Backend == "" {
+		// Use default store
+		return nil
+	}
+
+	str, err := store.New(fl.Store.Backend, func(v interface{}) error {
+		if !fl.meta.IsDefined("store", "options") {
+			return nil
+		}
+		return fl.meta.PrimitiveDecode(fl.Store.Options, v)
+	})
+	if err != nil {
+		return errors.Wrap(err, "backend")
+	}
+	conf.Store = str
+
+	return nil
+}
+
+func (fl *File) retention(conf *Config) error {
+	conf.Retention.MaxAge = time.Duration(fl.Store.Retention.MaxAge)
+	conf.Retention.MaxCount = fl.Store.Retention.MaxCount
+	conf.Retention.MaxJobAge = time.Duration(fl.Store.Retention.MaxJobAge)
+	conf.Retention.Interval = time.Duration(fl.Store.Retention.Interval)
+
+	var err error
+	conf.Retention.MaxTotalSize, err = parseFileSize(
+		fl.Store.Retention.MaxTotalSize,
+	)
+	if err != nil {
+		return errors.Wrap(err, "parsing max-total-size")
+	}
+
 	return nil
 }
 
@@ -187,16 +289,20 @@ func FromFile(path string) (*Config, error) {
 	conf := &Config{}
 
 	// Read TOML config file
-	if _, err := toml.DecodeFile(path, &file); err != nil {
+	meta, err := toml.DecodeFile(path, &file)
+	if err != nil {
 		return nil, errors.Wrap(err, "TOML decode")
 	}
+	file.meta = meta
 
 	for setterName, setter := range map[string]func(*Config) error{
-		"mode":           file.mode,
-		"log.debug":      file.debugLog,
-		"log.error":      file.errorLog,
-		"transport-http": file.transportHTTP,
-		"app":            file.app,
+		"mode":            file.mode,
+		"log.debug":       file.debugLog,
+		"log.error":       file.errorLog,
+		"transport-http":  file.transportHTTP,
+		"app":             file.app,
+		"store":           file.store,
+		"store.retention": file.retention,
 	} {
 		if err := setter(conf); err != nil {
 			return nil, errors.Wrap(err, setterName)
@@ -0,0 +1,33 @@
+package config
+
+import "fmt"
+
+// NameCollision defines how colliding archive entry names are handled
+type NameCollision string
+
+const (
+	// NameCollisionReject rejects requests containing colliding names
+	NameCollisionReject NameCollision = "reject"
+
+	// NameCollisionRename appends a numeric suffix to colliding names
+	// such as "foo (1).txt"
+	NameCollisionRename NameCollision = "rename"
+
+	// NameCollisionOverwrite only archives the last of all files
+	// with the same name. Not supported with streamed uploads
+	// because already written entries can't be replaced
+	NameCollisionOverwrite NameCollision = "overwrite"
+)
+
+// Validate returns an error if the name collision policy is unknown
+func (nc NameCollision) Validate() error {
+	switch nc {
+	case NameCollisionReject:
+		fallthrough
+	case NameCollisionRename:
+		fallthrough
+	case NameCollisionOverwrite:
+		return nil
+	}
+	return fmt.Errorf("unknown name collision policy: '%s'", nc)
+}
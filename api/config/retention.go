@@ -0,0 +1,38 @@
+package config
+
+import (
+	"time"
+
+	"github.com/romshark/zipapi/gc"
+)
+
+// Retention represents the archive and job retention policy configurations
+type Retention struct {
+	// MaxAge defines the maximum age of an archive
+	MaxAge time.Duration
+
+	// MaxTotalSize defines the maximum total size of all archives in bytes
+	// including the stored copies of their files
+	MaxTotalSize uint64
+
+	// MaxCount defines the maximum number of archives
+	MaxCount int
+
+	// MaxJobAge defines how long the records of finished jobs are kept
+	MaxJobAge time.Duration
+
+	// Interval defines the interval at which the server removes
+	// archives and jobs violating the retention policy,
+	// expired archives and jobs are not removed by the server if it's zero
+	Interval time.Duration
+}
+
+// Policy returns the garbage collector retention policy
+func (conf Retention) Policy() gc.Policy {
+	return gc.Policy{
+		MaxAge:       conf.MaxAge,
+		MaxTotalSize: conf.MaxTotalSize,
+		MaxCount:     conf.MaxCount,
+		MaxJobAge:    conf.MaxJobAge,
+	}
+}
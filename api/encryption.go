@@ -0,0 +1,217 @@
+package api
+
+import (
+	"archive/zip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// HeaderPassword defines the request header carrying the password
+	// the archive entries are encrypted with
+	HeaderPassword = "X-Archive-Password"
+
+	// FormFieldPassword defines the form field carrying the password
+	// the archive entries are encrypted with,
+	// it takes precedence over the password header
+	FormFieldPassword = "password"
+)
+
+// WinZip AES encryption, see https://www.winzip.com/en/support/aes-encryption
+const (
+	// zipMethodAES defines the zip compression method ID
+	// of WinZip AES encrypted entries
+	zipMethodAES uint16 = 99
+
+	// aesExtraID defines the ID of the WinZip AES extra field
+	aesExtraID uint16 = 0x9901
+
+	// aesVersion defines the WinZip AES vendor version AE-2
+	// which omits the CRC-32 of the entries
+	aesVersion uint16 = 2
+
+	// aesStrength defines the key strength identifying AES-256
+	aesStrength byte = 3
+
+	aesKeyLen        = 32
+	aesSaltLen       = 16
+	aesVerifierLen   = 2
+	aesMACLen        = 10
+	aesKeyIterations = 1000
+
+	// aesOverhead defines the number of bytes
+	// an encrypted entry is larger than the unencrypted entry
+	aesOverhead = aesSaltLen + aesVerifierLen + aesMACLen
+
+	// zipVersion51 defines the zip version required
+	// to extract AES encrypted entries
+	zipVersion51 = 51
+)
+
+// requestPassword returns the password requested by the client,
+// param returns the value of a form field.
+// An empty password disables encryption
+func requestPassword(in *http.Request, param func(name string) string) string {
+	if password := param(FormFieldPassword); password != "" {
+		return password
+	}
+	return in.Header.Get(HeaderPassword)
+}
+
+// checkEncryption returns an error if the archive format
+// doesn't support encryption while a password is set
+func checkEncryption(format archiveFormat, password string) error {
+	if password != "" && format != formatZip {
+		return invalidParameter(
+			FormFieldPassword,
+			"archive format '%s' doesn't support passwords",
+			format.name,
+		)
+	}
+	return nil
+}
+
+// encryptHeader prepares the header of an entry encrypted by an aesWriter.
+// The header must describe the unencrypted entry
+func encryptHeader(header *zip.FileHeader) {
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], aesExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], aesVersion)
+	copy(extra[6:], "AE")
+	extra[8] = aesStrength
+	binary.LittleEndian.PutUint16(extra[9:], header.Method)
+
+	header.Extra = append(header.Extra, extra...)
+	header.Method = zipMethodAES
+	header.Flags |= 0x1
+	header.CRC32 = 0
+	header.CompressedSize64 += aesOverhead
+	header.ReaderVersion = zipVersion51
+	header.CreatorVersion = header.CreatorVersion&0xff00 | zipVersion51
+}
+
+// aesWriter encrypts the compressed entry data written to it
+// using WinZip AES-256 and writes it to out preceded by the salt
+// and the password verifier. The authentication code is written on close
+type aesWriter struct {
+	out    io.Writer
+	stream cipher.Stream
+	mac    hash.Hash
+	buf    []byte
+}
+
+// newAESWriter derives the keys from the password using a random salt
+// and writes the salt and the password verifier to out
+func newAESWriter(out io.Writer, password string) (*aesWriter, error) {
+	salt := make([]byte, aesSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errors.Wrap(err, "generating salt")
+	}
+	keys := pbkdf2SHA1(
+		[]byte(password),
+		salt,
+		aesKeyIterations,
+		2*aesKeyLen+aesVerifierLen,
+	)
+	block, err := aes.NewCipher(keys[:aesKeyLen])
+	if err != nil {
+		return nil, errors.Wrap(err, "initializing cipher")
+	}
+
+	if _, err := out.Write(salt); err != nil {
+		return nil, err
+	}
+	if _, err := out.Write(keys[2*aesKeyLen:]); err != nil {
+		return nil, err
+	}
+	return &aesWriter{
+		out:    out,
+		stream: newWinZipCTR(block),
+		mac:    hmac.New(sha1.New, keys[aesKeyLen:2*aesKeyLen]),
+	}, nil
+}
+
+// Write implements the io.Writer interface
+func (w *aesWriter) Write(p []byte) (int, error) {
+	if cap(w.buf) < len(p) {
+		w.buf = make([]byte, len(p))
+	}
+	buf := w.buf[:len(p)]
+	w.stream.XORKeyStream(buf, p)
+	w.mac.Write(buf)
+	return w.out.Write(buf)
+}
+
+// Close writes the authentication code of the encrypted data
+func (w *aesWriter) Close() error {
+	_, err := w.out.Write(w.mac.Sum(nil)[:aesMACLen])
+	return err
+}
+
+// winZipCTR implements the counter mode used by WinZip AES
+// which, unlike cipher.NewCTR, increments the counter
+// as a little-endian integer starting at 1
+type winZipCTR struct {
+	block     cipher.Block
+	counter   [aes.BlockSize]byte
+	keyStream [aes.BlockSize]byte
+	used      int
+}
+
+func newWinZipCTR(block cipher.Block) *winZipCTR {
+	return &winZipCTR{block: block, used: aes.BlockSize}
+}
+
+// XORKeyStream implements the cipher.Stream interface
+func (s *winZipCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if s.used == aes.BlockSize {
+			for j := range s.counter {
+				s.counter[j]++
+				if s.counter[j] != 0 {
+					break
+				}
+			}
+			s.block.Encrypt(s.keyStream[:], s.counter[:])
+			s.used = 0
+		}
+		dst[i] = src[i] ^ s.keyStream[s.used]
+		s.used++
+	}
+}
+
+// pbkdf2SHA1 derives a key of the given length from the password
+// using PBKDF2 (RFC 8018) with HMAC-SHA1
+func pbkdf2SHA1(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	key := make([]byte, 0, keyLen+prf.Size())
+	block := make([]byte, 4)
+	for i := uint32(1); len(key) < keyLen; i++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(block, i)
+		prf.Write(block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// FormFieldModTimeSuffix defines the suffix of the companion form field
+	// defining the modification time (RFC 3339) of the files of a form field,
+	// the modification time of the files of field "foo" is defined by
+	// "foo.mtime". The field may be repeated for multiple files
+	FormFieldModTimeSuffix = ".mtime"
+
+	// FormFieldModeSuffix defines the suffix of the companion form field
+	// defining the octal Unix permission bits (e.g. "755")
+	// of the files of a form field. The field may be repeated
+	FormFieldModeSuffix = ".mode"
+
+	// FormFieldCommentSuffix defines the suffix of the companion form field
+	// defining the entry comment of the files of a form field.
+	// The field may be repeated
+	FormFieldCommentSuffix = ".comment"
+
+	// FormFieldComment defines the form field
+	// carrying the archive comment
+	FormFieldComment = "comment"
+
+	// maxCommentLen defines the maximum length of zip comments in bytes
+	maxCommentLen = 0xffff
+
+	// extTimeExtraID defines the ID of the extended timestamp extra field
+	extTimeExtraID uint16 = 0x5455
+)
+
+// maxModTime defines the latest time representable in zip archives
+var maxModTime = time.Date(2107, 12, 31, 23, 59, 58, 0, time.UTC)
+
+// entryMeta represents the metadata of an archive entry
+// supplied by the client, all values are optional
+type entryMeta struct {
+	// modTime is zero if not supplied
+	modTime time.Time
+
+	// mode holds the Unix permission bits, zero if not supplied
+	mode os.FileMode
+
+	comment string
+}
+
+// invalidMetadataError is returned for malformed file metadata
+type invalidMetadataError struct {
+	name   string
+	reason string
+
+	// limit defines the exceeded limit, if any
+	limit uint64
+}
+
+func (err invalidMetadataError) Error() string {
+	return fmt.Sprintf("invalid metadata of '%s': %s", err.name, err.reason)
+}
+
+// parseModTime parses a modification time in RFC 3339 format
+// returning it in UTC. Times outside the range of zip archives
+// (1980-2107) are refused
+func parseModTime(value string) (time.Time, error) {
+	modTime, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return modTime, fmt.Errorf("invalid time '%s', expected RFC 3339", value)
+	}
+	modTime = modTime.UTC()
+	if modTime.Before(dosEpoch) || modTime.After(maxModTime) {
+		return modTime, fmt.Errorf("time '%s' out of range (1980-2107)", value)
+	}
+	return modTime, nil
+}
+
+// parseMode parses octal Unix permission bits
+func parseMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > uint64(os.ModePerm) {
+		return 0, fmt.Errorf("invalid mode '%s', expected octal 0-777", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// parseEntryMeta parses the metadata of the file with the given name,
+// empty values are ignored
+func parseEntryMeta(
+	name string,
+	modTime string,
+	mode string,
+	comment string,
+) (meta entryMeta, err error) {
+	fail := func(err error) (entryMeta, error) {
+		return entryMeta{}, invalidMetadataError{
+			name:   name,
+			reason: err.Error(),
+		}
+	}
+	if modTime != "" {
+		if meta.modTime, err = parseModTime(modTime); err != nil {
+			return fail(err)
+		}
+	}
+	if mode != "" {
+		if meta.mode, err = parseMode(mode); err != nil {
+			return fail(err)
+		}
+	}
+	if len(comment) > maxCommentLen {
+		return entryMeta{}, invalidMetadataError{
+			name:   name,
+			reason: fmt.Sprintf("comment exceeds %d bytes", maxCommentLen),
+			limit:  maxCommentLen,
+		}
+	}
+	meta.comment = comment
+	return meta, nil
+}
+
+// setDOSTime sets the MS-DOS modification time of the entry
+func setDOSTime(header *zip.FileHeader, t time.Time) {
+	header.ModifiedDate = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	header.ModifiedTime = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+}
+
+// appendExtTime appends the extended timestamp extra field
+// holding the modification time of the entry.
+// zip.Writer.CreateRaw, unlike zip.Writer.CreateHeader,
+// doesn't write it for FileHeader.Modified
+func appendExtTime(header *zip.FileHeader, t time.Time) {
+	extra := make([]byte, 9)
+	binary.LittleEndian.PutUint16(extra[0:], extTimeExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 5)
+	extra[4] = 1 // Modification time only
+	binary.LittleEndian.PutUint32(extra[5:], uint32(t.Unix()))
+	header.Extra = append(header.Extra, extra...)
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/romshark/zipapi/api/config"
+)
+
+// QueryNameCollision defines the query parameter
+// choosing the name collision policy of a request
+const QueryNameCollision = "name-collision"
+
+// nameCollisionError is returned when a file name is taken
+// and colliding names are rejected
+type nameCollisionError struct {
+	name string
+}
+
+func (err nameCollisionError) Error() string {
+	return fmt.Sprintf("duplicate file name '%s'", err.name)
+}
+
+// nameCollisionPolicy returns the name collision policy
+// requested by the client or the configured default
+func (srv *server) nameCollisionPolicy(
+	in *http.Request,
+) (config.NameCollision, error) {
+	policy := config.NameCollision(in.URL.Query().Get(QueryNameCollision))
+	if policy == "" {
+		return srv.conf.App.NameCollision, nil
+	}
+	if err := policy.Validate(); err != nil {
+		return "", invalidParameter(QueryNameCollision, "%s", err)
+	}
+	if srv.conf.App.StreamUploads &&
+		policy == config.NameCollisionOverwrite {
+		return "", invalidParameter(
+			QueryNameCollision,
+			"name collision policy '%s' "+
+				"is not supported with streamed uploads",
+			policy,
+		)
+	}
+	return policy, nil
+}
+
+// pathConflictError is returned when a file would be archived
+// at the path of a directory or inside of a file
+type pathConflictError struct {
+	path     string
+	conflict string
+}
+
+func (err pathConflictError) Error() string {
+	return fmt.Sprintf(
+		"path '%s' conflicts with '%s'",
+		err.path,
+		err.conflict,
+	)
+}
+
+// entryNames keeps track of the archive entry names
+// resolving collisions according to the policy
+type entryNames struct {
+	policy      config.NameCollision
+	taken       map[string]struct{}
+	directories map[string]struct{}
+
+	// reserved holds the names of the entries generated by the server
+	// which can't be overwritten
+	reserved map[string]struct{}
+}
+
+func newEntryNames(policy config.NameCollision) *entryNames {
+	return &entryNames{
+		policy:      policy,
+		taken:       make(map[string]struct{}),
+		directories: make(map[string]struct{}),
+		reserved:    make(map[string]struct{}),
+	}
+}
+
+// reserve reserves the name of an entry generated by the server.
+// Files uploaded under a reserved name are renamed
+// or rejected even if colliding names are overwritten
+func (n *entryNames) reserve(name string) error {
+	if n.isTaken(name) {
+		return nameCollisionError{name: name}
+	}
+	n.taken[name] = struct{}{}
+	n.reserved[name] = struct{}{}
+	return nil
+}
+
+// isTaken returns true if there's a file or directory with the given name
+func (n *entryNames) isTaken(name string) bool {
+	_, file := n.taken[name]
+	_, dir := n.directories[name]
+	return file || dir
+}
+
+// takeParents registers all parent directories of the given path.
+// Returns a pathConflictError if any of them is a file
+func (n *entryNames) takeParents(name string) error {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if _, file := n.taken[dir]; file {
+			return pathConflictError{path: name, conflict: dir}
+		}
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		n.directories[dir] = struct{}{}
+	}
+	return nil
+}
+
+// resolveDirectory registers the given directory path.
+// Returns a pathConflictError if there's a file at the path
+// or any of its parent directories
+func (n *entryNames) resolveDirectory(dir string) error {
+	if _, file := n.taken[dir]; file {
+		return pathConflictError{path: dir, conflict: dir}
+	}
+	if err := n.takeParents(dir); err != nil {
+		return err
+	}
+	n.directories[dir] = struct{}{}
+	return nil
+}
+
+// resolve returns the entry name to use for the given file path.
+// Returns a nameCollisionError if the name is taken
+// and colliding names are rejected
+// or a pathConflictError if the path is taken by a directory
+// or any of its parent directories is a file
+func (n *entryNames) resolve(name string) (string, error) {
+	if _, dir := n.directories[name]; dir {
+		return "", pathConflictError{path: name, conflict: name + "/"}
+	}
+	if _, taken := n.taken[name]; taken {
+		_, reserved := n.reserved[name]
+		switch {
+		case n.policy == config.NameCollisionRename:
+			name = n.rename(name)
+		case n.policy == config.NameCollisionOverwrite && !reserved:
+			// The overwritten file is expected to be skipped by the caller
+		default:
+			return "", nameCollisionError{name: name}
+		}
+	}
+	if err := n.takeParents(name); err != nil {
+		return "", err
+	}
+	n.taken[name] = struct{}{}
+	return name, nil
+}
+
+// rename appends the lowest free numeric suffix to the name
+// keeping its extension: "foo.txt" becomes "foo (1).txt"
+func (n *entryNames) rename(name string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if base == "" || strings.HasSuffix(base, "/") {
+		// Hidden files such as ".gitignore" have no extension
+		base, ext = name, ""
+	}
+	for i := 1; ; i++ {
+		renamed := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if !n.isTaken(renamed) {
+			return renamed
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/textproto"
+	"path"
+	"strings"
+)
+
+const (
+	// FormFieldManifest defines the form field carrying
+	// the JSON encoded UploadManifest
+	FormFieldManifest = "manifest"
+
+	// FormFieldDirectory defines the form field defining
+	// an explicit, potentially empty, directory.
+	// The field may be repeated
+	FormFieldDirectory = "directory"
+
+	// FormFieldPathSuffix defines the suffix of the companion form field
+	// defining the archive path of the files of a form field,
+	// the path of the files of field "foo" is defined by "foo.path".
+	// The field may be repeated for multiple files in the same field
+	FormFieldPathSuffix = ".path"
+
+	// maxManifestSize defines the maximum size of the upload manifest
+	maxManifestSize = 1024 * 1024
+)
+
+// UploadManifestFile defines the archive path
+// and the optional metadata of an uploaded file
+type UploadManifestFile struct {
+	Path string `json:"path"`
+
+	// ModTime defines the modification time in RFC 3339 format
+	ModTime string `json:"mtime"`
+
+	// Mode defines the octal Unix permission bits, e.g. "755"
+	Mode string `json:"mode"`
+
+	Comment string `json:"comment"`
+}
+
+// UploadManifest describes the structure of the archive
+type UploadManifest struct {
+	// Files maps the uploaded file names to their archive paths
+	Files map[string]UploadManifestFile `json:"files"`
+
+	// Directories lists explicit, potentially empty, directories
+	Directories []string `json:"directories"`
+
+	// Comment defines the archive comment
+	Comment string `json:"comment"`
+}
+
+// invalidPathError is returned for archive paths
+// which are malformed or could escape the extraction directory
+type invalidPathError struct {
+	path   string
+	reason string
+}
+
+func (err invalidPathError) Error() string {
+	return fmt.Sprintf("invalid path '%s': %s", err.path, err.reason)
+}
+
+// cleanPath normalizes the given relative archive path.
+// Returns an invalidPathError for paths that are absolute,
+// contain backslashes or could otherwise escape the extraction directory
+func cleanPath(p string) (string, error) {
+	fail := func(reason string) (string, error) {
+		return "", invalidPathError{path: p, reason: reason}
+	}
+	switch {
+	case p == "":
+		return fail("empty")
+	case strings.ContainsRune(p, '\\'):
+		return fail("contains backslashes")
+	case strings.ContainsRune(p, 0):
+		return fail("contains null characters")
+	case strings.HasPrefix(p, "/"):
+		return fail("absolute")
+	case len(p) > 1 && p[1] == ':':
+		return fail("contains a drive letter")
+	}
+	for _, element := range strings.Split(p, "/") {
+		if element == ".." {
+			return fail("contains parent directory references")
+		}
+	}
+
+	cleaned := path.Clean(p)
+	if cleaned == "." {
+		return fail("empty")
+	}
+	return cleaned, nil
+}
+
+// rawFileName returns the file name of a multipart/form-data part
+// including the path which mime/multipart strips away
+func rawFileName(header textproto.MIMEHeader) string {
+	_, params, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
+
+// companionSuffixes lists the suffixes of the companion form fields
+var companionSuffixes = []string{
+	FormFieldPathSuffix,
+	FormFieldModTimeSuffix,
+	FormFieldModeSuffix,
+	FormFieldCommentSuffix,
+}
+
+// entryPaths determines the archive paths and the metadata
+// of the uploaded files. A path or metadata value defined
+// in the manifest takes precedence over a value defined
+// by a companion field which takes precedence over
+// the path in the file name
+type entryPaths struct {
+	names    *entryNames
+	manifest UploadManifest
+
+	// companions maps the companion fields to their pending values
+	companions  map[string][]string
+	directories []string
+
+	// comment holds the archive comment defined by the comment field
+	comment string
+
+	// stored lists the stored files and archives to include
+	stored []StoredSource
+}
+
+func newEntryPaths(names *entryNames) *entryPaths {
+	return &entryPaths{
+		names:      names,
+		companions: make(map[string][]string),
+	}
+}
+
+// readManifest decodes the upload manifest read from r
+func (p *entryPaths) readManifest(r io.Reader) error {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxManifestSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxManifestSize {
+		return invalidManifestError{
+			reason: fmt.Sprintf("exceeds %d bytes", maxManifestSize),
+			limit:  maxManifestSize,
+		}
+	}
+	var manifest UploadManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return invalidManifestError{reason: err.Error()}
+	}
+	return p.setManifest(manifest)
+}
+
+// setManifest sets the upload manifest
+func (p *entryPaths) setManifest(manifest UploadManifest) error {
+	p.manifest = manifest
+	if len(p.manifest.Comment) > maxCommentLen {
+		return invalidManifestError{
+			reason: fmt.Sprintf("comment exceeds %d bytes", maxCommentLen),
+			limit:  maxCommentLen,
+		}
+	}
+	for _, dir := range p.manifest.Directories {
+		if err := p.addDirectory(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// invalidManifestError is returned for malformed upload manifests
+type invalidManifestError struct {
+	reason string
+
+	// limit defines the exceeded limit, if any
+	limit uint64
+}
+
+func (err invalidManifestError) Error() string {
+	return "invalid manifest: " + err.reason
+}
+
+// addField handles a non-file form field.
+// Returns false if the field is unrelated to the archive structure
+func (p *entryPaths) addField(field, value string) (bool, error) {
+	switch {
+	case field == FormFieldManifest:
+		return true, p.readManifest(strings.NewReader(value))
+	case field == FormFieldDirectory:
+		return true, p.addDirectory(value)
+	case field == FieldStored:
+		sources, err := readStoredSources(value)
+		p.stored = append(p.stored, sources...)
+		return true, err
+	case field == FormFieldComment:
+		if len(value) > maxCommentLen {
+			return true, invalidMetadataError{
+				name:   "archive",
+				reason: fmt.Sprintf("comment exceeds %d bytes", maxCommentLen),
+				limit:  maxCommentLen,
+			}
+		}
+		p.comment = value
+		return true, nil
+	}
+	for _, suffix := range companionSuffixes {
+		if strings.HasSuffix(field, suffix) {
+			p.companions[field] = append(p.companions[field], value)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// nextCompanion returns the next pending value of the companion field
+// of the given form field. Returns false if there's none
+func (p *entryPaths) nextCompanion(field, suffix string) (string, bool) {
+	companions := p.companions[field+suffix]
+	if len(companions) < 1 {
+		return "", false
+	}
+	p.companions[field+suffix] = companions[1:]
+	return companions[0], true
+}
+
+// archiveComment returns the archive comment,
+// the manifest takes precedence over the comment field
+func (p *entryPaths) archiveComment() string {
+	if p.manifest.Comment != "" {
+		return p.manifest.Comment
+	}
+	return p.comment
+}
+
+// reserve reserves the name of the checksums entry, if any
+func (p *entryPaths) reserve(checksums checksumsEntry) error {
+	if checksums == checksumsNone {
+		return nil
+	}
+	return p.names.reserve(checksums.name())
+}
+
+// addDirectory adds an explicit directory
+func (p *entryPaths) addDirectory(dir string) error {
+	dir, err := cleanPath(strings.TrimSuffix(dir, "/"))
+	if err != nil {
+		return err
+	}
+	if err := p.names.resolveDirectory(dir); err != nil {
+		return err
+	}
+	p.directories = append(p.directories, dir)
+	return nil
+}
+
+// resolve returns the archive path and the metadata of the next file
+// uploaded in the given form field under the given raw file name
+func (p *entryPaths) resolve(
+	field string,
+	fileName string,
+) (string, entryMeta, error) {
+	filePath := fileName
+	if companion, ok := p.nextCompanion(field, FormFieldPathSuffix); ok {
+		filePath = companion
+	}
+	modTime, _ := p.nextCompanion(field, FormFieldModTimeSuffix)
+	mode, _ := p.nextCompanion(field, FormFieldModeSuffix)
+	comment, _ := p.nextCompanion(field, FormFieldCommentSuffix)
+
+	if fl, ok := p.manifest.Files[fileName]; ok {
+		if fl.Path != "" {
+			filePath = fl.Path
+		}
+		if fl.ModTime != "" {
+			modTime = fl.ModTime
+		}
+		if fl.Mode != "" {
+			mode = fl.Mode
+		}
+		if fl.Comment != "" {
+			comment = fl.Comment
+		}
+	}
+
+	cleaned, err := cleanPath(filePath)
+	if err != nil {
+		return "", entryMeta{}, err
+	}
+	meta, err := parseEntryMeta(cleaned, modTime, mode, comment)
+	if err != nil {
+		return "", entryMeta{}, err
+	}
+	name, err := p.names.resolve(cleaned)
+	return name, meta, err
+}
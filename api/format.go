@@ -0,0 +1,139 @@
+package api
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ParamFormat defines the query parameter or form field
+// choosing the archive format ("zip", "tar", "tar.gz" or "tar.zst")
+const ParamFormat = "format"
+
+// archiveFormat represents an archive output format
+type archiveFormat struct {
+	name        string
+	contentType string
+	extension   string
+}
+
+var (
+	formatZip    = archiveFormat{"zip", "application/zip", ".zip"}
+	formatTar    = archiveFormat{"tar", "application/x-tar", ".tar"}
+	formatTarGz  = archiveFormat{"tar.gz", "application/gzip", ".tar.gz"}
+	formatTarZst = archiveFormat{"tar.zst", "application/zstd", ".tar.zst"}
+)
+
+// archiveFormats lists all supported archive formats,
+// the first one is the default
+var archiveFormats = []archiveFormat{
+	formatZip,
+	formatTar,
+	formatTarGz,
+	formatTarZst,
+}
+
+// formatAliases maps the alternative media types to the formats
+var formatAliases = map[string]archiveFormat{
+	"application/x-zip-compressed": formatZip,
+	"application/x-gtar":           formatTarGz,
+	"application/x-gzip":           formatTarGz,
+	"application/x-zstd":           formatTarZst,
+}
+
+// lookupArchiveFormat returns the archive format by name,
+// archives recorded without a format are zip archives
+func lookupArchiveFormat(name string) (archiveFormat, bool) {
+	if name == "" {
+		return formatZip, true
+	}
+	for _, format := range archiveFormats {
+		if format.name == name {
+			return format, true
+		}
+	}
+	return archiveFormat{}, false
+}
+
+// notAcceptableError is returned when none of the archive formats
+// is acceptable to the client
+type notAcceptableError struct {
+	accept string
+}
+
+func (err notAcceptableError) Error() string {
+	return fmt.Sprintf("no archive format matches '%s'", err.accept)
+}
+
+// negotiateFormat returns the archive format requested by the client.
+// param returns the value of a request parameter,
+// the format parameter takes precedence over the Accept header
+// which is ignored unless negotiate is true.
+// Returns a notAcceptableError if no format matches the Accept header
+func negotiateFormat(
+	in *http.Request,
+	param func(name string) string,
+	negotiate bool,
+) (archiveFormat, error) {
+	if name := param(ParamFormat); name != "" {
+		format, ok := lookupArchiveFormat(name)
+		if !ok {
+			return format, invalidParameter(
+				ParamFormat,
+				"unsupported archive format '%s'",
+				name,
+			)
+		}
+		return format, nil
+	}
+
+	accept := in.Header.Get("Accept")
+	if accept == "" || !negotiate {
+		return formatZip, nil
+	}
+
+	// Choose the most preferred format, the first one on ties
+	var best archiveFormat
+	bestQuality := 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality <= bestQuality {
+			continue
+		}
+
+		format, ok := matchMediaType(mediaType)
+		if ok {
+			best, bestQuality = format, quality
+		}
+	}
+
+	if bestQuality == 0 {
+		return best, notAcceptableError{accept: accept}
+	}
+	return best, nil
+}
+
+// matchMediaType returns the archive format matching the media range
+func matchMediaType(mediaType string) (archiveFormat, bool) {
+	if mediaType == "*/*" || mediaType == "application/*" {
+		return formatZip, true
+	}
+	for _, format := range archiveFormats {
+		if format.contentType == mediaType {
+			return format, true
+		}
+	}
+	format, ok := formatAliases[mediaType]
+	return format, ok
+}
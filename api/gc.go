@@ -0,0 +1,34 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/romshark/zipapi/gc"
+)
+
+// runGC periodically removes the archives violating the retention policy
+// until the server is shut down
+func (srv *server) runGC() {
+	defer close(srv.gcDone)
+
+	collector := &gc.Collector{
+		Store:  srv.store,
+		Policy: srv.conf.Retention.Policy(),
+		Log:    srv.conf.DebugLog,
+	}
+
+	ticker := time.NewTicker(srv.conf.Retention.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-srv.gcStop:
+			return
+		case now := <-ticker.C:
+			if _, err := collector.Collect(context.Background(), now); err != nil {
+				srv.logErrf("gc: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/romshark/zipapi/store"
+
+	"github.com/pkg/errors"
+)
+
+func (srv *server) getArchive(
+	out http.ResponseWriter,
+	in *http.Request,
+) error {
+	archiveID := strings.TrimPrefix(in.URL.Path, "/archives/")
+	if archiveID == "" || strings.Contains(archiveID, "/") {
+		writeProblem(out, newProblem(
+			http.StatusNotFound,
+			CodeNotFound,
+			"archive not found",
+		))
+		return nil
+	}
+
+	archive, err := srv.store.Archive(in.Context(), archiveID)
+	switch {
+	case err == store.ErrNotFound:
+		writeProblem(out, newProblem(
+			http.StatusNotFound,
+			CodeNotFound,
+			"archive not found",
+		))
+		return nil
+	case err != nil:
+		return errors.Wrap(err, "reading archive from store")
+	}
+
+	format, ok := lookupArchiveFormat(archive.Format)
+	if !ok {
+		return errors.Errorf("unknown archive format '%s'", archive.Format)
+	}
+
+	contents, err := srv.store.OpenFile(in.Context(), archive.ContentsID)
+	if err != nil {
+		return errors.Wrap(err, "opening archive contents")
+	}
+	defer contents.Close()
+
+	// The checksum uniquely identifies the contents of the archive
+	// and is therefore used as a strong entity tag.
+	// http.ServeContent takes care of conditional and range requests
+	header := out.Header()
+	header.Set("Content-Type", format.contentType)
+	header.Set("ETag", `"`+archive.Checksum+`"`)
+	header.Set(
+		"Content-Disposition",
+		fmt.Sprintf(
+			`attachment; filename="%s%s"`,
+			archive.ID,
+			format.extension,
+		),
+	)
+	http.ServeContent(
+		out,
+		in,
+		"",
+		archive.Created,
+		contents,
+	)
+
+	return nil
+}
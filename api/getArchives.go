@@ -0,0 +1,185 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/romshark/zipapi/store"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultArchivesPageSize defines the default number of archives
+	// per page of GET /archives
+	defaultArchivesPageSize = 50
+
+	// maxArchivesPageSize defines the maximum number of archives
+	// per page of GET /archives
+	maxArchivesPageSize = 1000
+)
+
+// ArchiveFileInfo represents an archived file in the API responses
+type ArchiveFileInfo struct {
+	// ID identifies the stored file, it's used to reference the file
+	// when building new archives from stored files
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// SHA256 defines the hex encoded SHA-256 checksum of the file,
+	// it's omitted for files archived before checksums were recorded
+	SHA256 string `json:"sha256,omitempty"`
+
+	// ModTime, Mode and Comment are omitted
+	// unless supplied by the client
+	ModTime *time.Time `json:"mtime,omitempty"`
+	Mode    string     `json:"mode,omitempty"`
+	Comment string     `json:"comment,omitempty"`
+}
+
+// ArchiveInfo represents an archive in the API responses
+type ArchiveInfo struct {
+	ID          string            `json:"id"`
+	Created     time.Time         `json:"created"`
+	ClientAgent string            `json:"client_agent"`
+	Size        int64             `json:"size"`
+	Checksum    string            `json:"checksum"`
+	Format      string            `json:"format"`
+	Encrypted   bool              `json:"encrypted"`
+	Comment     string            `json:"comment,omitempty"`
+	Files       []ArchiveFileInfo `json:"files"`
+}
+
+// ArchivesPage represents a page of archives returned by GET /archives
+type ArchivesPage struct {
+	Archives []ArchiveInfo `json:"archives"`
+
+	// Cursor is passed as the cursor parameter to request the next page,
+	// it's omitted on the last page
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// parseArchiveQuery parses the query string parameters of GET /archives
+func parseArchiveQuery(in *http.Request) (store.ArchiveQuery, error) {
+	params := in.URL.Query()
+	query := store.ArchiveQuery{
+		ClientAgent: params.Get("agent"),
+		FileName:    params.Get("name"),
+		Cursor:      params.Get("cursor"),
+		Limit:       defaultArchivesPageSize,
+	}
+
+	for name, dest := range map[string]*time.Time{
+		"since": &query.Since,
+		"until": &query.Until,
+	} {
+		if val := params.Get(name); val != "" {
+			t, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				return query, invalidParameter(
+					name,
+					"invalid '%s' parameter, expected RFC 3339 time",
+					name,
+				)
+			}
+			*dest = t
+		}
+	}
+
+	for name, dest := range map[string]*int64{
+		"min-size": &query.MinSize,
+		"max-size": &query.MaxSize,
+	} {
+		if val := params.Get(name); val != "" {
+			v, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || v < 0 {
+				return query, invalidParameter(
+					name,
+					"invalid '%s' parameter, expected number of bytes",
+					name,
+				)
+			}
+			*dest = v
+		}
+	}
+
+	if val := params.Get("limit"); val != "" {
+		v, err := strconv.Atoi(val)
+		if err != nil || v < 1 || v > maxArchivesPageSize {
+			return query, invalidParameter(
+				"limit",
+				"invalid 'limit' parameter, expected number in [1, %d]",
+				maxArchivesPageSize,
+			)
+		}
+		query.Limit = v
+	}
+
+	return query, nil
+}
+
+func (srv *server) getArchives(
+	out http.ResponseWriter,
+	in *http.Request,
+) error {
+	query, err := parseArchiveQuery(in)
+	if err != nil {
+		return clientError(out, err)
+	}
+
+	page, err := srv.store.QueryArchives(in.Context(), query)
+	switch {
+	case err == store.ErrInvalidCursor:
+		return clientError(
+			out,
+			invalidParameter("cursor", "invalid 'cursor' parameter"),
+		)
+	case err != nil:
+		return errors.Wrap(err, "querying archives")
+	}
+
+	resp := ArchivesPage{
+		Archives: make([]ArchiveInfo, len(page.Archives)),
+		Cursor:   page.Cursor,
+	}
+	for i, archive := range page.Archives {
+		format, _ := lookupArchiveFormat(archive.Format)
+		info := ArchiveInfo{
+			ID:          archive.ID,
+			Created:     archive.Created,
+			ClientAgent: archive.ClientAgent,
+			Size:        archive.Size,
+			Checksum:    archive.Checksum,
+			Format:      format.name,
+			Encrypted:   archive.Encrypted,
+			Comment:     archive.Comment,
+			Files:       make([]ArchiveFileInfo, len(archive.Files)),
+		}
+		for j, fl := range archive.Files {
+			file := ArchiveFileInfo{
+				ID:      fl.ID,
+				Name:    fl.Name,
+				SHA256:  fl.Checksum,
+				Comment: fl.Comment,
+			}
+			if !fl.ModTime.IsZero() {
+				modTime := fl.ModTime
+				file.ModTime = &modTime
+			}
+			if fl.Mode != 0 {
+				file.Mode = fmt.Sprintf("%o", uint32(fl.Mode))
+			}
+			info.Files[j] = file
+		}
+		resp.Archives[i] = info
+	}
+
+	out.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(out).Encode(resp); err != nil {
+		return errors.Wrap(err, "writing response")
+	}
+	return nil
+}
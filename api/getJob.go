@@ -0,0 +1,48 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/romshark/zipapi/store"
+
+	"github.com/pkg/errors"
+)
+
+func (srv *server) getJob(
+	out http.ResponseWriter,
+	in *http.Request,
+) error {
+	jobID := strings.TrimPrefix(in.URL.Path, "/jobs/")
+	if jobID == "" || strings.Contains(jobID, "/") {
+		writeProblem(out, newProblem(
+			http.StatusNotFound,
+			CodeNotFound,
+			"job not found",
+		))
+		return nil
+	}
+
+	job, err := srv.store.Job(in.Context(), jobID)
+	switch {
+	case err == store.ErrNotFound:
+		writeProblem(out, newProblem(
+			http.StatusNotFound,
+			CodeNotFound,
+			"job not found",
+		))
+		return nil
+	case err != nil:
+		return errors.Wrap(err, "reading job from store")
+	}
+
+	// The status changes until the job is finished
+	header := out.Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(out).Encode(srv.jobInfo(job)); err != nil {
+		return errors.Wrap(err, "writing response")
+	}
+	return nil
+}
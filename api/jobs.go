@@ -0,0 +1,513 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/romshark/zipapi/api/config"
+	"github.com/romshark/zipapi/store"
+
+	"github.com/pkg/errors"
+)
+
+// JobProgress represents the progress of an asynchronous archive job
+type JobProgress struct {
+	// ProcessedBytes defines the number of bytes of the uploaded files
+	// written to the archive so far
+	ProcessedBytes int64 `json:"processed_bytes"`
+
+	// TotalBytes defines the total size of the uploaded files
+	TotalBytes int64 `json:"total_bytes"`
+}
+
+// JobInfo represents an asynchronous archive job in the API responses
+type JobInfo struct {
+	ID       string      `json:"id"`
+	Status   string      `json:"status"`
+	Created  time.Time   `json:"created"`
+	Progress JobProgress `json:"progress"`
+
+	// Finished is omitted until the job is finished
+	Finished *time.Time `json:"finished,omitempty"`
+
+	// ArchiveID and ResultURL identify the created archive
+	// once the job is done, the archive is downloaded from ResultURL
+	ArchiveID string `json:"archive_id,omitempty"`
+	ResultURL string `json:"result_url,omitempty"`
+
+	// Error describes why the job failed
+	Error string `json:"error,omitempty"`
+}
+
+// jobQueueFullError is returned for asynchronous archive requests
+// while the max number of jobs is queued
+type jobQueueFullError struct {
+	max int
+}
+
+func (err jobQueueFullError) Error() string {
+	return fmt.Sprintf("max number of queued jobs (%d) reached", err.max)
+}
+
+// jobOptions returns the archive options recorded with a job.
+// Jobs don't support passwords
+func (opts archiveOptions) jobOptions() store.JobOptions {
+	return store.JobOptions{
+		Format:        opts.format.name,
+		Compression:   string(opts.compression.method),
+		Level:         opts.compression.level,
+		Checksums:     string(opts.checksums),
+		Deterministic: opts.deterministic,
+		ModTime:       opts.modTime,
+	}
+}
+
+// parseJobOptions returns the archive options recorded with a job
+func parseJobOptions(recorded store.JobOptions) (archiveOptions, error) {
+	format, ok := lookupArchiveFormat(recorded.Format)
+	if !ok {
+		return archiveOptions{}, errors.Errorf(
+			"unknown archive format '%s'",
+			recorded.Format,
+		)
+	}
+	checksums, err := parseChecksumsEntry(recorded.Checksums)
+	if err != nil {
+		return archiveOptions{}, err
+	}
+	return archiveOptions{
+		format: format,
+		compression: compression{
+			method: config.CompressionMethod(recorded.Compression),
+			level:  recorded.Level,
+		},
+		checksums:     checksums,
+		deterministic: recorded.Deterministic,
+		modTime:       recorded.ModTime,
+	}, nil
+}
+
+// jobRecorder saves the uploaded files to the store
+// and records them in a job which is archived in the background
+type jobRecorder struct {
+	srv       *server
+	ctx       context.Context
+	out       http.ResponseWriter
+	job       store.Job
+	committed bool
+}
+
+// newJobRecorder creates a new job recorder responding to out
+// with the job once it's recorded. Jobs don't support passwords
+// because they're never stored.
+// Returns a jobQueueFullError if there's no slot left in the job queue.
+// The recorder must be released by calling release once it's no longer used
+func (srv *server) newJobRecorder(
+	ctx context.Context,
+	out http.ResponseWriter,
+	created time.Time,
+	clientAgent string,
+	opts archiveOptions,
+) (*jobRecorder, error) {
+	if opts.password != "" {
+		return nil, invalidParameter(
+			FormFieldPassword,
+			"asynchronous archive jobs don't support passwords",
+		)
+	}
+	id, err := store.NewID()
+	if err != nil {
+		return nil, err
+	}
+	// Reserve the slot before the files are uploaded
+	if err := srv.jobs.reserve(); err != nil {
+		return nil, err
+	}
+	return &jobRecorder{
+		srv: srv,
+		ctx: ctx,
+		out: out,
+		job: store.Job{
+			ID:          id,
+			Created:     created,
+			ClientAgent: clientAgent,
+			Status:      store.JobQueued,
+			Options:     opts.jobOptions(),
+		},
+	}, nil
+}
+
+// addFile implements the archiveSink interface
+func (r *jobRecorder) addFile(
+	name string,
+	meta entryMeta,
+	contents io.Reader,
+) error {
+	file, err := r.srv.store.SaveFile(r.ctx, store.File{
+		Upload: store.UploadInfo{
+			Time:        r.job.Created,
+			ClientAgent: r.job.ClientAgent,
+		},
+		Name:    name,
+		ModTime: meta.modTime,
+		Mode:    meta.mode,
+		Comment: meta.comment,
+	}, &fileSizeLimiter{
+		r: contents,
+		err: fileTooLargeError{
+			name:    name,
+			maxSize: r.srv.conf.App.MaxFileSize,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	r.job.Files = append(r.job.Files, file)
+	r.job.Size += file.Size
+	return nil
+}
+
+// addDirectory implements the archiveSink interface
+func (r *jobRecorder) addDirectory(dir string) error {
+	r.job.Directories = append(r.job.Directories, dir)
+	return nil
+}
+
+// finish implements the archiveSink interface.
+// finish saves the job, queues it and responds with it
+func (r *jobRecorder) finish(comment string) error {
+	r.job.Comment = comment
+	if err := r.srv.store.SaveJob(r.ctx, r.job); err != nil {
+		return errors.Wrap(err, "saving job to store")
+	}
+	r.committed = true
+	r.srv.jobs.submit(r.job)
+
+	header := r.out.Header()
+	header.Set("Location", "/jobs/"+r.job.ID)
+	header.Set("Content-Type", "application/json")
+	r.out.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(r.out).Encode(
+		r.srv.jobInfo(r.job),
+	); err != nil {
+		return errors.Wrap(err, "writing response")
+	}
+	return nil
+}
+
+// release implements the archiveSink interface.
+// release removes the saved files and frees the reserved queue slot
+// unless the job was saved
+func (r *jobRecorder) release() {
+	if r.committed {
+		return
+	}
+	r.srv.jobs.unreserve()
+	for _, fl := range r.job.Files {
+		r.srv.deleteFile(fl)
+	}
+}
+
+// jobRunner archives the queued jobs in the background
+// using a bounded pool of workers
+type jobRunner struct {
+	srv   *server
+	lock  *sync.Mutex
+	cond  *sync.Cond
+	queue []store.Job
+
+	// reserved counts the queue slots reserved for jobs being uploaded
+	reserved int
+
+	// processed maps the IDs of the running jobs
+	// to the number of bytes processed so far
+	processed map[string]*int64
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped bool
+	done    *sync.WaitGroup
+}
+
+func newJobRunner(srv *server) *jobRunner {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &jobRunner{
+		srv:       srv,
+		lock:      &sync.Mutex{},
+		processed: make(map[string]*int64),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      &sync.WaitGroup{},
+	}
+	r.cond = sync.NewCond(r.lock)
+	return r
+}
+
+// start queues the unfinished jobs of the store
+// and launches the workers.
+// Jobs interrupted by a shutdown are archived from the start again
+func (r *jobRunner) start(ctx context.Context) error {
+	jobs, err := r.srv.store.UnfinishedJobs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "reading unfinished jobs")
+	}
+	// Resumed jobs are queued regardless of the max number of queued jobs
+	r.lock.Lock()
+	r.queue = append(r.queue, jobs...)
+	r.lock.Unlock()
+
+	for i := 0; i < r.srv.conf.App.JobWorkers; i++ {
+		r.done.Add(1)
+		go r.work()
+	}
+	return nil
+}
+
+// stop stops the workers interrupting the running jobs
+// and blocks until they're stopped.
+// The interrupted jobs are resumed once the server is restarted
+func (r *jobRunner) stop() {
+	r.lock.Lock()
+	r.stopped = true
+	r.cond.Broadcast()
+	r.lock.Unlock()
+
+	r.cancel()
+	r.done.Wait()
+}
+
+// reserve reserves a queue slot for a job to be submitted.
+// Returns a jobQueueFullError if the max number of jobs is queued
+func (r *jobRunner) reserve() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	max := r.srv.conf.App.MaxQueuedJobs
+	if len(r.queue)+r.reserved >= max {
+		return jobQueueFullError{max: max}
+	}
+	r.reserved++
+	return nil
+}
+
+// unreserve frees a reserved queue slot of a job which wasn't submitted
+func (r *jobRunner) unreserve() {
+	r.lock.Lock()
+	r.reserved--
+	r.lock.Unlock()
+}
+
+// submit queues the given job taking its reserved slot
+func (r *jobRunner) submit(job store.Job) {
+	r.lock.Lock()
+	r.reserved--
+	r.queue = append(r.queue, job)
+	r.cond.Signal()
+	r.lock.Unlock()
+}
+
+// next blocks until a job is queued and returns it.
+// Returns false if the runner was stopped
+func (r *jobRunner) next() (store.Job, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for len(r.queue) < 1 && !r.stopped {
+		r.cond.Wait()
+	}
+	if r.stopped {
+		return store.Job{}, false
+	}
+	job := r.queue[0]
+	r.queue = r.queue[1:]
+	r.processed[job.ID] = new(int64)
+	return job, true
+}
+
+// progress returns the number of bytes processed by the running job.
+// Returns false if the job isn't running
+func (r *jobRunner) progress(id string) (int64, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	processed, running := r.processed[id]
+	if !running {
+		return 0, false
+	}
+	return atomic.LoadInt64(processed), true
+}
+
+func (r *jobRunner) work() {
+	defer r.done.Done()
+	for {
+		job, ok := r.next()
+		if !ok {
+			return
+		}
+		r.run(job)
+
+		r.lock.Lock()
+		delete(r.processed, job.ID)
+		r.lock.Unlock()
+	}
+}
+
+// run archives the job and records the outcome.
+// The job fails if it can't be marked running
+func (r *jobRunner) run(job store.Job) {
+	srv := r.srv
+	job.Status = store.JobRunning
+	var archiveID string
+	err := srv.store.SaveJob(r.ctx, job)
+	if err != nil {
+		err = errors.Wrap(err, "saving job to store")
+	} else {
+		r.lock.Lock()
+		processed := r.processed[job.ID]
+		r.lock.Unlock()
+
+		archiveID, err = srv.archiveJob(r.ctx, job, processed)
+	}
+	if err != nil && r.ctx.Err() != nil {
+		// Interrupted by a shutdown
+		return
+	}
+
+	job.Files = nil
+	job.Finished = time.Now()
+	if err != nil {
+		job.Status = store.JobFailed
+		job.Error = http.StatusText(http.StatusInternalServerError)
+		if problem, ok := problemOf(err); ok {
+			job.Error = problem.Detail
+		}
+		srv.logErrf("job %s failed: %s", job.ID, err)
+	} else {
+		job.Status = store.JobDone
+		job.ArchiveID = archiveID
+	}
+	if err := srv.store.SaveJob(context.Background(), job); err != nil {
+		srv.logErrf("job %s: saving job to store: %s", job.ID, err)
+	}
+}
+
+// archiveJob writes the files of the job to a new archive
+// counting the processed bytes and returns the ID of the saved archive.
+// The archive is saved under the ID of the job, so jobs interrupted
+// after their archive was saved aren't archived twice once they're resumed
+func (srv *server) archiveJob(
+	ctx context.Context,
+	job store.Job,
+	processed *int64,
+) (string, error) {
+	switch _, err := srv.store.Archive(ctx, job.ID); err {
+	case nil:
+		return job.ID, nil
+	case store.ErrNotFound:
+	default:
+		return "", errors.Wrap(err, "reading archive")
+	}
+
+	opts, err := parseJobOptions(job.Options)
+	if err != nil {
+		return "", err
+	}
+	arch, err := srv.newArchiveBuilder(
+		ctx,
+		discardResponse{header: make(http.Header)},
+		false,
+		job.ID,
+		job.Created,
+		job.ClientAgent,
+		opts,
+	)
+	if err != nil {
+		return "", err
+	}
+	defer arch.release()
+
+	for _, fl := range job.Files {
+		contents, err := srv.store.OpenFile(ctx, fl.ID)
+		if err != nil {
+			return "", errors.Wrapf(err, "opening file '%s'", fl.Name)
+		}
+		err = arch.addFile(fl.Name, entryMeta{
+			modTime: fl.ModTime,
+			mode:    fl.Mode,
+			comment: fl.Comment,
+		}, &progressReader{r: contents, processed: processed})
+		contents.Close()
+		if err != nil {
+			return "", errors.Wrapf(err, "archiving file '%s'", fl.Name)
+		}
+	}
+
+	for _, dir := range job.Directories {
+		if err := arch.addDirectory(dir); err != nil {
+			return "", err
+		}
+	}
+
+	if err := arch.finish(job.Comment); err != nil {
+		return "", err
+	}
+	return arch.id, nil
+}
+
+// jobInfo returns the job as represented in the API responses
+func (srv *server) jobInfo(job store.Job) JobInfo {
+	info := JobInfo{
+		ID:      job.ID,
+		Status:  string(job.Status),
+		Created: job.Created,
+		Progress: JobProgress{
+			TotalBytes: job.Size,
+		},
+		Error: job.Error,
+	}
+	switch job.Status {
+	case store.JobRunning:
+		info.Progress.ProcessedBytes, _ = srv.jobs.progress(job.ID)
+	case store.JobDone:
+		info.Progress.ProcessedBytes = job.Size
+		info.ArchiveID = job.ArchiveID
+		info.ResultURL = "/archives/" + job.ArchiveID
+	}
+	if !job.Finished.IsZero() {
+		finished := job.Finished
+		info.Finished = &finished
+	}
+	return info
+}
+
+// progressReader counts the bytes read from r
+type progressReader struct {
+	r         io.Reader
+	processed *int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(r.processed, int64(n))
+	return n, err
+}
+
+// discardResponse discards the archives written in the background
+type discardResponse struct {
+	header http.Header
+}
+
+// Header implements the http.ResponseWriter interface
+func (r discardResponse) Header() http.Header { return r.header }
+
+// Write implements the http.ResponseWriter interface
+func (discardResponse) Write(p []byte) (int, error) { return len(p), nil }
+
+// WriteHeader implements the http.ResponseWriter interface
+func (discardResponse) WriteHeader(statusCode int) {}
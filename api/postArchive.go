@@ -1,20 +1,70 @@
 package api
 
 import (
-	"archive/zip"
-	"compress/flate"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"time"
 
-	"github.com/romshark/zipapi/store"
+	"github.com/romshark/zipapi/api/config"
 
 	"github.com/pkg/errors"
 )
 
+const (
+	// HeaderArchiveID defines the response header
+	// carrying the ID of the generated archive
+	HeaderArchiveID = "X-Archive-ID"
+
+	// HeaderEntriesStored defines the response trailer carrying
+	// the number of entries written uncompressed
+	HeaderEntriesStored = "X-Archive-Entries-Stored"
+
+	// HeaderEntriesDeflated defines the response trailer carrying
+	// the number of entries written compressed using the requested
+	// compression method, which is deflate by default
+	HeaderEntriesDeflated = "X-Archive-Entries-Deflated"
+
+	// HeaderArchiveError defines the response trailer reporting
+	// the failure of an archive streamed with a successful status code,
+	// the archive is incomplete if it's set
+	HeaderArchiveError = "X-Archive-Error"
+
+	// ParamAsync defines the query parameter enabling the asynchronous
+	// mode responding with a job archived in the background
+	// instead of the archive
+	ParamAsync = "async"
+
+	// archiveContentTypes describes the content types
+	// of the request bodies accepted by POST /archive
+	archiveContentTypes = "multipart/form-data or application/json"
+)
+
+// archiveSink receives the uploaded files and directories of an archive
+type archiveSink interface {
+	// addFile reads the file from r and adds it with the given metadata.
+	// Returns a fileTooLargeError if the file exceeds the maximum file size
+	addFile(name string, meta entryMeta, r io.Reader) error
+
+	// addDirectory adds an explicit directory
+	addDirectory(dir string) error
+
+	// finish completes the archive with the given archive comment
+	// and responds to the client
+	finish(comment string) error
+
+	// release releases the resources held by the sink
+	release()
+}
+
+// newSinkFunc creates the archive sink for the given archive options
+type newSinkFunc func(opts archiveOptions) (archiveSink, error)
+
 func (srv *server) postArchive(
 	out http.ResponseWriter,
 	in *http.Request,
@@ -22,26 +72,35 @@ func (srv *server) postArchive(
 	// Make sure the content-type header is set
 	contentTypeHeader := in.Header.Get("Content-Type")
 	if contentTypeHeader == "" {
-		http.Error(
-			out,
-			http.StatusText(http.StatusBadRequest),
-			http.StatusBadRequest,
-		)
-		return nil
+		return clientError(out, unsupportedMediaTypeError{
+			expected: archiveContentTypes,
+		})
 	}
 
 	// Validate content-type
 	contentType, _, err := mime.ParseMediaType(contentTypeHeader)
+	if err != nil || (contentType != "multipart/form-data" &&
+		contentType != "application/json") {
+		return clientError(out, unsupportedMediaTypeError{
+			contentType: contentTypeHeader,
+			expected:    archiveContentTypes,
+		})
+	}
+
+	policy, err := srv.nameCollisionPolicy(in)
 	if err != nil {
-		return errors.Wrap(err, "parsing content-type header")
+		return clientError(out, err)
 	}
-	if contentType != "multipart/form-data" {
-		http.Error(
-			out,
-			http.StatusText(http.StatusBadRequest),
-			http.StatusBadRequest,
-		)
-		return nil
+
+	var async bool
+	if value := in.URL.Query().Get(ParamAsync); value != "" {
+		if async, err = strconv.ParseBool(value); err != nil {
+			return clientError(out, invalidParameter(
+				ParamAsync,
+				"invalid '%s' parameter, expected boolean",
+				ParamAsync,
+			))
+		}
 	}
 
 	startTime := time.Now()
@@ -54,107 +113,486 @@ func (srv *server) postArchive(
 		int64(srv.conf.App.MaxReqSize),
 	)
 
+	resp := &responseTracker{ResponseWriter: out}
+	newSink := func(opts archiveOptions) (archiveSink, error) {
+		if async {
+			return srv.newJobRecorder(in.Context(), resp, startTime, userAgent, opts)
+		}
+		return srv.newArchiveBuilder(
+			in.Context(),
+			resp,
+			srv.conf.App.SpoolResponses,
+			"",
+			startTime,
+			userAgent,
+			opts,
+		)
+	}
+	switch {
+	case contentType == "application/json":
+		err = srv.postArchiveUploads(resp, in, policy, newSink)
+	case srv.conf.App.StreamUploads:
+		err = srv.postArchiveStreamed(resp, in, policy, newSink)
+	default:
+		err = srv.postArchiveParsed(resp, in, policy, newSink)
+	}
+	if err != nil && resp.written {
+		// The status code can't be changed anymore
+		srv.logErrf(
+			"internal error: (%s '%s'): %s",
+			in.URL.Path,
+			in.Method,
+			err,
+		)
+		srv.failStream(
+			resp,
+			http.StatusText(http.StatusInternalServerError),
+		)
+		return nil
+	}
+	return err
+}
+
+// failStream reports the failure of an archive whose response
+// was already written to in the archive error trailer.
+// Internal errors must be logged by the caller
+func (srv *server) failStream(out http.ResponseWriter, message string) {
+	out.Header().Set(HeaderArchiveError, message)
+}
+
+// postArchiveParsed parses the entire multipart form
+// before writing the archive to the sink created by newSink
+func (srv *server) postArchiveParsed(
+	out *responseTracker,
+	in *http.Request,
+	policy config.NameCollision,
+	newSink newSinkFunc,
+) error {
 	// Parse inputs
 	if err := in.ParseMultipartForm(
 		int64(srv.conf.App.MaxMultipartMembuf),
 	); err != nil {
-		// This is damn ugly, but there seems to be no way around
-		// comparing the error string
-		if err.Error() == "http: request body too large" {
-			http.Error(
-				out,
-				"request body too large",
-				http.StatusBadRequest,
-			)
-			return nil
+		return clientError(out, errors.Wrap(
+			malformedRequest(err),
+			"parsing multipart/form-data",
+		))
+	}
+
+	param := func(name string) string {
+		if values := in.MultipartForm.Value[name]; len(values) > 0 {
+			return values[0]
 		}
-		return errors.Wrap(err, "parsing multipart/form-data")
+		return in.URL.Query().Get(name)
+	}
+	opts, err := srv.archiveOptions(in, param, func(name string) string {
+		if values := in.MultipartForm.Value[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	})
+	if err != nil {
+		return clientError(out, err)
 	}
 
-	// Init zip archive writer
-	arch := zip.NewWriter(out)
-	defer arch.Close()
-	arch.RegisterCompressor(
-		//TODO: make this compression optional
-		zip.Deflate,
-		func(out io.Writer) (io.WriteCloser, error) {
-			return flate.NewWriter(out, flate.BestCompression)
-		},
-	)
-	defer arch.Close()
+	// Read the archive structure defined by the non-file fields
+	paths := newEntryPaths(newEntryNames(policy))
+	if err := paths.reserve(opts.checksums); err != nil {
+		return clientError(out, err)
+	}
+	if err := srv.readEntryPaths(paths, in.MultipartForm); err != nil {
+		return clientError(out, err)
+	}
 
-	files := make([]store.File, 0, len(in.MultipartForm.File))
+	// Collect the files of all fields in a deterministic order,
+	// fields may contain multiple files
+	fields := make([]string, 0, len(in.MultipartForm.File))
+	for field := range in.MultipartForm.File {
+		if field == FormFieldManifest {
+			continue
+		}
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var files []*multipart.FileHeader
+	var entries []string
+	var metas []entryMeta
+	for _, field := range fields {
+		for _, fl := range in.MultipartForm.File[field] {
+			if uint64(fl.Size) > srv.conf.App.MaxFileSize {
+				return clientError(out, fileTooLargeError{
+					name:    fl.Filename,
+					maxSize: srv.conf.App.MaxFileSize,
+					field:   field,
+				})
+			}
 
-	if len(in.MultipartForm.File) < 1 {
-		// Missing files
-		http.Error(
-			out,
-			http.StatusText(http.StatusBadRequest),
-			http.StatusBadRequest,
-		)
-		return nil
+			entry, meta, err := paths.resolve(field, rawFileName(fl.Header))
+			if err != nil {
+				return clientError(out, err)
+			}
+			files = append(files, fl)
+			entries = append(entries, entry)
+			metas = append(metas, meta)
+		}
 	}
 
-	for flName, fl := range in.MultipartForm.File {
-		// Check file size
-		if uint64(fl[0].Size) > srv.conf.App.MaxFileSize {
-			http.Error(
-				out,
-				fmt.Sprintf(
-					"file '%s' exceeds max file size (%d)",
-					flName,
-					srv.conf.App.MaxFileSize,
-				),
-				http.StatusBadRequest,
-			)
-			return nil
+	// The stored files follow the uploaded files
+	stored, storedSize, err := srv.resolveStored(in.Context(), paths)
+	if err != nil {
+		return clientError(out, err)
+	}
+	if storedSize > srv.conf.App.MaxReqSize {
+		return clientError(out, uploadsTooLargeError{
+			size:  storedSize,
+			limit: srv.conf.App.MaxReqSize,
+		})
+	}
+	for _, fl := range stored {
+		entries = append(entries, fl.entry)
+		metas = append(metas, fl.meta)
+	}
+
+	if len(entries) < 1 {
+		return clientError(out, missingFilesError{})
+	}
+
+	order := archiveOrder(entries, opts.deterministic)
+	directories := paths.directories
+	if opts.deterministic {
+		directories = append([]string(nil), directories...)
+		sort.Strings(directories)
+	}
+
+	arch, err := newSink(opts)
+	if err != nil {
+		return clientError(out, err)
+	}
+	defer arch.release()
+
+	for _, i := range order {
+		if i >= len(files) {
+			if err := srv.addStored(
+				in.Context(),
+				arch,
+				stored[i-len(files)],
+			); err != nil {
+				return err
+			}
+			continue
 		}
 
-		file, err := fl[0].Open()
+		fl := files[i]
+		file, err := fl.Open()
 		if err != nil {
 			return errors.Wrapf(
 				err,
 				"opening file '%s' from multipart/form-data",
-				flName,
+				fl.Filename,
 			)
 		}
 
-		// Read file
-		contents, err := ioutil.ReadAll(file)
+		err = arch.addFile(entries[i], metas[i], file)
+		file.Close()
 		if err != nil {
 			return errors.Wrapf(
 				err,
 				"reading file '%s' multipart/form-data",
-				flName,
+				fl.Filename,
 			)
 		}
+	}
 
-		files = append(files, store.File{
-			Upload: store.UploadInfo{
-				Time:        startTime,
-				ClientAgent: userAgent,
-			},
-			Name:     flName,
-			Contents: contents,
+	for _, dir := range directories {
+		if err := arch.addDirectory(dir); err != nil {
+			return err
+		}
+	}
+
+	return arch.finish(paths.archiveComment())
+}
+
+// archiveOrder returns the indexes of the given entry names
+// in the order of archivation skipping the entries overwritten
+// by a subsequent entry with the same name
+func archiveOrder(entries []string, deterministic bool) []int {
+	last := make(map[string]int, len(entries))
+	for i, name := range entries {
+		last[name] = i
+	}
+	order := make([]int, 0, len(last))
+	for i := range entries {
+		if last[entries[i]] == i {
+			order = append(order, i)
+		}
+	}
+	if deterministic {
+		// Sort the entries by name to make the archive
+		// independent of the upload order
+		sort.Slice(order, func(i, j int) bool {
+			return entries[order[i]] < entries[order[j]]
 		})
+	}
+	return order
+}
 
-		// Add file to archive
-		fout, err := arch.Create(flName)
+// readEntryPaths reads the manifest, the explicit directories
+// and the companion path fields of a parsed multipart form
+func (srv *server) readEntryPaths(
+	paths *entryPaths,
+	form *multipart.Form,
+) error {
+	// The manifest may also be uploaded as a file
+	if manifests := form.File[FormFieldManifest]; len(manifests) > 0 {
+		manifest, err := manifests[0].Open()
 		if err != nil {
-			return errors.Wrap(err, "creating archive file")
+			return errors.Wrap(err, "opening manifest")
+		}
+		defer manifest.Close()
+		if err := paths.readManifest(manifest); err != nil {
+			return err
+		}
+	}
+
+	// The manifest must be read before the directories
+	// and the order of the companion path fields must be preserved
+	fields := make([]string, 0, len(form.Value))
+	for field := range form.Value {
+		if field != FormFieldManifest {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	if _, ok := form.Value[FormFieldManifest]; ok {
+		fields = append([]string{FormFieldManifest}, fields...)
+	}
+	for _, field := range fields {
+		for _, value := range form.Value[field] {
+			if _, err := paths.addField(field, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// postArchiveStreamed reads the uploaded files one by one
+// writing each of them to the sink created by newSink
+// while it's being received instead of parsing
+// the entire multipart form first
+func (srv *server) postArchiveStreamed(
+	out *responseTracker,
+	in *http.Request,
+	policy config.NameCollision,
+	newSink newSinkFunc,
+) error {
+	reader, err := in.MultipartReader()
+	if err != nil {
+		return clientError(out, errors.Wrap(
+			malformedRequest(err),
+			"reading multipart/form-data",
+		))
+	}
+
+	// Allow reading the request body
+	// while the response is already being written
+	if err := http.NewResponseController(out).EnableFullDuplex(); err != nil {
+		return errors.Wrap(err, "enabling full-duplex")
+	}
+
+	// fail responds with the problem describing the given client error
+	// if the response wasn't written to yet, otherwise the failure
+	// is reported in the trailer because the status code
+	// can't be changed anymore. Other errors are returned
+	fail := func(err error) error {
+		problem, ok := problemOf(err)
+		if !ok {
+			return err
+		}
+		if out.written {
+			srv.failStream(out, problem.Detail)
+			return nil
+		}
+		writeProblem(out, problem)
+		return nil
+	}
+
+	// Options sent as form fields take precedence over the query
+	query := in.URL.Query()
+	fields := make(url.Values)
+	param := func(name string) string {
+		if value := fields.Get(name); value != "" {
+			return value
+		}
+		return query.Get(name)
+	}
+
+	paths := newEntryPaths(newEntryNames(policy))
+	parseOptions := func() (*archiveOptions, error) {
+		opts, err := srv.archiveOptions(in, param, fields.Get)
+		if err != nil {
+			return nil, err
+		}
+		if err := paths.reserve(opts.checksums); err != nil {
+			return nil, err
+		}
+		return &opts, nil
+	}
+
+	var opts *archiveOptions
+	var arch archiveSink
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(errors.Wrap(
+				malformedRequest(err),
+				"reading multipart/form-data part",
+			))
+		}
+
+		if part.FormName() == FormFieldManifest || part.FileName() == "" {
+			// Read the fields defining the archive structure,
+			// they must precede the files they apply to
+			if err := readStreamedField(paths, fields, part); err != nil {
+				return fail(errors.Wrap(err, "reading multipart/form-data field"))
+			}
+			continue
 		}
 
-		// Write file
-		_, err = fout.Write(contents)
+		if opts == nil {
+			// The archive options must precede the first file.
+			// Deterministic mode keeps the upload order
+			// since the entries are written while being received
+			if opts, err = parseOptions(); err != nil {
+				return fail(err)
+			}
+		}
+
+		flName, meta, err := paths.resolve(
+			part.FormName(),
+			rawFileName(part.Header),
+		)
 		if err != nil {
-			return errors.Wrap(err, "copying multipart file to archive")
+			return fail(err)
+		}
+
+		if arch == nil {
+			// Lazily initialize the archive on the first file
+			// to still be able to respond with an error
+			// in case of missing files
+			if arch, err = newSink(*opts); err != nil {
+				return fail(err)
+			}
+			defer arch.release()
+		}
+
+		if err := arch.addFile(flName, meta, partReader{part}); err != nil {
+			if tooLarge, ok := errors.Cause(err).(fileTooLargeError); ok {
+				tooLarge.field = part.FormName()
+				err = tooLarge
+			}
+			return fail(errors.Wrapf(
+				err,
+				"reading file '%s' multipart/form-data",
+				flName,
+			))
 		}
 	}
 
-	// Save file to store
-	if err := srv.store.SaveFiles(files...); err != nil {
-		return errors.Wrap(err, "saving files to store")
+	// The stored files follow the uploaded files,
+	// their sources must be defined before the end of the form
+	if opts == nil && len(paths.stored) > 0 {
+		if opts, err = parseOptions(); err != nil {
+			return fail(err)
+		}
+	}
+	stored, storedSize, err := srv.resolveStored(in.Context(), paths)
+	if err != nil {
+		return fail(err)
+	}
+	if storedSize > srv.conf.App.MaxReqSize {
+		return fail(uploadsTooLargeError{
+			size:  storedSize,
+			limit: srv.conf.App.MaxReqSize,
+		})
+	}
+	if arch == nil && len(stored) > 0 {
+		if arch, err = newSink(*opts); err != nil {
+			return fail(err)
+		}
+		defer arch.release()
+	}
+	if arch == nil {
+		return fail(missingFilesError{})
+	}
+	for _, fl := range stored {
+		if err := srv.addStored(in.Context(), arch, fl); err != nil {
+			return fail(err)
+		}
 	}
 
-	return nil
+	for _, dir := range paths.directories {
+		if err := arch.addDirectory(dir); err != nil {
+			return err
+		}
+	}
+
+	return arch.finish(paths.archiveComment())
+}
+
+// partReader reports the failures reading a multipart/form-data part
+// as malformed request bodies unless they're caused
+// by the max request size
+type partReader struct {
+	part *multipart.Part
+}
+
+func (r partReader) Read(p []byte) (int, error) {
+	n, err := r.part.Read(p)
+	if err != nil && err != io.EOF {
+		err = malformedRequest(err)
+	}
+	return n, err
+}
+
+// readStreamedField reads a non-file field of a streamed upload
+// recording the archive options in fields
+// and skipping fields unrelated to the archive
+func readStreamedField(
+	paths *entryPaths,
+	fields url.Values,
+	part *multipart.Part,
+) error {
+	r := partReader{part}
+	if part.FormName() == FormFieldManifest {
+		return paths.readManifest(r)
+	}
+
+	value, err := ioutil.ReadAll(io.LimitReader(r, maxManifestSize))
+	if err != nil {
+		return err
+	}
+	switch part.FormName() {
+	case ParamCompression,
+		ParamLevel,
+		ParamFormat,
+		ParamChecksums,
+		ParamDeterministic,
+		ParamModTime,
+		FormFieldPassword:
+		fields.Set(part.FormName(), string(value))
+	default:
+		if _, err := paths.addField(
+			part.FormName(),
+			string(value),
+		); err != nil {
+			return err
+		}
+	}
+
+	// Skip the remainder of oversized unrelated fields
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
 }
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+
+	"github.com/romshark/zipapi/store"
+
+	"github.com/pkg/errors"
+)
+
+// FieldStored defines the field of JSON archive requests
+// and the form field of multipart archive requests
+// carrying the JSON encoded list of StoredSource
+// to include in the archive. The form field may be repeated
+const FieldStored = "stored"
+
+// StoredSource references a file or all files of an archive
+// already in the store by the IDs listed by GET /archives.
+// Exactly one of File and Archive must be set
+type StoredSource struct {
+	// File identifies an archived file
+	File string `json:"file,omitempty"`
+
+	// Archive identifies an archive whose files are all included
+	Archive string `json:"archive,omitempty"`
+
+	// Path defines the archive path of the file or the directory
+	// the files of the archive are placed in.
+	// The files keep their stored paths if it's empty
+	Path string `json:"path,omitempty"`
+}
+
+// storedFile represents a stored file included in an archive
+type storedFile struct {
+	id    string
+	entry string
+	meta  entryMeta
+}
+
+// readStoredSources decodes the stored sources of a form field
+func readStoredSources(value string) ([]StoredSource, error) {
+	var sources []StoredSource
+	if err := json.Unmarshal([]byte(value), &sources); err != nil {
+		return nil, invalidParameter(
+			FieldStored,
+			"invalid '%s' field, expected JSON array of stored sources",
+			FieldStored,
+		)
+	}
+	return sources, nil
+}
+
+// resolveStored looks up the stored sources of the archive
+// and resolves the archive paths of their files.
+// Returns the files in the order of the sources
+// and their total size in bytes
+func (srv *server) resolveStored(
+	ctx context.Context,
+	paths *entryPaths,
+) ([]storedFile, uint64, error) {
+	var files []storedFile
+	var size uint64
+	for _, source := range paths.stored {
+		var archive store.Archive
+		var err error
+		switch {
+		case source.File != "" && source.Archive == "":
+			archive, err = srv.store.FileArchive(ctx, source.File)
+		case source.Archive != "" && source.File == "":
+			archive, err = srv.store.Archive(ctx, source.Archive)
+		default:
+			return nil, 0, invalidParameter(
+				FieldStored,
+				"stored source must reference either a file or an archive",
+			)
+		}
+		switch {
+		case err == store.ErrNotFound && source.File != "":
+			return nil, 0, invalidParameter(
+				FieldStored,
+				"stored file '%s' not found",
+				source.File,
+			)
+		case err == store.ErrNotFound:
+			return nil, 0, invalidParameter(
+				FieldStored,
+				"stored archive '%s' not found",
+				source.Archive,
+			)
+		case err != nil:
+			return nil, 0, errors.Wrap(err, "reading stored archive")
+		case archive.Encrypted:
+			// The files of encrypted archives aren't stored
+			return nil, 0, invalidParameter(
+				FieldStored,
+				"archive '%s' is encrypted, its files can't be reused",
+				archive.ID,
+			)
+		}
+
+		for _, fl := range archive.Files {
+			var filePath string
+			switch {
+			case source.File != "" && fl.ID != source.File:
+				continue
+			case source.File != "" && source.Path != "":
+				filePath = source.Path
+			case source.Archive != "" && source.Path != "":
+				filePath = path.Join(source.Path, fl.Name)
+			default:
+				filePath = fl.Name
+			}
+
+			cleaned, err := cleanPath(filePath)
+			if err != nil {
+				return nil, 0, err
+			}
+			entry, err := paths.names.resolve(cleaned)
+			if err != nil {
+				return nil, 0, err
+			}
+			files = append(files, storedFile{
+				id:    fl.ID,
+				entry: entry,
+				meta: entryMeta{
+					modTime: fl.ModTime,
+					mode:    fl.Mode,
+					comment: fl.Comment,
+				},
+			})
+			size += uint64(fl.Size)
+		}
+	}
+	return files, size, nil
+}
+
+// addStored adds the given stored file to the archive sink
+func (srv *server) addStored(
+	ctx context.Context,
+	arch archiveSink,
+	fl storedFile,
+) error {
+	contents, err := srv.store.OpenFile(ctx, fl.id)
+	if err == store.ErrNotFound {
+		// The archive was removed in the meantime
+		return invalidParameter(
+			FieldStored,
+			"stored file '%s' not found",
+			fl.id,
+		)
+	} else if err != nil {
+		return errors.Wrapf(err, "opening stored file '%s'", fl.id)
+	}
+	defer contents.Close()
+
+	if err := arch.addFile(fl.entry, fl.meta, contents); err != nil {
+		return errors.Wrapf(err, "reading stored file '%s'", fl.id)
+	}
+	return nil
+}
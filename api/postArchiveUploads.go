@@ -0,0 +1,236 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/romshark/zipapi/api/config"
+
+	"github.com/pkg/errors"
+)
+
+// FieldUploads defines the field of JSON archive requests
+// listing the IDs of the resumable uploads to archive
+const FieldUploads = "uploads"
+
+// UploadArchiveRequest defines an archive of finished resumable uploads
+// and files already in the store, it's sent to POST /archive as JSON.
+// The uploads are archived under their file names unless the embedded
+// manifest, keyed by the file names, defines other paths
+type UploadArchiveRequest struct {
+	// Uploads lists the IDs of the finished resumable uploads
+	// in the order of archivation
+	Uploads []string `json:"uploads"`
+
+	// Stored lists the stored files and archives
+	// archived after the uploads
+	Stored []StoredSource `json:"stored"`
+
+	UploadManifest
+}
+
+// uploadIncompleteError is returned for archive requests
+// referencing unfinished uploads
+type uploadIncompleteError struct {
+	id     string
+	offset int64
+	length int64
+}
+
+func (err uploadIncompleteError) Error() string {
+	return fmt.Sprintf(
+		"upload '%s' is incomplete (%d of %d bytes)",
+		err.id,
+		err.offset,
+		err.length,
+	)
+}
+
+// uploadsTooLargeError is returned when the uploaded or stored files
+// of an archive request exceed the max request size in total
+type uploadsTooLargeError struct {
+	size  uint64
+	limit uint64
+}
+
+func (err uploadsTooLargeError) Error() string {
+	return fmt.Sprintf(
+		"files of %d bytes exceed max request size (%d)",
+		err.size,
+		err.limit,
+	)
+}
+
+// readUploadArchiveRequest decodes the archive request read from r
+func readUploadArchiveRequest(r io.Reader) (UploadArchiveRequest, error) {
+	var req UploadArchiveRequest
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxManifestSize+1))
+	if err != nil {
+		return req, malformedRequest(err)
+	}
+	if len(data) > maxManifestSize {
+		return req, invalidManifestError{
+			reason: fmt.Sprintf("exceeds %d bytes", maxManifestSize),
+			limit:  maxManifestSize,
+		}
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return req, invalidManifestError{reason: err.Error()}
+	}
+	return req, nil
+}
+
+// postArchiveUploads archives the finished resumable uploads
+// and the stored files listed by the JSON request
+// to the sink created by newSink.
+// The archive options are read from the query parameters.
+// The uploads are removed once they're archived
+func (srv *server) postArchiveUploads(
+	out *responseTracker,
+	in *http.Request,
+	policy config.NameCollision,
+	newSink newSinkFunc,
+) error {
+	req, err := readUploadArchiveRequest(in.Body)
+	if err != nil {
+		return clientError(out, errors.Wrap(err, "reading request"))
+	}
+
+	// The password is read from the password header
+	opts, err := srv.archiveOptions(
+		in,
+		in.URL.Query().Get,
+		func(string) string { return "" },
+	)
+	if err != nil {
+		return clientError(out, err)
+	}
+
+	paths := newEntryPaths(newEntryNames(policy))
+	if err := paths.reserve(opts.checksums); err != nil {
+		return clientError(out, err)
+	}
+	if err := paths.setManifest(req.UploadManifest); err != nil {
+		return clientError(out, err)
+	}
+	paths.stored = req.Stored
+
+	if len(req.Uploads) < 1 && len(req.Stored) < 1 {
+		return clientError(out, missingFilesError{})
+	}
+	requested := make(map[string]struct{}, len(req.Uploads))
+	for _, id := range req.Uploads {
+		if _, ok := requested[id]; ok {
+			return clientError(out, invalidParameter(
+				FieldUploads,
+				"duplicate upload '%s'",
+				id,
+			))
+		}
+		requested[id] = struct{}{}
+	}
+
+	uploads, err := srv.uploads.acquireAll(req.Uploads, time.Now())
+	if notFound, ok := errors.Cause(err).(uploadNotFoundError); ok {
+		return clientError(out, invalidParameter(FieldUploads, "%s", notFound))
+	} else if err != nil {
+		return clientError(out, err)
+	}
+	defer srv.uploads.release(uploads...)
+
+	// Resolve the archive paths of the uploads
+	entries := make([]string, len(uploads))
+	metas := make([]entryMeta, len(uploads))
+	var size uint64
+	for i, u := range uploads {
+		if !u.complete() {
+			return clientError(out, uploadIncompleteError{
+				id:     u.info.ID,
+				offset: u.offset,
+				length: u.info.Length,
+			})
+		}
+		size += uint64(u.info.Length)
+
+		if entries[i], metas[i], err = paths.resolve(
+			u.info.ID,
+			u.info.Name,
+		); err != nil {
+			return clientError(out, err)
+		}
+	}
+
+	// The stored files follow the uploads
+	stored, storedSize, err := srv.resolveStored(in.Context(), paths)
+	if err != nil {
+		return clientError(out, err)
+	}
+	size += storedSize
+	for _, fl := range stored {
+		entries = append(entries, fl.entry)
+		metas = append(metas, fl.meta)
+	}
+	if size > srv.conf.App.MaxReqSize {
+		return clientError(out, uploadsTooLargeError{
+			size:  size,
+			limit: srv.conf.App.MaxReqSize,
+		})
+	}
+
+	order := archiveOrder(entries, opts.deterministic)
+	directories := paths.directories
+	if opts.deterministic {
+		directories = append([]string(nil), directories...)
+		sort.Strings(directories)
+	}
+
+	arch, err := newSink(opts)
+	if err != nil {
+		return clientError(out, err)
+	}
+	defer arch.release()
+
+	for _, i := range order {
+		if i >= len(uploads) {
+			if err := srv.addStored(
+				in.Context(),
+				arch,
+				stored[i-len(uploads)],
+			); err != nil {
+				return err
+			}
+			continue
+		}
+
+		file, err := srv.uploads.open(uploads[i])
+		if err != nil {
+			return err
+		}
+		err = arch.addFile(entries[i], metas[i], file)
+		file.Close()
+		if err != nil {
+			return errors.Wrapf(
+				err,
+				"reading upload '%s'",
+				uploads[i].info.ID,
+			)
+		}
+	}
+
+	for _, dir := range directories {
+		if err := arch.addDirectory(dir); err != nil {
+			return err
+		}
+	}
+
+	if err := arch.finish(paths.archiveComment()); err != nil {
+		return err
+	}
+	srv.uploads.discard(uploads...)
+	return nil
+}
@@ -0,0 +1,357 @@
+package api
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorCode identifies the kind of a failed request
+type ErrorCode string
+
+const (
+	// CodeMissingFiles is returned for archive requests without files
+	CodeMissingFiles ErrorCode = "missing_files"
+
+	// CodeFileTooLarge is returned for files exceeding the max file size
+	CodeFileTooLarge ErrorCode = "file_too_large"
+
+	// CodeRequestTooLarge is returned for request bodies
+	// exceeding the max request size
+	CodeRequestTooLarge ErrorCode = "request_too_large"
+
+	// CodeUnsupportedMediaType is returned for request bodies
+	// of an unsupported content type
+	CodeUnsupportedMediaType ErrorCode = "unsupported_media_type"
+
+	// CodeNotAcceptable is returned when none of the archive formats
+	// is acceptable to the client
+	CodeNotAcceptable ErrorCode = "not_acceptable"
+
+	// CodeMalformedRequest is returned for request bodies
+	// which can't be parsed
+	CodeMalformedRequest ErrorCode = "malformed_request"
+
+	// CodeInvalidParameter is returned for malformed or unsupported
+	// query parameters and form fields
+	CodeInvalidParameter ErrorCode = "invalid_parameter"
+
+	// CodeInvalidPath is returned for malformed archive paths
+	CodeInvalidPath ErrorCode = "invalid_path"
+
+	// CodeInvalidManifest is returned for malformed upload manifests
+	CodeInvalidManifest ErrorCode = "invalid_manifest"
+
+	// CodeInvalidMetadata is returned for malformed file metadata
+	CodeInvalidMetadata ErrorCode = "invalid_metadata"
+
+	// CodeNameCollision is returned for rejected duplicate file names
+	CodeNameCollision ErrorCode = "name_collision"
+
+	// CodePathConflict is returned for files archived at the path
+	// of a directory or inside of a file
+	CodePathConflict ErrorCode = "path_conflict"
+
+	// CodeNotFound is returned for unknown resources
+	CodeNotFound ErrorCode = "not_found"
+
+	// CodeMethodNotAllowed is returned for unsupported request methods
+	CodeMethodNotAllowed ErrorCode = "method_not_allowed"
+
+	// CodeUnsupportedVersion is returned for resumable upload requests
+	// of an unsupported tus protocol version
+	CodeUnsupportedVersion ErrorCode = "unsupported_version"
+
+	// CodeOffsetMismatch is returned for resumable upload chunks
+	// not continuing at the current offset of the upload
+	CodeOffsetMismatch ErrorCode = "offset_mismatch"
+
+	// CodeUploadLocked is returned for resumable uploads
+	// which are already being written to or archived
+	CodeUploadLocked ErrorCode = "upload_locked"
+
+	// CodeUploadIncomplete is returned for archive requests
+	// referencing unfinished resumable uploads
+	CodeUploadIncomplete ErrorCode = "upload_incomplete"
+
+	// CodeJobQueueFull is returned for asynchronous archive requests
+	// while the max number of jobs is queued
+	CodeJobQueueFull ErrorCode = "job_queue_full"
+
+	// CodeInternal is returned for unexpected server errors
+	CodeInternal ErrorCode = "internal_error"
+)
+
+// ContentTypeProblem defines the content type of error responses
+const ContentTypeProblem = "application/problem+json"
+
+// Problem represents an RFC 7807 problem details error response
+type Problem struct {
+	Type   string    `json:"type"`
+	Title  string    `json:"title"`
+	Status int       `json:"status"`
+	Detail string    `json:"detail,omitempty"`
+	Code   ErrorCode `json:"code"`
+
+	// Field names the offending parameter, form field or header
+	Field string `json:"field,omitempty"`
+
+	// Limit defines the exceeded limit, if any
+	Limit uint64 `json:"limit,omitempty"`
+}
+
+// newProblem creates a problem of the given status and code
+func newProblem(status int, code ErrorCode, detail string) Problem {
+	return Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// writeProblem responds with the given problem
+func writeProblem(out http.ResponseWriter, problem Problem) {
+	header := out.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Type", ContentTypeProblem)
+	header.Set("X-Content-Type-Options", "nosniff")
+	out.WriteHeader(problem.Status)
+
+	// Failing to write means the client is gone
+	_ = json.NewEncoder(out).Encode(problem)
+}
+
+// invalidParameterError is returned for malformed or unsupported
+// query parameters and form fields
+type invalidParameterError struct {
+	name    string
+	message string
+}
+
+func (err invalidParameterError) Error() string {
+	return err.message
+}
+
+// invalidParameter returns an invalidParameterError
+// for the given parameter with a formatted message
+func invalidParameter(
+	name string,
+	format string,
+	v ...interface{},
+) invalidParameterError {
+	return invalidParameterError{
+		name:    name,
+		message: fmt.Sprintf(format, v...),
+	}
+}
+
+// unsupportedMediaTypeError is returned for request bodies
+// of an unsupported or missing content type
+type unsupportedMediaTypeError struct {
+	contentType string
+
+	// expected describes the supported content types
+	expected string
+}
+
+func (err unsupportedMediaTypeError) Error() string {
+	if err.contentType == "" {
+		return "missing content type, expected " + err.expected
+	}
+	return fmt.Sprintf(
+		"unsupported content type '%s', expected %s",
+		err.contentType,
+		err.expected,
+	)
+}
+
+// malformedRequestError is returned for request bodies
+// which can't be parsed
+type malformedRequestError struct {
+	err error
+}
+
+func (err malformedRequestError) Error() string {
+	return "malformed request body: " + err.err.Error()
+}
+
+// Unwrap allows detecting request bodies
+// exceeding the max request size
+func (err malformedRequestError) Unwrap() error { return err.err }
+
+// malformedRequest returns a malformedRequestError
+// for the given error reading the request body unless it's caused
+// by the max request size or by the filesystem of the server
+func malformedRequest(err error) error {
+	var maxBytes *http.MaxBytesError
+	var pathErr *fs.PathError
+	if err == nil ||
+		stderrors.As(err, &maxBytes) ||
+		stderrors.As(err, &pathErr) {
+		return err
+	}
+	return malformedRequestError{err: err}
+}
+
+// missingFilesError is returned for archive requests without files
+type missingFilesError struct{}
+
+func (missingFilesError) Error() string {
+	return "missing files"
+}
+
+// problemOf returns the problem describing the given client error.
+// Returns false if the error isn't caused by the client
+func problemOf(err error) (Problem, bool) {
+	cause := errors.Cause(err)
+
+	// Errors wrapped by the standard library aren't
+	// unwrapped by errors.Cause
+	var maxBytes *http.MaxBytesError
+	if stderrors.As(cause, &maxBytes) {
+		problem := newProblem(
+			http.StatusRequestEntityTooLarge,
+			CodeRequestTooLarge,
+			"request body too large",
+		)
+		problem.Limit = uint64(maxBytes.Limit)
+		return problem, true
+	}
+
+	var problem Problem
+	switch err := cause.(type) {
+	case fileTooLargeError:
+		problem = newProblem(
+			http.StatusRequestEntityTooLarge,
+			CodeFileTooLarge,
+			err.Error(),
+		)
+		problem.Field = err.field
+		problem.Limit = err.maxSize
+	case unsupportedMediaTypeError:
+		problem = newProblem(
+			http.StatusUnsupportedMediaType,
+			CodeUnsupportedMediaType,
+			err.Error(),
+		)
+		problem.Field = "Content-Type"
+	case notAcceptableError:
+		problem = newProblem(
+			http.StatusNotAcceptable,
+			CodeNotAcceptable,
+			err.Error(),
+		)
+		problem.Field = "Accept"
+	case invalidParameterError:
+		problem = newProblem(
+			http.StatusBadRequest,
+			CodeInvalidParameter,
+			err.Error(),
+		)
+		problem.Field = err.name
+	case malformedRequestError:
+		problem = newProblem(
+			http.StatusBadRequest,
+			CodeMalformedRequest,
+			err.Error(),
+		)
+	case missingFilesError:
+		problem = newProblem(
+			http.StatusBadRequest,
+			CodeMissingFiles,
+			err.Error(),
+		)
+	case unsupportedVersionError:
+		problem = newProblem(
+			http.StatusPreconditionFailed,
+			CodeUnsupportedVersion,
+			err.Error(),
+		)
+		problem.Field = HeaderTusResumable
+	case offsetMismatchError:
+		problem = newProblem(
+			http.StatusConflict,
+			CodeOffsetMismatch,
+			err.Error(),
+		)
+		problem.Field = HeaderUploadOffset
+	case uploadLockedError:
+		problem = newProblem(http.StatusLocked, CodeUploadLocked, err.Error())
+	case uploadIncompleteError:
+		problem = newProblem(
+			http.StatusConflict,
+			CodeUploadIncomplete,
+			err.Error(),
+		)
+	case uploadLengthExceededError:
+		problem = newProblem(
+			http.StatusRequestEntityTooLarge,
+			CodeFileTooLarge,
+			err.Error(),
+		)
+		problem.Limit = uint64(err.length)
+	case uploadsTooLargeError:
+		problem = newProblem(
+			http.StatusRequestEntityTooLarge,
+			CodeRequestTooLarge,
+			err.Error(),
+		)
+		problem.Limit = err.limit
+	case jobQueueFullError:
+		problem = newProblem(
+			http.StatusServiceUnavailable,
+			CodeJobQueueFull,
+			err.Error(),
+		)
+		problem.Limit = uint64(err.max)
+	case invalidPathError:
+		problem = newProblem(http.StatusBadRequest, CodeInvalidPath, err.Error())
+	case invalidManifestError:
+		problem = newProblem(
+			http.StatusBadRequest,
+			CodeInvalidManifest,
+			err.Error(),
+		)
+		problem.Field = FormFieldManifest
+		problem.Limit = err.limit
+	case invalidMetadataError:
+		problem = newProblem(
+			http.StatusBadRequest,
+			CodeInvalidMetadata,
+			err.Error(),
+		)
+		problem.Limit = err.limit
+	case nameCollisionError:
+		problem = newProblem(
+			http.StatusBadRequest,
+			CodeNameCollision,
+			err.Error(),
+		)
+	case pathConflictError:
+		problem = newProblem(
+			http.StatusBadRequest,
+			CodePathConflict,
+			err.Error(),
+		)
+	default:
+		return problem, false
+	}
+	return problem, true
+}
+
+// clientError responds with the problem describing the error
+// if it was caused by the client, otherwise the error is returned
+func clientError(out http.ResponseWriter, err error) error {
+	problem, ok := problemOf(err)
+	if !ok {
+		return err
+	}
+	writeProblem(out, problem)
+	return nil
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// sniffLen defines the number of bytes considered by content sniffing
+const sniffLen = 512
+
+// compressedContentTypes lists the sniffed content types
+// of already compressed formats
+var compressedContentTypes = map[string]bool{
+	"image/jpeg":                    true,
+	"image/png":                     true,
+	"image/gif":                     true,
+	"image/webp":                    true,
+	"video/mp4":                     true,
+	"video/webm":                    true,
+	"audio/mpeg":                    true,
+	"audio/aac":                     true,
+	"application/ogg":               true,
+	"application/zip":               true,
+	"application/x-gzip":            true,
+	"application/x-rar-compressed":  true,
+	"application/vnd.ms-fontobject": true,
+	"font/woff":                     true,
+	"font/woff2":                    true,
+}
+
+// compressedExtensions lists the file extensions
+// of already compressed formats
+var compressedExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
+	".webp": true, ".heic": true, ".avif": true,
+	".mp4": true, ".m4v": true, ".mov": true, ".mkv": true, ".webm": true,
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true, ".opus": true,
+	".flac": true,
+	".zip":  true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true,
+	".zst": true, ".7z": true, ".rar": true, ".br": true, ".lz4": true,
+	".jar": true, ".apk": true, ".docx": true, ".xlsx": true, ".pptx": true,
+	".odt": true, ".ods": true, ".odp": true, ".epub": true,
+	".woff": true, ".woff2": true,
+}
+
+// isCompressed returns true if the file is of an already compressed format
+// judging by its extension and the sniffed content type of its head
+func isCompressed(name string, head []byte) bool {
+	if compressedExtensions[strings.ToLower(path.Ext(name))] {
+		return true
+	}
+	contentType := http.DetectContentType(head)
+	if i := strings.IndexByte(contentType, ';'); i > -1 {
+		contentType = contentType[:i]
+	}
+	return compressedContentTypes[contentType]
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// spool buffers written data in memory up to a limit
+// and moves it to a temporary file once the limit is exceeded.
+// The spool must be closed to remove the temporary file
+type spool struct {
+	limit int64
+	size  int64
+	mem   bytes.Buffer
+	file  *os.File
+}
+
+func newSpool(limit int64) *spool {
+	return &spool{limit: limit}
+}
+
+// Write implements the io.Writer interface
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil && s.size+int64(len(p)) > s.limit {
+		file, err := ioutil.TempFile("", "zipapi-spool-")
+		if err != nil {
+			return 0, errors.Wrap(err, "creating spool file")
+		}
+		s.file = file
+		if _, err := s.mem.WriteTo(file); err != nil {
+			return 0, errors.Wrap(err, "writing spool file")
+		}
+	}
+
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.mem.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// Size returns the number of bytes written
+func (s *spool) Size() int64 { return s.size }
+
+// WriteTo writes the spooled data to w
+func (s *spool) WriteTo(w io.Writer) (int64, error) {
+	if s.file == nil {
+		return io.Copy(w, bytes.NewReader(s.mem.Bytes()))
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return 0, errors.Wrap(err, "seeking spool file")
+	}
+	return io.Copy(w, s.file)
+}
+
+// Close releases the buffer and removes the temporary file
+func (s *spool) Close() error {
+	s.mem = bytes.Buffer{}
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"time"
+
+	"github.com/romshark/zipapi/api/config"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// tarWriter writes tar archives optionally compressed as a whole
+type tarWriter struct {
+	srv     *server
+	tar     *tar.Writer
+	modTime time.Time
+
+	// compressor compresses the entire archive, nil if uncompressed
+	compressor io.WriteCloser
+}
+
+// newTarWriter creates a new tar archive writer writing to out
+// compressing the archive according to the format.
+// The gzip compression level is defined by the compression options
+func (srv *server) newTarWriter(
+	out io.Writer,
+	format archiveFormat,
+	modTime time.Time,
+	compression compression,
+) (*tarWriter, error) {
+	w := &tarWriter{srv: srv, modTime: modTime}
+	switch format {
+	case formatTarGz:
+		level := compression.level
+		if compression.method == config.CompressionStore {
+			level = gzip.NoCompression
+		}
+		gz, err := gzip.NewWriterLevel(out, level)
+		if err != nil {
+			return nil, errors.Wrap(err, "initializing gzip compressor")
+		}
+		w.compressor = gz
+	case formatTarZst:
+		// Encode synchronously to not leak the encoder's goroutines
+		// in case the archive isn't finalized
+		zst, err := zstd.NewWriter(out, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, errors.Wrap(err, "initializing zstd compressor")
+		}
+		w.compressor = zst
+	}
+
+	if w.compressor != nil {
+		out = w.compressor
+	}
+	w.tar = tar.NewWriter(out)
+	return w, nil
+}
+
+// writeFile spools the file read from r to determine its size
+// and writes it to the archive. The entry comment is written
+// as a PAX comment record
+func (w *tarWriter) writeFile(
+	name string,
+	meta entryMeta,
+	r io.Reader,
+) error {
+	contents := newSpool(int64(w.srv.conf.App.MaxMultipartMembuf))
+	defer contents.Close()
+	if _, err := io.Copy(contents, r); err != nil {
+		return err
+	}
+
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     contents.Size(),
+		Mode:     0644,
+		ModTime:  w.modTime,
+		Format:   tar.FormatPAX,
+	}
+	if meta.mode != 0 {
+		header.Mode = int64(meta.mode)
+	}
+	if !meta.modTime.IsZero() {
+		header.ModTime = meta.modTime
+	}
+	if meta.comment != "" {
+		header.PAXRecords = map[string]string{"comment": meta.comment}
+	}
+	if err := w.tar.WriteHeader(header); err != nil {
+		return errors.Wrap(err, "creating archive file")
+	}
+	if _, err := contents.WriteTo(w.tar); err != nil {
+		return errors.Wrap(err, "writing archive file")
+	}
+	return nil
+}
+
+// writeDirectory writes an explicit directory entry to the archive
+func (w *tarWriter) writeDirectory(dir string) error {
+	if err := w.tar.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     dir + "/",
+		Mode:     0755,
+		ModTime:  w.modTime,
+		Format:   tar.FormatPAX,
+	}); err != nil {
+		return errors.Wrapf(err, "creating archive directory '%s'", dir)
+	}
+	return nil
+}
+
+// close finalizes the archive and flushes the compressor,
+// tar archives don't support archive comments
+func (w *tarWriter) close(comment string) error {
+	if err := w.tar.Close(); err != nil {
+		return errors.Wrap(err, "finalizing archive")
+	}
+	if w.compressor != nil {
+		if err := w.compressor.Close(); err != nil {
+			return errors.Wrap(err, "finalizing archive compression")
+		}
+	}
+	return nil
+}
+
+// release implements the archiveWriter interface,
+// entries are spooled synchronously and need no release
+func (w *tarWriter) release() {}
@@ -0,0 +1,352 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/romshark/zipapi/store"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// TusVersion defines the supported version of the tus
+	// resumable upload protocol
+	TusVersion = "1.0.0"
+
+	// TusExtensions lists the supported tus protocol extensions
+	TusExtensions = "creation,expiration,termination"
+
+	// HeaderTusResumable defines the header carrying
+	// the tus protocol version of requests and responses
+	HeaderTusResumable = "Tus-Resumable"
+
+	// HeaderTusVersion defines the header listing
+	// the supported tus protocol versions
+	HeaderTusVersion = "Tus-Version"
+
+	// HeaderTusExtension defines the header listing
+	// the supported tus protocol extensions
+	HeaderTusExtension = "Tus-Extension"
+
+	// HeaderTusMaxSize defines the header carrying
+	// the maximum size of an upload in bytes
+	HeaderTusMaxSize = "Tus-Max-Size"
+
+	// HeaderUploadOffset defines the header carrying
+	// the number of bytes of an upload received so far
+	HeaderUploadOffset = "Upload-Offset"
+
+	// HeaderUploadLength defines the header carrying
+	// the total size of an upload in bytes
+	HeaderUploadLength = "Upload-Length"
+
+	// HeaderUploadDeferLength defines the header deferring the length
+	// of an upload, which isn't supported
+	HeaderUploadDeferLength = "Upload-Defer-Length"
+
+	// HeaderUploadMetadata defines the header carrying
+	// the comma separated key and base64 encoded value pairs
+	// of the upload metadata
+	HeaderUploadMetadata = "Upload-Metadata"
+
+	// HeaderUploadExpires defines the header carrying
+	// the expiration time of an unfinished upload
+	HeaderUploadExpires = "Upload-Expires"
+
+	// UploadMetadataFileName defines the upload metadata key
+	// of the file name, which is required
+	UploadMetadataFileName = "filename"
+
+	// ContentTypeOffsetStream defines the content type of upload chunks
+	ContentTypeOffsetStream = "application/offset+octet-stream"
+)
+
+// unsupportedVersionError is returned for requests
+// of an unsupported or missing tus protocol version
+type unsupportedVersionError struct {
+	version string
+}
+
+func (err unsupportedVersionError) Error() string {
+	if err.version == "" {
+		return fmt.Sprintf(
+			"missing %s header, expected %s",
+			HeaderTusResumable,
+			TusVersion,
+		)
+	}
+	return fmt.Sprintf(
+		"unsupported tus version '%s', expected %s",
+		err.version,
+		TusVersion,
+	)
+}
+
+// offsetMismatchError is returned for chunks which don't continue
+// at the current offset of the upload
+type offsetMismatchError struct {
+	offset   int64
+	expected int64
+}
+
+func (err offsetMismatchError) Error() string {
+	return fmt.Sprintf(
+		"offset %d doesn't match the upload offset %d",
+		err.offset,
+		err.expected,
+	)
+}
+
+// parseUploadMetadata parses the Upload-Metadata header
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		key, encoded := pair, ""
+		if i := strings.IndexByte(pair, ' '); i >= 0 {
+			key, encoded = pair[:i], pair[i+1:]
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if key == "" || err != nil {
+			return nil, invalidParameter(
+				HeaderUploadMetadata,
+				"invalid %s header, expected key and base64 encoded value pairs",
+				HeaderUploadMetadata,
+			)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// checkTusVersion returns an unsupportedVersionError
+// if the request doesn't use the supported tus protocol version.
+// OPTIONS requests don't require a version
+func checkTusVersion(out http.ResponseWriter, in *http.Request) error {
+	out.Header().Set(HeaderTusResumable, TusVersion)
+	if in.Method == http.MethodOptions {
+		return nil
+	}
+	if version := in.Header.Get(HeaderTusResumable); version != TusVersion {
+		out.Header().Set(HeaderTusVersion, TusVersion)
+		return unsupportedVersionError{version: version}
+	}
+	return nil
+}
+
+// serveUploads handles the tus upload creation endpoint
+func (srv *server) serveUploads(
+	out http.ResponseWriter,
+	in *http.Request,
+) error {
+	if err := checkTusVersion(out, in); err != nil {
+		return clientError(out, err)
+	}
+	if in.Method == http.MethodOptions {
+		return srv.optionsUploads(out, in)
+	}
+	return srv.postUpload(out, in)
+}
+
+// serveUpload handles the tus endpoint of an upload
+func (srv *server) serveUpload(
+	out http.ResponseWriter,
+	in *http.Request,
+) error {
+	if err := checkTusVersion(out, in); err != nil {
+		return clientError(out, err)
+	}
+	if in.Method == http.MethodOptions {
+		return srv.optionsUploads(out, in)
+	}
+
+	uploadID := strings.TrimPrefix(in.URL.Path, "/uploads/")
+	var err error
+	switch in.Method {
+	case http.MethodHead:
+		err = srv.headUpload(out, uploadID)
+	case http.MethodPatch:
+		err = srv.patchUpload(out, in, uploadID)
+	case http.MethodDelete:
+		err = srv.deleteUpload(out, uploadID)
+	}
+	if _, ok := errors.Cause(err).(uploadNotFoundError); ok {
+		writeProblem(out, newProblem(
+			http.StatusNotFound,
+			CodeNotFound,
+			"upload not found",
+		))
+		return nil
+	}
+	return clientError(out, err)
+}
+
+// optionsUploads describes the supported tus protocol features
+func (srv *server) optionsUploads(
+	out http.ResponseWriter,
+	in *http.Request,
+) error {
+	header := out.Header()
+	header.Set(HeaderTusVersion, TusVersion)
+	header.Set(HeaderTusExtension, TusExtensions)
+	header.Set(
+		HeaderTusMaxSize,
+		strconv.FormatUint(srv.conf.App.MaxFileSize, 10),
+	)
+	out.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// postUpload creates a new resumable upload
+func (srv *server) postUpload(
+	out http.ResponseWriter,
+	in *http.Request,
+) error {
+	if in.Header.Get(HeaderUploadDeferLength) != "" {
+		return clientError(out, invalidParameter(
+			HeaderUploadDeferLength,
+			"deferred upload lengths aren't supported",
+		))
+	}
+	length, err := strconv.ParseInt(in.Header.Get(HeaderUploadLength), 10, 64)
+	if err != nil || length < 0 {
+		return clientError(out, invalidParameter(
+			HeaderUploadLength,
+			"invalid %s header, expected non-negative integer",
+			HeaderUploadLength,
+		))
+	}
+
+	metadata, err := parseUploadMetadata(in.Header.Get(HeaderUploadMetadata))
+	if err != nil {
+		return clientError(out, err)
+	}
+	name := metadata[UploadMetadataFileName]
+	if name == "" {
+		return clientError(out, invalidParameter(
+			HeaderUploadMetadata,
+			"missing '%s' upload metadata",
+			UploadMetadataFileName,
+		))
+	}
+	if uint64(length) > srv.conf.App.MaxFileSize {
+		return clientError(out, fileTooLargeError{
+			name:    name,
+			maxSize: srv.conf.App.MaxFileSize,
+			field:   HeaderUploadLength,
+		})
+	}
+
+	id, err := store.NewID()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	info := uploadInfo{
+		ID:          id,
+		Name:        name,
+		Length:      length,
+		Metadata:    in.Header.Get(HeaderUploadMetadata),
+		Created:     now,
+		Expires:     now.Add(srv.conf.App.UploadExpiration),
+		ClientAgent: in.Header.Get("User-Agent"),
+	}
+	if err := srv.uploads.create(info, now); err != nil {
+		return err
+	}
+
+	header := out.Header()
+	header.Set("Location", "/uploads/"+id)
+	header.Set(HeaderUploadExpires, info.Expires.UTC().Format(http.TimeFormat))
+	out.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// headUpload responds with the offset of an upload
+func (srv *server) headUpload(out http.ResponseWriter, uploadID string) error {
+	u, err := srv.uploads.lookup(uploadID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	header := out.Header()
+	header.Set(HeaderUploadOffset, strconv.FormatInt(u.offset, 10))
+	header.Set(HeaderUploadLength, strconv.FormatInt(u.info.Length, 10))
+	if u.info.Metadata != "" {
+		header.Set(HeaderUploadMetadata, u.info.Metadata)
+	}
+	header.Set(
+		HeaderUploadExpires,
+		u.info.Expires.UTC().Format(http.TimeFormat),
+	)
+	header.Set("Cache-Control", "no-store")
+	out.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// patchUpload appends a chunk to an upload
+func (srv *server) patchUpload(
+	out http.ResponseWriter,
+	in *http.Request,
+	uploadID string,
+) error {
+	contentType := in.Header.Get("Content-Type")
+	if contentType != ContentTypeOffsetStream {
+		return unsupportedMediaTypeError{
+			contentType: contentType,
+			expected:    ContentTypeOffsetStream,
+		}
+	}
+	offset, err := strconv.ParseInt(in.Header.Get(HeaderUploadOffset), 10, 64)
+	if err != nil || offset < 0 {
+		return invalidParameter(
+			HeaderUploadOffset,
+			"invalid %s header, expected non-negative integer",
+			HeaderUploadOffset,
+		)
+	}
+
+	now := time.Now()
+	u, err := srv.uploads.acquire(uploadID, now)
+	if err != nil {
+		return err
+	}
+	defer srv.uploads.release(u)
+
+	if offset != u.offset {
+		return offsetMismatchError{offset: offset, expected: u.offset}
+	}
+
+	// Limit the chunk size, the bytes received until a failure are kept
+	chunk := http.MaxBytesReader(out, in.Body, int64(srv.conf.App.MaxReqSize))
+	expires := now.Add(srv.conf.App.UploadExpiration)
+	err = srv.uploads.write(u, chunk, expires)
+
+	header := out.Header()
+	header.Set(HeaderUploadOffset, strconv.FormatInt(u.offset, 10))
+	header.Set(HeaderUploadExpires, expires.UTC().Format(http.TimeFormat))
+	if err != nil {
+		return err
+	}
+	out.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// deleteUpload terminates an upload removing its partial file
+func (srv *server) deleteUpload(out http.ResponseWriter, uploadID string) error {
+	u, err := srv.uploads.acquire(uploadID, time.Now())
+	if err != nil {
+		return err
+	}
+	srv.uploads.discard(u)
+	out.WriteHeader(http.StatusNoContent)
+	return nil
+}
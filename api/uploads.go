@@ -0,0 +1,418 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// extUploadInfo defines the extension of the files holding
+// the information about the resumable uploads
+const extUploadInfo = ".json"
+
+// maxUploadPurgeInterval defines the max interval
+// at which the expired uploads are removed
+const maxUploadPurgeInterval = time.Minute
+
+// uploadInfo represents the persisted information about a resumable upload
+type uploadInfo struct {
+	ID string `json:"id"`
+
+	// Name defines the file name supplied in the upload metadata
+	Name string `json:"name"`
+
+	// Length defines the total size of the file in bytes
+	Length int64 `json:"length"`
+
+	// Metadata holds the raw Upload-Metadata header
+	Metadata string `json:"metadata,omitempty"`
+
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+	ClientAgent string    `json:"client_agent"`
+}
+
+// upload represents a resumable upload
+type upload struct {
+	info uploadInfo
+
+	// offset defines the number of bytes received so far
+	offset int64
+
+	// locked is true while the upload is written to, archived or removed
+	locked bool
+}
+
+// complete returns true if all bytes of the upload were received
+func (u *upload) complete() bool { return u.offset == u.info.Length }
+
+// uploadNotFoundError is returned for unknown or expired uploads
+type uploadNotFoundError struct {
+	id string
+}
+
+func (err uploadNotFoundError) Error() string {
+	return fmt.Sprintf("upload '%s' not found", err.id)
+}
+
+// uploadLockedError is returned for uploads which are
+// already being written to or archived by another request
+type uploadLockedError struct {
+	id string
+}
+
+func (err uploadLockedError) Error() string {
+	return fmt.Sprintf("upload '%s' is locked by another request", err.id)
+}
+
+// uploadLengthExceededError is returned for chunks
+// exceeding the declared length of the upload
+type uploadLengthExceededError struct {
+	id     string
+	length int64
+}
+
+func (err uploadLengthExceededError) Error() string {
+	return fmt.Sprintf(
+		"upload '%s' exceeds its length (%d)",
+		err.id,
+		err.length,
+	)
+}
+
+// uploadRegistry keeps the partial files of the resumable uploads
+// along with their information in a directory.
+//
+// All methods except startPurging and close are thread-safe
+type uploadRegistry struct {
+	dir string
+
+	// temporary is true if the directory is removed on close
+	temporary bool
+
+	lock    *sync.Mutex
+	uploads map[string]*upload
+
+	// purgeStop stops the periodic removal of the expired uploads,
+	// purgeDone is closed when it stopped. Both are nil until it's started
+	purgeStop chan struct{}
+	purgeDone chan struct{}
+}
+
+// openUploadRegistry opens the upload registry keeping its files in dir
+// resuming the uploads which didn't expire yet. A temporary directory
+// is created if dir is empty
+func openUploadRegistry(dir string, now time.Time) (*uploadRegistry, error) {
+	r := &uploadRegistry{
+		dir:     dir,
+		lock:    &sync.Mutex{},
+		uploads: make(map[string]*upload),
+	}
+	if dir == "" {
+		tempDir, err := ioutil.TempDir("", "zipapi-uploads-")
+		if err != nil {
+			return nil, errors.Wrap(err, "creating upload directory")
+		}
+		r.dir = tempDir
+		r.temporary = true
+		return r, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "creating upload directory")
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading upload directory")
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), extUploadInfo) {
+			continue
+		}
+		u, err := r.load(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if u == nil || !u.info.Expires.After(now) {
+			r.remove(strings.TrimSuffix(entry.Name(), extUploadInfo))
+			continue
+		}
+		r.uploads[u.info.ID] = u
+	}
+
+	// Remove the contents of the uploads whose creation was interrupted
+	for _, entry := range entries {
+		if _, ok := r.uploads[entry.Name()]; !ok &&
+			!strings.HasSuffix(entry.Name(), extUploadInfo) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+	return r, nil
+}
+
+func (r *uploadRegistry) contentPath(id string) string {
+	return filepath.Join(r.dir, id)
+}
+
+func (r *uploadRegistry) infoPath(id string) string {
+	return filepath.Join(r.dir, id+extUploadInfo)
+}
+
+// load reads the upload described by the given info file.
+// Returns nil if the upload is corrupted
+func (r *uploadRegistry) load(infoFile string) (*upload, error) {
+	data, err := ioutil.ReadFile(filepath.Join(r.dir, infoFile))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading upload info %s", infoFile)
+	}
+	u := &upload{}
+	if err := json.Unmarshal(data, &u.info); err != nil ||
+		u.info.ID+extUploadInfo != infoFile {
+		return nil, nil
+	}
+
+	stat, err := os.Stat(r.contentPath(u.info.ID))
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, errors.Wrapf(err, "reading upload %s", u.info.ID)
+	case stat.Size() > u.info.Length:
+		return nil, nil
+	}
+	u.offset = stat.Size()
+	return u, nil
+}
+
+// writeInfo atomically writes the information about an upload
+func (r *uploadRegistry) writeInfo(info uploadInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return errors.Wrap(err, "encoding upload info")
+	}
+	path := r.infoPath(info.ID)
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return errors.Wrap(err, "writing upload info")
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return errors.Wrap(err, "writing upload info")
+	}
+	return nil
+}
+
+// remove removes the files of the given upload
+func (r *uploadRegistry) remove(id string) {
+	os.Remove(r.infoPath(id))
+	os.Remove(r.contentPath(id))
+}
+
+// removeExpired removes the expired uploads which aren't locked.
+// The registry must be locked by the caller
+func (r *uploadRegistry) removeExpired(now time.Time) {
+	for id, u := range r.uploads {
+		if !u.locked && !u.info.Expires.After(now) {
+			delete(r.uploads, id)
+			r.remove(id)
+		}
+	}
+}
+
+// startPurging removes the expired uploads which aren't locked
+// at the given interval until the registry is closed
+func (r *uploadRegistry) startPurging(interval time.Duration) {
+	r.purgeStop = make(chan struct{})
+	r.purgeDone = make(chan struct{})
+	go func() {
+		defer close(r.purgeDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.purgeStop:
+				return
+			case now := <-ticker.C:
+				r.lock.Lock()
+				r.removeExpired(now)
+				r.lock.Unlock()
+			}
+		}
+	}()
+}
+
+// create creates a new empty upload
+// removing the expired uploads which aren't locked
+func (r *uploadRegistry) create(info uploadInfo, now time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.removeExpired(now)
+
+	file, err := os.OpenFile(
+		r.contentPath(info.ID),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		0600,
+	)
+	if err != nil {
+		return errors.Wrap(err, "creating upload")
+	}
+	file.Close()
+	if err := r.writeInfo(info); err != nil {
+		r.remove(info.ID)
+		return err
+	}
+	r.uploads[info.ID] = &upload{info: info}
+	return nil
+}
+
+// lookup returns a copy of the upload identified by the given ID.
+// Returns an uploadNotFoundError if there's no such upload
+// or if it expired
+func (r *uploadRegistry) lookup(id string, now time.Time) (upload, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	u, ok := r.uploads[id]
+	if !ok || !u.info.Expires.After(now) {
+		return upload{}, uploadNotFoundError{id: id}
+	}
+	return *u, nil
+}
+
+// acquire locks the upload identified by the given ID
+// and returns it, the upload must be released once it's no longer used.
+// Returns an uploadNotFoundError if there's no such upload
+// or if it expired and an uploadLockedError if it's already locked
+func (r *uploadRegistry) acquire(id string, now time.Time) (*upload, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	u, ok := r.uploads[id]
+	switch {
+	case !ok:
+		return nil, uploadNotFoundError{id: id}
+	case u.locked:
+		return nil, uploadLockedError{id: id}
+	case !u.info.Expires.After(now):
+		delete(r.uploads, id)
+		r.remove(id)
+		return nil, uploadNotFoundError{id: id}
+	}
+	u.locked = true
+	return u, nil
+}
+
+// acquireAll acquires all uploads identified by the given IDs
+// or none of them
+func (r *uploadRegistry) acquireAll(
+	ids []string,
+	now time.Time,
+) ([]*upload, error) {
+	uploads := make([]*upload, 0, len(ids))
+	for _, id := range ids {
+		u, err := r.acquire(id, now)
+		if err != nil {
+			r.release(uploads...)
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, nil
+}
+
+// release unlocks the given acquired uploads
+func (r *uploadRegistry) release(uploads ...*upload) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, u := range uploads {
+		u.locked = false
+	}
+}
+
+// discard removes the given acquired uploads
+func (r *uploadRegistry) discard(uploads ...*upload) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, u := range uploads {
+		delete(r.uploads, u.info.ID)
+		r.remove(u.info.ID)
+	}
+}
+
+// write appends the chunk read from chunk to the given acquired upload
+// and postpones its expiration. The bytes received before a failure
+// are kept. Returns an uploadLengthExceededError if the chunk
+// exceeds the length of the upload
+func (r *uploadRegistry) write(
+	u *upload,
+	chunk io.Reader,
+	expires time.Time,
+) error {
+	file, err := os.OpenFile(
+		r.contentPath(u.info.ID),
+		os.O_WRONLY|os.O_APPEND,
+		0600,
+	)
+	if err != nil {
+		return errors.Wrap(err, "opening upload")
+	}
+	written, err := io.Copy(
+		file,
+		io.LimitReader(chunk, u.info.Length-u.offset),
+	)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "writing upload")
+	}
+
+	r.lock.Lock()
+	u.offset += written
+	u.info.Expires = expires
+	r.lock.Unlock()
+
+	if infoErr := r.writeInfo(u.info); err == nil {
+		err = infoErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// Make sure the chunk doesn't exceed the length
+	var extra [1]byte
+	if n, _ := chunk.Read(extra[:]); n > 0 {
+		return uploadLengthExceededError{id: u.info.ID, length: u.info.Length}
+	}
+	return nil
+}
+
+// open opens the contents of the given acquired upload for reading
+func (r *uploadRegistry) open(u *upload) (*os.File, error) {
+	file, err := os.Open(r.contentPath(u.info.ID))
+	if err != nil {
+		return nil, errors.Wrap(err, "opening upload")
+	}
+	return file, nil
+}
+
+// close stops removing the expired uploads
+// and removes the upload directory if it's temporary
+func (r *uploadRegistry) close() error {
+	if r.purgeStop != nil {
+		close(r.purgeStop)
+		<-r.purgeDone
+	}
+	if !r.temporary {
+		return nil
+	}
+	return os.RemoveAll(r.dir)
+}
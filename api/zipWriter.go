@@ -0,0 +1,423 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// zipWriter writes zip archives choosing the compression method
+// of each entry individually
+type zipWriter struct {
+	srv         *server
+	ctx         context.Context
+	id          string
+	header      http.Header
+	zip         *zip.Writer
+	compression compression
+
+	// password encrypts all entries if not empty
+	password string
+
+	// modTime defines the modification time of all entries,
+	// entries have no modification time if it's zero
+	modTime time.Time
+
+	// pending holds the entries being compressed concurrently
+	pending []*entryJob
+
+	// stored and compressed count the entries
+	// written uncompressed and compressed
+	stored     int
+	compressed int
+}
+
+// newZipWriter creates a new zip archive writer writing to out
+// according to the archive options.
+// The numbers of stored and compressed entries are reported
+// in the trailers of the response header
+func (srv *server) newZipWriter(
+	ctx context.Context,
+	out io.Writer,
+	id string,
+	header http.Header,
+	opts archiveOptions,
+) *zipWriter {
+	header.Add(
+		"Trailer",
+		HeaderEntriesStored+", "+HeaderEntriesDeflated,
+	)
+
+	w := &zipWriter{
+		srv:         srv,
+		ctx:         ctx,
+		id:          id,
+		header:      header,
+		zip:         zip.NewWriter(out),
+		compression: opts.compression,
+		password:    opts.password,
+	}
+	if opts.deterministic {
+		w.modTime = opts.modTime
+	}
+	registerCompressors(w.zip, opts.compression.level)
+	return w
+}
+
+// writeFile writes an archive entry reading its contents from r
+// choosing the compression method of the entry
+func (w *zipWriter) writeFile(
+	name string,
+	meta entryMeta,
+	r io.Reader,
+) error {
+	method := zip.Store
+	c, compressed := compressors[w.compression.method]
+	if compressed {
+		method = c.method
+	}
+
+	conf := w.srv.conf.App.Compression
+	if method != zip.Store && conf.SkipCompressed {
+		// Sniff the content type of the file's head
+		head := make([]byte, sniffLen)
+		n, err := io.ReadFull(r, head)
+		if err != nil &&
+			err != io.EOF &&
+			err != io.ErrUnexpectedEOF {
+			return err
+		}
+		head = head[:n]
+		if isCompressed(name, head) {
+			method = zip.Store
+			c = compressor{}
+		}
+		r = io.MultiReader(bytes.NewReader(head), r)
+	}
+
+	if method != zip.Store && w.srv.conf.App.CompressionWorkers > 1 {
+		return w.writeConcurrent(c, name, meta, r)
+	}
+
+	// Entries compressed concurrently must be written first
+	// to preserve the order of the entries
+	if err := w.flush(true); err != nil {
+		return err
+	}
+
+	// Encrypted entries must be written raw
+	if method != zip.Store && conf.CompareSizes || w.password != "" {
+		job, err := w.spoolEntry(c, name, meta, r)
+		if err != nil {
+			return err
+		}
+		defer job.close()
+		if job.compress(w.compression.level, conf.CompareSizes); job.err != nil {
+			return job.err
+		}
+		return w.writeRaw(job)
+	}
+
+	header := &zip.FileHeader{Name: name, Method: method}
+	w.setMetadata(header, meta)
+	fout, err := w.zip.CreateHeader(header)
+	if err != nil {
+		return errors.Wrap(err, "creating archive file")
+	}
+	if _, err := io.Copy(fout, r); err != nil {
+		return err
+	}
+	w.count(method)
+	return nil
+}
+
+// entryJob is an archive entry spooled for compression
+type entryJob struct {
+	name       string
+	meta       entryMeta
+	compressor compressor
+	raw        *spool
+	compressed *spool
+	crc32      uint32
+	header     *zip.FileHeader
+
+	// done is closed once the entry is compressed
+	done chan struct{}
+	err  error
+}
+
+// spoolEntry reads the contents of an entry from r into a spool
+// to be compressed by the given compressor
+func (w *zipWriter) spoolEntry(
+	c compressor,
+	name string,
+	meta entryMeta,
+	r io.Reader,
+) (*entryJob, error) {
+	limit := int64(w.srv.conf.App.MaxMultipartMembuf)
+	job := &entryJob{
+		name:       name,
+		meta:       meta,
+		compressor: c,
+		raw:        newSpool(limit),
+		compressed: newSpool(limit),
+		done:       make(chan struct{}),
+	}
+	checksum := crc32.NewIEEE()
+	if _, err := io.Copy(io.MultiWriter(job.raw, checksum), r); err != nil {
+		job.close()
+		return nil, err
+	}
+	job.crc32 = checksum.Sum32()
+	return job, nil
+}
+
+// compress compresses the spooled entry and prepares its header.
+// If compareSizes is true the entry is stored uncompressed instead
+// when compressing didn't reduce its size.
+// Entries without a compressor are stored uncompressed
+func (job *entryJob) compress(level int, compareSizes bool) {
+	if job.compressor.newWriter == nil {
+		job.header = &zip.FileHeader{
+			Name:               job.name,
+			Method:             zip.Store,
+			CRC32:              job.crc32,
+			CompressedSize64:   uint64(job.raw.Size()),
+			UncompressedSize64: uint64(job.raw.Size()),
+		}
+		prepareRawHeader(job.header)
+		return
+	}
+
+	compressor, err := job.compressor.newWriter(job.compressed, level)
+	if err != nil {
+		job.err = errors.Wrap(err, "initializing compressor")
+		return
+	}
+	if _, err := job.raw.WriteTo(compressor); err != nil {
+		job.err = errors.Wrap(err, "compressing")
+		return
+	}
+	if err := compressor.Close(); err != nil {
+		job.err = errors.Wrap(err, "compressing")
+		return
+	}
+
+	job.header = &zip.FileHeader{
+		Name:               job.name,
+		Method:             job.compressor.method,
+		CRC32:              job.crc32,
+		CompressedSize64:   uint64(job.compressed.Size()),
+		UncompressedSize64: uint64(job.raw.Size()),
+	}
+	if compareSizes && job.compressed.Size() >= job.raw.Size() {
+		job.header.Method = zip.Store
+		job.header.CompressedSize64 = uint64(job.raw.Size())
+	}
+	prepareRawHeader(job.header)
+}
+
+// close releases the spools of the entry
+func (job *entryJob) close() {
+	job.raw.Close()
+	job.compressed.Close()
+}
+
+// writeConcurrent spools the entry read from r and compresses it
+// in the background once a compression worker is available.
+// Compressed entries are written in the order they were added
+func (w *zipWriter) writeConcurrent(
+	c compressor,
+	name string,
+	meta entryMeta,
+	r io.Reader,
+) error {
+	job, err := w.spoolEntry(c, name, meta, r)
+	if err != nil {
+		return err
+	}
+	w.pending = append(w.pending, job)
+
+	conf := w.srv.conf.App
+	go func() {
+		defer close(job.done)
+		select {
+		case w.srv.compressionSlots <- struct{}{}:
+			defer func() { <-w.srv.compressionSlots }()
+		case <-w.ctx.Done():
+			job.err = w.ctx.Err()
+			return
+		}
+		job.compress(w.compression.level, conf.Compression.CompareSizes)
+	}()
+
+	// Limit the number of entries buffered per archive
+	return w.flush(len(w.pending) >= 2*conf.CompressionWorkers)
+}
+
+// flush writes the compressed pending entries to the archive
+// in the order they were added. If wait is true flush waits
+// for all pending entries to be compressed
+func (w *zipWriter) flush(wait bool) error {
+	for len(w.pending) > 0 {
+		job := w.pending[0]
+		if wait {
+			<-job.done
+		} else {
+			select {
+			case <-job.done:
+			default:
+				return nil
+			}
+		}
+
+		w.pending = w.pending[1:]
+		err := job.err
+		if err == nil {
+			err = w.writeRaw(job)
+		}
+		job.close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRaw writes a compressed entry to the archive
+// encrypting it if a password is set
+func (w *zipWriter) writeRaw(job *entryJob) error {
+	method := job.header.Method
+	contents := job.compressed
+	if method == zip.Store {
+		contents = job.raw
+	}
+	if w.password != "" {
+		encryptHeader(job.header)
+	}
+	w.setMetadata(job.header, job.meta)
+
+	fout, err := w.zip.CreateRaw(job.header)
+	if err != nil {
+		return errors.Wrap(err, "creating archive file")
+	}
+	var dest io.Writer = fout
+	var encrypter *aesWriter
+	if w.password != "" {
+		if encrypter, err = newAESWriter(fout, w.password); err != nil {
+			return errors.Wrap(err, "initializing encryption")
+		}
+		dest = encrypter
+	}
+	if _, err := contents.WriteTo(dest); err != nil {
+		return errors.Wrap(err, "writing archive file")
+	}
+	if encrypter != nil {
+		if err := encrypter.Close(); err != nil {
+			return errors.Wrap(err, "writing archive file")
+		}
+	}
+	w.count(method)
+	return nil
+}
+
+// prepareRawHeader sets the header fields zip.Writer.CreateHeader sets
+// but zip.Writer.CreateRaw doesn't
+func prepareRawHeader(header *zip.FileHeader) {
+	const zipVersion20 = 20
+	header.CreatorVersion = header.CreatorVersion&0xff00 | zipVersion20
+	header.ReaderVersion = zipVersion20
+	for _, r := range header.Name {
+		if r >= utf8.RuneSelf {
+			// Mark the name as UTF-8 encoded
+			header.Flags |= 0x800
+			break
+		}
+	}
+}
+
+// setMetadata sets the modification time, the Unix permission bits
+// and the comment of the entry. The fixed modification time
+// of deterministic mode applies to entries without a modification time.
+// The extended timestamp extra field is only written
+// outside of deterministic mode since it depends on the time zone
+func (w *zipWriter) setMetadata(header *zip.FileHeader, meta entryMeta) {
+	header.Comment = meta.comment
+	if meta.mode != 0 {
+		header.SetMode(meta.mode)
+	}
+	switch {
+	case !w.modTime.IsZero() && !meta.modTime.IsZero():
+		setDOSTime(header, meta.modTime)
+	case !w.modTime.IsZero():
+		setDOSTime(header, w.modTime)
+	case !meta.modTime.IsZero():
+		setDOSTime(header, meta.modTime)
+		appendExtTime(header, meta.modTime)
+	}
+}
+
+// count counts an entry written with the given compression method
+func (w *zipWriter) count(method uint16) {
+	if method == zip.Store {
+		w.stored++
+	} else {
+		w.compressed++
+	}
+}
+
+// writeDirectory writes an explicit directory entry to the archive
+func (w *zipWriter) writeDirectory(dir string) error {
+	if err := w.flush(true); err != nil {
+		return err
+	}
+	header := &zip.FileHeader{Name: dir + "/", Method: zip.Deflate}
+	w.setMetadata(header, entryMeta{})
+	if _, err := w.zip.CreateHeader(header); err != nil {
+		return errors.Wrapf(err, "creating archive directory '%s'", dir)
+	}
+	return nil
+}
+
+// close finalizes the archive with the given archive comment
+// and reports the number of entries written uncompressed and compressed
+func (w *zipWriter) close(comment string) error {
+	if err := w.flush(true); err != nil {
+		return err
+	}
+	if err := w.zip.SetComment(comment); err != nil {
+		return errors.Wrap(err, "setting archive comment")
+	}
+	if err := w.zip.Close(); err != nil {
+		return errors.Wrap(err, "finalizing archive")
+	}
+
+	w.header.Set(HeaderEntriesStored, strconv.Itoa(w.stored))
+	w.header.Set(HeaderEntriesDeflated, strconv.Itoa(w.compressed))
+	w.srv.logDebugf(
+		"archive %s: %d entries stored, %d entries compressed (%s)",
+		w.id,
+		w.stored,
+		w.compressed,
+		w.compression.method,
+	)
+	return nil
+}
+
+// release waits for the entries being compressed
+// and releases their spools
+func (w *zipWriter) release() {
+	for _, job := range w.pending {
+		<-job.done
+		job.close()
+	}
+	w.pending = nil
+}
@@ -0,0 +1,146 @@
+package apitest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/romshark/zipapi/api"
+	"github.com/romshark/zipapi/apitest/setup"
+
+	"github.com/stretchr/testify/require"
+)
+
+// postArchive creates a new archive returning its ID and contents
+func postArchive(ts *setup.TestSetup, files ...File) (string, []byte) {
+	t := ts.T()
+
+	req := newfileUploadRequest(t, files...)
+	req.URL.Path = "/archive"
+	resp := ts.Guest().Do(req)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp.Header.Get(api.HeaderArchiveID), contents
+}
+
+func newGetArchiveRequest(t *testing.T, archiveID string) *http.Request {
+	req, err := http.NewRequest("GET", "", nil)
+	require.NoError(t, err)
+	req.URL.Path = "/archives/" + archiveID
+	return req
+}
+
+// TestGetArchive tests GET /archives/{id}
+func TestGetArchive(t *testing.T) {
+	ts := setup.New(t, nil)
+	defer ts.Teardown()
+
+	files := []File{
+		File{
+			Name:     "foo.txt",
+			Contents: []byte("foo foo foo"),
+		}, File{
+			Name:     "bar.txt",
+			Contents: []byte("bar bar bar bar"),
+		},
+	}
+	archiveID, expected := postArchive(ts, files...)
+
+	resp := ts.Guest().Do(newGetArchiveRequest(t, archiveID))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/zip", resp.Header.Get("Content-Type"))
+	require.NotEmpty(t, resp.Header.Get("ETag"))
+	require.NotEmpty(t, resp.Header.Get("Last-Modified"))
+
+	actual, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	checkFiles(ts, files, actual)
+}
+
+// TestGetArchiveConditional tests conditional GET /archives/{id} requests
+func TestGetArchiveConditional(t *testing.T) {
+	ts := setup.New(t, nil)
+	defer ts.Teardown()
+
+	archiveID, _ := postArchive(ts, File{
+		Name:     "foo.txt",
+		Contents: []byte("foo foo foo"),
+	})
+
+	resp := ts.Guest().Do(newGetArchiveRequest(t, archiveID))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+
+	// Matching entity tag
+	req := newGetArchiveRequest(t, archiveID)
+	req.Header.Set("If-None-Match", etag)
+	resp = ts.Guest().Do(req)
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// Mismatching entity tag
+	req = newGetArchiveRequest(t, archiveID)
+	req.Header.Set("If-None-Match", `"mismatching"`)
+	resp = ts.Guest().Do(req)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// TestGetArchiveRange tests resuming GET /archives/{id} downloads
+func TestGetArchiveRange(t *testing.T) {
+	ts := setup.New(t, nil)
+	defer ts.Teardown()
+
+	archiveID, expected := postArchive(ts, File{
+		Name:     "foo.txt",
+		Contents: []byte("foo foo foo"),
+	})
+	offset := len(expected) / 2
+
+	req := newGetArchiveRequest(t, archiveID)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	resp := ts.Guest().Do(req)
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+
+	actual, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, expected[offset:], actual)
+}
+
+// TestGetArchiveErr tests GET /archives/{id} errors
+func TestGetArchiveErr(t *testing.T) {
+	// NotFound tests requesting an inexistent archive
+	t.Run("NotFound", func(t *testing.T) {
+		ts := setup.New(t, nil)
+		defer ts.Teardown()
+
+		resp := ts.Guest().Do(newGetArchiveRequest(t, "inexistent"))
+		requireProblem(t, resp, http.StatusNotFound, api.CodeNotFound)
+	})
+
+	// MethodNotAllowed tests using an unsupported method
+	t.Run("MethodNotAllowed", func(t *testing.T) {
+		ts := setup.New(t, nil)
+		defer ts.Teardown()
+
+		archiveID, _ := postArchive(ts, File{
+			Name:     "foo.txt",
+			Contents: []byte("foo foo foo"),
+		})
+
+		req := newGetArchiveRequest(t, archiveID)
+		req.Method = "DELETE"
+		resp := ts.Guest().Do(req)
+		requireProblem(
+			t,
+			resp,
+			http.StatusMethodNotAllowed,
+			api.CodeMethodNotAllowed,
+		)
+		require.Equal(t, "GET, HEAD", resp.Header.Get("Allow"))
+	})
+}
@@ -0,0 +1,131 @@
+package apitest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/romshark/zipapi/api"
+	"github.com/romshark/zipapi/apitest/setup"
+
+	"github.com/stretchr/testify/require"
+)
+
+func getArchives(
+	ts *setup.TestSetup,
+	params url.Values,
+) (*http.Response, api.ArchivesPage) {
+	t := ts.T()
+
+	req, err := http.NewRequest("GET", "", nil)
+	require.NoError(t, err)
+	req.URL.Path = "/archives"
+	req.URL.RawQuery = params.Encode()
+	resp := ts.Guest().Do(req)
+
+	var page api.ArchivesPage
+	if resp.StatusCode == http.StatusOK {
+		require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&page))
+	}
+	return resp, page
+}
+
+// TestGetArchives tests GET /archives
+func TestGetArchives(t *testing.T) {
+	ts := setup.New(t, nil)
+	defer ts.Teardown()
+
+	// Create archives
+	ids := make([]string, 3)
+	for i, agent := range []string{"client-a", "client-b", "client-a"} {
+		req := newfileUploadRequest(t, File{
+			Name:     []string{"foo.txt", "bar.txt", "baz.txt"}[i],
+			Contents: []byte("contents"),
+		})
+		req.URL.Path = "/archive"
+		req.Header.Set("User-Agent", agent)
+		resp := ts.Guest().Do(req)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		ids[i] = resp.Header.Get(api.HeaderArchiveID)
+	}
+
+	requireIDs := func(page api.ArchivesPage, expected ...string) {
+		actual := make([]string, len(page.Archives))
+		for i, archive := range page.Archives {
+			actual[i] = archive.ID
+		}
+		require.Equal(t, expected, actual)
+	}
+
+	// All, newest first
+	resp, page := getArchives(ts, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	requireIDs(page, ids[2], ids[1], ids[0])
+	require.Empty(t, page.Cursor)
+	require.Equal(t, "client-a", page.Archives[0].ClientAgent)
+	stored, err := ts.APIServer().Store().Archive(context.Background(), ids[2])
+	require.NoError(t, err)
+	require.Equal(t, []api.ArchiveFileInfo{
+		api.ArchiveFileInfo{
+			ID:     stored.Files[0].ID,
+			Name:   "baz.txt",
+			SHA256: sha256Hex("contents"),
+		},
+	}, page.Archives[0].Files)
+
+	// Client agent
+	resp, page = getArchives(ts, url.Values{"agent": {"client-a"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	requireIDs(page, ids[2], ids[0])
+
+	// File name
+	resp, page = getArchives(ts, url.Values{"name": {"bar"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	requireIDs(page, ids[1])
+
+	// Pagination
+	resp, page = getArchives(ts, url.Values{"limit": {"2"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	requireIDs(page, ids[2], ids[1])
+	require.NotEmpty(t, page.Cursor)
+
+	resp, page = getArchives(ts, url.Values{
+		"limit":  {"2"},
+		"cursor": {page.Cursor},
+	})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	requireIDs(page, ids[0])
+	require.Empty(t, page.Cursor)
+}
+
+// TestGetArchivesErr tests GET /archives errors
+func TestGetArchivesErr(t *testing.T) {
+	ts := setup.New(t, nil)
+	defer ts.Teardown()
+
+	for _, params := range []url.Values{
+		url.Values{"since": {"yesterday"}},
+		url.Values{"until": {"2019-08-01"}},
+		url.Values{"min-size": {"-1"}},
+		url.Values{"max-size": {"big"}},
+		url.Values{"limit": {"0"}},
+		url.Values{"limit": {"1001"}},
+		url.Values{"cursor": {"!"}},
+	} {
+		t.Run(params.Encode(), func(t *testing.T) {
+			resp, _ := getArchives(ts, params)
+			problem := requireProblem(
+				t,
+				resp,
+				http.StatusBadRequest,
+				api.CodeInvalidParameter,
+			)
+			for name := range params {
+				require.Equal(t, name, problem.Field)
+			}
+		})
+	}
+}
@@ -0,0 +1,452 @@
+package apitest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/romshark/zipapi/api"
+	"github.com/romshark/zipapi/api/config"
+	"github.com/romshark/zipapi/apitest/setup"
+	"github.com/romshark/zipapi/store"
+	fsstore "github.com/romshark/zipapi/store/fs"
+	mockstore "github.com/romshark/zipapi/store/mock"
+
+	"github.com/stretchr/testify/require"
+)
+
+// getJob returns the job identified by the given ID
+func getJob(ts *setup.TestSetup, jobID string) api.JobInfo {
+	t := ts.T()
+
+	req, err := http.NewRequest("GET", "", nil)
+	require.NoError(t, err)
+	req.URL.Path = "/jobs/" + jobID
+	resp := ts.Guest().Do(req)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var job api.JobInfo
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+	require.Equal(t, jobID, job.ID)
+	return job
+}
+
+// awaitJob polls the job identified by the given ID until it's finished
+func awaitJob(ts *setup.TestSetup, jobID string) api.JobInfo {
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		job := getJob(ts, jobID)
+		if store.JobStatus(job.Status).Finished() {
+			return job
+		}
+		require.True(ts.T(), time.Now().Before(deadline), "job not finished")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// downloadResult downloads the archive created by the given job
+func downloadResult(ts *setup.TestSetup, job api.JobInfo) []byte {
+	t := ts.T()
+
+	req, err := http.NewRequest("GET", "", nil)
+	require.NoError(t, err)
+	req.URL.Path = job.ResultURL
+	resp := ts.Guest().Do(req)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return contents
+}
+
+// TestPostArchiveAsync tests POST /archive?async=1
+// archiving the uploaded files in the background
+func TestPostArchiveAsync(t *testing.T) {
+	for _, format := range []string{"zip", "tar.gz"} {
+		for mode, conf := range uploadModes() {
+			t.Run(format+"/"+mode, func(t *testing.T) {
+				ts := setup.New(t, conf())
+				defer ts.Teardown()
+
+				parts := textFiles(3, 8*1024)
+				req := newFormRequest(t, append(parts, formPart{
+					field:    "files",
+					fileName: "docs/readme.txt",
+					value:    "read me",
+				})...)
+				req.URL.RawQuery = api.ParamAsync + "=1&format=" + format
+				resp := ts.Guest().Do(req)
+				require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+				var accepted api.JobInfo
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&accepted))
+				require.NotEmpty(t, accepted.ID)
+				require.Equal(t, string(store.JobQueued), accepted.Status)
+				require.Equal(
+					t,
+					int64(3*8*1024+len("read me")),
+					accepted.Progress.TotalBytes,
+				)
+				require.Empty(t, accepted.ResultURL)
+				require.Equal(
+					t,
+					"/jobs/"+accepted.ID,
+					resp.Header.Get("Location"),
+				)
+
+				job := awaitJob(ts, accepted.ID)
+				require.Equal(t, string(store.JobDone), job.Status)
+				require.Empty(t, job.Error)
+				require.NotNil(t, job.Finished)
+				require.Equal(t, "/archives/"+job.ArchiveID, job.ResultURL)
+				require.Equal(
+					t,
+					job.Progress.TotalBytes,
+					job.Progress.ProcessedBytes,
+				)
+
+				expected := map[string]string{"docs/readme.txt": "read me"}
+				for _, part := range parts {
+					expected[part.fileName] = part.value
+				}
+				contents := downloadResult(ts, job)
+				if format == "zip" {
+					require.Equal(t, expected, readEntries(t, contents))
+				} else {
+					require.Equal(
+						t,
+						expected,
+						readTarEntries(t, format, contents),
+					)
+				}
+
+				// The uploaded files are referenced by the archive only
+				str := ts.APIServer().Store().(*mockstore.Store)
+				require.Zero(t, str.UncommittedFiles())
+				require.Len(t, str.SavedArchives(), 1)
+				require.Len(t, str.SavedFiles(), 4)
+			})
+		}
+	}
+}
+
+// TestPostArchiveAsyncAcceptJSON tests POST /archive?async=1
+// ignoring the Accept header asking for the JSON job response
+func TestPostArchiveAsyncAcceptJSON(t *testing.T) {
+	for _, format := range []string{"", "tar.gz"} {
+		for mode, conf := range uploadModes() {
+			t.Run(fmt.Sprintf("'%s'/%s", format, mode), func(t *testing.T) {
+				ts := setup.New(t, conf())
+				defer ts.Teardown()
+
+				req := newFormRequest(t, compressibleFile())
+				req.URL.RawQuery = api.ParamAsync + "=1"
+				if format != "" {
+					req.URL.RawQuery += "&format=" + format
+				}
+				req.Header.Set("Accept", "application/json")
+				resp := ts.Guest().Do(req)
+				require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+				var accepted api.JobInfo
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&accepted))
+				job := awaitJob(ts, accepted.ID)
+				require.Equal(t, string(store.JobDone), job.Status)
+
+				// The format defaults to zip unless requested explicitly
+				expected := format
+				if expected == "" {
+					expected = "zip"
+				}
+				str := ts.APIServer().Store().(*mockstore.Store)
+				require.Equal(t, expected, str.SavedArchives()[0].Format)
+			})
+		}
+	}
+}
+
+// TestPostArchiveAsyncErr tests POST /archive?async=1
+// responding with problems to invalid requests
+func TestPostArchiveAsyncErr(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		query  string
+		parts  []formPart
+		status int
+		code   api.ErrorCode
+		field  string
+	}{
+		{"InvalidAsync", api.ParamAsync + "=maybe",
+			[]formPart{compressibleFile()}, http.StatusBadRequest,
+			api.CodeInvalidParameter, api.ParamAsync},
+		{"Password", api.ParamAsync + "=1", []formPart{
+			{field: api.FormFieldPassword, value: "secret"},
+			compressibleFile(),
+		}, http.StatusBadRequest, api.CodeInvalidParameter,
+			api.FormFieldPassword},
+		{"MissingFiles", api.ParamAsync + "=1", []formPart{
+			{field: api.ParamFormat, value: "zip"},
+		}, http.StatusBadRequest, api.CodeMissingFiles, ""},
+	} {
+		for mode, conf := range uploadModes() {
+			t.Run(tc.name+"/"+mode, func(t *testing.T) {
+				ts := setup.New(t, conf())
+				defer ts.Teardown()
+
+				req := newFormRequest(t, tc.parts...)
+				req.URL.RawQuery = tc.query
+				problem := requireProblem(
+					t,
+					ts.Guest().Do(req),
+					tc.status,
+					tc.code,
+				)
+				require.Equal(t, tc.field, problem.Field)
+
+				str := ts.APIServer().Store().(*mockstore.Store)
+				require.Zero(t, str.UncommittedFiles())
+				require.Len(t, str.SavedArchives(), 0)
+			})
+		}
+	}
+}
+
+// TestPostArchiveAsyncFileTooLarge tests POST /archive?async=1
+// rejecting files exceeding the max file size
+func TestPostArchiveAsyncFileTooLarge(t *testing.T) {
+	for mode, conf := range map[string]*config.Config{
+		"Parsed":   {App: config.App{MaxFileSize: 1024}},
+		"Streamed": streamedConfig(1024, 0),
+	} {
+		t.Run(mode, func(t *testing.T) {
+			ts := setup.New(t, conf)
+			defer ts.Teardown()
+
+			req := newFormRequest(t, textFiles(1, 2048)...)
+			req.URL.RawQuery = api.ParamAsync + "=1"
+			requireProblem(
+				t,
+				ts.Guest().Do(req),
+				http.StatusRequestEntityTooLarge,
+				api.CodeFileTooLarge,
+			)
+
+			str := ts.APIServer().Store().(*mockstore.Store)
+			require.Zero(t, str.UncommittedFiles())
+		})
+	}
+}
+
+// failingJobStore fails to mark jobs running
+type failingJobStore struct {
+	*mockstore.Store
+}
+
+func (str failingJobStore) SaveJob(ctx context.Context, job store.Job) error {
+	if job.Status == store.JobRunning {
+		return errors.New("store unavailable")
+	}
+	return str.Store.SaveJob(ctx, job)
+}
+
+// TestPostArchiveAsyncStartErr tests POST /archive?async=1
+// failing the jobs which can't be marked running
+func TestPostArchiveAsyncStartErr(t *testing.T) {
+	str := failingJobStore{new(mockstore.Store)}
+	ts := setup.New(t, &config.Config{Store: str})
+	defer ts.Teardown()
+
+	req := newFormRequest(t, compressibleFile())
+	req.URL.RawQuery = api.ParamAsync + "=1"
+	resp := ts.Guest().Do(req)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	var accepted api.JobInfo
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&accepted))
+	job := awaitJob(ts, accepted.ID)
+	require.Equal(t, string(store.JobFailed), job.Status)
+	require.Equal(
+		t,
+		http.StatusText(http.StatusInternalServerError),
+		job.Error,
+	)
+
+	// The files of the failed job are removed
+	require.Zero(t, str.UncommittedFiles())
+	require.Len(t, str.SavedFiles(), 0)
+}
+
+// blockingJobStore blocks the jobs marked running until proceed is closed
+type blockingJobStore struct {
+	*mockstore.Store
+	running chan string
+	proceed chan struct{}
+}
+
+func (str blockingJobStore) SaveJob(ctx context.Context, job store.Job) error {
+	if job.Status == store.JobRunning {
+		str.running <- job.ID
+		<-str.proceed
+	}
+	return str.Store.SaveJob(ctx, job)
+}
+
+// TestPostArchiveAsyncQueueFull tests POST /archive?async=1
+// rejecting jobs while the max number of jobs is queued
+func TestPostArchiveAsyncQueueFull(t *testing.T) {
+	for mode, conf := range uploadModes() {
+		t.Run(mode, func(t *testing.T) {
+			str := blockingJobStore{
+				Store:   new(mockstore.Store),
+				running: make(chan string, 2),
+				proceed: make(chan struct{}),
+			}
+			conf := conf()
+			if conf == nil {
+				conf = &config.Config{}
+			}
+			conf.Store = str
+			conf.App.JobWorkers = 1
+			conf.App.MaxQueuedJobs = 1
+			ts := setup.New(t, conf)
+			defer ts.Teardown()
+
+			postJob := func() *http.Response {
+				req := newFormRequest(t, compressibleFile())
+				req.URL.RawQuery = api.ParamAsync + "=1"
+				return ts.Guest().Do(req)
+			}
+
+			// The first job is running, the second one is queued
+			var jobIDs []string
+			for i := 0; i < 2; i++ {
+				resp := postJob()
+				require.Equal(t, http.StatusAccepted, resp.StatusCode)
+				var accepted api.JobInfo
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&accepted))
+				jobIDs = append(jobIDs, accepted.ID)
+				if i == 0 {
+					require.Equal(t, accepted.ID, <-str.running)
+				}
+			}
+
+			problem := requireProblem(
+				t,
+				postJob(),
+				http.StatusServiceUnavailable,
+				api.CodeJobQueueFull,
+			)
+			require.Equal(t, uint64(1), problem.Limit)
+			require.Zero(t, str.UncommittedFiles())
+
+			// Jobs are accepted again once the queue drains
+			close(str.proceed)
+			for _, id := range jobIDs {
+				require.Equal(t, string(store.JobDone), awaitJob(ts, id).Status)
+			}
+			resp := postJob()
+			require.Equal(t, http.StatusAccepted, resp.StatusCode)
+			var accepted api.JobInfo
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&accepted))
+			require.Equal(t, string(store.JobDone), awaitJob(ts, accepted.ID).Status)
+		})
+	}
+}
+
+// TestPostArchiveAsyncResume tests resuming the unfinished jobs
+// of a persistent store once the server is started
+func TestPostArchiveAsyncResume(t *testing.T) {
+	str := fsstore.New(fsstore.Options{Root: t.TempDir()})
+	require.NoError(t, str.Init())
+
+	ctx := context.Background()
+	file, err := str.SaveFile(ctx, store.File{
+		Name: "foo.txt",
+	}, strings.NewReader("foo foo foo"))
+	require.NoError(t, err)
+	jobID, err := store.NewID()
+	require.NoError(t, err)
+	require.NoError(t, str.SaveJob(ctx, store.Job{
+		ID:      jobID,
+		Created: time.Now(),
+		Status:  store.JobRunning,
+		Options: store.JobOptions{Format: "zip"},
+		Files:   []store.File{file},
+		Size:    file.Size,
+	}))
+	require.NoError(t, str.Close())
+
+	ts := setup.New(t, &config.Config{Store: str})
+	defer ts.Teardown()
+
+	job := awaitJob(ts, jobID)
+	require.Equal(t, string(store.JobDone), job.Status)
+	require.Equal(
+		t,
+		map[string]string{"foo.txt": "foo foo foo"},
+		readEntries(t, downloadResult(ts, job)),
+	)
+}
+
+// TestPostArchiveAsyncResumeArchived tests resuming jobs
+// interrupted after their archive was saved without archiving them again
+func TestPostArchiveAsyncResumeArchived(t *testing.T) {
+	str := fsstore.New(fsstore.Options{Root: t.TempDir()})
+	ts := setup.New(t, &config.Config{Store: str})
+
+	req := newFormRequest(t, compressibleFile())
+	req.URL.RawQuery = api.ParamAsync + "=1"
+	resp := ts.Guest().Do(req)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	var accepted api.JobInfo
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&accepted))
+	done := awaitJob(ts, accepted.ID)
+	require.Equal(t, string(store.JobDone), done.Status)
+	require.Equal(t, done.ID, done.ArchiveID)
+	ts.Teardown()
+
+	// Simulate an interruption before the job was marked done
+	ctx := context.Background()
+	require.NoError(t, str.Init())
+	job, err := str.Job(ctx, accepted.ID)
+	require.NoError(t, err)
+	job.Status = store.JobRunning
+	job.ArchiveID = ""
+	job.Finished = time.Time{}
+	require.NoError(t, str.SaveJob(ctx, job))
+	require.NoError(t, str.Close())
+
+	ts = setup.New(t, &config.Config{Store: str})
+	defer ts.Teardown()
+
+	resumed := awaitJob(ts, accepted.ID)
+	require.Equal(t, string(store.JobDone), resumed.Status)
+	require.Equal(t, done.ArchiveID, resumed.ArchiveID)
+	page, err := str.QueryArchives(ctx, store.ArchiveQuery{})
+	require.NoError(t, err)
+	require.Len(t, page.Archives, 1)
+}
+
+// TestGetJobNotFound tests GET /jobs/{id} for unknown jobs
+func TestGetJobNotFound(t *testing.T) {
+	ts := setup.New(t, nil)
+	defer ts.Teardown()
+
+	for _, path := range []string{"/jobs/unknown", "/jobs/", "/jobs/a/b"} {
+		req, err := http.NewRequest("GET", "", nil)
+		require.NoError(t, err)
+		req.URL.Path = path
+		requireProblem(
+			t,
+			ts.Guest().Do(req),
+			http.StatusNotFound,
+			api.CodeNotFound,
+		)
+	}
+}
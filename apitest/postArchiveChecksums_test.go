@@ -0,0 +1,250 @@
+package apitest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/romshark/zipapi/api"
+	"github.com/romshark/zipapi/api/config"
+	"github.com/romshark/zipapi/apitest/setup"
+	mockstore "github.com/romshark/zipapi/store/mock"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sha256Hex returns the hex encoded SHA-256 checksum of the contents
+func sha256Hex(contents string) string {
+	sum := sha256.Sum256([]byte(contents))
+	return hex.EncodeToString(sum[:])
+}
+
+// checksumFiles returns the files uploaded by the checksums tests
+func checksumFiles() []formPart {
+	return []formPart{
+		{field: "files", fileName: "docs/readme.txt", value: "read me"},
+		{field: "files", fileName: "page.html", value: "<html><body></body></html>"},
+		{field: api.FormFieldDirectory, value: "empty"},
+	}
+}
+
+// TestPostArchiveChecksumsManifest tests POST /archive
+// writing the MANIFEST.json entry at the end of the archive
+func TestPostArchiveChecksumsManifest(t *testing.T) {
+	files := checksumFiles()
+	for _, format := range []string{"zip", "tar.gz"} {
+		for mode, conf := range uploadModes() {
+			t.Run(format+"/"+mode, func(t *testing.T) {
+				ts := setup.New(t, conf())
+				defer ts.Teardown()
+
+				req := newFormRequest(t, files...)
+				req.URL.RawQuery = "checksums=manifest&format=" + format
+				resp := ts.Guest().Do(req)
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				actual, err := ioutil.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				var entries map[string]string
+				if format == "zip" {
+					entries = readEntries(t, actual)
+					headers := readHeaders(t, actual)
+					require.Equal(
+						t,
+						api.ManifestEntryName,
+						headers[len(headers)-1].Name,
+					)
+				} else {
+					entries = readTarEntries(t, format, actual)
+				}
+				require.Len(t, entries, 4)
+
+				var manifest api.ArchiveManifest
+				require.NoError(t, json.Unmarshal(
+					[]byte(entries[api.ManifestEntryName]),
+					&manifest,
+				))
+				require.Len(t, manifest.Entries, 2)
+
+				checkArchive(ts, resp, actual)
+				str := ts.APIServer().Store().(*mockstore.Store)
+				archive := str.SavedArchives()[0]
+				require.Len(t, archive.Files, 2)
+
+				for i, part := range files[:2] {
+					entry := manifest.Entries[i]
+					require.Equal(t, part.fileName, entry.Name)
+					require.Equal(t, int64(len(part.value)), entry.Size)
+					require.Equal(t, sha256Hex(part.value), entry.SHA256)
+					require.NotNil(t, entry.UploadTime)
+					require.True(t, archive.Created.Equal(*entry.UploadTime))
+
+					// Make sure the checksums are recorded
+					require.Equal(t, entry.SHA256, archive.Files[i].Checksum)
+				}
+				require.Equal(
+					t,
+					"text/plain; charset=utf-8",
+					manifest.Entries[0].ContentType,
+				)
+				require.Equal(
+					t,
+					"text/html; charset=utf-8",
+					manifest.Entries[1].ContentType,
+				)
+
+				// Make sure the checksums are listed
+				_, page := getArchives(ts, nil)
+				require.Len(t, page.Archives, 1)
+				for i, fl := range page.Archives[0].Files {
+					require.Equal(t, manifest.Entries[i].SHA256, fl.SHA256)
+				}
+			})
+		}
+	}
+}
+
+// TestPostArchiveChecksumsSHA256Sums tests POST /archive
+// writing the SHA256SUMS entry at the end of the archive
+func TestPostArchiveChecksumsSHA256Sums(t *testing.T) {
+	files := checksumFiles()
+	for mode, conf := range uploadModes() {
+		t.Run(mode, func(t *testing.T) {
+			ts := setup.New(t, conf())
+			defer ts.Teardown()
+
+			req := newFormRequest(t, append([]formPart{
+				{field: api.ParamChecksums, value: "sha256sums"},
+			}, files...)...)
+			resp := ts.Guest().Do(req)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			actual, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			headers := readHeaders(t, actual)
+			require.Equal(
+				t,
+				api.SHA256SumsEntryName,
+				headers[len(headers)-1].Name,
+			)
+			require.Equal(t, fmt.Sprintf(
+				"%s  docs/readme.txt\n%s  page.html\n",
+				sha256Hex(files[0].value),
+				sha256Hex(files[1].value),
+			), readEntries(t, actual)[api.SHA256SumsEntryName])
+		})
+	}
+}
+
+// TestPostArchiveChecksumsEncrypted tests POST /archive
+// writing the checksums of encrypted archives
+func TestPostArchiveChecksumsEncrypted(t *testing.T) {
+	const password = "secret"
+	files := checksumFiles()
+	ts := setup.New(t, nil)
+	defer ts.Teardown()
+
+	req := newFormRequest(t, files...)
+	req.URL.RawQuery = "checksums=sha256sums"
+	req.Header.Set(api.HeaderPassword, password)
+	resp := ts.Guest().Do(req)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	actual, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	require.Equal(t, fmt.Sprintf(
+		"%s  docs/readme.txt\n%s  page.html\n",
+		sha256Hex(files[0].value),
+		sha256Hex(files[1].value),
+	), decryptEntries(t, actual, password)[api.SHA256SumsEntryName])
+
+	// The plaintext checksums are only kept inside the encrypted archive
+	str := ts.APIServer().Store().(*mockstore.Store)
+	require.Empty(t, str.SavedArchives()[0].Files)
+}
+
+// TestPostArchiveChecksumsDeterministic tests POST /archive
+// omitting the upload times from the manifest in deterministic mode
+func TestPostArchiveChecksumsDeterministic(t *testing.T) {
+	ts := setup.New(t, nil)
+	defer ts.Teardown()
+
+	query := "checksums=manifest&deterministic=1"
+	first := postArchiveChecksum(ts, query, checksumFiles()...)
+	second := postArchiveChecksum(ts, query, checksumFiles()...)
+	require.Equal(t, first, second)
+}
+
+// TestPostArchiveChecksumsNameCollision tests POST /archive
+// handling uploaded files named like the checksums entry
+func TestPostArchiveChecksumsNameCollision(t *testing.T) {
+	for _, tc := range []struct {
+		policy   config.NameCollision
+		streamed bool
+		status   int
+	}{
+		{config.NameCollisionReject, false, http.StatusBadRequest},
+		{config.NameCollisionReject, true, http.StatusBadRequest},
+		{config.NameCollisionOverwrite, false, http.StatusBadRequest},
+		{config.NameCollisionRename, false, http.StatusOK},
+		{config.NameCollisionRename, true, http.StatusOK},
+	} {
+		name := fmt.Sprintf("%s/Streamed=%t", tc.policy, tc.streamed)
+		t.Run(name, func(t *testing.T) {
+			conf := streamedConfig(0, 0)
+			conf.App.StreamUploads = tc.streamed
+			ts := setup.New(t, conf)
+			defer ts.Teardown()
+
+			req := newFormRequest(t, formPart{
+				field:    "files",
+				fileName: api.ManifestEntryName,
+				value:    "{}",
+			})
+			req.URL.RawQuery = "checksums=manifest&" +
+				api.QueryNameCollision + "=" + string(tc.policy)
+			resp := ts.Guest().Do(req)
+			require.Equal(t, tc.status, resp.StatusCode)
+			if tc.status != http.StatusOK {
+				return
+			}
+
+			actual, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			entries := readEntries(t, actual)
+			require.Equal(t, "{}", entries["MANIFEST (1).json"])
+
+			var manifest api.ArchiveManifest
+			require.NoError(t, json.Unmarshal(
+				[]byte(entries[api.ManifestEntryName]),
+				&manifest,
+			))
+			require.Len(t, manifest.Entries, 1)
+			require.Equal(t, "MANIFEST (1).json", manifest.Entries[0].Name)
+		})
+	}
+}
+
+// TestPostArchiveChecksumsErr tests POST /archive
+// rejecting unknown checksums entries
+func TestPostArchiveChecksumsErr(t *testing.T) {
+	for mode, conf := range uploadModes() {
+		t.Run(mode, func(t *testing.T) {
+			ts := setup.New(t, conf())
+			defer ts.Teardown()
+
+			req := newFormRequest(t, compressibleFile())
+			req.URL.RawQuery = "checksums=md5"
+			resp := ts.Guest().Do(req)
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+			str := ts.APIServer().Store().(*mockstore.Store)
+			require.Len(t, str.SavedArchives(), 0)
+			require.Equal(t, 0, str.UncommittedFiles())
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package apitest
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/romshark/zipapi/api"
+	"github.com/romshark/zipapi/api/config"
+	"github.com/romshark/zipapi/apitest/setup"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+// compressibleFile returns a highly compressible test file
+func compressibleFile() formPart {
+	return formPart{
+		field:    "files",
+		fileName: "zeros.bin",
+		value:    string(make([]byte, 64*1024)),
+	}
+}
+
+// registerDecompressors registers the decompressors
+// of the compression methods not supported by archive/zip
+func registerDecompressors(reader *zip.Reader) {
+	reader.RegisterDecompressor(93, func(r io.Reader) io.ReadCloser {
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return ioutil.NopCloser(errReader{err})
+		}
+		return decoder.IOReadCloser()
+	})
+	reader.RegisterDecompressor(95, func(r io.Reader) io.ReadCloser {
+		decoder, err := xz.NewReader(r)
+		if err != nil {
+			return ioutil.NopCloser(errReader{err})
+		}
+		return ioutil.NopCloser(decoder)
+	})
+}
+
+// errReader fails reading with err
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// readHeaders returns the headers of all archive entries
+func readHeaders(t *testing.T, archive []byte) []zip.FileHeader {
+	reader, err := zip.NewReader(
+		bytes.NewReader(archive),
+		int64(len(archive)),
+	)
+	require.NoError(t, err)
+
+	headers := make([]zip.FileHeader, len(reader.File))
+	for i, fl := range reader.File {
+		headers[i] = fl.FileHeader
+	}
+	return headers
+}
+
+// TestPostArchiveCompression tests POST /archive
+// choosing the compression method and level
+func TestPostArchiveCompression(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		query      string
+		fields     []formPart
+		method     uint16
+		compressed bool
+	}{
+		{"Default", "", nil, zip.Deflate, true},
+		{"StoreQuery", "compression=store", nil, zip.Store, false},
+		{"StoreField", "", []formPart{
+			{field: api.ParamCompression, value: "store"},
+		}, zip.Store, false},
+		{"FieldOverridesQuery", "compression=store", []formPart{
+			{field: api.ParamCompression, value: "deflate"},
+		}, zip.Deflate, true},
+		{"DeflateLevel", "compression=deflate&level=1", nil, zip.Deflate, true},
+		{"DeflateLevelZero", "", []formPart{
+			{field: api.ParamLevel, value: "0"},
+		}, zip.Deflate, false},
+	} {
+		for mode, conf := range uploadModes() {
+			t.Run(tc.name+"/"+mode, func(t *testing.T) {
+				ts := setup.New(t, conf())
+				defer ts.Teardown()
+
+				req := newFormRequest(
+					t,
+					append(tc.fields, compressibleFile())...,
+				)
+				req.URL.RawQuery = tc.query
+				resp := ts.Guest().Do(req)
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+
+				actual, err := ioutil.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				headers := readHeaders(t, actual)
+				require.Len(t, headers, 1)
+				require.Equal(t, tc.method, headers[0].Method)
+				require.Equal(
+					t,
+					tc.compressed,
+					headers[0].CompressedSize64 <
+						headers[0].UncompressedSize64,
+				)
+				require.Equal(t, readEntries(t, actual), map[string]string{
+					"zeros.bin": compressibleFile().value,
+				})
+			})
+		}
+	}
+}
+
+// TestPostArchiveCompressionErr tests POST /archive rejecting
+// compression options exceeding the server-side limits
+func TestPostArchiveCompressionErr(t *testing.T) {
+	limited := func(streamed bool) *config.Config {
+		return &config.Config{App: config.App{
+			StreamUploads: streamed,
+			Compression: &config.Compression{
+				Method:   config.CompressionDeflate,
+				Level:    3,
+				MaxLevel: 5,
+				Methods:  []config.CompressionMethod{config.CompressionDeflate},
+			},
+		}}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		query string
+	}{
+		{"UnknownMethod", "compression=lzma"},
+		{"MethodNotAllowed", "compression=store"},
+		{"MethodNotEnabled", "compression=zstd"},
+		{"MalformedLevel", "level=high"},
+		{"LevelOutOfRange", "level=10"},
+		{"NegativeLevel", "level=-1"},
+		{"LevelExceedsMax", "level=6"},
+	} {
+		for _, streamed := range []bool{false, true} {
+			name := tc.name + "/Parsed"
+			if streamed {
+				name = tc.name + "/Streamed"
+			}
+			t.Run(name, func(t *testing.T) {
+				ts := setup.New(t, limited(streamed))
+				defer ts.Teardown()
+
+				req := newFormRequest(t, compressibleFile())
+				req.URL.RawQuery = tc.query
+				resp := ts.Guest().Do(req)
+				require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			})
+		}
+	}
+}
+
+// TestPostArchiveCompressionLevelErr tests POST /archive rejecting
+// compression levels not supported by the compression method
+func TestPostArchiveCompressionLevelErr(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"ZstdLevelZero", "compression=zstd&level=0", http.StatusBadRequest},
+		{"ZstdLevelOne", "compression=zstd&level=1", http.StatusOK},
+		{"XzLevel", "compression=xz&level=1", http.StatusBadRequest},
+		{"XzDefaultLevel", "compression=xz&level=9", http.StatusOK},
+		{"XzWithoutLevel", "compression=xz", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			compression := config.DefaultCompression()
+			compression.Methods = []config.CompressionMethod{
+				config.CompressionDeflate,
+				config.CompressionZstd,
+				config.CompressionXz,
+			}
+			ts := setup.New(t, &config.Config{App: config.App{
+				Compression: compression,
+			}})
+			defer ts.Teardown()
+
+			req := newFormRequest(t, compressibleFile())
+			req.URL.RawQuery = tc.query
+			resp := ts.Guest().Do(req)
+			if tc.status == http.StatusOK {
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				return
+			}
+			problem := requireProblem(
+				t,
+				resp,
+				http.StatusBadRequest,
+				api.CodeInvalidParameter,
+			)
+			require.Equal(t, api.ParamLevel, problem.Field)
+		})
+	}
+}
+
+// TestPostArchiveSkipCompressed tests POST /archive storing
+// already compressed and incompressible files uncompressed
+func TestPostArchiveSkipCompressed(t *testing.T) {
+	random := make([]byte, 64*1024)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+
+	parts := []formPart{
+		// Sniffed content type
+		{field: "files", fileName: "image", value: "\x89PNG\r\n\x1a\n" +
+			string(make([]byte, 1024))},
+		// Extension
+		{field: "files", fileName: "nested.ZIP", value: string(
+			make([]byte, 1024),
+		)},
+		// Incompressible
+		{field: "files", fileName: "random.bin", value: string(random)},
+		compressibleFile(),
+	}
+
+	compression := func(compareSizes bool) *config.Compression {
+		conf := config.DefaultCompression()
+		conf.CompareSizes = compareSizes
+		return conf
+	}
+
+	for _, tc := range []struct {
+		name     string
+		conf     *config.Compression
+		expected []uint16
+	}{
+		{"SkipCompressed", compression(false), []uint16{
+			zip.Store, zip.Store, zip.Deflate, zip.Deflate,
+		}},
+		{"CompareSizes", compression(true), []uint16{
+			zip.Store, zip.Store, zip.Store, zip.Deflate,
+		}},
+		{"Disabled", &config.Compression{
+			Method:   config.CompressionDeflate,
+			Level:    9,
+			MaxLevel: 9,
+			Methods:  []config.CompressionMethod{config.CompressionDeflate},
+		}, []uint16{
+			zip.Deflate, zip.Deflate, zip.Deflate, zip.Deflate,
+		}},
+	} {
+		for _, streamed := range []bool{false, true} {
+			name := tc.name + "/Parsed"
+			if streamed {
+				name = tc.name + "/Streamed"
+			}
+			t.Run(name, func(t *testing.T) {
+				ts := setup.New(t, &config.Config{App: config.App{
+					StreamUploads: streamed,
+					Compression:   tc.conf,
+					// Spool entries in temporary files
+					MaxMultipartMembuf: 1024,
+				}})
+				defer ts.Teardown()
+
+				resp := ts.Guest().Do(newFormRequest(t, parts...))
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+
+				actual, err := ioutil.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				// Make sure all entries are intact
+				expectedEntries := make(map[string]string, len(parts))
+				for _, part := range parts {
+					expectedEntries[part.fileName] = part.value
+				}
+				require.Equal(t, expectedEntries, readEntries(t, actual))
+
+				headers := readHeaders(t, actual)
+				methods := make([]uint16, len(headers))
+				stored := 0
+				for i, header := range headers {
+					methods[i] = header.Method
+					if header.Method == zip.Store {
+						stored++
+					}
+				}
+				require.Equal(t, tc.expected, methods)
+
+				require.Equal(
+					t,
+					strconv.Itoa(stored),
+					resp.Trailer.Get(api.HeaderEntriesStored),
+				)
+				require.Equal(
+					t,
+					strconv.Itoa(len(headers)-stored),
+					resp.Trailer.Get(api.HeaderEntriesDeflated),
+				)
+			})
+		}
+	}
+}
+
+// TestPostArchiveCompressionMethods tests POST /archive compressing
+// entries using the compression methods enabled in the configuration
+func TestPostArchiveCompressionMethods(t *testing.T) {
+	parts := textFiles(4, 16*1024)
+
+	for _, tc := range []struct {
+		method   string
+		expected uint16
+	}{
+		{"deflate", zip.Deflate},
+		{"zstd", 93},
+		{"xz", 95},
+	} {
+		for _, workers := range []int{1, 4} {
+			for _, streamed := range []bool{false, true} {
+				name := fmt.Sprintf("%s/Workers=%d/Parsed", tc.method, workers)
+				if streamed {
+					name = fmt.Sprintf(
+						"%s/Workers=%d/Streamed",
+						tc.method,
+						workers,
+					)
+				}
+				t.Run(name, func(t *testing.T) {
+					compression := config.DefaultCompression()
+					compression.Methods = []config.CompressionMethod{
+						config.CompressionDeflate,
+						config.CompressionZstd,
+						config.CompressionXz,
+					}
+					ts := setup.New(t, &config.Config{App: config.App{
+						StreamUploads:      streamed,
+						Compression:        compression,
+						CompressionWorkers: workers,
+					}})
+					defer ts.Teardown()
+
+					req := newFormRequest(t, parts...)
+					req.URL.RawQuery = "compression=" + tc.method
+					resp := ts.Guest().Do(req)
+					require.Equal(t, http.StatusOK, resp.StatusCode)
+
+					actual, err := ioutil.ReadAll(resp.Body)
+					require.NoError(t, err)
+
+					expectedEntries := make(map[string]string, len(parts))
+					for _, part := range parts {
+						expectedEntries[part.fileName] = part.value
+					}
+					require.Equal(t, expectedEntries, readEntries(t, actual))
+
+					for _, header := range readHeaders(t, actual) {
+						require.Equal(t, tc.expected, header.Method)
+						require.Less(
+							t,
+							header.CompressedSize64,
+							header.UncompressedSize64,
+						)
+					}
+					require.Equal(
+						t,
+						strconv.Itoa(len(parts)),
+						resp.Trailer.Get(api.HeaderEntriesDeflated),
+					)
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package apitest
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/romshark/zipapi/api/config"
+	"github.com/romshark/zipapi/apitest/setup"
+
+	"github.com/stretchr/testify/require"
+)
+
+// textFiles returns num compressible pseudo-random text files
+// of the given size
+func textFiles(num, size int) []formPart {
+	words := []string{
+		"lorem", "ipsum", "dolor", "sit", "amet", "consectetur",
+		"adipiscing", "elit", "sed", "do", "eiusmod", "tempor",
+	}
+	random := rand.New(rand.NewSource(42))
+	parts := make([]formPart, num)
+	for i := range parts {
+		var text strings.Builder
+		for text.Len() < size {
+			text.WriteString(words[random.Intn(len(words))])
+			text.WriteByte(' ')
+		}
+		parts[i] = formPart{
+			field:    "files",
+			fileName: fmt.Sprintf("file%02d.txt", i),
+			value:    text.String()[:size],
+		}
+	}
+	return parts
+}
+
+// TestPostArchiveConcurrentCompression tests POST /archive
+// compressing entries concurrently preserving the order of the entries
+func TestPostArchiveConcurrentCompression(t *testing.T) {
+	// Interleave the compressed entries with entries stored uncompressed
+	parts := textFiles(12, 32*1024)
+	for i := 0; i < len(parts); i += 3 {
+		parts[i].value = "\x89PNG\r\n\x1a\n" + parts[i].value
+	}
+
+	for _, compareSizes := range []bool{false, true} {
+		for _, streamed := range []bool{false, true} {
+			name := fmt.Sprintf("CompareSizes=%t/Parsed", compareSizes)
+			if streamed {
+				name = fmt.Sprintf("CompareSizes=%t/Streamed", compareSizes)
+			}
+			t.Run(name, func(t *testing.T) {
+				compression := config.DefaultCompression()
+				compression.CompareSizes = compareSizes
+				ts := setup.New(t, &config.Config{App: config.App{
+					StreamUploads:      streamed,
+					Compression:        compression,
+					CompressionWorkers: 4,
+					// Spool entries in temporary files
+					MaxMultipartMembuf: 16 * 1024,
+				}})
+				defer ts.Teardown()
+
+				resp := ts.Guest().Do(newFormRequest(t, parts...))
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+
+				actual, err := ioutil.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				expectedEntries := make(map[string]string, len(parts))
+				for _, part := range parts {
+					expectedEntries[part.fileName] = part.value
+				}
+				require.Equal(t, expectedEntries, readEntries(t, actual))
+
+				headers := readHeaders(t, actual)
+				require.Len(t, headers, len(parts))
+				for i, header := range headers {
+					require.Equal(t, parts[i].fileName, header.Name)
+					expectedMethod := zip.Deflate
+					if i%3 == 0 {
+						expectedMethod = zip.Store
+					}
+					require.Equal(t, expectedMethod, header.Method)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkPostArchive benchmarks POST /archive
+// compressing entries with different numbers of workers
+func BenchmarkPostArchive(b *testing.B) {
+	parts := textFiles(16, 256*1024)
+	size := 0
+	for _, part := range parts {
+		size += len(part.value)
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("Workers=%d", workers), func(b *testing.B) {
+			ts := setup.New(b, &config.Config{App: config.App{
+				MaxReqSize:         32 * 1024 * 1024,
+				CompressionWorkers: workers,
+			}})
+			defer ts.Teardown()
+
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				req := newFormRequest(b, parts...)
+				b.StartTimer()
+
+				resp := ts.Guest().Do(req)
+				require.Equal(b, http.StatusOK, resp.StatusCode)
+				_, err := ioutil.ReadAll(resp.Body)
+				require.NoError(b, err)
+				resp.Body.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package apitest
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/romshark/zipapi/api"
+	"github.com/romshark/zipapi/apitest/setup"
+	mockstore "github.com/romshark/zipapi/store/mock"
+
+	"github.com/stretchr/testify/require"
+)
+
+// postArchiveChecksum uploads the parts and returns
+// the SHA-256 checksum of the returned archive
+func postArchiveChecksum(
+	ts *setup.TestSetup,
+	query string,
+	parts ...formPart,
+) [sha256.Size]byte {
+	t := ts.T()
+	req := newFormRequest(t, parts...)
+	req.URL.RawQuery = query
+	resp := ts.Guest().Do(req)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	actual, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return sha256.Sum256(actual)
+}
+
+// TestPostArchiveDeterministic tests POST /archive producing
+// identical archives for identical inputs in deterministic mode
+// regardless of the upload order
+func TestPostArchiveDeterministic(t *testing.T) {
+	foo := formPart{field: "files", fileName: "foo.txt", value: "foo foo foo"}
+	bar := formPart{field: "files", fileName: "bar.txt", value: "bar bar bar"}
+	baz := formPart{field: "other", fileName: "baz.txt", value: "baz baz baz"}
+	dirA := formPart{field: api.FormFieldDirectory, value: "a"}
+	dirB := formPart{field: api.FormFieldDirectory, value: "b"}
+
+	for _, format := range []string{"zip", "tar", "tar.gz", "tar.zst"} {
+		for _, workers := range []int{1, 4} {
+			t.Run(fmt.Sprintf("%s/Workers=%d", format, workers), func(t *testing.T) {
+				conf := streamedConfig(0, 0)
+				conf.App.StreamUploads = false
+				conf.App.CompressionWorkers = workers
+				ts := setup.New(t, conf)
+				defer ts.Teardown()
+
+				query := "deterministic=1&format=" + format
+				first := postArchiveChecksum(ts, query,
+					foo, bar, baz, dirA, dirB,
+				)
+				time.Sleep(10 * time.Millisecond)
+				second := postArchiveChecksum(ts, query,
+					dirB, baz, bar, foo, dirA,
+				)
+				require.Equal(t, first, second)
+
+				// Make sure the entries are sorted by name
+				str := ts.APIServer().Store().(*mockstore.Store)
+				archives := str.SavedArchives()
+				require.Len(t, archives, 2)
+				for _, archive := range archives {
+					require.Len(t, archive.Files, 3)
+					require.Equal(t, "bar.txt", archive.Files[0].Name)
+					require.Equal(t, "baz.txt", archive.Files[1].Name)
+					require.Equal(t, "foo.txt", archive.Files[2].Name)
+				}
+			})
+		}
+	}
+}
+
+// TestPostArchiveDeterministicStreamed tests POST /archive producing
+// identical archives for identical streamed uploads in deterministic mode
+func TestPostArchiveDeterministicStreamed(t *testing.T) {
+	ts := setup.New(t, streamedConfig(0, 0))
+	defer ts.Teardown()
+
+	parts := append(
+		[]formPart{{field: api.ParamDeterministic, value: "true"}},
+		textFiles(3, 4*1024)...,
+	)
+	first := postArchiveChecksum(ts, "", parts...)
+	time.Sleep(10 * time.Millisecond)
+	second := postArchiveChecksum(ts, "", parts...)
+	require.Equal(t, first, second)
+}
+
+// TestPostArchiveDeterministicModTime tests POST /archive
+// setting the modification time of all entries in deterministic mode
+func TestPostArchiveDeterministicModTime(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		query    string
+		expected time.Time
+	}{
+		{"Default", "deterministic=1",
+			time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"Client", "deterministic=1&mtime=2020-05-17T13:45:31Z",
+			time.Date(2020, 5, 17, 13, 45, 30, 0, time.UTC)},
+		{"ClientZone", "deterministic=1&mtime=2020-05-17T15:45:30%2B02:00",
+			time.Date(2020, 5, 17, 13, 45, 30, 0, time.UTC)},
+	} {
+		for mode, conf := range uploadModes() {
+			t.Run(tc.name+"/"+mode, func(t *testing.T) {
+				ts := setup.New(t, conf())
+				defer ts.Teardown()
+
+				req := newFormRequest(t,
+					compressibleFile(),
+					formPart{field: api.FormFieldDirectory, value: "empty"},
+				)
+				req.URL.RawQuery = tc.query
+				resp := ts.Guest().Do(req)
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				actual, err := ioutil.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				headers := readHeaders(t, actual)
+				require.Len(t, headers, 2)
+				for _, header := range headers {
+					require.True(
+						t,
+						tc.expected.Equal(header.Modified),
+						"%s: expected %s, got %s",
+						header.Name,
+						tc.expected,
+						header.Modified,
+					)
+					// No extended timestamp extra field
+					require.Empty(t, header.Extra)
+				}
+			})
+		}
+	}
+}
+
+// TestPostArchiveDeterministicErr tests POST /archive
+// rejecting invalid deterministic mode options
+func TestPostArchiveDeterministicErr(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		query    string
+		password string
+	}{
+		{"InvalidDeterministic", "deterministic=maybe", ""},
+		{"ModTimeWithoutDeterministic", "mtime=2020-05-17T13:45:30Z", ""},
+		{"InvalidModTime", "deterministic=1&mtime=yesterday", ""},
+		{"ModTimeTooEarly", "deterministic=1&mtime=1970-01-01T00:00:00Z", ""},
+		{"ModTimeTooLate", "deterministic=1&mtime=2200-01-01T00:00:00Z", ""},
+		{"Password", "deterministic=1", "secret"},
+	} {
+		for mode, conf := range uploadModes() {
+			t.Run(tc.name+"/"+mode, func(t *testing.T) {
+				ts := setup.New(t, conf())
+				defer ts.Teardown()
+
+				req := newFormRequest(t, compressibleFile())
+				req.URL.RawQuery = tc.query
+				if tc.password != "" {
+					req.Header.Set(api.HeaderPassword, tc.password)
+				}
+				resp := ts.Guest().Do(req)
+				require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+				str := ts.APIServer().Store().(*mockstore.Store)
+				require.Len(t, str.SavedArchives(), 0)
+				require.Equal(t, 0, str.UncommittedFiles())
+			})
+		}
+	}
+}
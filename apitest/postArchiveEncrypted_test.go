@@ -0,0 +1,502 @@
+package apitest
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/romshark/zipapi/api"
+	"github.com/romshark/zipapi/api/config"
+	"github.com/romshark/zipapi/apitest/setup"
+	"github.com/romshark/zipapi/store"
+	boltstore "github.com/romshark/zipapi/store/bolt"
+	fsstore "github.com/romshark/zipapi/store/fs"
+	mockstore "github.com/romshark/zipapi/store/mock"
+	"github.com/romshark/zipapi/store/storetest"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// errWrongPassword is returned by decryptEntry
+// if the password verifier doesn't match
+var errWrongPassword = errors.New("wrong password")
+
+// pbkdf2SHA1 derives a key of keyLen bytes using PBKDF2-HMAC-SHA1,
+// it's verified against the RFC 6070 test vectors
+func pbkdf2SHA1(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{
+			byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block),
+		})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(nil)
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// deriveAESKeys derives the WinZip AES-256 encryption key,
+// authentication key and password verifier
+func deriveAESKeys(password string, salt []byte) (enc, auth, pv []byte) {
+	key := pbkdf2SHA1([]byte(password), salt, 1000, 2*32+2)
+	return key[:32], key[32:64], key[64:]
+}
+
+// decryptEntry verifies and decrypts a WinZip AES-256 (AE-1 or AE-2)
+// encrypted entry and returns its decompressed contents.
+// It's verified against an archive written by libarchive
+func decryptEntry(fl *zip.File, password string) ([]byte, error) {
+	if fl.Method != 99 || fl.Flags&0x1 == 0 {
+		return nil, fmt.Errorf("entry '%s' isn't encrypted", fl.Name)
+	}
+
+	// Find the AES extra field
+	var version, method uint16
+	found := false
+	for extra := fl.Extra; len(extra) >= 4; {
+		id := binary.LittleEndian.Uint16(extra[0:])
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		if id == 0x9901 && size == 7 {
+			field := extra[4 : 4+size]
+			version = binary.LittleEndian.Uint16(field[0:])
+			if version < 1 || version > 2 ||
+				string(field[2:4]) != "AE" ||
+				field[4] != 3 {
+				return nil, errors.New("not an AE-1 or AE-2 AES-256 entry")
+			}
+			method = binary.LittleEndian.Uint16(field[5:])
+			found = true
+		}
+		extra = extra[4+size:]
+	}
+	if !found {
+		return nil, errors.New("missing AES extra field")
+	}
+
+	raw, err := fl.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 16+2+10 {
+		return nil, errors.New("encrypted entry too short")
+	}
+	salt, verifier := data[:16], data[16:18]
+	encrypted, code := data[18:len(data)-10], data[len(data)-10:]
+
+	encKey, authKey, pv := deriveAESKeys(password, salt)
+	if !bytes.Equal(pv, verifier) {
+		return nil, errWrongPassword
+	}
+	mac := hmac.New(sha1.New, authKey)
+	mac.Write(encrypted)
+	if !hmac.Equal(mac.Sum(nil)[:10], code) {
+		return nil, errors.New("authentication code mismatch")
+	}
+
+	// Decrypt in counter mode with a little-endian counter starting at 1
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	compressed := make([]byte, len(encrypted))
+	var counter, keyStream [aes.BlockSize]byte
+	for i := range encrypted {
+		if i%aes.BlockSize == 0 {
+			for j := range counter {
+				counter[j]++
+				if counter[j] != 0 {
+					break
+				}
+			}
+			block.Encrypt(keyStream[:], counter[:])
+		}
+		compressed[i] = encrypted[i] ^ keyStream[i%aes.BlockSize]
+	}
+
+	var contents []byte
+	switch method {
+	case zip.Store:
+		contents = compressed
+	case zip.Deflate:
+		if contents, err = ioutil.ReadAll(
+			flate.NewReader(bytes.NewReader(compressed)),
+		); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression method %d", method)
+	}
+
+	// Only AE-1 entries carry the CRC-32 of the plaintext
+	if version == 1 && crc32.ChecksumIEEE(contents) != fl.CRC32 {
+		return nil, errors.New("CRC-32 mismatch")
+	}
+	return contents, nil
+}
+
+// decryptEntries decrypts all entries of an encrypted archive
+// and returns their contents by name, directory entries have empty contents
+func decryptEntries(
+	t testing.TB,
+	archive []byte,
+	password string,
+) map[string]string {
+	reader, err := zip.NewReader(
+		bytes.NewReader(archive),
+		int64(len(archive)),
+	)
+	require.NoError(t, err)
+
+	entries := make(map[string]string, len(reader.File))
+	for _, fl := range reader.File {
+		if strings.HasSuffix(fl.Name, "/") {
+			entries[fl.Name] = ""
+			continue
+		}
+		contents, err := decryptEntry(fl, password)
+		require.NoError(t, err, "decrypting '%s'", fl.Name)
+		entries[fl.Name] = string(contents)
+	}
+	return entries
+}
+
+// extractExternally extracts the encrypted archive using libarchive,
+// an implementation independent of the server, if bsdtar is installed
+func extractExternally(
+	t *testing.T,
+	archive []byte,
+	password string,
+) map[string]string {
+	bsdtar, err := exec.LookPath("bsdtar")
+	if err != nil {
+		return nil
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "archive.zip")
+	require.NoError(t, ioutil.WriteFile(path, archive, 0600))
+	extracted := filepath.Join(dir, "extracted")
+	require.NoError(t, os.Mkdir(extracted, 0700))
+	out, err := exec.Command(
+		bsdtar,
+		"-xf", path,
+		"-C", extracted,
+		"--passphrase", password,
+	).CombinedOutput()
+	require.NoError(t, err, "bsdtar: %s", out)
+
+	entries := make(map[string]string)
+	require.NoError(t, filepath.Walk(extracted, func(
+		p string,
+		info os.FileInfo,
+		err error,
+	) error {
+		if err != nil || p == extracted {
+			return err
+		}
+		name, err := filepath.Rel(extracted, p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			entries[filepath.ToSlash(name)+"/"] = ""
+			return nil
+		}
+		contents, err := ioutil.ReadFile(p)
+		entries[filepath.ToSlash(name)] = string(contents)
+		return err
+	}))
+	return entries
+}
+
+// TestPBKDF2SHA1 verifies the key derivation
+// against the test vectors of RFC 6070
+func TestPBKDF2SHA1(t *testing.T) {
+	for _, tc := range []struct {
+		password   string
+		salt       string
+		iterations int
+		expected   string
+	}{
+		{"password", "salt", 1, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{"password", "salt", 2, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{"password", "salt", 4096, "4b007901b765489abead49d926f721d065a429c1"},
+		{
+			"passwordPASSWORDpassword",
+			"saltSALTsaltSALTsaltSALTsaltSALTsalt",
+			4096,
+			"3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038",
+		},
+		{"pass\x00word", "sa\x00lt", 4096, "56fa6aa75548099dcc37d7f03425e0c3"},
+	} {
+		expected, err := hex.DecodeString(tc.expected)
+		require.NoError(t, err)
+		require.Equal(t, expected, pbkdf2SHA1(
+			[]byte(tc.password),
+			[]byte(tc.salt),
+			tc.iterations,
+			len(expected),
+		))
+	}
+}
+
+// TestDecryptWinZipAES verifies decryptEntry against an archive
+// written by libarchive (bsdtar --format zip
+// --options zip:encryption=aes256 --passphrase pässword)
+func TestDecryptWinZipAES(t *testing.T) {
+	archive, err := ioutil.ReadFile("testdata/winzip-aes256.zip")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"hello.txt": "hello from libarchive\n",
+		"lorem.txt": strings.Repeat("lorem ipsum dolor sit amet ", 200),
+	}, decryptEntries(t, archive, "pässword"))
+
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	require.NoError(t, err)
+	_, err = decryptEntry(reader.File[0], "wrong")
+	require.Equal(t, errWrongPassword, err)
+}
+
+// TestPostArchiveEncrypted tests POST /archive
+// encrypting the archive entries with a password
+func TestPostArchiveEncrypted(t *testing.T) {
+	const password = "s3cr3t pässword"
+	parts := append(textFiles(3, 8*1024), formPart{
+		field:    "files",
+		fileName: "image.png",
+		value:    "\x89PNG\r\n\x1a\n" + string(make([]byte, 1024)),
+	}, formPart{
+		field: api.FormFieldDirectory,
+		value: "empty",
+	})
+
+	for _, viaField := range []bool{false, true} {
+		for _, workers := range []int{1, 4} {
+			for _, streamed := range []bool{false, true} {
+				name := fmt.Sprintf(
+					"Field=%t/Workers=%d/Streamed=%t",
+					viaField,
+					workers,
+					streamed,
+				)
+				t.Run(name, func(t *testing.T) {
+					logs := new(bytes.Buffer)
+					ts := setup.New(t, &config.Config{
+						App: config.App{
+							StreamUploads:      streamed,
+							CompressionWorkers: workers,
+						},
+						DebugLog: log.New(logs, "", 0),
+						ErrorLog: log.New(logs, "", 0),
+					})
+					defer ts.Teardown()
+
+					reqParts := parts
+					if viaField {
+						reqParts = append([]formPart{{
+							field: api.FormFieldPassword,
+							value: password,
+						}}, parts...)
+					}
+					req := newFormRequest(t, reqParts...)
+					if !viaField {
+						req.Header.Set(api.HeaderPassword, password)
+					}
+					resp := ts.Guest().Do(req)
+					require.Equal(t, http.StatusOK, resp.StatusCode)
+
+					actual, err := ioutil.ReadAll(resp.Body)
+					require.NoError(t, err)
+
+					expectedEntries := map[string]string{"empty/": ""}
+					for _, part := range parts[:4] {
+						expectedEntries[part.fileName] = part.value
+						// Make sure no plaintext is leaked
+						require.NotContains(t, string(actual), part.value)
+					}
+					require.Equal(
+						t,
+						expectedEntries,
+						decryptEntries(t, actual, password),
+					)
+					if external := extractExternally(
+						t,
+						actual,
+						password,
+					); external != nil {
+						require.Equal(t, expectedEntries, external)
+					}
+
+					// Make sure the wrong password is refused
+					reader, err := zip.NewReader(
+						bytes.NewReader(actual),
+						int64(len(actual)),
+					)
+					require.NoError(t, err)
+					_, err = decryptEntry(reader.File[0], "wrong")
+					require.Equal(t, errWrongPassword, err)
+
+					// Make sure the store only keeps the encrypted archive
+					checkArchive(ts, resp, actual)
+					str := ts.APIServer().Store().(*mockstore.Store)
+					archive := str.SavedArchives()[0]
+					require.True(t, archive.Encrypted)
+					require.Empty(t, archive.Files)
+					require.Zero(t, str.UncommittedFiles())
+
+					require.NotContains(t, logs.String(), password)
+				})
+			}
+		}
+	}
+}
+
+// TestPostArchiveEncryptedErr tests POST /archive rejecting passwords
+// for archive formats not supporting encryption
+func TestPostArchiveEncryptedErr(t *testing.T) {
+	for mode, conf := range uploadModes() {
+		t.Run(mode, func(t *testing.T) {
+			ts := setup.New(t, conf())
+			defer ts.Teardown()
+
+			req := newFormRequest(t, compressibleFile())
+			req.URL.RawQuery = "format=tar.gz"
+			req.Header.Set(api.HeaderPassword, "secret")
+			resp := ts.Guest().Do(req)
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+			str := ts.APIServer().Store().(*mockstore.Store)
+			require.Len(t, str.SavedArchives(), 0)
+			require.Equal(t, 0, str.UncommittedFiles())
+		})
+	}
+}
+
+// TestPostArchiveEncryptedCompareSizes tests POST /archive
+// storing incompressible encrypted entries uncompressed
+// only if size comparison is enabled
+func TestPostArchiveEncryptedCompareSizes(t *testing.T) {
+	random := make([]byte, 64*1024)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+
+	for _, compareSizes := range []bool{false, true} {
+		t.Run(fmt.Sprintf("CompareSizes=%t", compareSizes), func(t *testing.T) {
+			compression := config.DefaultCompression()
+			compression.CompareSizes = compareSizes
+			ts := setup.New(t, &config.Config{App: config.App{
+				Compression: compression,
+			}})
+			defer ts.Teardown()
+
+			req := newFormRequest(t, formPart{
+				field:    "files",
+				fileName: "random.bin",
+				value:    string(random),
+			})
+			req.Header.Set(api.HeaderPassword, "secret")
+			resp := ts.Guest().Do(req)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			actual, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(
+				t,
+				map[string]string{"random.bin": string(random)},
+				decryptEntries(t, actual, "secret"),
+			)
+
+			stored, deflated := "0", "1"
+			if compareSizes {
+				stored, deflated = "1", "0"
+			}
+			require.Equal(t, stored, resp.Trailer.Get(api.HeaderEntriesStored))
+			require.Equal(
+				t,
+				deflated,
+				resp.Trailer.Get(api.HeaderEntriesDeflated),
+			)
+		})
+	}
+}
+
+// TestPostArchiveEncryptedRestart tests reopening persistent stores
+// holding encrypted archives
+func TestPostArchiveEncryptedRestart(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		newStore func(dir string) store.Store
+	}{
+		{"FS", func(dir string) store.Store {
+			return fsstore.New(fsstore.Options{Root: dir})
+		}},
+		{"Bolt", func(dir string) store.Store {
+			return boltstore.New(boltstore.Options{
+				Path: filepath.Join(dir, "zipapi.db"),
+			})
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			str := tc.newStore(t.TempDir())
+			ts := setup.New(t, &config.Config{Store: str})
+			req := newFormRequest(t, textFiles(2, 1024)...)
+			req.Header.Set(api.HeaderPassword, "secret")
+			resp := ts.Guest().Do(req)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			actual, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			ts.Teardown()
+
+			require.NoError(t, str.Init())
+			defer str.Close()
+			archive, err := str.Archive(
+				context.Background(),
+				resp.Header.Get(api.HeaderArchiveID),
+			)
+			require.NoError(t, err)
+			require.True(t, archive.Encrypted)
+			require.Empty(t, archive.Files)
+			require.Equal(
+				t,
+				string(actual),
+				storetest.ReadFile(t, str, archive.ContentsID),
+			)
+		})
+	}
+}
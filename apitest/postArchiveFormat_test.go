@@ -0,0 +1,223 @@
+package apitest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/romshark/zipapi/api"
+	"github.com/romshark/zipapi/apitest/setup"
+	mockstore "github.com/romshark/zipapi/store/mock"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+// readTarEntries decompresses the tar archive according to its format
+// and returns the contents of all entries by name,
+// directory entries have empty contents
+func readTarEntries(
+	t testing.TB,
+	format string,
+	archive []byte,
+) map[string]string {
+	var r io.Reader = bytes.NewReader(archive)
+	switch format {
+	case "tar.gz":
+		gz, err := gzip.NewReader(r)
+		require.NoError(t, err)
+		defer gz.Close()
+		r = gz
+	case "tar.zst":
+		zst, err := zstd.NewReader(r)
+		require.NoError(t, err)
+		defer zst.Close()
+		r = zst
+	}
+
+	entries := make(map[string]string)
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		contents, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		entries[header.Name] = string(contents)
+	}
+	return entries
+}
+
+// TestPostArchiveFormat tests POST /archive choosing the archive format
+func TestPostArchiveFormat(t *testing.T) {
+	parts := []formPart{
+		{field: api.FormFieldDirectory, value: "empty"},
+		{field: "files", fileName: "docs/foo.txt", value: "foo foo foo"},
+		{field: "files", fileName: "bar.txt", value: "bar bar bar bar"},
+	}
+	expectedEntries := map[string]string{
+		"docs/foo.txt": "foo foo foo",
+		"bar.txt":      "bar bar bar bar",
+		"empty/":       "",
+	}
+
+	for _, tc := range []struct {
+		name        string
+		query       string
+		accept      string
+		fields      []formPart
+		format      string
+		contentType string
+		extension   string
+	}{
+		{"Default", "", "", nil,
+			"zip", "application/zip", ".zip"},
+		{"AcceptAny", "", "*/*", nil,
+			"zip", "application/zip", ".zip"},
+		{"TarQuery", "format=tar", "", nil,
+			"tar", "application/x-tar", ".tar"},
+		{"TarGzAccept", "", "application/gzip", nil,
+			"tar.gz", "application/gzip", ".tar.gz"},
+		{"TarZstAccept", "", "application/zip;q=0.5, application/zstd", nil,
+			"tar.zst", "application/zstd", ".tar.zst"},
+		{"AcceptQuality", "", "application/x-tar;q=0.8, application/zip;q=0.9", nil,
+			"zip", "application/zip", ".zip"},
+		{"FieldOverridesAccept", "", "application/zip", []formPart{
+			{field: api.ParamFormat, value: "tar.gz"},
+		}, "tar.gz", "application/gzip", ".tar.gz"},
+		{"QueryOverridesAccept", "format=tar.zst", "application/x-tar", nil,
+			"tar.zst", "application/zstd", ".tar.zst"},
+	} {
+		for mode, conf := range uploadModes() {
+			t.Run(tc.name+"/"+mode, func(t *testing.T) {
+				ts := setup.New(t, conf())
+				defer ts.Teardown()
+
+				req := newFormRequest(t, append(tc.fields, parts...)...)
+				req.URL.RawQuery = tc.query
+				if tc.accept != "" {
+					req.Header.Set("Accept", tc.accept)
+				}
+				resp := ts.Guest().Do(req)
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				require.Equal(
+					t,
+					tc.contentType,
+					resp.Header.Get("Content-Type"),
+				)
+
+				archiveID := resp.Header.Get(api.HeaderArchiveID)
+				require.Equal(
+					t,
+					`attachment; filename="`+archiveID+tc.extension+`"`,
+					resp.Header.Get("Content-Disposition"),
+				)
+
+				actual, err := ioutil.ReadAll(resp.Body)
+				require.NoError(t, err)
+				if tc.format == "zip" {
+					require.Equal(
+						t,
+						expectedEntries,
+						readEntries(t, actual),
+					)
+				} else {
+					require.Equal(
+						t,
+						expectedEntries,
+						readTarEntries(t, tc.format, actual),
+					)
+				}
+
+				checkArchive(ts, resp, actual)
+				str := ts.APIServer().Store().(*mockstore.Store)
+				require.Equal(t, tc.format, str.SavedArchives()[0].Format)
+
+				// Make sure the archive is served in its format again
+				resp = ts.Guest().Do(newGetArchiveRequest(t, archiveID))
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				require.Equal(
+					t,
+					tc.contentType,
+					resp.Header.Get("Content-Type"),
+				)
+				served, err := ioutil.ReadAll(resp.Body)
+				require.NoError(t, err)
+				require.Equal(t, actual, served)
+			})
+		}
+	}
+}
+
+// TestPostArchiveFormatErr tests POST /archive rejecting
+// unsupported archive formats
+func TestPostArchiveFormatErr(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		query  string
+		accept string
+		status int
+	}{
+		{"UnknownFormat", "format=7z", "", http.StatusBadRequest},
+		{"NotAcceptable", "", "text/html", http.StatusNotAcceptable},
+		{"NotAcceptableQuality", "", "application/zip;q=0",
+			http.StatusNotAcceptable},
+	} {
+		for mode, conf := range uploadModes() {
+			t.Run(tc.name+"/"+mode, func(t *testing.T) {
+				ts := setup.New(t, conf())
+				defer ts.Teardown()
+
+				req := newFormRequest(t, compressibleFile())
+				req.URL.RawQuery = tc.query
+				if tc.accept != "" {
+					req.Header.Set("Accept", tc.accept)
+				}
+				resp := ts.Guest().Do(req)
+				require.Equal(t, tc.status, resp.StatusCode)
+
+				str := ts.APIServer().Store().(*mockstore.Store)
+				require.Len(t, str.SavedArchives(), 0)
+				require.Equal(t, 0, str.UncommittedFiles())
+			})
+		}
+	}
+}
+
+// TestPostArchiveFormatFileTooLarge tests POST /archive
+// rejecting files exceeding the max file size in all formats
+func TestPostArchiveFormatFileTooLarge(t *testing.T) {
+	for _, format := range []string{"zip", "tar", "tar.gz", "tar.zst"} {
+		for _, streamed := range []bool{false, true} {
+			name := format + "/Parsed"
+			if streamed {
+				name = format + "/Streamed"
+			}
+			t.Run(name, func(t *testing.T) {
+				conf := streamedConfig(1024, 0)
+				conf.App.StreamUploads = streamed
+				ts := setup.New(t, conf)
+				defer ts.Teardown()
+
+				req := newFormRequest(t, formPart{
+					field:    "files",
+					fileName: "large.bin",
+					value:    string(make([]byte, 2048)),
+				})
+				req.URL.RawQuery = "format=" + format
+				resp := ts.Guest().Do(req)
+				require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+				str := ts.APIServer().Store().(*mockstore.Store)
+				require.Len(t, str.SavedArchives(), 0)
+				require.Equal(t, 0, str.UncommittedFiles())
+			})
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package apitest
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/romshark/zipapi/api"
+	"github.com/romshark/zipapi/apitest/setup"
+	mockstore "github.com/romshark/zipapi/store/mock"
+
+	"github.com/stretchr/testify/require"
+)
+
+// metadataRequests returns requests uploading an executable
+// and a plain file with metadata defined by companion fields
+// and by the manifest respectively
+func metadataRequests(t *testing.T) map[string]*http.Request {
+	files := []formPart{
+		{field: "files", fileName: "run.sh", value: "#!/bin/sh\necho hi\n"},
+		{field: "files", fileName: "notes.txt", value: "notes notes notes"},
+	}
+
+	manifest, err := json.Marshal(api.UploadManifest{
+		Files: map[string]api.UploadManifestFile{
+			"run.sh": {
+				ModTime: "2020-05-17T13:45:30Z",
+				Mode:    "755",
+				Comment: "run me",
+			},
+		},
+		Comment: "archive comment",
+	})
+	require.NoError(t, err)
+
+	return map[string]*http.Request{
+		"CompanionFields": newFormRequest(t, append([]formPart{
+			{field: "files" + api.FormFieldModTimeSuffix,
+				value: "2020-05-17T15:45:30+02:00"},
+			{field: "files" + api.FormFieldModeSuffix, value: "755"},
+			{field: "files" + api.FormFieldCommentSuffix, value: "run me"},
+			{field: api.FormFieldComment, value: "archive comment"},
+		}, files...)...),
+		"Manifest": newFormRequest(t, append([]formPart{
+			{field: api.FormFieldManifest, value: string(manifest)},
+		}, files...)...),
+	}
+}
+
+// TestPostArchiveMetadata tests POST /archive preserving
+// the file metadata supplied by the client
+func TestPostArchiveMetadata(t *testing.T) {
+	modTime := time.Date(2020, 5, 17, 13, 45, 30, 0, time.UTC)
+
+	for mode, conf := range uploadModes() {
+		for name, req := range metadataRequests(t) {
+			t.Run(name+"/"+mode, func(t *testing.T) {
+				ts := setup.New(t, conf())
+				defer ts.Teardown()
+
+				resp := ts.Guest().Do(req)
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				actual, err := ioutil.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				reader, err := zip.NewReader(
+					bytes.NewReader(actual),
+					int64(len(actual)),
+				)
+				require.NoError(t, err)
+				require.Equal(t, "archive comment", reader.Comment)
+
+				headers := make(map[string]zip.FileHeader)
+				for _, fl := range reader.File {
+					headers[fl.Name] = fl.FileHeader
+				}
+				require.Len(t, headers, 2)
+
+				exec := headers["run.sh"]
+				require.True(t, modTime.Equal(exec.Modified))
+				require.Equal(t, os.FileMode(0755), exec.Mode().Perm())
+				require.Equal(t, "run me", exec.Comment)
+
+				plain := headers["notes.txt"]
+				require.Zero(t, plain.ModifiedDate)
+				require.Empty(t, plain.Comment)
+
+				// Make sure the metadata is recorded
+				checkArchive(ts, resp, actual)
+				str := ts.APIServer().Store().(*mockstore.Store)
+				archive := str.SavedArchives()[0]
+				require.Equal(t, "archive comment", archive.Comment)
+				for _, fl := range archive.Files {
+					if fl.Name != "run.sh" {
+						require.True(t, fl.ModTime.IsZero())
+						require.Zero(t, fl.Mode)
+						require.Empty(t, fl.Comment)
+						continue
+					}
+					require.True(t, modTime.Equal(fl.ModTime))
+					require.Equal(t, os.FileMode(0755), fl.Mode)
+					require.Equal(t, "run me", fl.Comment)
+				}
+
+				// Make sure the metadata is listed
+				_, page := getArchives(ts, nil)
+				require.Len(t, page.Archives, 1)
+				require.Equal(t, "archive comment", page.Archives[0].Comment)
+				for _, fl := range page.Archives[0].Files {
+					if fl.Name != "run.sh" {
+						require.Nil(t, fl.ModTime)
+						continue
+					}
+					require.True(t, modTime.Equal(*fl.ModTime))
+					require.Equal(t, "755", fl.Mode)
+					require.Equal(t, "run me", fl.Comment)
+				}
+			})
+		}
+	}
+}
+
+// TestPostArchiveMetadataTar tests POST /archive
+// preserving the file metadata in tar archives
+func TestPostArchiveMetadataTar(t *testing.T) {
+	modTime := time.Date(2020, 5, 17, 13, 45, 30, 0, time.UTC)
+
+	for mode, conf := range uploadModes() {
+		t.Run(mode, func(t *testing.T) {
+			ts := setup.New(t, conf())
+			defer ts.Teardown()
+
+			req := metadataRequests(t)["CompanionFields"]
+			req.URL.RawQuery = "format=tar"
+			resp := ts.Guest().Do(req)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			reader := tar.NewReader(resp.Body)
+			headers := make(map[string]*tar.Header)
+			for {
+				header, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				headers[header.Name] = header
+			}
+			require.Len(t, headers, 2)
+
+			exec := headers["run.sh"]
+			require.True(t, modTime.Equal(exec.ModTime))
+			require.Equal(t, int64(0755), exec.Mode)
+			require.Equal(t, "run me", exec.PAXRecords["comment"])
+
+			plain := headers["notes.txt"]
+			require.Equal(t, int64(0644), plain.Mode)
+			require.NotContains(t, plain.PAXRecords, "comment")
+		})
+	}
+}
+
+// TestPostArchiveMetadataDeterministic tests POST /archive
+// preferring the file modification times over the fixed
+// modification time in deterministic mode
+func TestPostArchiveMetadataDeterministic(t *testing.T) {
+	ts := setup.New(t, nil)
+	defer ts.Teardown()
+
+	req := metadataRequests(t)["CompanionFields"]
+	req.URL.RawQuery = "deterministic=1"
+	resp := ts.Guest().Do(req)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	actual, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	for _, header := range readHeaders(t, actual) {
+		expected := time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+		if header.Name == "run.sh" {
+			expected = time.Date(2020, 5, 17, 13, 45, 30, 0, time.UTC)
+		}
+		require.True(t, expected.Equal(header.Modified))
+		require.Empty(t, header.Extra)
+	}
+}
+
+// TestPostArchiveMetadataErr tests POST /archive
+// rejecting malformed file metadata
+func TestPostArchiveMetadataErr(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		field string
+		value string
+	}{
+		{"InvalidModTime", "files.mtime", "yesterday"},
+		{"ModTimeTooEarly", "files.mtime", "1970-01-01T00:00:00Z"},
+		{"InvalidMode", "files.mode", "rwx"},
+		{"ModeNotOctal", "files.mode", "999"},
+		{"ModeSpecialBits", "files.mode", "4755"},
+		{"CommentTooLong", "files.comment", strings.Repeat("c", 64*1024)},
+		{"ArchiveCommentTooLong", "comment", strings.Repeat("c", 64*1024)},
+		{"InvalidManifestMode", "manifest",
+			`{"files": {"zeros.bin": {"mode": "-1"}}}`},
+	} {
+		for mode, conf := range uploadModes() {
+			t.Run(tc.name+"/"+mode, func(t *testing.T) {
+				ts := setup.New(t, conf())
+				defer ts.Teardown()
+
+				req := newFormRequest(t,
+					formPart{field: tc.field, value: tc.value},
+					compressibleFile(),
+				)
+				resp := ts.Guest().Do(req)
+				require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+				str := ts.APIServer().Store().(*mockstore.Store)
+				require.Len(t, str.SavedArchives(), 0)
+				require.Equal(t, 0, str.UncommittedFiles())
+			})
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package apitest
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"testing"
+
+	"github.com/romshark/zipapi/api"
+	"github.com/romshark/zipapi/api/config"
+	"github.com/romshark/zipapi/apitest/setup"
+	mockstore "github.com/romshark/zipapi/store/mock"
+
+	"github.com/stretchr/testify/require"
+)
+
+// formPart represents a part of a multipart/form-data request,
+// parts without a file name are written as regular fields
+type formPart struct {
+	field    string
+	fileName string
+	value    string
+}
+
+// newFormRequest creates a new multipart/form-data request
+// writing the parts in the given order
+func newFormRequest(t testing.TB, parts ...formPart) *http.Request {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+
+	for _, part := range parts {
+		if part.fileName == "" {
+			require.NoError(t, writer.WriteField(part.field, part.value))
+			continue
+		}
+		// The file name is written unescaped to preserve backslashes
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(
+			`form-data; name="%s"; filename="%s"`,
+			part.field,
+			part.fileName,
+		))
+		header.Set("Content-Type", "application/octet-stream")
+		w, err := writer.CreatePart(header)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(part.value))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, writer.Close())
+
+	req, err := http.NewRequest("POST", "/archive", body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+// readEntries returns the contents of all archive entries by name,
+// directory entries have empty contents
+func readEntries(t testing.TB, archive []byte) map[string]string {
+	reader, err := zip.NewReader(
+		bytes.NewReader(archive),
+		int64(len(archive)),
+	)
+	require.NoError(t, err)
+	registerDecompressors(reader)
+
+	entries := make(map[string]string, len(reader.File))
+	for _, fl := range reader.File {
+		rd, err := fl.Open()
+		require.NoError(t, err)
+		contents, err := ioutil.ReadAll(rd)
+		require.NoError(t, err)
+		require.NoError(t, rd.Close())
+		entries[fl.Name] = string(contents)
+	}
+	return entries
+}
+
+// uploadModes returns the configurations of both upload modes
+func uploadModes() map[string]func() *config.Config {
+	return map[string]func() *config.Config{
+		"Parsed": func() *config.Config { return nil },
+		"Streamed": func() *config.Config {
+			return streamedConfig(0, 0)
+		},
+	}
+}
+
+// TestPostArchivePaths tests POST /archive building nested directories
+func TestPostArchivePaths(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		parts    []formPart
+		expected map[string]string
+	}{
+		{"FileName", []formPart{
+			{field: "files", fileName: "dir/sub/foo.txt", value: "foo"},
+			{field: "files", fileName: "./dir//bar.txt", value: "bar"},
+			{field: "files", fileName: "baz.txt", value: "baz"},
+		}, map[string]string{
+			"dir/sub/foo.txt": "foo",
+			"dir/bar.txt":     "bar",
+			"baz.txt":         "baz",
+		}},
+		{"CompanionField", []formPart{
+			{field: "files.path", value: "docs/a.txt"},
+			{field: "files.path", value: "docs/nested/b.txt"},
+			{field: "files", fileName: "a.txt", value: "a"},
+			{field: "files", fileName: "b.txt", value: "b"},
+			{field: "other", fileName: "c.txt", value: "c"},
+		}, map[string]string{
+			"docs/a.txt":        "a",
+			"docs/nested/b.txt": "b",
+			"c.txt":             "c",
+		}},
+		{"Manifest", []formPart{
+			{field: api.FormFieldManifest, value: `{
+				"files": {"a.txt": {"path": "x/a.txt"}},
+				"directories": ["empty", "x/also-empty/"]
+			}`},
+			{field: api.FormFieldDirectory, value: "another/empty"},
+			{field: "files.path", value: "ignored/a.txt"},
+			{field: "files", fileName: "a.txt", value: "a"},
+			{field: "files", fileName: "b.txt", value: "b"},
+		}, map[string]string{
+			"x/a.txt":        "a",
+			"b.txt":          "b",
+			"empty/":         "",
+			"x/also-empty/":  "",
+			"another/empty/": "",
+		}},
+		{"ManifestFile", []formPart{
+			{
+				field:    api.FormFieldManifest,
+				fileName: "manifest.json",
+				value:    `{"files": {"a.txt": {"path": "x/a.txt"}}}`,
+			},
+			{field: "files", fileName: "a.txt", value: "a"},
+		}, map[string]string{
+			"x/a.txt": "a",
+		}},
+	} {
+		for mode, conf := range uploadModes() {
+			t.Run(tc.name+"/"+mode, func(t *testing.T) {
+				ts := setup.New(t, conf())
+				defer ts.Teardown()
+
+				resp := ts.Guest().Do(newFormRequest(t, tc.parts...))
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+
+				actual, err := ioutil.ReadAll(resp.Body)
+				require.NoError(t, err)
+				require.Equal(t, tc.expected, readEntries(t, actual))
+			})
+		}
+	}
+}
+
+// TestPostArchivePathsErr tests POST /archive rejecting invalid paths
+func TestPostArchivePathsErr(t *testing.T) {
+	file := func(name string) formPart {
+		return formPart{field: "files", fileName: name, value: "x"}
+	}
+	for _, tc := range []struct {
+		name  string
+		parts []formPart
+	}{
+		{"ParentReference", []formPart{file("../evil.txt")}},
+		{"NestedParentReference", []formPart{file("a/../../evil.txt")}},
+		{"Absolute", []formPart{file("/etc/passwd")}},
+		{"Backslashes", []formPart{file(`..\\evil.txt`)}},
+		{"DriveLetter", []formPart{file("C:/evil.txt")}},
+		{"CompanionField", []formPart{
+			{field: "files.path", value: "../evil.txt"},
+			file("a.txt"),
+		}},
+		{"ManifestPath", []formPart{
+			{
+				field: api.FormFieldManifest,
+				value: `{"files": {"a.txt": {"path": "/evil.txt"}}}`,
+			},
+			file("a.txt"),
+		}},
+		{"ManifestDirectory", []formPart{
+			{
+				field: api.FormFieldManifest,
+				value: `{"directories": ["../evil"]}`,
+			},
+			file("a.txt"),
+		}},
+		{"Directory", []formPart{
+			{field: api.FormFieldDirectory, value: "/evil"},
+			file("a.txt"),
+		}},
+		{"MalformedManifest", []formPart{
+			{field: api.FormFieldManifest, value: "{"},
+			file("a.txt"),
+		}},
+		{"FileInsideFile", []formPart{file("a"), file("a/b.txt")}},
+		{"FileAtDirectory", []formPart{file("a/b.txt"), file("a")}},
+		{"DirectoryAtFile", []formPart{
+			{field: api.FormFieldDirectory, value: "a"},
+			file("a"),
+		}},
+	} {
+		for mode, conf := range uploadModes() {
+			t.Run(tc.name+"/"+mode, func(t *testing.T) {
+				ts := setup.New(t, conf())
+				defer ts.Teardown()
+
+				resp := ts.Guest().Do(newFormRequest(t, tc.parts...))
+				require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+				str := ts.APIServer().Store().(*mockstore.Store)
+				require.Len(t, str.SavedArchives(), 0)
+				require.Equal(t, 0, str.UncommittedFiles())
+			})
+		}
+	}
+}
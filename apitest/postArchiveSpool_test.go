@@ -0,0 +1,108 @@
+package apitest
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/romshark/zipapi/api"
+	"github.com/romshark/zipapi/apitest/setup"
+	mockstore "github.com/romshark/zipapi/store/mock"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestPostArchiveSpool tests POST /archive
+// building the entire archive before sending it
+func TestPostArchiveSpool(t *testing.T) {
+	for _, streamed := range []bool{false, true} {
+		for _, format := range []string{"zip", "tar.gz"} {
+			name := format + "/Parsed"
+			if streamed {
+				name = format + "/Streamed"
+			}
+			t.Run(name, func(t *testing.T) {
+				// Spill the archive to a temporary file
+				conf := streamedConfig(0, 0)
+				conf.App.StreamUploads = streamed
+				conf.App.SpoolResponses = true
+				conf.App.MaxMultipartMembuf = 1024
+				ts := setup.New(t, conf)
+				defer ts.Teardown()
+
+				req := newFormRequest(t, textFiles(3, 8*1024)...)
+				req.URL.RawQuery = "format=" + format
+				resp := ts.Guest().Do(req)
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				actual, err := ioutil.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				require.Equal(
+					t,
+					strconv.Itoa(len(actual)),
+					resp.Header.Get("Content-Length"),
+				)
+				archiveID := resp.Header.Get(api.HeaderArchiveID)
+				require.Equal(
+					t,
+					`attachment; filename="`+archiveID+"."+format+`"`,
+					resp.Header.Get("Content-Disposition"),
+				)
+				require.Empty(t, resp.Trailer)
+				require.Empty(t, resp.Header.Get(api.HeaderArchiveError))
+				if format == "zip" {
+					// The trailers are sent as headers
+					require.Equal(
+						t,
+						"3",
+						resp.Header.Get(api.HeaderEntriesDeflated),
+					)
+					require.Len(t, readEntries(t, actual), 3)
+				} else {
+					require.Len(t, readTarEntries(t, format, actual), 3)
+				}
+				checkArchive(ts, resp, actual)
+			})
+		}
+	}
+}
+
+// TestPostArchiveSpoolFileTooLarge tests POST /archive
+// responding with an error status to files exceeding
+// the max file size after the archive was partially written
+func TestPostArchiveSpoolFileTooLarge(t *testing.T) {
+	conf := streamedConfig(64*1024, 1024*1024)
+	conf.App.SpoolResponses = true
+	ts := setup.New(t, conf)
+	defer ts.Teardown()
+
+	// Random contents are incompressible
+	first := make([]byte, 64*1024)
+	_, err := rand.Read(first)
+	require.NoError(t, err)
+
+	req := newFormRequest(t, formPart{
+		field:    "files",
+		fileName: "first.bin",
+		value:    string(first),
+	}, formPart{
+		field:    "files",
+		fileName: "toolarge.bin",
+		value:    string(make([]byte, 64*1024+1)),
+	})
+	resp := ts.Guest().Do(req)
+	requireProblem(
+		t,
+		resp,
+		http.StatusRequestEntityTooLarge,
+		api.CodeFileTooLarge,
+	)
+	require.Empty(t, resp.Header.Get(api.HeaderArchiveID))
+	require.Empty(t, resp.Header.Get("Content-Disposition"))
+
+	str := ts.APIServer().Store().(*mockstore.Store)
+	require.Len(t, str.SavedArchives(), 0)
+	require.Equal(t, 0, str.UncommittedFiles())
+}
@@ -0,0 +1,192 @@
+package apitest
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/romshark/zipapi/api"
+	"github.com/romshark/zipapi/api/config"
+	"github.com/romshark/zipapi/apitest/setup"
+	"github.com/romshark/zipapi/store"
+
+	"github.com/stretchr/testify/require"
+)
+
+func storedArchive(ts *setup.TestSetup, archiveID string) store.Archive {
+	archive, err := ts.APIServer().Store().Archive(
+		context.Background(),
+		archiveID,
+	)
+	require.NoError(ts.T(), err)
+	return archive
+}
+
+// storedFile returns the stored file archived under the given name
+func storedFile(ts *setup.TestSetup, archiveID, name string) store.File {
+	for _, fl := range storedArchive(ts, archiveID).Files {
+		if fl.Name == name {
+			return fl
+		}
+	}
+	ts.T().Fatalf("file '%s' not found in archive %s", name, archiveID)
+	return store.File{}
+}
+
+func storedSourcesField(t *testing.T, sources ...api.StoredSource) formPart {
+	value, err := json.Marshal(sources)
+	require.NoError(t, err)
+	return formPart{field: api.FieldStored, value: string(value)}
+}
+
+// TestPostArchiveStored tests POST /archive building archives
+// from files already in the store
+func TestPostArchiveStored(t *testing.T) {
+	for _, mode := range []string{"Parsed", "Streamed", "JSON"} {
+		t.Run(mode, func(t *testing.T) {
+			var conf *config.Config
+			if newConf, ok := uploadModes()[mode]; ok {
+				conf = newConf()
+			}
+			ts := setup.New(t, conf)
+			defer ts.Teardown()
+
+			sourceA, _ := postArchive(
+				ts,
+				File{Name: "foo.txt", Contents: []byte("foo")},
+				File{Name: "bar.txt", Contents: []byte("bar bar")},
+			)
+			sourceB, _ := postArchive(
+				ts,
+				File{Name: "baz.txt", Contents: []byte("baz baz baz")},
+			)
+			foo := storedFile(ts, sourceA, "foo.txt")
+
+			sources := []api.StoredSource{
+				{File: foo.ID, Path: "renamed/foo.txt"},
+				{Archive: sourceB, Path: "b"},
+				{Archive: sourceA},
+			}
+			expected := map[string]string{
+				"renamed/foo.txt": "foo",
+				"b/baz.txt":       "baz baz baz",
+				"foo.txt":         "foo",
+				"bar.txt":         "bar bar",
+			}
+
+			var req *http.Request
+			if mode == "JSON" {
+				req = newUploadArchiveRequest(t, api.UploadArchiveRequest{
+					Stored: sources,
+				})
+			} else {
+				req = newFormRequest(
+					t,
+					storedSourcesField(t, sources...),
+					formPart{field: "files", fileName: "new.txt", value: "new"},
+				)
+				expected["new.txt"] = "new"
+			}
+			resp := ts.Guest().Do(req)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			actual, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, expected, readEntries(t, actual))
+
+			// The composed archive owns copies of the stored files
+			composedID := resp.Header.Get(api.HeaderArchiveID)
+			composed := storedArchive(ts, composedID)
+			require.Len(t, composed.Files, len(expected))
+			for _, fl := range composed.Files {
+				require.NotEqual(t, foo.ID, fl.ID)
+			}
+			require.NoError(t, ts.APIServer().Store().DeleteArchive(
+				context.Background(),
+				sourceA,
+			))
+			resp = ts.Guest().Do(newGetArchiveRequest(t, composedID))
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			stored, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, actual, stored)
+		})
+	}
+}
+
+// TestPostArchiveStoredErr tests POST /archive referencing
+// inexistent, encrypted or malformed stored sources
+func TestPostArchiveStoredErr(t *testing.T) {
+	ts := setup.New(t, nil)
+	defer ts.Teardown()
+
+	source, _ := postArchive(ts, File{Name: "foo.txt", Contents: []byte("foo")})
+	foo := storedFile(ts, source, "foo.txt")
+
+	encryptedReq := newfileUploadRequest(t, File{
+		Name:     "secret.txt",
+		Contents: []byte("secret"),
+	})
+	encryptedReq.URL.Path = "/archive"
+	encryptedReq.Header.Set(api.HeaderPassword, "s3cr3t")
+	resp := ts.Guest().Do(encryptedReq)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	encrypted := resp.Header.Get(api.HeaderArchiveID)
+
+	for _, tc := range []struct {
+		name    string
+		sources []api.StoredSource
+		code    api.ErrorCode
+	}{
+		{"UnknownFile", []api.StoredSource{
+			{File: "inexistent"},
+		}, api.CodeInvalidParameter},
+		{"UnknownArchive", []api.StoredSource{
+			{Archive: "inexistent"},
+		}, api.CodeInvalidParameter},
+		{"ArchiveContents", []api.StoredSource{
+			{File: storedArchive(ts, source).ContentsID},
+		}, api.CodeInvalidParameter},
+		{"FileAndArchive", []api.StoredSource{
+			{File: foo.ID, Archive: source},
+		}, api.CodeInvalidParameter},
+		{"Empty", []api.StoredSource{
+			{Path: "foo.txt"},
+		}, api.CodeInvalidParameter},
+		{"EncryptedArchive", []api.StoredSource{
+			{Archive: encrypted},
+		}, api.CodeInvalidParameter},
+		{"InvalidPath", []api.StoredSource{
+			{File: foo.ID, Path: "../foo.txt"},
+		}, api.CodeInvalidPath},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := ts.Guest().Do(newUploadArchiveRequest(
+				t,
+				api.UploadArchiveRequest{Stored: tc.sources},
+			))
+			problem := requireProblem(t, resp, http.StatusBadRequest, tc.code)
+			if tc.code == api.CodeInvalidParameter {
+				require.Equal(t, api.FieldStored, problem.Field)
+			}
+		})
+	}
+
+	t.Run("MalformedField", func(t *testing.T) {
+		resp := ts.Guest().Do(newFormRequest(
+			t,
+			formPart{field: api.FieldStored, value: "{"},
+			formPart{field: "files", fileName: "new.txt", value: "new"},
+		))
+		requireProblem(t, resp, http.StatusBadRequest, api.CodeInvalidParameter)
+	})
+
+	// No archive is created for failed requests
+	page, err := ts.APIServer().Store().QueryArchives(
+		context.Background(),
+		store.ArchiveQuery{},
+	)
+	require.NoError(t, err)
+	require.Len(t, page.Archives, 2)
+}
@@ -0,0 +1,258 @@
+package apitest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/romshark/zipapi/api"
+	"github.com/romshark/zipapi/api/config"
+	"github.com/romshark/zipapi/apitest/setup"
+	"github.com/romshark/zipapi/store"
+	mockstore "github.com/romshark/zipapi/store/mock"
+
+	"github.com/stretchr/testify/require"
+)
+
+func streamedConfig(maxFileSize, maxReqSize uint64) *config.Config {
+	return &config.Config{
+		App: config.App{
+			MaxFileSize:   maxFileSize,
+			MaxReqSize:    maxReqSize,
+			StreamUploads: true,
+		},
+	}
+}
+
+// TestPostArchiveStreamed tests POST /archive with streamed uploads
+func TestPostArchiveStreamed(t *testing.T) {
+	ts := setup.New(t, streamedConfig(0, 0))
+	defer ts.Teardown()
+
+	files := []File{
+		File{
+			Name:     "foo.txt",
+			Contents: []byte("foo foo foo"),
+			Params:   map[string]string{"ignored": "field"},
+		}, File{
+			Name:     "bar.txt",
+			Contents: []byte("bar bar bar bar"),
+		},
+	}
+
+	// Prepare input files
+	req := newfileUploadRequest(t, files...)
+
+	// Make request
+	req.URL.Path = "/archive"
+	resp := ts.Guest().Do(req)
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	actual, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	checkFiles(ts, files, actual)
+	checkArchive(ts, resp, actual)
+}
+
+// TestPostArchiveStreamedNameCollision tests the name collision policies
+// with streamed uploads
+func TestPostArchiveStreamedNameCollision(t *testing.T) {
+	post := func(
+		t *testing.T,
+		policy config.NameCollision,
+	) (*setup.TestSetup, *http.Response) {
+		ts := setup.New(t, streamedConfig(0, 0))
+
+		req := newfileUploadRequest(t, collidingFiles()...)
+		req.URL.Path = "/archive"
+		req.URL.RawQuery = api.QueryNameCollision + "=" + string(policy)
+		return ts, ts.Guest().Do(req)
+	}
+
+	t.Run("Rename", func(t *testing.T) {
+		ts, resp := post(t, config.NameCollisionRename)
+		defer ts.Teardown()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		actual, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		expected := collidingFiles()
+		expected[1].Name = "foo (1).txt"
+		checkFiles(ts, expected, actual)
+		checkArchive(ts, resp, actual)
+	})
+
+	// Reject tests rejecting a colliding name. Small files are still
+	// buffered by the archive writer so the client error can be responded
+	t.Run("Reject", func(t *testing.T) {
+		ts, resp := post(t, config.NameCollisionReject)
+		defer ts.Teardown()
+
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		str := ts.APIServer().Store().(*mockstore.Store)
+		require.Len(t, str.SavedArchives(), 0)
+		require.Equal(t, 0, str.UncommittedFiles())
+	})
+
+	// Overwrite tests whether overwriting is refused
+	// because already written entries can't be replaced
+	t.Run("Overwrite", func(t *testing.T) {
+		ts, resp := post(t, config.NameCollisionOverwrite)
+		defer ts.Teardown()
+
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+// TestPostArchiveStreamedErr tests POST /archive errors
+// with streamed uploads
+func TestPostArchiveStreamedErr(t *testing.T) {
+	// NoFiles tests sending an empty multipart/form-data request
+	t.Run("NoFiles", func(t *testing.T) {
+		ts := setup.New(t, streamedConfig(0, 0))
+		defer ts.Teardown()
+
+		req := newfileUploadRequest(t)
+		req.URL.Path = "/archive"
+		resp := ts.Guest().Do(req)
+
+		requireProblem(t, resp, http.StatusBadRequest, api.CodeMissingFiles)
+	})
+
+	// FileTooBig tests sending a file exceeding the file-size limit
+	t.Run("FileTooBig", func(t *testing.T) {
+		ts := setup.New(t, streamedConfig(1024, 2048))
+		defer ts.Teardown()
+
+		req := newfileUploadRequest(t, File{
+			Name:     "toolarge.txt",
+			Contents: make([]byte, 1025),
+		})
+		req.URL.Path = "/archive"
+		resp := ts.Guest().Do(req)
+
+		problem := requireProblem(
+			t,
+			resp,
+			http.StatusRequestEntityTooLarge,
+			api.CodeFileTooLarge,
+		)
+		require.Equal(t, "toolarge.txt", problem.Field)
+		require.Equal(t, uint64(1024), problem.Limit)
+	})
+
+	// ReqTooBig tests sending a request exceeding the req-size limit
+	t.Run("ReqTooBig", func(t *testing.T) {
+		ts := setup.New(t, streamedConfig(1024, 2048))
+		defer ts.Teardown()
+
+		req := newfileUploadRequest(t, File{
+			Name:     "first.txt",
+			Contents: make([]byte, 1024),
+		}, File{
+			Name:     "second.txt",
+			Contents: make([]byte, 1024),
+		}, File{
+			Name:     "third.txt",
+			Contents: make([]byte, 1024),
+		})
+		req.URL.Path = "/archive"
+		resp := ts.Guest().Do(req)
+
+		requireProblem(
+			t,
+			resp,
+			http.StatusRequestEntityTooLarge,
+			api.CodeRequestTooLarge,
+		)
+	})
+
+	// FileTooBigMidStream tests sending a file exceeding the file-size limit
+	// after the archive was partially written to the response
+	t.Run("FileTooBigMidStream", func(t *testing.T) {
+		ts := setup.New(t, streamedConfig(64*1024, 1024*1024))
+		defer ts.Teardown()
+
+		// Random contents are incompressible
+		first := make([]byte, 64*1024)
+		_, err := rand.Read(first)
+		require.NoError(t, err)
+
+		req := newfileUploadRequest(t, File{
+			Name:     "first.bin",
+			Contents: first,
+		}, File{
+			Name:     "toolarge.bin",
+			Contents: make([]byte, 64*1024+1),
+		})
+		req.URL.Path = "/archive"
+		resp := ts.Guest().Do(req)
+
+		// The failure is reported in the trailer
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		_, err = ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(
+			t,
+			"file 'toolarge.bin' exceeds max file size (65536)",
+			resp.Trailer.Get(api.HeaderArchiveError),
+		)
+
+		// Files saved before the failure are removed again
+		str := ts.APIServer().Store().(*mockstore.Store)
+		require.Len(t, str.SavedArchives(), 0)
+		require.Equal(t, 0, str.UncommittedFiles())
+	})
+}
+
+// failingArchiveStore fails to save archives
+type failingArchiveStore struct {
+	*mockstore.Store
+}
+
+func (str failingArchiveStore) SaveArchive(
+	ctx context.Context,
+	archive store.Archive,
+) error {
+	return errors.New("store unavailable")
+}
+
+// TestPostArchiveStreamedInternalErr tests POST /archive
+// reporting internal errors after the archive was partially written
+// to the response and logging them once
+func TestPostArchiveStreamedInternalErr(t *testing.T) {
+	logs := new(bytes.Buffer)
+	conf := streamedConfig(0, 0)
+	conf.Store = failingArchiveStore{new(mockstore.Store)}
+	conf.ErrorLog = log.New(logs, "", 0)
+	ts := setup.New(t, conf)
+	defer ts.Teardown()
+
+	req := newfileUploadRequest(t, File{
+		Name:     "foo.txt",
+		Contents: []byte("foo foo foo"),
+	})
+	req.URL.Path = "/archive"
+	resp := ts.Guest().Do(req)
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		http.StatusText(http.StatusInternalServerError),
+		resp.Trailer.Get(api.HeaderArchiveError),
+	)
+	require.Equal(t, 1, strings.Count(logs.String(), "\n"))
+	require.Contains(t, logs.String(), "store unavailable")
+}
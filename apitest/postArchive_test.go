@@ -3,17 +3,22 @@ package apitest
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"strings"
 	"testing"
 
+	"github.com/romshark/zipapi/api"
 	"github.com/romshark/zipapi/api/config"
 	"github.com/romshark/zipapi/apitest/setup"
 	"github.com/romshark/zipapi/store"
 	mockstore "github.com/romshark/zipapi/store/mock"
+	"github.com/romshark/zipapi/store/storetest"
 
 	"github.com/stretchr/testify/require"
 )
@@ -22,18 +27,25 @@ type File struct {
 	Name     string
 	Contents []byte
 	Params   map[string]string
+
+	// Field defines the form field name, defaults to Name
+	Field string
 }
 
 // Creates a new file upload http request with optional extra params
 func newfileUploadRequest(
-	t *testing.T,
+	t testing.TB,
 	files ...File,
 ) *http.Request {
 	body := new(bytes.Buffer)
 	writer := multipart.NewWriter(body)
 
 	for _, fl := range files {
-		part, err := writer.CreateFormFile(fl.Name, fl.Name)
+		field := fl.Field
+		if field == "" {
+			field = fl.Name
+		}
+		part, err := writer.CreateFormFile(field, fl.Name)
 		require.NoError(t, err)
 		_, err = io.Copy(part, bytes.NewBuffer(fl.Contents))
 		require.NoError(t, err)
@@ -75,6 +87,12 @@ func checkFiles(
 	for _, expectedFile := range expectedFiles {
 		actualFile := findFile(expectedFile)
 		require.NotNil(t, actualFile)
+		require.Equal(t, int64(len(expectedFile.Contents)), actualFile.Size)
+		require.Equal(
+			t,
+			string(expectedFile.Contents),
+			storetest.ReadFile(t, str, actualFile.ID),
+		)
 	}
 
 	// Unarchive files
@@ -108,6 +126,32 @@ func checkFiles(
 	}
 }
 
+func checkArchive(
+	ts *setup.TestSetup,
+	resp *http.Response,
+	actualArchive []byte,
+) {
+	t := ts.T()
+
+	str := ts.APIServer().Store().(*mockstore.Store)
+	savedArchives := str.SavedArchives()
+
+	// Make sure the archive was recorded
+	require.Len(t, savedArchives, 1)
+	archive := savedArchives[0]
+	require.NotEmpty(t, archive.ID)
+	require.Equal(t, archive.ID, resp.Header.Get(api.HeaderArchiveID))
+	require.Equal(t, int64(len(actualArchive)), archive.Size)
+	checksum := sha256.Sum256(actualArchive)
+	require.Equal(t, hex.EncodeToString(checksum[:]), archive.Checksum)
+	require.Equal(
+		t,
+		string(actualArchive),
+		storetest.ReadFile(t, str, archive.ContentsID),
+	)
+	require.Equal(t, 0, str.UncommittedFiles())
+}
+
 // TestPostArchive tests POST /archive sending 2 .txt files
 func TestPostArchive(t *testing.T) {
 	ts := setup.New(t, nil)
@@ -136,6 +180,121 @@ func TestPostArchive(t *testing.T) {
 	require.NoError(t, err)
 
 	checkFiles(ts, files, actual)
+	checkArchive(ts, resp, actual)
+}
+
+// TestPostArchiveMultipleFilesPerField tests POST /archive
+// sending multiple files under the same form field name
+func TestPostArchiveMultipleFilesPerField(t *testing.T) {
+	ts := setup.New(t, nil)
+	defer ts.Teardown()
+
+	files := []File{
+		File{
+			Field:    "files",
+			Name:     "foo.txt",
+			Contents: []byte("foo foo foo"),
+		}, File{
+			Field:    "files",
+			Name:     "bar.txt",
+			Contents: []byte("bar bar bar bar"),
+		}, File{
+			Field:    "other",
+			Name:     "baz.txt",
+			Contents: []byte("baz"),
+		},
+	}
+
+	req := newfileUploadRequest(t, files...)
+	req.URL.Path = "/archive"
+	resp := ts.Guest().Do(req)
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	actual, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	checkFiles(ts, files, actual)
+	checkArchive(ts, resp, actual)
+}
+
+// collidingFiles returns 3 files of which the last 2 have the same name
+func collidingFiles() []File {
+	return []File{
+		File{
+			Field:    "files",
+			Name:     "foo.txt",
+			Contents: []byte("first"),
+		}, File{
+			Field:    "files",
+			Name:     "foo.txt",
+			Contents: []byte("second"),
+		}, File{
+			Field:    "files",
+			Name:     "bar.txt",
+			Contents: []byte("third"),
+		},
+	}
+}
+
+// TestPostArchiveNameCollision tests the name collision policies
+func TestPostArchiveNameCollision(t *testing.T) {
+	post := func(
+		t *testing.T,
+		conf *config.Config,
+		policy config.NameCollision,
+		expected []File,
+	) {
+		ts := setup.New(t, conf)
+		defer ts.Teardown()
+
+		req := newfileUploadRequest(t, collidingFiles()...)
+		req.URL.Path = "/archive"
+		if policy != "" {
+			req.URL.RawQuery = api.QueryNameCollision + "=" + string(policy)
+		}
+		resp := ts.Guest().Do(req)
+
+		if expected == nil {
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			str := ts.APIServer().Store().(*mockstore.Store)
+			require.Len(t, str.SavedArchives(), 0)
+			return
+		}
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		actual, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		checkFiles(ts, expected, actual)
+		checkArchive(ts, resp, actual)
+	}
+
+	renamed := collidingFiles()
+	renamed[1].Name = "foo (1).txt"
+
+	t.Run("RejectByDefault", func(t *testing.T) {
+		post(t, nil, "", nil)
+	})
+	t.Run("Reject", func(t *testing.T) {
+		post(t, &config.Config{App: config.App{
+			NameCollision: config.NameCollisionRename,
+		}}, config.NameCollisionReject, nil)
+	})
+	t.Run("Rename", func(t *testing.T) {
+		post(t, nil, config.NameCollisionRename, renamed)
+	})
+	t.Run("RenameByConfig", func(t *testing.T) {
+		post(t, &config.Config{App: config.App{
+			NameCollision: config.NameCollisionRename,
+		}}, "", renamed)
+	})
+	t.Run("Overwrite", func(t *testing.T) {
+		post(t, nil, config.NameCollisionOverwrite, collidingFiles()[1:])
+	})
+	t.Run("UnknownPolicy", func(t *testing.T) {
+		post(t, nil, "unknown", nil)
+	})
 }
 
 // TestPostArchiveErr tests POST /archive errors
@@ -144,7 +303,7 @@ func TestPostArchiveErr(t *testing.T) {
 	t.Run("NonMultipart", func(t *testing.T) {
 		mimeTypes := []string{
 			"",
-			"application/json",
+			"application/xml",
 			"text/plain",
 			"image/jpeg",
 		}
@@ -164,11 +323,53 @@ func TestPostArchiveErr(t *testing.T) {
 				req.URL.Path = "/archive"
 				resp := ts.Guest().Do(req)
 
-				require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+				requireProblem(
+					t,
+					resp,
+					http.StatusUnsupportedMediaType,
+					api.CodeUnsupportedMediaType,
+				)
 			})
 		}
 	})
 
+	// Malformed tests sending malformed multipart/form-data bodies
+	t.Run("Malformed", func(t *testing.T) {
+		for name, body := range map[string]string{
+			"Garbage": "garbage",
+			"Truncated": "--boundary\r\n" +
+				"Content-Disposition: form-data; name=\"comment\"\r\n" +
+				"\r\n" +
+				"truncated",
+		} {
+			for mode, conf := range uploadModes() {
+				t.Run(name+"/"+mode, func(t *testing.T) {
+					ts := setup.New(t, conf())
+					defer ts.Teardown()
+
+					req, err := http.NewRequest(
+						"POST",
+						"/archive",
+						strings.NewReader(body),
+					)
+					require.NoError(t, err)
+					req.Header.Set(
+						"Content-Type",
+						"multipart/form-data; boundary=boundary",
+					)
+					resp := ts.Guest().Do(req)
+
+					requireProblem(
+						t,
+						resp,
+						http.StatusBadRequest,
+						api.CodeMalformedRequest,
+					)
+				})
+			}
+		}
+	})
+
 	// NoFiles tests sending an empty multipart/form-data request
 	t.Run("NoFiles", func(t *testing.T) {
 		ts := setup.New(t, nil)
@@ -181,7 +382,7 @@ func TestPostArchiveErr(t *testing.T) {
 		req.URL.Path = "/archive"
 		resp := ts.Guest().Do(req)
 
-		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		requireProblem(t, resp, http.StatusBadRequest, api.CodeMissingFiles)
 	})
 
 	// FileTooBig tests sending a file exceeding the file-size limit
@@ -206,7 +407,14 @@ func TestPostArchiveErr(t *testing.T) {
 		req.URL.Path = "/archive"
 		resp := ts.Guest().Do(req)
 
-		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		problem := requireProblem(
+			t,
+			resp,
+			http.StatusRequestEntityTooLarge,
+			api.CodeFileTooLarge,
+		)
+		require.Equal(t, "toolarge.txt", problem.Field)
+		require.Equal(t, conf.App.MaxFileSize, problem.Limit)
 	})
 
 	// ReqTooBig tests sending a request exceeding the req-size limit
@@ -237,6 +445,44 @@ func TestPostArchiveErr(t *testing.T) {
 		req.URL.Path = "/archive"
 		resp := ts.Guest().Do(req)
 
-		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		problem := requireProblem(
+			t,
+			resp,
+			http.StatusRequestEntityTooLarge,
+			api.CodeRequestTooLarge,
+		)
+		require.Equal(t, conf.App.MaxReqSize, problem.Limit)
 	})
 }
+
+// TestPostArchiveInjectedStore tests POST /archive using a store
+// injected through the configuration
+func TestPostArchiveInjectedStore(t *testing.T) {
+	str := new(mockstore.Store)
+	ts := setup.New(t, &config.Config{Store: str})
+	defer ts.Teardown()
+
+	require.Equal(t, str, ts.APIServer().Store())
+
+	files := []File{
+		File{
+			Name:     "foo.txt",
+			Contents: []byte("foo foo foo"),
+		},
+	}
+
+	// Prepare input files
+	req := newfileUploadRequest(t, files...)
+
+	// Make request
+	req.URL.Path = "/archive"
+	resp := ts.Guest().Do(req)
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	actual, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	checkFiles(ts, files, actual)
+	require.Len(t, str.SavedFiles(), 1)
+}
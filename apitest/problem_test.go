@@ -0,0 +1,126 @@
+package apitest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/romshark/zipapi/api"
+	"github.com/romshark/zipapi/apitest/setup"
+
+	"github.com/stretchr/testify/require"
+)
+
+// requireProblem makes sure the response is a problem
+// of the given status and code and returns it
+func requireProblem(
+	t *testing.T,
+	resp *http.Response,
+	status int,
+	code api.ErrorCode,
+) api.Problem {
+	require.Equal(t, status, resp.StatusCode)
+	require.Equal(t, api.ContentTypeProblem, resp.Header.Get("Content-Type"))
+
+	var problem api.Problem
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&problem))
+	require.Equal(t, "about:blank", problem.Type)
+	require.Equal(t, http.StatusText(status), problem.Title)
+	require.Equal(t, status, problem.Status)
+	require.Equal(t, code, problem.Code)
+	return problem
+}
+
+// TestProblem tests responding with problems
+// naming the offending field
+func TestProblem(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		query  string
+		accept string
+		parts  []formPart
+		status int
+		code   api.ErrorCode
+		field  string
+	}{
+		{"NotAcceptable", "", "text/html", []formPart{compressibleFile()},
+			http.StatusNotAcceptable, api.CodeNotAcceptable, "Accept"},
+		{"InvalidFormat", "format=7z", "", []formPart{compressibleFile()},
+			http.StatusBadRequest, api.CodeInvalidParameter, api.ParamFormat},
+		{"InvalidLevel", "", "", []formPart{
+			{field: api.ParamLevel, value: "max"},
+			compressibleFile(),
+		}, http.StatusBadRequest, api.CodeInvalidParameter, api.ParamLevel},
+		{"InvalidPolicy", api.QueryNameCollision + "=unknown", "",
+			[]formPart{compressibleFile()}, http.StatusBadRequest,
+			api.CodeInvalidParameter, api.QueryNameCollision},
+		{"InvalidManifest", "", "", []formPart{
+			{field: api.FormFieldManifest, value: "{"},
+			compressibleFile(),
+		}, http.StatusBadRequest, api.CodeInvalidManifest, api.FormFieldManifest},
+		{"InvalidPath", "", "", []formPart{
+			{field: "files", fileName: "../escape.txt", value: "escape"},
+		}, http.StatusBadRequest, api.CodeInvalidPath, ""},
+		{"NameCollision", "", "", []formPart{
+			{field: "files", fileName: "foo.txt", value: "foo"},
+			{field: "files", fileName: "foo.txt", value: "bar"},
+		}, http.StatusBadRequest, api.CodeNameCollision, ""},
+		{"PathConflict", "", "", []formPart{
+			{field: "files", fileName: "foo", value: "foo"},
+			{field: "files", fileName: "foo/bar.txt", value: "bar"},
+		}, http.StatusBadRequest, api.CodePathConflict, ""},
+		{"MissingFiles", "", "", []formPart{
+			{field: api.ParamFormat, value: "zip"},
+		}, http.StatusBadRequest, api.CodeMissingFiles, ""},
+	} {
+		for mode, conf := range uploadModes() {
+			t.Run(tc.name+"/"+mode, func(t *testing.T) {
+				ts := setup.New(t, conf())
+				defer ts.Teardown()
+
+				req := newFormRequest(t, tc.parts...)
+				req.URL.RawQuery = tc.query
+				if tc.accept != "" {
+					req.Header.Set("Accept", tc.accept)
+				}
+				resp := ts.Guest().Do(req)
+				problem := requireProblem(t, resp, tc.status, tc.code)
+				require.Equal(t, tc.field, problem.Field)
+				require.NotEmpty(t, problem.Detail)
+			})
+		}
+	}
+}
+
+// TestProblemMetadataLimit tests responding with a problem
+// carrying the exceeded comment length
+func TestProblemMetadataLimit(t *testing.T) {
+	ts := setup.New(t, nil)
+	defer ts.Teardown()
+
+	req := newFormRequest(t,
+		formPart{field: api.FormFieldComment, value: strings.Repeat("c", 1<<16)},
+		compressibleFile(),
+	)
+	resp := ts.Guest().Do(req)
+	problem := requireProblem(
+		t,
+		resp,
+		http.StatusBadRequest,
+		api.CodeInvalidMetadata,
+	)
+	require.Equal(t, uint64(0xffff), problem.Limit)
+}
+
+// TestProblemNotFound tests responding with a problem
+// to requests for unknown endpoints
+func TestProblemNotFound(t *testing.T) {
+	ts := setup.New(t, nil)
+	defer ts.Teardown()
+
+	req, err := http.NewRequest("GET", "", nil)
+	require.NoError(t, err)
+	req.URL.Path = "/unknown"
+	requireProblem(t, ts.Guest().Do(req), http.StatusNotFound, api.CodeNotFound)
+}
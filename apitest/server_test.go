@@ -0,0 +1,104 @@
+package apitest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/romshark/zipapi/api"
+	"github.com/romshark/zipapi/api/config"
+	boltstore "github.com/romshark/zipapi/store/bolt"
+
+	"github.com/stretchr/testify/require"
+)
+
+// requireStoreReleased makes sure the bolt database
+// isn't locked by a server anymore
+func requireStoreReleased(t *testing.T, path string) {
+	str := boltstore.New(boltstore.Options{Path: path})
+	require.NoError(t, str.Init())
+	require.NoError(t, str.Close())
+}
+
+// TestNewServerErr tests the server setup
+// releasing the store when it fails
+func TestNewServerErr(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		uploadDir func(dir string) string
+		host      string
+	}{
+		{"UploadDir", func(dir string) string {
+			// A regular file can't contain the upload directory
+			file := filepath.Join(dir, "file")
+			require.NoError(t, ioutil.WriteFile(file, nil, 0600))
+			return filepath.Join(file, "uploads")
+		}, "localhost:"},
+		{"Listener", func(dir string) string {
+			return filepath.Join(dir, "uploads")
+		}, "256.256.256.256:0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "zipapi.db")
+			conf := &config.Config{
+				Mode:          config.ModeDebug,
+				TransportHTTP: &config.TransportHTTP{Host: tc.host},
+				Store:         boltstore.New(boltstore.Options{Path: path}),
+			}
+			conf.App.UploadDir = tc.uploadDir(dir)
+
+			srv, err := api.NewServer(conf)
+			require.Error(t, err)
+			require.Nil(t, srv)
+			requireStoreReleased(t, path)
+		})
+	}
+}
+
+// TestShutdownTimeout tests the server shutdown
+// releasing the store even if the server doesn't shut down gracefully
+func TestShutdownTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zipapi.db")
+	srv, err := api.NewServer(&config.Config{
+		Mode:          config.ModeDebug,
+		TransportHTTP: &config.TransportHTTP{Host: "localhost:"},
+		Store:         boltstore.New(boltstore.Options{Path: path}),
+	})
+	require.NoError(t, err)
+	stopped := make(chan error, 1)
+	go func() { stopped <- srv.Run() }()
+
+	// Keep a request pending by never sending its body
+	conn, err := net.Dial("tcp", srv.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(
+		conn,
+		"POST /archive HTTP/1.1\r\n"+
+			"Host: %s\r\n"+
+			"Content-Type: multipart/form-data; boundary=x\r\n"+
+			"Content-Length: 1024\r\n"+
+			"Expect: 100-continue\r\n\r\n",
+		srv.Addr(),
+	)
+	require.NoError(t, err)
+
+	// The server continues once the handler reads the body
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusContinue, resp.StatusCode)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = srv.Shutdown(ctx)
+	require.True(t, errors.Is(err, context.Canceled), "unexpected error: %v", err)
+	require.NoError(t, <-stopped)
+	requireStoreReleased(t, path)
+}
@@ -13,19 +13,19 @@ import (
 
 // TestSetup represents the Dgraph-based server setup of an individual test
 type TestSetup struct {
-	t         *testing.T
+	t         testing.TB
 	apiServer api.Server
 	shutdown  chan struct{}
 }
 
-// T returns the test reference
-func (ts *TestSetup) T() *testing.T { return ts.t }
+// T returns the test or benchmark reference
+func (ts *TestSetup) T() testing.TB { return ts.t }
 
 // APIServer returns the API server interface
 func (ts *TestSetup) APIServer() api.Server { return ts.apiServer }
 
-// New creates a new test setup
-func New(t *testing.T, conf *config.Config) *TestSetup {
+// New creates a new test or benchmark setup
+func New(t testing.TB, conf *config.Config) *TestSetup {
 	if conf == nil {
 		conf = &config.Config{}
 	}
@@ -0,0 +1,398 @@
+package apitest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/romshark/zipapi/api"
+	"github.com/romshark/zipapi/api/config"
+	"github.com/romshark/zipapi/apitest/setup"
+	mockstore "github.com/romshark/zipapi/store/mock"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTusRequest creates a new tus protocol request
+func newTusRequest(
+	t *testing.T,
+	method string,
+	path string,
+	body io.Reader,
+) *http.Request {
+	req, err := http.NewRequest(method, "", body)
+	require.NoError(t, err)
+	req.URL.Path = path
+	req.Header.Set(api.HeaderTusResumable, api.TusVersion)
+	return req
+}
+
+// createUpload creates a new resumable upload returning its ID
+func createUpload(ts *setup.TestSetup, name string, length int) string {
+	t := ts.T().(*testing.T)
+
+	req := newTusRequest(t, http.MethodPost, "/uploads", nil)
+	req.Header.Set(api.HeaderUploadLength, strconv.Itoa(length))
+	req.Header.Set(
+		api.HeaderUploadMetadata,
+		api.UploadMetadataFileName+" "+
+			base64.StdEncoding.EncodeToString([]byte(name)),
+	)
+	resp := ts.Guest().Do(req)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, api.TusVersion, resp.Header.Get(api.HeaderTusResumable))
+	require.NotEmpty(t, resp.Header.Get(api.HeaderUploadExpires))
+
+	location := resp.Header.Get("Location")
+	require.True(t, strings.HasPrefix(location, "/uploads/"))
+	return strings.TrimPrefix(location, "/uploads/")
+}
+
+// newPatchRequest creates a new request appending chunk
+// to the upload identified by the given ID at the given offset
+func newPatchRequest(
+	t *testing.T,
+	uploadID string,
+	offset int,
+	chunk string,
+) *http.Request {
+	req := newTusRequest(
+		t,
+		http.MethodPatch,
+		"/uploads/"+uploadID,
+		strings.NewReader(chunk),
+	)
+	req.Header.Set("Content-Type", api.ContentTypeOffsetStream)
+	req.Header.Set(api.HeaderUploadOffset, strconv.Itoa(offset))
+	return req
+}
+
+// patchUpload appends chunk to the upload identified by the given ID
+func patchUpload(ts *setup.TestSetup, uploadID string, offset int, chunk string) {
+	t := ts.T().(*testing.T)
+
+	resp := ts.Guest().Do(newPatchRequest(t, uploadID, offset, chunk))
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(
+		t,
+		strconv.Itoa(offset+len(chunk)),
+		resp.Header.Get(api.HeaderUploadOffset),
+	)
+}
+
+// headUpload returns the response to a HEAD request
+// for the upload identified by the given ID
+func headUpload(ts *setup.TestSetup, uploadID string) *http.Response {
+	t := ts.T().(*testing.T)
+	return ts.Guest().Do(
+		newTusRequest(t, http.MethodHead, "/uploads/"+uploadID, nil),
+	)
+}
+
+// newUploadArchiveRequest creates a new request archiving
+// the resumable uploads
+func newUploadArchiveRequest(
+	t *testing.T,
+	archiveRequest api.UploadArchiveRequest,
+) *http.Request {
+	body, err := json.Marshal(archiveRequest)
+	require.NoError(t, err)
+	req, err := http.NewRequest("POST", "", bytes.NewReader(body))
+	require.NoError(t, err)
+	req.URL.Path = "/archive"
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// TestTusOptions tests OPTIONS /uploads
+func TestTusOptions(t *testing.T) {
+	ts := setup.New(t, &config.Config{App: config.App{MaxFileSize: 2048}})
+	defer ts.Teardown()
+
+	req, err := http.NewRequest(http.MethodOptions, "", nil)
+	require.NoError(t, err)
+	req.URL.Path = "/uploads"
+	resp := ts.Guest().Do(req)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, api.TusVersion, resp.Header.Get(api.HeaderTusResumable))
+	require.Equal(t, api.TusVersion, resp.Header.Get(api.HeaderTusVersion))
+	require.Equal(t, api.TusExtensions, resp.Header.Get(api.HeaderTusExtension))
+	require.Equal(t, "2048", resp.Header.Get(api.HeaderTusMaxSize))
+}
+
+// TestTusUpload tests uploading files in chunks
+// and archiving the finished uploads
+func TestTusUpload(t *testing.T) {
+	ts := setup.New(t, nil)
+	defer ts.Teardown()
+
+	fooID := createUpload(ts, "foo.txt", len("foo foo foo"))
+	barID := createUpload(ts, "bar.txt", len("bar bar bar bar"))
+
+	resp := headUpload(ts, fooID)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "0", resp.Header.Get(api.HeaderUploadOffset))
+	require.Equal(t, "11", resp.Header.Get(api.HeaderUploadLength))
+	require.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+	// Resume the upload at the offset reported by HEAD
+	patchUpload(ts, fooID, 0, "foo ")
+	resp = headUpload(ts, fooID)
+	require.Equal(t, "4", resp.Header.Get(api.HeaderUploadOffset))
+	patchUpload(ts, fooID, 4, "foo foo")
+	patchUpload(ts, barID, 0, "bar bar bar bar")
+
+	resp = ts.Guest().Do(newUploadArchiveRequest(t, api.UploadArchiveRequest{
+		Uploads: []string{fooID, barID},
+		UploadManifest: api.UploadManifest{
+			Files: map[string]api.UploadManifestFile{
+				"bar.txt": {Path: "docs/bar.txt", Comment: "bar"},
+			},
+			Directories: []string{"empty"},
+		},
+	}))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	actual, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"foo.txt":      "foo foo foo",
+		"docs/bar.txt": "bar bar bar bar",
+		"empty/":       "",
+	}, readEntries(t, actual))
+	checkArchive(ts, resp, actual)
+
+	// Archived uploads are removed
+	require.Equal(t, http.StatusNotFound, headUpload(ts, fooID).StatusCode)
+	require.Equal(t, http.StatusNotFound, headUpload(ts, barID).StatusCode)
+}
+
+// TestTusUploadAsync tests archiving finished uploads asynchronously
+func TestTusUploadAsync(t *testing.T) {
+	ts := setup.New(t, nil)
+	defer ts.Teardown()
+
+	uploadID := createUpload(ts, "foo.txt", len("foo foo foo"))
+	patchUpload(ts, uploadID, 0, "foo foo foo")
+
+	req := newUploadArchiveRequest(t, api.UploadArchiveRequest{
+		Uploads: []string{uploadID},
+	})
+	req.URL.RawQuery = api.ParamAsync + "=1"
+	resp := ts.Guest().Do(req)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	var accepted api.JobInfo
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&accepted))
+
+	job := awaitJob(ts, accepted.ID)
+	require.Equal(
+		t,
+		map[string]string{"foo.txt": "foo foo foo"},
+		readEntries(t, downloadResult(ts, job)),
+	)
+	require.Equal(t, http.StatusNotFound, headUpload(ts, uploadID).StatusCode)
+}
+
+// TestTusErr tests rejecting invalid tus requests
+func TestTusErr(t *testing.T) {
+	ts := setup.New(t, &config.Config{
+		App: config.App{MaxFileSize: 256, MaxReqSize: 512},
+	})
+	defer ts.Teardown()
+
+	uploadID := createUpload(ts, "foo.txt", 8)
+	patchUpload(ts, uploadID, 0, "foo ")
+
+	for _, tc := range []struct {
+		name   string
+		req    func() *http.Request
+		status int
+		code   api.ErrorCode
+		field  string
+	}{
+		{"MissingVersion", func() *http.Request {
+			req := newTusRequest(t, http.MethodPost, "/uploads", nil)
+			req.Header.Del(api.HeaderTusResumable)
+			return req
+		}, http.StatusPreconditionFailed, api.CodeUnsupportedVersion,
+			api.HeaderTusResumable},
+		{"InvalidLength", func() *http.Request {
+			req := newTusRequest(t, http.MethodPost, "/uploads", nil)
+			req.Header.Set(api.HeaderUploadLength, "-1")
+			return req
+		}, http.StatusBadRequest, api.CodeInvalidParameter,
+			api.HeaderUploadLength},
+		{"FileTooLarge", func() *http.Request {
+			req := newTusRequest(t, http.MethodPost, "/uploads", nil)
+			req.Header.Set(api.HeaderUploadLength, "257")
+			req.Header.Set(api.HeaderUploadMetadata, "filename Zm9v")
+			return req
+		}, http.StatusRequestEntityTooLarge, api.CodeFileTooLarge,
+			api.HeaderUploadLength},
+		{"MissingFileName", func() *http.Request {
+			req := newTusRequest(t, http.MethodPost, "/uploads", nil)
+			req.Header.Set(api.HeaderUploadLength, "4")
+			req.Header.Set(api.HeaderUploadMetadata, "type dGV4dA==")
+			return req
+		}, http.StatusBadRequest, api.CodeInvalidParameter,
+			api.HeaderUploadMetadata},
+		{"OffsetMismatch", func() *http.Request {
+			return newPatchRequest(t, uploadID, 0, "foo ")
+		}, http.StatusConflict, api.CodeOffsetMismatch,
+			api.HeaderUploadOffset},
+		{"UnsupportedMediaType", func() *http.Request {
+			req := newPatchRequest(t, uploadID, 4, "foo ")
+			req.Header.Set("Content-Type", "text/plain")
+			return req
+		}, http.StatusUnsupportedMediaType, api.CodeUnsupportedMediaType,
+			"Content-Type"},
+		{"UnknownUpload", func() *http.Request {
+			return newPatchRequest(t, "unknown", 0, "foo ")
+		}, http.StatusNotFound, api.CodeNotFound, ""},
+		{"Incomplete", func() *http.Request {
+			return newUploadArchiveRequest(t, api.UploadArchiveRequest{
+				Uploads: []string{uploadID},
+			})
+		}, http.StatusConflict, api.CodeUploadIncomplete, ""},
+		{"UnknownArchiveUpload", func() *http.Request {
+			return newUploadArchiveRequest(t, api.UploadArchiveRequest{
+				Uploads: []string{"unknown"},
+			})
+		}, http.StatusBadRequest, api.CodeInvalidParameter, api.FieldUploads},
+		{"MissingUploads", func() *http.Request {
+			return newUploadArchiveRequest(t, api.UploadArchiveRequest{})
+		}, http.StatusBadRequest, api.CodeMissingFiles, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			problem := requireProblem(
+				t,
+				ts.Guest().Do(tc.req()),
+				tc.status,
+				tc.code,
+			)
+			require.Equal(t, tc.field, problem.Field)
+		})
+	}
+
+	// The failed requests don't affect the upload
+	resp := headUpload(ts, uploadID)
+	require.Equal(t, "4", resp.Header.Get(api.HeaderUploadOffset))
+
+	// Chunks exceeding the upload length are truncated
+	resp = ts.Guest().Do(newPatchRequest(t, uploadID, 4, "foo foo"))
+	requireProblem(
+		t,
+		resp,
+		http.StatusRequestEntityTooLarge,
+		api.CodeFileTooLarge,
+	)
+	require.Equal(t, "8", resp.Header.Get(api.HeaderUploadOffset))
+
+	// The uploads of an archive must not exceed the max request size
+	otherIDs := []string{uploadID}
+	for i := 0; i < 2; i++ {
+		id := createUpload(ts, "other"+strconv.Itoa(i)+".txt", 256)
+		patchUpload(ts, id, 0, strings.Repeat("o", 256))
+		otherIDs = append(otherIDs, id)
+	}
+	problem := requireProblem(
+		t,
+		ts.Guest().Do(newUploadArchiveRequest(t, api.UploadArchiveRequest{
+			Uploads: otherIDs,
+		})),
+		http.StatusRequestEntityTooLarge,
+		api.CodeRequestTooLarge,
+	)
+	require.Equal(t, uint64(512), problem.Limit)
+
+	str := ts.APIServer().Store().(*mockstore.Store)
+	require.Len(t, str.SavedArchives(), 0)
+	require.Zero(t, str.UncommittedFiles())
+}
+
+// TestTusDelete tests terminating an upload
+func TestTusDelete(t *testing.T) {
+	ts := setup.New(t, nil)
+	defer ts.Teardown()
+
+	uploadID := createUpload(ts, "foo.txt", 8)
+	patchUpload(ts, uploadID, 0, "foo ")
+
+	resp := ts.Guest().Do(
+		newTusRequest(t, http.MethodDelete, "/uploads/"+uploadID, nil),
+	)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, http.StatusNotFound, headUpload(ts, uploadID).StatusCode)
+}
+
+// TestTusExpiration tests expiring unfinished uploads
+func TestTusExpiration(t *testing.T) {
+	ts := setup.New(t, &config.Config{
+		App: config.App{UploadExpiration: 100 * time.Millisecond},
+	})
+	defer ts.Teardown()
+
+	uploadID := createUpload(ts, "foo.txt", 8)
+	time.Sleep(150 * time.Millisecond)
+	require.Equal(t, http.StatusNotFound, headUpload(ts, uploadID).StatusCode)
+}
+
+// TestTusExpirationPurge tests removing the files
+// of expired uploads while no new uploads are created
+func TestTusExpirationPurge(t *testing.T) {
+	dir := t.TempDir()
+	ts := setup.New(t, &config.Config{App: config.App{
+		UploadDir:        dir,
+		UploadExpiration: 100 * time.Millisecond,
+	}})
+	defer ts.Teardown()
+
+	uploadID := createUpload(ts, "foo.txt", 8)
+	patchUpload(ts, uploadID, 0, "foo ")
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		entries, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		if len(entries) < 1 {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "upload not removed")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestTusResume tests resuming uploads after a server restart
+func TestTusResume(t *testing.T) {
+	dir := t.TempDir()
+
+	ts := setup.New(t, &config.Config{App: config.App{UploadDir: dir}})
+	uploadID := createUpload(ts, "foo.txt", len("foo foo foo"))
+	patchUpload(ts, uploadID, 0, "foo ")
+	ts.Teardown()
+
+	ts = setup.New(t, &config.Config{App: config.App{UploadDir: dir}})
+	defer ts.Teardown()
+
+	resp := headUpload(ts, uploadID)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "4", resp.Header.Get(api.HeaderUploadOffset))
+	patchUpload(ts, uploadID, 4, "foo foo")
+
+	resp = ts.Guest().Do(newUploadArchiveRequest(t, api.UploadArchiveRequest{
+		Uploads: []string{uploadID},
+	}))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	actual, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		map[string]string{"foo.txt": "foo foo foo"},
+		readEntries(t, actual),
+	)
+}
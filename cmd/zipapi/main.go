@@ -3,12 +3,22 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"time"
 
 	zipapi "github.com/romshark/zipapi/api"
 	"github.com/romshark/zipapi/api/config"
+	"github.com/romshark/zipapi/gc"
+
+	// Register store backends
+	"github.com/romshark/zipapi/store/bolt"
+	"github.com/romshark/zipapi/store/fs"
+	"github.com/romshark/zipapi/store/mock"
+
+	"github.com/pkg/errors"
 )
 
 var argConfigFile = flag.String(
@@ -17,6 +27,17 @@ var argConfigFile = flag.String(
 	"path to the configuration file",
 )
 
+func init() {
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [flags] [command]\n\n", os.Args[0])
+		fmt.Fprint(out, "Commands:\n")
+		fmt.Fprint(out, "  gc\tremove expired archives and jobs once and exit\n\n")
+		fmt.Fprint(out, "Flags:\n")
+		flag.PrintDefaults()
+	}
+}
+
 func main() {
 	flag.Parse()
 
@@ -25,6 +46,15 @@ func main() {
 		log.Fatalf("reading config: %s", err)
 	}
 
+	switch flag.Arg(0) {
+	case "":
+	case "gc":
+		collectGarbage(conf)
+		return
+	default:
+		log.Fatalf("unknown command: '%s'", flag.Arg(0))
+	}
+
 	api, err := zipapi.NewServer(conf)
 	if err != nil {
 		log.Fatalf("API server init: %s", err)
@@ -51,3 +81,35 @@ func onTerminate(callback func()) {
 		callback()
 	}()
 }
+
+// collectGarbage removes the archives and jobs violating
+// the retention policy once. It refuses to run
+// while the store is used by a running server
+func collectGarbage(conf *config.Config) {
+	policy := conf.Retention.Policy()
+	if !policy.Enabled() {
+		log.Fatal("gc: no retention policy defined")
+	}
+	if _, ok := conf.Store.(*mock.Store); ok {
+		log.Fatal("gc: the mock store isn't persistent")
+	}
+
+	collector := &gc.Collector{
+		Store:  conf.Store,
+		Policy: policy,
+		Log:    conf.DebugLog,
+	}
+	removed, err := collector.CollectOnce(context.Background(), time.Now())
+	switch errors.Cause(err) {
+	case nil:
+	case fs.ErrLocked, bolt.ErrLocked:
+		log.Fatal(
+			"gc: the store is used by a running server, " +
+				"which removes expired archives itself " +
+				"if store.retention.interval is set",
+		)
+	default:
+		log.Fatalf("gc: %s", err)
+	}
+	conf.DebugLog.Printf("gc: removed %d archives", len(removed))
+}
@@ -0,0 +1,211 @@
+// Package gc implements the archive garbage collector
+// enforcing the archive and job retention policy
+package gc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/romshark/zipapi/store"
+
+	"github.com/pkg/errors"
+)
+
+// queryPageSize defines the number of archives read per store query
+const queryPageSize = 1000
+
+// Policy defines the archive retention policy.
+// Zero values don't limit
+type Policy struct {
+	// MaxAge defines the maximum age of an archive
+	MaxAge time.Duration
+
+	// MaxTotalSize defines the maximum total size of all archives in bytes
+	// including the stored copies of their files,
+	// the oldest archives exceeding it are removed
+	MaxTotalSize uint64
+
+	// MaxCount defines the maximum number of archives,
+	// the oldest archives exceeding it are removed
+	MaxCount int
+
+	// MaxJobAge defines how long the records of finished jobs are kept,
+	// the archives they created are subject to the archive limits
+	MaxJobAge time.Duration
+}
+
+// Enabled returns true if the policy limits
+// the retention of archives or jobs
+func (p Policy) Enabled() bool {
+	return p.MaxAge > 0 ||
+		p.MaxTotalSize > 0 ||
+		p.MaxCount > 0 ||
+		p.MaxJobAge > 0
+}
+
+// Collector removes archives and jobs violating the retention policy
+// from the store
+type Collector struct {
+	Store  store.Store
+	Policy Policy
+
+	// Log logs the removed archives if not nil
+	Log *log.Logger
+}
+
+// expired returns the reason the archive violates the retention policy,
+// it's empty if it doesn't.
+// Newer archives are expected to be passed first
+func (c *Collector) expired(
+	now time.Time,
+	archive store.Archive,
+	count int,
+	totalSize uint64,
+) string {
+	switch {
+	case c.Policy.MaxAge > 0 && now.Sub(archive.Created) > c.Policy.MaxAge:
+		return fmt.Sprintf("older than %s", c.Policy.MaxAge)
+	case c.Policy.MaxCount > 0 && count > c.Policy.MaxCount:
+		return fmt.Sprintf("exceeds max count (%d)", c.Policy.MaxCount)
+	case c.Policy.MaxTotalSize > 0 && totalSize > c.Policy.MaxTotalSize:
+		return fmt.Sprintf(
+			"exceeds max total size (%d)",
+			c.Policy.MaxTotalSize,
+		)
+	}
+	return ""
+}
+
+// storedSize returns the number of bytes stored for the archive,
+// which keeps a copy of each of its files next to its contents
+func storedSize(archive store.Archive) uint64 {
+	size := uint64(archive.Size)
+	for _, fl := range archive.Files {
+		size += uint64(fl.Size)
+	}
+	return size
+}
+
+// Collect removes all archives and finished jobs violating
+// the retention policy at the given time and returns
+// the removed archive records
+func (c *Collector) Collect(
+	ctx context.Context,
+	now time.Time,
+) ([]store.Archive, error) {
+	if !c.Policy.Enabled() {
+		return nil, nil
+	}
+
+	// Determine the expired archives going from newest to oldest
+	var expired []store.Archive
+	var reasons []string
+	count, totalSize := 0, uint64(0)
+	query := store.ArchiveQuery{Limit: queryPageSize}
+	for {
+		page, err := c.Store.QueryArchives(ctx, query)
+		if err != nil {
+			return nil, errors.Wrap(err, "querying archives")
+		}
+		for _, archive := range page.Archives {
+			count++
+			totalSize += storedSize(archive)
+			reason := c.expired(now, archive, count, totalSize)
+			if reason == "" {
+				continue
+			}
+			expired = append(expired, archive)
+			reasons = append(reasons, reason)
+		}
+		if page.Cursor == "" {
+			break
+		}
+		query.Cursor = page.Cursor
+	}
+
+	// Remove expired archives
+	removed := make([]store.Archive, 0, len(expired))
+	for i, archive := range expired {
+		switch err := c.Store.DeleteArchive(ctx, archive.ID); err {
+		case nil:
+		case store.ErrNotFound:
+			// Removed concurrently
+			continue
+		default:
+			return removed, errors.Wrapf(
+				err,
+				"deleting archive %s",
+				archive.ID,
+			)
+		}
+		removed = append(removed, archive)
+		if c.Log != nil {
+			c.Log.Printf(
+				"gc: removed archive %s (created %s, %d bytes, %d files): %s",
+				archive.ID,
+				archive.Created.Format(time.RFC3339),
+				archive.Size,
+				len(archive.Files),
+				reasons[i],
+			)
+		}
+	}
+
+	if err := c.collectJobs(ctx, now); err != nil {
+		return removed, err
+	}
+	return removed, nil
+}
+
+// CollectOnce initializes the store, removes all archives and finished jobs
+// violating the retention policy at the given time and closes the store.
+// Persistent stores refuse to initialize while they're used
+// by a running server since its pending writes would be removed otherwise
+func (c *Collector) CollectOnce(
+	ctx context.Context,
+	now time.Time,
+) ([]store.Archive, error) {
+	if err := c.Store.Init(); err != nil {
+		return nil, errors.Wrap(err, "store preparation")
+	}
+	removed, err := c.Collect(ctx, now)
+	if closeErr := c.Store.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "closing store")
+	}
+	return removed, err
+}
+
+// collectJobs removes the records of the jobs
+// which finished longer than the max job age ago
+func (c *Collector) collectJobs(ctx context.Context, now time.Time) error {
+	if c.Policy.MaxJobAge <= 0 {
+		return nil
+	}
+
+	jobs, err := c.Store.FinishedJobs(ctx, now.Add(-c.Policy.MaxJobAge))
+	if err != nil {
+		return errors.Wrap(err, "querying finished jobs")
+	}
+	for _, job := range jobs {
+		switch err := c.Store.DeleteJob(ctx, job.ID); err {
+		case nil:
+		case store.ErrNotFound:
+			// Removed concurrently
+			continue
+		default:
+			return errors.Wrapf(err, "deleting job %s", job.ID)
+		}
+		if c.Log != nil {
+			c.Log.Printf(
+				"gc: removed job %s (%s, finished %s): older than %s",
+				job.ID,
+				job.Status,
+				job.Finished.Format(time.RFC3339),
+				c.Policy.MaxJobAge,
+			)
+		}
+	}
+	return nil
+}
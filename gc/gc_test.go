@@ -0,0 +1,194 @@
+package gc_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/romshark/zipapi/gc"
+	"github.com/romshark/zipapi/store"
+	"github.com/romshark/zipapi/store/fs"
+	"github.com/romshark/zipapi/store/mock"
+	"github.com/romshark/zipapi/store/storetest"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+var now = time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC)
+
+// setup creates a new store containing 5 archives of 100 bytes each
+// created 0 to 4 hours ago
+func setup(t *testing.T) *mock.Store {
+	str := new(mock.Store)
+	require.NoError(t, str.Init())
+	for i := 0; i < 5; i++ {
+		contents, err := str.SaveFile(
+			context.Background(),
+			store.File{Name: fmt.Sprintf("%d.zip", i)},
+			bytes.NewReader(make([]byte, 100)),
+		)
+		require.NoError(t, err)
+		require.NoError(t, str.SaveArchive(context.Background(), store.Archive{
+			ID:         fmt.Sprintf("%d", i),
+			Created:    now.Add(-time.Duration(i) * time.Hour),
+			ContentsID: contents.ID,
+			Size:       contents.Size,
+		}))
+	}
+	return str
+}
+
+func requireRemaining(t *testing.T, str *mock.Store, expected ...string) {
+	actual := make([]string, 0)
+	for _, archive := range str.SavedArchives() {
+		actual = append(actual, archive.ID)
+	}
+	require.ElementsMatch(t, expected, actual)
+}
+
+func TestCollect(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		policy    gc.Policy
+		remaining []string
+	}{
+		{"Disabled", gc.Policy{}, []string{"0", "1", "2", "3", "4"}},
+		{"MaxAge", gc.Policy{
+			MaxAge: 90 * time.Minute,
+		}, []string{"0", "1"}},
+		{"MaxCount", gc.Policy{
+			MaxCount: 3,
+		}, []string{"0", "1", "2"}},
+		{"MaxTotalSize", gc.Policy{
+			MaxTotalSize: 250,
+		}, []string{"0", "1"}},
+		{"Combined", gc.Policy{
+			MaxAge:       150 * time.Minute,
+			MaxCount:     4,
+			MaxTotalSize: 450,
+		}, []string{"0", "1", "2"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			str := setup(t)
+			collector := &gc.Collector{Store: str, Policy: tc.policy}
+
+			removed, err := collector.Collect(context.Background(), now)
+			require.NoError(t, err)
+			require.Len(t, removed, 5-len(tc.remaining))
+			requireRemaining(t, str, tc.remaining...)
+
+			// Make sure a subsequent collection removes nothing
+			removed, err = collector.Collect(context.Background(), now)
+			require.NoError(t, err)
+			require.Len(t, removed, 0)
+		})
+	}
+}
+
+// TestCollectMaxTotalSizeFiles tests counting the stored copies
+// of the archived files towards the max total size
+func TestCollectMaxTotalSizeFiles(t *testing.T) {
+	ctx := context.Background()
+	str := setup(t)
+	archive := storetest.NewArchive(t, str, storetest.File{
+		Name:     "foo.txt",
+		Contents: string(make([]byte, 150)),
+	})
+	archive.Created = now.Add(-30 * time.Minute)
+	require.NoError(t, str.SaveArchive(ctx, archive))
+	require.Equal(t, int64(40), archive.Size)
+
+	// The new archive takes 190 bytes including its file
+	collector := &gc.Collector{Store: str, Policy: gc.Policy{
+		MaxTotalSize: 450,
+	}}
+	removed, err := collector.Collect(ctx, now)
+	require.NoError(t, err)
+	require.Len(t, removed, 3)
+	requireRemaining(t, str, "0", archive.ID, "1")
+}
+
+func TestCollectJobs(t *testing.T) {
+	ctx := context.Background()
+	str := setup(t)
+	for i, status := range []store.JobStatus{
+		store.JobDone,
+		store.JobFailed,
+		store.JobDone,
+		store.JobRunning,
+	} {
+		job := store.Job{
+			ID:      fmt.Sprintf("job%d", i),
+			Created: now.Add(-time.Duration(i+1) * time.Hour),
+			Status:  status,
+		}
+		if status.Finished() {
+			job.Finished = now.Add(-time.Duration(i) * time.Hour)
+		}
+		require.NoError(t, str.SaveJob(ctx, job))
+	}
+
+	collector := &gc.Collector{Store: str, Policy: gc.Policy{
+		MaxJobAge: 90 * time.Minute,
+	}}
+	removed, err := collector.Collect(ctx, now)
+	require.NoError(t, err)
+	require.Len(t, removed, 0)
+	requireRemaining(t, str, "0", "1", "2", "3", "4")
+
+	// Only the jobs finished longer ago than the max job age are removed
+	for id, exists := range map[string]bool{
+		"job0": true,
+		"job1": true,
+		"job2": false,
+		"job3": true,
+	} {
+		_, err := str.Job(ctx, id)
+		if exists {
+			require.NoError(t, err, id)
+		} else {
+			require.Equal(t, store.ErrNotFound, err, id)
+		}
+	}
+}
+
+// TestCollectOnceLocked tests running the garbage collector once
+// while the store is used by a server with pending files
+func TestCollectOnceLocked(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+
+	server := fs.New(fs.Options{Root: root})
+	require.NoError(t, server.Init())
+	expired := storetest.NewArchive(t, server, storetest.File{
+		Name:     "foo.txt",
+		Contents: "foo",
+	})
+	require.NoError(t, server.SaveArchive(ctx, expired))
+	pending := storetest.SaveFile(t, server, storetest.File{
+		Name:     "pending.txt",
+		Contents: "pending",
+	})
+
+	collector := &gc.Collector{
+		Store:  fs.New(fs.Options{Root: root}),
+		Policy: gc.Policy{MaxAge: time.Hour},
+	}
+	_, err := collector.CollectOnce(ctx, time.Now())
+	require.Equal(t, fs.ErrLocked, errors.Cause(err))
+
+	// The store of the server is left untouched
+	require.Equal(t, "pending", storetest.ReadFile(t, server, pending.ID))
+	_, err = server.Archive(ctx, expired.ID)
+	require.NoError(t, err)
+
+	// The garbage collector runs once the server is stopped
+	require.NoError(t, server.Close())
+	removed, err := collector.CollectOnce(ctx, time.Now())
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	require.Equal(t, expired.ID, removed[0].ID)
+}
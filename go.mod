@@ -1,10 +1,20 @@
 module github.com/romshark/zipapi
 
-go 1.12
+go 1.22
 
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/c2h5oh/datasize v0.0.0-20171227191756-4eba002a5eae
+	github.com/klauspost/compress v1.18.0
 	github.com/pkg/errors v0.8.1
 	github.com/stretchr/testify v1.4.0
+	github.com/ulikunitz/xz v0.5.9
+	go.etcd.io/bbolt v1.3.6
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.0.0-20200923182605-d9f96fdee20d // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
@@ -0,0 +1,963 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/romshark/zipapi/store"
+
+	"github.com/pkg/errors"
+	bbolt "go.etcd.io/bbolt"
+)
+
+func init() {
+	store.Register("bolt", func(
+		decodeOptions store.OptionsDecoder,
+	) (store.Store, error) {
+		var opts Options
+		if err := decodeOptions(&opts); err != nil {
+			return nil, errors.Wrap(err, "decoding options")
+		}
+		return New(opts), nil
+	})
+}
+
+// chunkSize defines the maximum size of a file contents chunk
+const chunkSize = 256 * 1024
+
+// chunksPerTx defines the maximum number of chunks
+// written in a single transaction
+const chunksPerTx = 16
+
+var (
+	bucketArchives   = []byte("archives")
+	bucketArchiveIDs = []byte("archive-ids")
+
+	// bucketArchiveTimes indexes the archive records by their creation time,
+	// the keys consist of the creation time in nanoseconds
+	// followed by the archive ID
+	bucketArchiveTimes = []byte("archive-times")
+
+	// bucketFileArchives indexes the archive records by the IDs
+	// of their archived files
+	bucketFileArchives = []byte("file-archives")
+
+	// bucketFiles holds the sizes of all saved files under their IDs
+	bucketFiles = []byte("files")
+
+	// bucketPending holds the IDs of all uncommitted files
+	bucketPending = []byte("pending")
+
+	// bucketChunks holds the contents of the saved files split into chunks,
+	// the keys consist of the file ID followed by the chunk index
+	bucketChunks = []byte("chunks")
+
+	// bucketJobs holds the job records under their IDs
+	bucketJobs = []byte("jobs")
+)
+
+// ErrReadOnly is returned when trying to modify a read-only store
+var ErrReadOnly = errors.New("store is read-only")
+
+// ErrLocked is returned by Init if the database file is used
+// by another store instance, such as the one of a running server
+var ErrLocked = errors.New("store is locked by another instance")
+
+// Options represents the bolt store options
+type Options struct {
+	// Path defines the path to the database file
+	Path string `toml:"path"`
+
+	// ReadOnly opens the database in read-only mode
+	// which allows inspecting it while it's not used by a server
+	ReadOnly bool `toml:"read-only"`
+}
+
+// fileMeta represents the metadata of a stored file
+type fileMeta struct {
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Size        int64       `json:"size"`
+	UploadTime  time.Time   `json:"upload-time"`
+	ClientAgent string      `json:"client-agent"`
+	ModTime     time.Time   `json:"mtime"`
+	Mode        os.FileMode `json:"mode,omitempty"`
+	Comment     string      `json:"comment,omitempty"`
+	Checksum    string      `json:"checksum,omitempty"`
+}
+
+// newFileMeta returns the metadata of the given file
+func newFileMeta(fl store.File) fileMeta {
+	return fileMeta{
+		ID:          fl.ID,
+		Name:        fl.Name,
+		Size:        fl.Size,
+		UploadTime:  fl.Upload.Time,
+		ClientAgent: fl.Upload.ClientAgent,
+		ModTime:     fl.ModTime,
+		Mode:        fl.Mode,
+		Comment:     fl.Comment,
+		Checksum:    fl.Checksum,
+	}
+}
+
+// file returns the stored file
+func (fl fileMeta) file() store.File {
+	return store.File{
+		ID: fl.ID,
+		Upload: store.UploadInfo{
+			Time:        fl.UploadTime,
+			ClientAgent: fl.ClientAgent,
+		},
+		Name:     fl.Name,
+		Size:     fl.Size,
+		ModTime:  fl.ModTime,
+		Mode:     fl.Mode,
+		Comment:  fl.Comment,
+		Checksum: fl.Checksum,
+	}
+}
+
+// archiveMeta represents the metadata record of a stored archive
+type archiveMeta struct {
+	ID          string     `json:"id"`
+	Created     time.Time  `json:"created"`
+	ClientAgent string     `json:"client-agent"`
+	ContentsID  string     `json:"contents-id"`
+	Size        int64      `json:"size"`
+	Checksum    string     `json:"checksum"`
+	Format      string     `json:"format,omitempty"`
+	Encrypted   bool       `json:"encrypted,omitempty"`
+	Comment     string     `json:"comment,omitempty"`
+	Files       []fileMeta `json:"files"`
+}
+
+// jobMeta represents the record of an asynchronous archive job
+type jobMeta struct {
+	ID            string     `json:"id"`
+	Created       time.Time  `json:"created"`
+	ClientAgent   string     `json:"client-agent"`
+	Status        string     `json:"status"`
+	Format        string     `json:"format"`
+	Compression   string     `json:"compression"`
+	Level         int        `json:"level"`
+	Checksums     string     `json:"checksums,omitempty"`
+	Deterministic bool       `json:"deterministic,omitempty"`
+	ModTime       time.Time  `json:"mtime"`
+	Files         []fileMeta `json:"files"`
+	Directories   []string   `json:"directories,omitempty"`
+	Comment       string     `json:"comment,omitempty"`
+	Size          int64      `json:"size"`
+	ArchiveID     string     `json:"archive-id,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	Finished      time.Time  `json:"finished"`
+}
+
+func newJobMeta(job store.Job) jobMeta {
+	meta := jobMeta{
+		ID:            job.ID,
+		Created:       job.Created,
+		ClientAgent:   job.ClientAgent,
+		Status:        string(job.Status),
+		Format:        job.Options.Format,
+		Compression:   job.Options.Compression,
+		Level:         job.Options.Level,
+		Checksums:     job.Options.Checksums,
+		Deterministic: job.Options.Deterministic,
+		ModTime:       job.Options.ModTime,
+		Files:         make([]fileMeta, len(job.Files)),
+		Directories:   append([]string(nil), job.Directories...),
+		Comment:       job.Comment,
+		Size:          job.Size,
+		ArchiveID:     job.ArchiveID,
+		Error:         job.Error,
+		Finished:      job.Finished,
+	}
+	for i, fl := range job.Files {
+		meta.Files[i] = newFileMeta(fl)
+	}
+	return meta
+}
+
+// record returns the job record
+func (meta jobMeta) record() store.Job {
+	job := store.Job{
+		ID:          meta.ID,
+		Created:     meta.Created,
+		ClientAgent: meta.ClientAgent,
+		Status:      store.JobStatus(meta.Status),
+		Options: store.JobOptions{
+			Format:        meta.Format,
+			Compression:   meta.Compression,
+			Level:         meta.Level,
+			Checksums:     meta.Checksums,
+			Deterministic: meta.Deterministic,
+			ModTime:       meta.ModTime,
+		},
+		Files:       make([]store.File, len(meta.Files)),
+		Directories: append([]string(nil), meta.Directories...),
+		Comment:     meta.Comment,
+		Size:        meta.Size,
+		ArchiveID:   meta.ArchiveID,
+		Error:       meta.Error,
+		Finished:    meta.Finished,
+	}
+	for i, fl := range meta.Files {
+		job.Files[i] = fl.file()
+	}
+	return job
+}
+
+// Store represents a store implementation based on an embedded
+// single-file transactional bolt database.
+//
+// Archive records are kept under sequential keys preserving the order
+// of creation and are indexed by their IDs. File contents are written
+// in chunks, each in its own transaction, to keep memory usage bounded
+// and are marked pending until the archive or job record referencing them
+// is committed. Pending files are removed by Init
+type Store struct {
+	opts Options
+	db   *bbolt.DB
+}
+
+// New creates a new uninitialized bolt store instance
+func New(opts Options) *Store {
+	return &Store{opts: opts}
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// Init implements the Store interface.
+// Init opens the database file and creates it if it doesn't exist yet
+// unless the store is read-only
+func (str *Store) Init() error {
+	if str.opts.Path == "" {
+		return errors.New("missing database file path")
+	}
+
+	db, err := bbolt.Open(str.opts.Path, 0640, &bbolt.Options{
+		Timeout:  time.Second,
+		ReadOnly: str.opts.ReadOnly,
+	})
+	if err == bbolt.ErrTimeout {
+		return ErrLocked
+	} else if err != nil {
+		return errors.Wrap(err, "opening database")
+	}
+	str.db = db
+
+	if str.opts.ReadOnly {
+		return nil
+	}
+
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{
+			bucketArchives,
+			bucketArchiveIDs,
+			bucketArchiveTimes,
+			bucketFileArchives,
+			bucketFiles,
+			bucketPending,
+			bucketChunks,
+			bucketJobs,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return errors.Wrapf(err, "creating bucket '%s'", name)
+			}
+		}
+
+		// Remove uncommitted files
+		pending := make([][]byte, 0)
+		if err := tx.Bucket(bucketPending).ForEach(func(
+			id, _ []byte,
+		) error {
+			pending = append(pending, copyBytes(id))
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, id := range pending {
+			if err := deleteFile(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return err
+	}
+
+	return nil
+}
+
+// Close implements the Store interface
+func (str *Store) Close() error {
+	if str.db == nil {
+		return nil
+	}
+	return str.db.Close()
+}
+
+// SaveFile implements the Store interface
+func (str *Store) SaveFile(
+	ctx context.Context,
+	fl store.File,
+	contents io.Reader,
+) (store.File, error) {
+	if str.opts.ReadOnly {
+		return store.File{}, ErrReadOnly
+	}
+
+	id, err := store.NewID()
+	if err != nil {
+		return store.File{}, err
+	}
+	key := []byte(id)
+
+	size, err := str.writeChunks(key, store.ContextReader(ctx, contents))
+	if err != nil {
+		if err := str.db.Update(func(tx *bbolt.Tx) error {
+			return deleteFile(tx, key)
+		}); err != nil {
+			return store.File{}, errors.Wrap(err, "removing incomplete file")
+		}
+		return store.File{}, errors.Wrapf(
+			err,
+			"writing contents of file '%s'",
+			fl.Name,
+		)
+	}
+
+	fl.ID = id
+	fl.Size = size
+	return fl, nil
+}
+
+// writeChunks writes the contents read from r in chunks
+// and returns the total number of bytes written.
+// Up to chunksPerTx chunks are written per transaction,
+// the first one marks the file pending to make sure Init removes
+// leftovers of an interrupted write and the last one records its size
+func (str *Store) writeChunks(id []byte, r io.Reader) (int64, error) {
+	var size int64
+	var index uint64
+	buf := make([]byte, chunksPerTx*chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return size, err
+		}
+		last := n < len(buf)
+		if err := str.db.Update(func(tx *bbolt.Tx) error {
+			if index == 0 {
+				if err := tx.Bucket(bucketPending).Put(id, []byte{1}); err != nil {
+					return errors.Wrap(err, "marking file pending")
+				}
+			}
+			chunks := tx.Bucket(bucketChunks)
+			for offset := 0; offset < n; offset += chunkSize {
+				end := offset + chunkSize
+				if end > n {
+					end = n
+				}
+				if err := chunks.Put(
+					chunkKey(id, index),
+					buf[offset:end],
+				); err != nil {
+					return errors.Wrap(err, "writing chunk")
+				}
+				index++
+			}
+			if last {
+				return tx.Bucket(bucketFiles).Put(
+					id,
+					itob(uint64(size+int64(n))),
+				)
+			}
+			return nil
+		}); err != nil {
+			return size, err
+		}
+		size += int64(n)
+		if last {
+			return size, nil
+		}
+	}
+}
+
+// OpenFile implements the Store interface
+func (str *Store) OpenFile(
+	ctx context.Context,
+	id string,
+) (io.ReadSeekCloser, error) {
+	var size int64
+	if err := str.db.View(func(tx *bbolt.Tx) error {
+		files := tx.Bucket(bucketFiles)
+		if files == nil {
+			// Uninitialized read-only database
+			return store.ErrNotFound
+		}
+		val := files.Get([]byte(id))
+		if val == nil {
+			return store.ErrNotFound
+		}
+		size = int64(binary.BigEndian.Uint64(val))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &fileReader{db: str.db, id: []byte(id), size: size}, nil
+}
+
+// DeleteFile implements the Store interface
+func (str *Store) DeleteFile(ctx context.Context, id string) error {
+	if str.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return str.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(bucketPending).Get([]byte(id)) == nil {
+			return store.ErrNotFound
+		}
+		return deleteFile(tx, []byte(id))
+	})
+}
+
+// SaveArchive implements the Store interface
+func (str *Store) SaveArchive(
+	ctx context.Context,
+	archive store.Archive,
+) error {
+	if str.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return str.db.Update(func(tx *bbolt.Tx) error {
+		archives := tx.Bucket(bucketArchives)
+		archiveIDs := tx.Bucket(bucketArchiveIDs)
+		pending := tx.Bucket(bucketPending)
+
+		if archiveIDs.Get([]byte(archive.ID)) != nil {
+			return fmt.Errorf("duplicate archive ID: '%s'", archive.ID)
+		}
+
+		meta := archiveMeta{
+			ID:          archive.ID,
+			Created:     archive.Created,
+			ClientAgent: archive.ClientAgent,
+			ContentsID:  archive.ContentsID,
+			Size:        archive.Size,
+			Checksum:    archive.Checksum,
+			Format:      archive.Format,
+			Encrypted:   archive.Encrypted,
+			Comment:     archive.Comment,
+			Files:       make([]fileMeta, len(archive.Files)),
+		}
+		for i, fl := range archive.Files {
+			meta.Files[i] = newFileMeta(fl)
+		}
+
+		// Commit the referenced files
+		ids := make([]string, 0, len(meta.Files)+1)
+		for _, fl := range meta.Files {
+			ids = append(ids, fl.ID)
+		}
+		ids = append(ids, meta.ContentsID)
+		for _, id := range ids {
+			if pending.Get([]byte(id)) == nil {
+				return fmt.Errorf("referenced file not found: '%s'", id)
+			}
+			if err := pending.Delete([]byte(id)); err != nil {
+				return errors.Wrap(err, "committing file")
+			}
+		}
+
+		// Write the archive record
+		key, err := archives.NextSequence()
+		if err != nil {
+			return errors.Wrap(err, "generating archive key")
+		}
+		encoded, err := json.Marshal(meta)
+		if err != nil {
+			return errors.Wrap(err, "marshaling archive record")
+		}
+		if err := archives.Put(itob(key), encoded); err != nil {
+			return errors.Wrap(err, "writing archive record")
+		}
+		if err := archiveIDs.Put([]byte(archive.ID), itob(key)); err != nil {
+			return errors.Wrap(err, "indexing archive ID")
+		}
+		if err := tx.Bucket(bucketArchiveTimes).Put(
+			timeKey(archive.Created, archive.ID),
+			itob(key),
+		); err != nil {
+			return errors.Wrap(err, "indexing archive creation time")
+		}
+		fileArchives := tx.Bucket(bucketFileArchives)
+		for _, fl := range meta.Files {
+			if err := fileArchives.Put([]byte(fl.ID), itob(key)); err != nil {
+				return errors.Wrap(err, "indexing archived file")
+			}
+		}
+
+		return nil
+	})
+}
+
+// Archive implements the Store interface
+func (str *Store) Archive(
+	ctx context.Context,
+	id string,
+) (archive store.Archive, err error) {
+	err = str.db.View(func(tx *bbolt.Tx) error {
+		archiveIDs := tx.Bucket(bucketArchiveIDs)
+		if archiveIDs == nil {
+			// Uninitialized read-only database
+			return store.ErrNotFound
+		}
+		key := archiveIDs.Get([]byte(id))
+		if key == nil {
+			return store.ErrNotFound
+		}
+
+		var err error
+		archive, err = loadArchive(tx.Bucket(bucketArchives).Get(key))
+		return err
+	})
+	return
+}
+
+// FileArchive implements the Store interface
+func (str *Store) FileArchive(
+	ctx context.Context,
+	fileID string,
+) (archive store.Archive, err error) {
+	err = str.db.View(func(tx *bbolt.Tx) error {
+		fileArchives := tx.Bucket(bucketFileArchives)
+		if fileArchives == nil {
+			// Uninitialized read-only database
+			return store.ErrNotFound
+		}
+		key := fileArchives.Get([]byte(fileID))
+		if key == nil {
+			return store.ErrNotFound
+		}
+
+		var err error
+		archive, err = loadArchive(tx.Bucket(bucketArchives).Get(key))
+		return err
+	})
+	return
+}
+
+// QueryArchives implements the Store interface
+func (str *Store) QueryArchives(
+	ctx context.Context,
+	query store.ArchiveQuery,
+) (store.ArchivePage, error) {
+	// Determine the key to start scanning backwards from
+	var start []byte
+	if query.Cursor != "" {
+		created, id, err := store.DecodeCursor(query.Cursor)
+		if err != nil {
+			return store.ArchivePage{}, err
+		}
+		start = timeKey(created, id)
+	}
+	if !query.Until.IsZero() {
+		until := timeKey(query.Until, "")
+		if start == nil || bytes.Compare(until, start) < 0 {
+			start = until
+		}
+	}
+
+	page := store.ArchivePage{Archives: make([]store.Archive, 0)}
+	err := str.db.View(func(tx *bbolt.Tx) error {
+		times := tx.Bucket(bucketArchiveTimes)
+		if times == nil {
+			// Uninitialized read-only database
+			return nil
+		}
+		archives := tx.Bucket(bucketArchives)
+
+		cursor := times.Cursor()
+		var tkey, key []byte
+		if start == nil {
+			tkey, key = cursor.Last()
+		} else if tkey, _ = cursor.Seek(start); tkey == nil {
+			tkey, key = cursor.Last()
+		} else {
+			tkey, key = cursor.Prev()
+		}
+
+		var since []byte
+		if !query.Since.IsZero() {
+			since = timeKeyPrefix(query.Since)
+		}
+
+		for ; tkey != nil; tkey, key = cursor.Prev() {
+			if since != nil && bytes.Compare(tkey[:8], since) < 0 {
+				break
+			}
+			archive, err := loadArchive(archives.Get(key))
+			if err != nil {
+				return err
+			}
+			if !query.Match(archive) {
+				continue
+			}
+			if query.Limit > 0 && len(page.Archives) >= query.Limit {
+				last := page.Archives[len(page.Archives)-1]
+				page.Cursor = store.EncodeCursor(last.Created, last.ID)
+				break
+			}
+			page.Archives = append(page.Archives, archive)
+		}
+		return nil
+	})
+	return page, err
+}
+
+// DeleteArchive implements the Store interface
+func (str *Store) DeleteArchive(ctx context.Context, id string) error {
+	if str.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return str.db.Update(func(tx *bbolt.Tx) error {
+		archives := tx.Bucket(bucketArchives)
+		archiveIDs := tx.Bucket(bucketArchiveIDs)
+
+		key := archiveIDs.Get([]byte(id))
+		if key == nil {
+			return store.ErrNotFound
+		}
+		key = copyBytes(key)
+
+		archive, err := loadArchive(archives.Get(key))
+		if err != nil {
+			return err
+		}
+
+		for _, fl := range archive.Files {
+			if err := deleteFile(tx, []byte(fl.ID)); err != nil {
+				return errors.Wrapf(err, "deleting file '%s'", fl.Name)
+			}
+			if err := tx.Bucket(bucketFileArchives).Delete(
+				[]byte(fl.ID),
+			); err != nil {
+				return errors.Wrapf(err, "deleting from '%s'", bucketFileArchives)
+			}
+		}
+		if err := deleteFile(tx, []byte(archive.ContentsID)); err != nil {
+			return errors.Wrap(err, "deleting archive contents")
+		}
+		for _, del := range []struct {
+			bucket []byte
+			key    []byte
+		}{
+			{bucketArchiveTimes, timeKey(archive.Created, archive.ID)},
+			{bucketArchiveIDs, []byte(id)},
+			{bucketArchives, key},
+		} {
+			if err := tx.Bucket(del.bucket).Delete(del.key); err != nil {
+				return errors.Wrapf(err, "deleting from '%s'", del.bucket)
+			}
+		}
+		return nil
+	})
+}
+
+// SaveJob implements the Store interface
+func (str *Store) SaveJob(ctx context.Context, job store.Job) error {
+	if str.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return str.db.Update(func(tx *bbolt.Tx) error {
+		jobs := tx.Bucket(bucketJobs)
+		pending := tx.Bucket(bucketPending)
+
+		released := make(map[string]struct{})
+		if record := jobs.Get([]byte(job.ID)); record != nil {
+			previous, err := loadJob(record)
+			if err != nil {
+				return err
+			}
+			for _, fl := range previous.Files {
+				released[fl.ID] = struct{}{}
+			}
+		}
+
+		// Commit the newly referenced files
+		// and remove the ones no longer referenced
+		for _, fl := range job.Files {
+			if _, ok := released[fl.ID]; ok {
+				delete(released, fl.ID)
+				continue
+			}
+			if pending.Get([]byte(fl.ID)) == nil {
+				return fmt.Errorf("referenced file not found: '%s'", fl.ID)
+			}
+			if err := pending.Delete([]byte(fl.ID)); err != nil {
+				return errors.Wrap(err, "committing file")
+			}
+		}
+		for id := range released {
+			if err := deleteFile(tx, []byte(id)); err != nil {
+				return errors.Wrapf(err, "deleting released file '%s'", id)
+			}
+		}
+
+		encoded, err := json.Marshal(newJobMeta(job))
+		if err != nil {
+			return errors.Wrap(err, "marshaling job record")
+		}
+		if err := jobs.Put([]byte(job.ID), encoded); err != nil {
+			return errors.Wrap(err, "writing job record")
+		}
+		return nil
+	})
+}
+
+// Job implements the Store interface
+func (str *Store) Job(ctx context.Context, id string) (job store.Job, err error) {
+	err = str.db.View(func(tx *bbolt.Tx) error {
+		jobs := tx.Bucket(bucketJobs)
+		if jobs == nil {
+			// Uninitialized read-only database
+			return store.ErrNotFound
+		}
+		record := jobs.Get([]byte(id))
+		if record == nil {
+			return store.ErrNotFound
+		}
+
+		var err error
+		job, err = loadJob(record)
+		return err
+	})
+	return
+}
+
+// UnfinishedJobs implements the Store interface
+func (str *Store) UnfinishedJobs(ctx context.Context) ([]store.Job, error) {
+	jobs := make([]store.Job, 0)
+	err := str.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketJobs)
+		if bucket == nil {
+			// Uninitialized read-only database
+			return nil
+		}
+		return bucket.ForEach(func(_, record []byte) error {
+			job, err := loadJob(record)
+			if err != nil {
+				return err
+			}
+			if !job.Status.Finished() {
+				jobs = append(jobs, job)
+			}
+			return nil
+		})
+	})
+	store.SortJobs(jobs)
+	return jobs, err
+}
+
+// FinishedJobs implements the Store interface
+func (str *Store) FinishedJobs(
+	ctx context.Context,
+	before time.Time,
+) ([]store.Job, error) {
+	jobs := make([]store.Job, 0)
+	err := str.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketJobs)
+		if bucket == nil {
+			// Uninitialized read-only database
+			return nil
+		}
+		return bucket.ForEach(func(_, record []byte) error {
+			job, err := loadJob(record)
+			if err != nil {
+				return err
+			}
+			if job.Status.Finished() && job.Finished.Before(before) {
+				jobs = append(jobs, job)
+			}
+			return nil
+		})
+	})
+	store.SortJobs(jobs)
+	return jobs, err
+}
+
+// DeleteJob implements the Store interface
+func (str *Store) DeleteJob(ctx context.Context, id string) error {
+	if str.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return str.db.Update(func(tx *bbolt.Tx) error {
+		jobs := tx.Bucket(bucketJobs)
+		record := jobs.Get([]byte(id))
+		if record == nil {
+			return store.ErrNotFound
+		}
+		job, err := loadJob(record)
+		if err != nil {
+			return err
+		}
+		for _, fl := range job.Files {
+			if err := deleteFile(tx, []byte(fl.ID)); err != nil {
+				return errors.Wrapf(err, "deleting file '%s'", fl.Name)
+			}
+		}
+		if err := jobs.Delete([]byte(id)); err != nil {
+			return errors.Wrapf(err, "deleting from '%s'", bucketJobs)
+		}
+		return nil
+	})
+}
+
+// deleteFile removes the file identified by id including all its chunks
+func deleteFile(tx *bbolt.Tx, id []byte) error {
+	chunks := tx.Bucket(bucketChunks).Cursor()
+	for k, _ := chunks.Seek(id); k != nil && bytes.HasPrefix(k, id); {
+		if err := chunks.Delete(); err != nil {
+			return errors.Wrap(err, "deleting chunk")
+		}
+		// Deleting moves the cursor to the next key
+		k, _ = chunks.Seek(id)
+	}
+	for _, bucket := range [][]byte{bucketFiles, bucketPending} {
+		if err := tx.Bucket(bucket).Delete(id); err != nil {
+			return errors.Wrapf(err, "deleting from '%s'", bucket)
+		}
+	}
+	return nil
+}
+
+// chunkKey returns the key of the chunk at the given index of a file
+func chunkKey(id []byte, index uint64) []byte {
+	key := make([]byte, 0, len(id)+8)
+	return append(append(key, id...), itob(index)...)
+}
+
+// fileReader reads the contents of a file chunk by chunk,
+// each chunk in its own read transaction
+type fileReader struct {
+	db     *bbolt.DB
+	id     []byte
+	size   int64
+	offset int64
+}
+
+// Read implements the io.Reader interface
+func (r *fileReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	index := uint64(r.offset / chunkSize)
+	within := int(r.offset % chunkSize)
+
+	var n int
+	if err := r.db.View(func(tx *bbolt.Tx) error {
+		chunk := tx.Bucket(bucketChunks).Get(chunkKey(r.id, index))
+		if len(chunk) <= within {
+			return io.ErrUnexpectedEOF
+		}
+		n = copy(p, chunk[within:])
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	r.offset += int64(n)
+	return n, nil
+}
+
+// Seek implements the io.Seeker interface
+func (r *fileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Close implements the io.Closer interface
+func (r *fileReader) Close() error { return nil }
+
+// timeKeyPrefix returns the creation time prefix of a time index key
+func timeKeyPrefix(created time.Time) []byte {
+	return itob(uint64(created.UnixNano()))
+}
+
+// timeKey returns the time index key of an archive
+func timeKey(created time.Time, id string) []byte {
+	return append(timeKeyPrefix(created), id...)
+}
+
+// copyBytes copies b because values returned by bolt
+// are only valid during the lifetime of the transaction
+func copyBytes(b []byte) []byte {
+	cp := make([]byte, len(b))
+	copy(cp, b)
+	return cp
+}
+
+// loadArchive decodes the given archive record
+func loadArchive(record []byte) (store.Archive, error) {
+	var meta archiveMeta
+	if err := json.Unmarshal(record, &meta); err != nil {
+		return store.Archive{}, errors.Wrap(
+			err,
+			"unmarshaling archive record",
+		)
+	}
+
+	archive := store.Archive{
+		ID:          meta.ID,
+		Created:     meta.Created,
+		ClientAgent: meta.ClientAgent,
+		ContentsID:  meta.ContentsID,
+		Size:        meta.Size,
+		Checksum:    meta.Checksum,
+		Format:      meta.Format,
+		Encrypted:   meta.Encrypted,
+		Comment:     meta.Comment,
+		Files:       make([]store.File, len(meta.Files)),
+	}
+	for i, fl := range meta.Files {
+		archive.Files[i] = fl.file()
+	}
+	return archive, nil
+}
+
+// loadJob decodes the given job record
+func loadJob(record []byte) (store.Job, error) {
+	var meta jobMeta
+	if err := json.Unmarshal(record, &meta); err != nil {
+		return store.Job{}, errors.Wrap(err, "unmarshaling job record")
+	}
+	return meta.record(), nil
+}
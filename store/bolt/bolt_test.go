@@ -0,0 +1,203 @@
+package bolt_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/romshark/zipapi/store"
+	"github.com/romshark/zipapi/store/bolt"
+	"github.com/romshark/zipapi/store/storetest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.Store, func()) {
+		dir, err := ioutil.TempDir("", "zipapi-bolt-store-")
+		require.NoError(t, err)
+
+		str := bolt.New(bolt.Options{Path: filepath.Join(dir, "test.db")})
+		require.NoError(t, str.Init())
+
+		return str, func() {
+			require.NoError(t, str.Close())
+			require.NoError(t, os.RemoveAll(dir))
+		}
+	})
+}
+
+// TestInitCleanup tests whether Init removes uncommitted files
+// keeping the files of archives and jobs
+func TestInitCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipapi-bolt-store-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.db")
+
+	str := bolt.New(bolt.Options{Path: path})
+	require.NoError(t, str.Init())
+	archive := storetest.NewArchive(t, str, storetest.File{
+		Name:     "foo.txt",
+		Contents: "foo foo foo",
+	})
+	require.NoError(t, str.SaveArchive(context.Background(), archive))
+	job := storetest.NewJob(t, str, storetest.File{
+		Name:     "bar.txt",
+		Contents: "bar bar bar",
+	})
+	require.NoError(t, str.SaveJob(context.Background(), job))
+	uncommitted := storetest.SaveFile(t, str, storetest.File{
+		Name:     "uncommitted.txt",
+		Contents: "x",
+	})
+	require.NoError(t, str.Close())
+
+	reopened := bolt.New(bolt.Options{Path: path})
+	require.NoError(t, reopened.Init())
+	defer reopened.Close()
+
+	_, err = reopened.OpenFile(context.Background(), uncommitted.ID)
+	require.Equal(t, store.ErrNotFound, err)
+	require.Equal(
+		t,
+		"foo foo foo",
+		storetest.ReadFile(t, reopened, archive.Files[0].ID),
+	)
+
+	jobs, err := reopened.UnfinishedJobs(context.Background())
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	storetest.RequireEqualJob(t, job, jobs[0])
+	require.Equal(
+		t,
+		"bar bar bar",
+		storetest.ReadFile(t, reopened, job.Files[0].ID),
+	)
+}
+
+// TestReadOnly tests opening a database in read-only mode
+func TestReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipapi-bolt-store-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.db")
+
+	str := bolt.New(bolt.Options{Path: path})
+	require.NoError(t, str.Init())
+	archive := storetest.NewArchive(t, str, storetest.File{
+		Name:     "foo.txt",
+		Contents: "foo foo foo",
+	})
+	require.NoError(t, str.SaveArchive(context.Background(), archive))
+	require.NoError(t, str.Close())
+
+	readOnly := bolt.New(bolt.Options{Path: path, ReadOnly: true})
+	require.NoError(t, readOnly.Init())
+	defer readOnly.Close()
+
+	saved, err := readOnly.Archive(context.Background(), archive.ID)
+	require.NoError(t, err)
+	storetest.RequireEqualArchive(t, archive, saved)
+	require.Equal(
+		t,
+		"foo foo foo",
+		storetest.ReadFile(t, readOnly, archive.Files[0].ID),
+	)
+
+	_, err = readOnly.SaveFile(
+		context.Background(),
+		store.File{Name: "bar.txt"},
+		strings.NewReader("bar"),
+	)
+	require.Equal(t, bolt.ErrReadOnly, err)
+	archive.ID = "bar"
+	require.Equal(
+		t,
+		bolt.ErrReadOnly,
+		readOnly.SaveArchive(context.Background(), archive),
+	)
+}
+
+// TestInitLocked tests whether Init refuses to open the database file
+// of another instance keeping its pending files
+func TestInitLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipapi-bolt-store-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.db")
+
+	str := bolt.New(bolt.Options{Path: path})
+	require.NoError(t, str.Init())
+	pending := storetest.SaveFile(t, str, storetest.File{
+		Name:     "pending.txt",
+		Contents: "pending",
+	})
+
+	second := bolt.New(bolt.Options{Path: path})
+	require.Equal(t, bolt.ErrLocked, second.Init())
+	require.Equal(t, "pending", storetest.ReadFile(t, str, pending.ID))
+
+	require.NoError(t, str.Close())
+	require.NoError(t, second.Init())
+	require.NoError(t, second.Close())
+}
+
+// TestSaveFileSizes tests saving files filling
+// one or more write transactions exactly or partially
+func TestSaveFileSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipapi-bolt-store-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	str := bolt.New(bolt.Options{Path: filepath.Join(dir, "test.db")})
+	require.NoError(t, str.Init())
+	defer str.Close()
+
+	const batchSize = 4 * 1024 * 1024
+	for _, size := range []int{
+		0,
+		batchSize - 1,
+		batchSize,
+		batchSize + 1,
+		2*batchSize + 256*1024,
+	} {
+		contents := make([]byte, size)
+		for i := range contents {
+			contents[i] = byte(i % 251)
+		}
+		fl := storetest.SaveFile(t, str, storetest.File{
+			Name:     "file.bin",
+			Contents: string(contents),
+		})
+		require.Equal(t, string(contents), storetest.ReadFile(t, str, fl.ID))
+	}
+}
+
+// BenchmarkSaveFile measures saving large files
+func BenchmarkSaveFile(b *testing.B) {
+	dir, err := ioutil.TempDir("", "zipapi-bolt-store-")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	str := bolt.New(bolt.Options{Path: filepath.Join(dir, "test.db")})
+	require.NoError(b, str.Init())
+	defer str.Close()
+
+	contents := make([]byte, 16*1024*1024)
+	b.SetBytes(int64(len(contents)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fl, err := str.SaveFile(
+			context.Background(),
+			store.File{Name: "large.bin"},
+			bytes.NewReader(contents),
+		)
+		require.NoError(b, err)
+		require.NoError(b, str.DeleteFile(context.Background(), fl.ID))
+	}
+}
@@ -0,0 +1,899 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/romshark/zipapi/store"
+	"github.com/romshark/zipapi/store/internal/index"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	store.Register("filesystem", func(
+		decodeOptions store.OptionsDecoder,
+	) (store.Store, error) {
+		var opts Options
+		if err := decodeOptions(&opts); err != nil {
+			return nil, errors.Wrap(err, "decoding options")
+		}
+		return New(opts), nil
+	})
+}
+
+const (
+	dirFiles    = "files"
+	dirArchives = "archives"
+	dirJobs     = "jobs"
+	dirTemp     = "tmp"
+	extMeta     = ".json"
+
+	// fileLock is locked exclusively by the initialized store
+	fileLock = "lock"
+)
+
+// ErrLocked is returned by Init if the store directory
+// is used by another store instance, such as the one of a running server
+var ErrLocked = errors.New("store is locked by another instance")
+
+// Options represents the filesystem store options
+type Options struct {
+	// Root defines the path to the directory the store keeps its data in
+	Root string `toml:"root"`
+}
+
+// fileMeta represents the metadata of a stored file
+type fileMeta struct {
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Size        int64       `json:"size"`
+	UploadTime  time.Time   `json:"upload-time"`
+	ClientAgent string      `json:"client-agent"`
+	ModTime     time.Time   `json:"mtime"`
+	Mode        os.FileMode `json:"mode,omitempty"`
+	Comment     string      `json:"comment,omitempty"`
+	Checksum    string      `json:"checksum,omitempty"`
+}
+
+// newFileMeta returns the metadata of the given file
+func newFileMeta(fl store.File) fileMeta {
+	return fileMeta{
+		ID:          fl.ID,
+		Name:        fl.Name,
+		Size:        fl.Size,
+		UploadTime:  fl.Upload.Time,
+		ClientAgent: fl.Upload.ClientAgent,
+		ModTime:     fl.ModTime,
+		Mode:        fl.Mode,
+		Comment:     fl.Comment,
+		Checksum:    fl.Checksum,
+	}
+}
+
+// file returns the stored file
+func (fl fileMeta) file() store.File {
+	return store.File{
+		ID: fl.ID,
+		Upload: store.UploadInfo{
+			Time:        fl.UploadTime,
+			ClientAgent: fl.ClientAgent,
+		},
+		Name:     fl.Name,
+		Size:     fl.Size,
+		ModTime:  fl.ModTime,
+		Mode:     fl.Mode,
+		Comment:  fl.Comment,
+		Checksum: fl.Checksum,
+	}
+}
+
+// archiveMeta represents the metadata record of a stored archive
+type archiveMeta struct {
+	ID          string     `json:"id"`
+	Created     time.Time  `json:"created"`
+	ClientAgent string     `json:"client-agent"`
+	ContentsID  string     `json:"contents-id"`
+	Size        int64      `json:"size"`
+	Checksum    string     `json:"checksum"`
+	Format      string     `json:"format,omitempty"`
+	Encrypted   bool       `json:"encrypted,omitempty"`
+	Comment     string     `json:"comment,omitempty"`
+	Files       []fileMeta `json:"files"`
+}
+
+// jobMeta represents the record of an asynchronous archive job
+type jobMeta struct {
+	ID            string     `json:"id"`
+	Created       time.Time  `json:"created"`
+	ClientAgent   string     `json:"client-agent"`
+	Status        string     `json:"status"`
+	Format        string     `json:"format"`
+	Compression   string     `json:"compression"`
+	Level         int        `json:"level"`
+	Checksums     string     `json:"checksums,omitempty"`
+	Deterministic bool       `json:"deterministic,omitempty"`
+	ModTime       time.Time  `json:"mtime"`
+	Files         []fileMeta `json:"files"`
+	Directories   []string   `json:"directories,omitempty"`
+	Comment       string     `json:"comment,omitempty"`
+	Size          int64      `json:"size"`
+	ArchiveID     string     `json:"archive-id,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	Finished      time.Time  `json:"finished"`
+}
+
+func newJobMeta(job store.Job) jobMeta {
+	meta := jobMeta{
+		ID:            job.ID,
+		Created:       job.Created,
+		ClientAgent:   job.ClientAgent,
+		Status:        string(job.Status),
+		Format:        job.Options.Format,
+		Compression:   job.Options.Compression,
+		Level:         job.Options.Level,
+		Checksums:     job.Options.Checksums,
+		Deterministic: job.Options.Deterministic,
+		ModTime:       job.Options.ModTime,
+		Files:         make([]fileMeta, len(job.Files)),
+		Directories:   append([]string(nil), job.Directories...),
+		Comment:       job.Comment,
+		Size:          job.Size,
+		ArchiveID:     job.ArchiveID,
+		Error:         job.Error,
+		Finished:      job.Finished,
+	}
+	for i, fl := range job.Files {
+		meta.Files[i] = newFileMeta(fl)
+	}
+	return meta
+}
+
+// record returns the job record
+func (meta jobMeta) record() store.Job {
+	job := store.Job{
+		ID:          meta.ID,
+		Created:     meta.Created,
+		ClientAgent: meta.ClientAgent,
+		Status:      store.JobStatus(meta.Status),
+		Options: store.JobOptions{
+			Format:        meta.Format,
+			Compression:   meta.Compression,
+			Level:         meta.Level,
+			Checksums:     meta.Checksums,
+			Deterministic: meta.Deterministic,
+			ModTime:       meta.ModTime,
+		},
+		Files:       make([]store.File, len(meta.Files)),
+		Directories: append([]string(nil), meta.Directories...),
+		Comment:     meta.Comment,
+		Size:        meta.Size,
+		ArchiveID:   meta.ArchiveID,
+		Error:       meta.Error,
+		Finished:    meta.Finished,
+	}
+	for i, fl := range meta.Files {
+		job.Files[i] = fl.file()
+	}
+	return job
+}
+
+// Store represents a filesystem-based store implementation.
+//
+// The contents of each file as well as the compressed archive
+// are written to their own content file while the archive
+// is recorded in a JSON metadata file referencing them.
+// Both are written to a temporary file first, synced and then
+// atomically renamed into place. The archive record is always written last
+// and thus marks the archive and all its files as committed.
+// Job records are written the same way and commit the files
+// they reference until they're replaced by a record
+// which no longer references them.
+// Content files not referenced by any archive or job record are considered
+// leftovers of an interrupted write and are removed by Init,
+// which is why the store directory is locked until the store is closed
+type Store struct {
+	opts     Options
+	dirLock  *os.File
+	lock     *sync.RWMutex
+	metas    map[string]archiveMeta
+	jobs     map[string]jobMeta
+	pending  map[string]struct{}
+	archives *index.Index
+}
+
+// New creates a new uninitialized filesystem store instance
+func New(opts Options) *Store {
+	return &Store{opts: opts}
+}
+
+func (str *Store) filesDir() string {
+	return filepath.Join(str.opts.Root, dirFiles)
+}
+
+func (str *Store) archivesDir() string {
+	return filepath.Join(str.opts.Root, dirArchives)
+}
+
+func (str *Store) jobsDir() string {
+	return filepath.Join(str.opts.Root, dirJobs)
+}
+
+func (str *Store) tempDir() string {
+	return filepath.Join(str.opts.Root, dirTemp)
+}
+
+func (str *Store) contentPath(id string) string {
+	return filepath.Join(str.filesDir(), id)
+}
+
+func (str *Store) archivePath(id string) string {
+	return filepath.Join(str.archivesDir(), id+extMeta)
+}
+
+func (str *Store) jobPath(id string) string {
+	return filepath.Join(str.jobsDir(), id+extMeta)
+}
+
+// Init implements the Store interface.
+// Init locks the store directory, creates the store directories
+// if they don't exist yet, removes leftovers of interrupted writes
+// and rebuilds the index. Returns ErrLocked if the store directory
+// is locked by another instance
+func (str *Store) Init() error {
+	if str.opts.Root == "" {
+		return errors.New("missing root directory")
+	}
+
+	// Make sure no other instance is using the store,
+	// its pending writes would be removed as leftovers otherwise
+	if err := os.MkdirAll(str.opts.Root, 0750); err != nil {
+		return errors.Wrap(err, "creating store directory")
+	}
+	dirLock, err := os.OpenFile(
+		filepath.Join(str.opts.Root, fileLock),
+		os.O_RDWR|os.O_CREATE,
+		0640,
+	)
+	if err != nil {
+		return errors.Wrap(err, "opening lock file")
+	}
+	if err := lockFile(dirLock); err != nil {
+		dirLock.Close()
+		return err
+	}
+
+	if err := str.recover(); err != nil {
+		dirLock.Close()
+		return err
+	}
+	str.dirLock = dirLock
+	return nil
+}
+
+// recover removes leftovers of interrupted writes and rebuilds the index
+func (str *Store) recover() error {
+	str.lock = &sync.RWMutex{}
+	str.metas = make(map[string]archiveMeta)
+	str.jobs = make(map[string]jobMeta)
+	str.pending = make(map[string]struct{})
+	str.archives = index.New()
+
+	for _, dir := range []string{
+		str.filesDir(),
+		str.archivesDir(),
+		str.jobsDir(),
+		str.tempDir(),
+	} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return errors.Wrap(err, "creating store directory")
+		}
+	}
+
+	// Remove temporary files of interrupted writes
+	temps, err := ioutil.ReadDir(str.tempDir())
+	if err != nil {
+		return errors.Wrap(err, "reading temp directory")
+	}
+	for _, tmp := range temps {
+		if err := os.RemoveAll(
+			filepath.Join(str.tempDir(), tmp.Name()),
+		); err != nil {
+			return errors.Wrap(err, "removing temporary file")
+		}
+	}
+
+	// Determine the sizes of all content files
+	files, err := ioutil.ReadDir(str.filesDir())
+	if err != nil {
+		return errors.Wrap(err, "reading files directory")
+	}
+	sizes := make(map[string]int64, len(files))
+	for _, fl := range files {
+		sizes[fl.Name()] = fl.Size()
+	}
+
+	// Rebuild the index
+	archives, err := ioutil.ReadDir(str.archivesDir())
+	if err != nil {
+		return errors.Wrap(err, "reading archives directory")
+	}
+	for _, fl := range archives {
+		id := strings.TrimSuffix(fl.Name(), extMeta)
+		meta, err := str.readArchive(id)
+		if err != nil {
+			return errors.Wrapf(err, "reading archive %s", id)
+		}
+
+		// Make sure the archive and all referenced files are complete
+		size, exists := sizes[meta.ContentsID]
+		if !exists {
+			return fmt.Errorf("missing contents of archive %s", id)
+		}
+		if size != meta.Size {
+			return fmt.Errorf(
+				"corrupted contents of archive %s: size %d, expected %d",
+				id,
+				size,
+				meta.Size,
+			)
+		}
+		delete(sizes, meta.ContentsID)
+
+		for _, file := range meta.Files {
+			size, exists := sizes[file.ID]
+			if !exists {
+				return fmt.Errorf(
+					"missing contents of file %s of archive %s",
+					file.ID,
+					id,
+				)
+			}
+			if size != file.Size {
+				return fmt.Errorf(
+					"corrupted contents of file %s of archive %s: "+
+						"size %d, expected %d",
+					file.ID,
+					id,
+					size,
+					file.Size,
+				)
+			}
+			delete(sizes, file.ID)
+		}
+		str.metas[meta.ID] = meta
+		str.archives.Insert(meta.record())
+	}
+
+	// Read the job records keeping the files they reference
+	jobs, err := ioutil.ReadDir(str.jobsDir())
+	if err != nil {
+		return errors.Wrap(err, "reading jobs directory")
+	}
+	for _, fl := range jobs {
+		id := strings.TrimSuffix(fl.Name(), extMeta)
+		meta, err := str.readJob(id)
+		if err != nil {
+			return errors.Wrapf(err, "reading job %s", id)
+		}
+		for _, file := range meta.Files {
+			size, exists := sizes[file.ID]
+			if !exists || size != file.Size {
+				return fmt.Errorf(
+					"missing or corrupted contents of file %s of job %s",
+					file.ID,
+					id,
+				)
+			}
+			delete(sizes, file.ID)
+		}
+		str.jobs[meta.ID] = meta
+	}
+
+	// Remove uncommitted contents
+	for id := range sizes {
+		if err := os.Remove(str.contentPath(id)); err != nil {
+			return errors.Wrap(err, "removing uncommitted file contents")
+		}
+	}
+	if len(sizes) > 0 {
+		if err := syncDir(str.filesDir()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close implements the Store interface.
+// Close unlocks the store directory
+func (str *Store) Close() error {
+	if str.dirLock == nil {
+		return nil
+	}
+	err := str.dirLock.Close()
+	str.dirLock = nil
+	return errors.Wrap(err, "closing lock file")
+}
+
+// SaveFile implements the Store interface
+func (str *Store) SaveFile(
+	ctx context.Context,
+	fl store.File,
+	contents io.Reader,
+) (store.File, error) {
+	id, err := store.NewID()
+	if err != nil {
+		return store.File{}, err
+	}
+	var size int64
+	if err := str.writeAtomic(
+		str.contentPath(id),
+		func(w io.Writer) error {
+			size, err = io.Copy(w, store.ContextReader(ctx, contents))
+			return err
+		},
+	); err != nil {
+		return store.File{}, errors.Wrapf(
+			err,
+			"writing contents of file '%s'",
+			fl.Name,
+		)
+	}
+	fl.ID = id
+	fl.Size = size
+
+	str.lock.Lock()
+	str.pending[id] = struct{}{}
+	str.lock.Unlock()
+
+	return fl, nil
+}
+
+// OpenFile implements the Store interface
+func (str *Store) OpenFile(
+	ctx context.Context,
+	id string,
+) (io.ReadSeekCloser, error) {
+	if !validID(id) {
+		return nil, store.ErrNotFound
+	}
+	fl, err := os.Open(str.contentPath(id))
+	if os.IsNotExist(err) {
+		return nil, store.ErrNotFound
+	} else if err != nil {
+		return nil, errors.Wrap(err, "opening file contents")
+	}
+	return fl, nil
+}
+
+// DeleteFile implements the Store interface
+func (str *Store) DeleteFile(ctx context.Context, id string) error {
+	str.lock.Lock()
+	_, exists := str.pending[id]
+	delete(str.pending, id)
+	str.lock.Unlock()
+
+	if !exists {
+		return store.ErrNotFound
+	}
+	if err := os.Remove(str.contentPath(id)); err != nil {
+		return errors.Wrap(err, "removing file contents")
+	}
+	return nil
+}
+
+// SaveArchive implements the Store interface
+func (str *Store) SaveArchive(
+	ctx context.Context,
+	archive store.Archive,
+) error {
+	if !validID(archive.ID) {
+		return fmt.Errorf("invalid archive ID: '%s'", archive.ID)
+	}
+
+	meta := archiveMeta{
+		ID:          archive.ID,
+		Created:     archive.Created,
+		ClientAgent: archive.ClientAgent,
+		ContentsID:  archive.ContentsID,
+		Size:        archive.Size,
+		Checksum:    archive.Checksum,
+		Format:      archive.Format,
+		Encrypted:   archive.Encrypted,
+		Comment:     archive.Comment,
+		Files:       make([]fileMeta, len(archive.Files)),
+	}
+	for i, fl := range archive.Files {
+		meta.Files[i] = newFileMeta(fl)
+	}
+
+	// Claim the referenced uncommitted files
+	// and release them again if saving fails
+	ids := make([]string, 0, len(meta.Files)+1)
+	for _, fl := range meta.Files {
+		ids = append(ids, fl.ID)
+	}
+	ids = append(ids, meta.ContentsID)
+
+	str.lock.Lock()
+	if _, taken := str.metas[meta.ID]; taken {
+		str.lock.Unlock()
+		return fmt.Errorf("duplicate archive ID: '%s'", meta.ID)
+	}
+	for i, id := range ids {
+		if _, exists := str.pending[id]; !exists {
+			for _, id := range ids[:i] {
+				str.pending[id] = struct{}{}
+			}
+			str.lock.Unlock()
+			return fmt.Errorf("referenced file not found: '%s'", id)
+		}
+		delete(str.pending, id)
+	}
+	str.metas[meta.ID] = meta
+	str.lock.Unlock()
+
+	if err := str.commit(meta); err != nil {
+		str.lock.Lock()
+		delete(str.metas, meta.ID)
+		for _, id := range ids {
+			str.pending[id] = struct{}{}
+		}
+		str.lock.Unlock()
+		return err
+	}
+
+	str.lock.Lock()
+	str.archives.Insert(meta.record())
+	str.lock.Unlock()
+
+	return nil
+}
+
+// commit makes sure the contents are durable
+// and writes the archive record
+func (str *Store) commit(meta archiveMeta) error {
+	if err := syncDir(str.filesDir()); err != nil {
+		return err
+	}
+	if err := str.writeAtomic(
+		str.archivePath(meta.ID),
+		func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(meta)
+		},
+	); err != nil {
+		return errors.Wrap(err, "writing archive record")
+	}
+	return syncDir(str.archivesDir())
+}
+
+// Archive implements the Store interface
+func (str *Store) Archive(
+	ctx context.Context,
+	id string,
+) (store.Archive, error) {
+	str.lock.RLock()
+	defer str.lock.RUnlock()
+
+	record, exists := str.archives.Get(id)
+	if !exists {
+		return store.Archive{}, store.ErrNotFound
+	}
+	return index.Copy(record), nil
+}
+
+// FileArchive implements the Store interface
+func (str *Store) FileArchive(
+	ctx context.Context,
+	fileID string,
+) (store.Archive, error) {
+	str.lock.RLock()
+	defer str.lock.RUnlock()
+
+	record, exists := str.archives.FileArchive(fileID)
+	if !exists {
+		return store.Archive{}, store.ErrNotFound
+	}
+	return index.Copy(record), nil
+}
+
+// QueryArchives implements the Store interface
+func (str *Store) QueryArchives(
+	ctx context.Context,
+	query store.ArchiveQuery,
+) (store.ArchivePage, error) {
+	str.lock.RLock()
+	defer str.lock.RUnlock()
+
+	return str.archives.Query(query)
+}
+
+// DeleteArchive implements the Store interface.
+// The archive record is removed first, the remaining contents are
+// removed by Init if the deletion is interrupted
+func (str *Store) DeleteArchive(ctx context.Context, id string) error {
+	str.lock.Lock()
+	_, indexed := str.archives.Get(id)
+	meta := str.metas[id]
+	if indexed {
+		delete(str.metas, id)
+		str.archives.Remove(id)
+	}
+	str.lock.Unlock()
+
+	if !indexed {
+		return store.ErrNotFound
+	}
+
+	if err := os.Remove(str.archivePath(id)); err != nil {
+		return errors.Wrap(err, "removing archive record")
+	}
+	if err := syncDir(str.archivesDir()); err != nil {
+		return err
+	}
+
+	contents := make([]string, 1, len(meta.Files)+1)
+	contents[0] = meta.ContentsID
+	for _, fl := range meta.Files {
+		contents = append(contents, fl.ID)
+	}
+	for _, id := range contents {
+		if err := os.Remove(str.contentPath(id)); err != nil {
+			return errors.Wrap(err, "removing contents")
+		}
+	}
+	return syncDir(str.filesDir())
+}
+
+// record returns the archive record
+func (meta archiveMeta) record() store.Archive {
+	archive := store.Archive{
+		ID:          meta.ID,
+		Created:     meta.Created,
+		ClientAgent: meta.ClientAgent,
+		ContentsID:  meta.ContentsID,
+		Size:        meta.Size,
+		Checksum:    meta.Checksum,
+		Format:      meta.Format,
+		Encrypted:   meta.Encrypted,
+		Comment:     meta.Comment,
+		Files:       make([]store.File, len(meta.Files)),
+	}
+	for i, fl := range meta.Files {
+		archive.Files[i] = fl.file()
+	}
+	return archive
+}
+
+// SaveJob implements the Store interface
+func (str *Store) SaveJob(ctx context.Context, job store.Job) error {
+	if !validID(job.ID) {
+		return fmt.Errorf("invalid job ID: '%s'", job.ID)
+	}
+	meta := newJobMeta(job)
+
+	// Claim the newly referenced uncommitted files
+	// and release them again if saving fails
+	str.lock.Lock()
+	previous, replaced := str.jobs[meta.ID]
+	released := make(map[string]struct{}, len(previous.Files))
+	for _, fl := range previous.Files {
+		released[fl.ID] = struct{}{}
+	}
+	var claimed []string
+	for _, fl := range meta.Files {
+		if _, ok := released[fl.ID]; ok {
+			delete(released, fl.ID)
+			continue
+		}
+		if _, exists := str.pending[fl.ID]; !exists {
+			for _, id := range claimed {
+				str.pending[id] = struct{}{}
+			}
+			str.lock.Unlock()
+			return fmt.Errorf("referenced file not found: '%s'", fl.ID)
+		}
+		delete(str.pending, fl.ID)
+		claimed = append(claimed, fl.ID)
+	}
+	str.jobs[meta.ID] = meta
+	str.lock.Unlock()
+
+	if err := str.commitJob(meta); err != nil {
+		str.lock.Lock()
+		if replaced {
+			str.jobs[meta.ID] = previous
+		} else {
+			delete(str.jobs, meta.ID)
+		}
+		for _, id := range claimed {
+			str.pending[id] = struct{}{}
+		}
+		str.lock.Unlock()
+		return err
+	}
+
+	// Remove the files no longer referenced,
+	// they're removed by Init if this is interrupted
+	for id := range released {
+		if err := os.Remove(str.contentPath(id)); err != nil {
+			return errors.Wrap(err, "removing released contents")
+		}
+	}
+	if len(released) > 0 {
+		return syncDir(str.filesDir())
+	}
+	return nil
+}
+
+// commitJob makes sure the contents are durable
+// and writes the job record
+func (str *Store) commitJob(meta jobMeta) error {
+	if err := syncDir(str.filesDir()); err != nil {
+		return err
+	}
+	if err := str.writeAtomic(
+		str.jobPath(meta.ID),
+		func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(meta)
+		},
+	); err != nil {
+		return errors.Wrap(err, "writing job record")
+	}
+	return syncDir(str.jobsDir())
+}
+
+// Job implements the Store interface
+func (str *Store) Job(ctx context.Context, id string) (store.Job, error) {
+	str.lock.RLock()
+	defer str.lock.RUnlock()
+
+	meta, exists := str.jobs[id]
+	if !exists {
+		return store.Job{}, store.ErrNotFound
+	}
+	return meta.record(), nil
+}
+
+// UnfinishedJobs implements the Store interface
+func (str *Store) UnfinishedJobs(ctx context.Context) ([]store.Job, error) {
+	str.lock.RLock()
+	defer str.lock.RUnlock()
+
+	jobs := make([]store.Job, 0)
+	for _, meta := range str.jobs {
+		if job := meta.record(); !job.Status.Finished() {
+			jobs = append(jobs, job)
+		}
+	}
+	store.SortJobs(jobs)
+	return jobs, nil
+}
+
+// FinishedJobs implements the Store interface
+func (str *Store) FinishedJobs(
+	ctx context.Context,
+	before time.Time,
+) ([]store.Job, error) {
+	str.lock.RLock()
+	defer str.lock.RUnlock()
+
+	jobs := make([]store.Job, 0)
+	for _, meta := range str.jobs {
+		job := meta.record()
+		if job.Status.Finished() && job.Finished.Before(before) {
+			jobs = append(jobs, job)
+		}
+	}
+	store.SortJobs(jobs)
+	return jobs, nil
+}
+
+// DeleteJob implements the Store interface.
+// The job record is removed first, the remaining contents are
+// removed by Init if the deletion is interrupted
+func (str *Store) DeleteJob(ctx context.Context, id string) error {
+	str.lock.Lock()
+	meta, exists := str.jobs[id]
+	delete(str.jobs, id)
+	str.lock.Unlock()
+
+	if !exists {
+		return store.ErrNotFound
+	}
+
+	if err := os.Remove(str.jobPath(id)); err != nil {
+		return errors.Wrap(err, "removing job record")
+	}
+	if err := syncDir(str.jobsDir()); err != nil {
+		return err
+	}
+
+	for _, fl := range meta.Files {
+		if err := os.Remove(str.contentPath(fl.ID)); err != nil {
+			return errors.Wrap(err, "removing contents")
+		}
+	}
+	if len(meta.Files) > 0 {
+		return syncDir(str.filesDir())
+	}
+	return nil
+}
+
+func (str *Store) readJob(id string) (meta jobMeta, err error) {
+	fl, err := os.Open(str.jobPath(id))
+	if err != nil {
+		return
+	}
+	defer fl.Close()
+	err = json.NewDecoder(fl).Decode(&meta)
+	return
+}
+
+func (str *Store) readArchive(id string) (meta archiveMeta, err error) {
+	fl, err := os.Open(str.archivePath(id))
+	if err != nil {
+		return
+	}
+	defer fl.Close()
+	err = json.NewDecoder(fl).Decode(&meta)
+	return
+}
+
+// writeAtomic writes a temporary file, syncs it and renames it to path
+func (str *Store) writeAtomic(path string, write func(io.Writer) error) error {
+	tmp, err := ioutil.TempFile(str.tempDir(), "write-")
+	if err != nil {
+		return errors.Wrap(err, "creating temporary file")
+	}
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "syncing temporary file")
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "closing temporary file")
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "renaming temporary file")
+	}
+	return nil
+}
+
+// validID returns true if the given ID
+// can safely be used as a file name
+func validID(id string) bool {
+	return id != "" &&
+		id == filepath.Base(id) &&
+		!strings.HasPrefix(id, ".")
+}
+
+// syncDir flushes directory entry changes (creations, renames, removals)
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "opening directory")
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return errors.Wrap(err, "syncing directory")
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package fs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/romshark/zipapi/store"
+	"github.com/romshark/zipapi/store/fs"
+	"github.com/romshark/zipapi/store/storetest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func saveTestArchive(t *testing.T, str store.Store) store.Archive {
+	archive := storetest.NewArchive(
+		t,
+		str,
+		storetest.File{Name: "foo.txt", Contents: "foo foo foo"},
+		storetest.File{Name: "empty.txt", Contents: ""},
+	)
+	require.NoError(t, str.SaveArchive(context.Background(), archive))
+	return archive
+}
+
+// TestReopen tests whether saved files survive reopening the store
+func TestReopen(t *testing.T) {
+	root, err := ioutil.TempDir("", "zipapi-fs-store-")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	str := fs.New(fs.Options{Root: root})
+	require.NoError(t, str.Init())
+	archive := saveTestArchive(t, str)
+	require.NoError(t, str.Close())
+
+	reopened := fs.New(fs.Options{Root: root})
+	require.NoError(t, reopened.Init())
+
+	saved, err := reopened.Archive(context.Background(), archive.ID)
+	require.NoError(t, err)
+	storetest.RequireEqualArchive(t, archive, saved)
+	require.Equal(
+		t,
+		"foo foo foo",
+		storetest.ReadFile(t, reopened, saved.Files[0].ID),
+	)
+}
+
+// TestInitCleanup tests whether Init removes leftovers of interrupted writes
+// keeping the files of archives and jobs
+func TestInitCleanup(t *testing.T) {
+	root, err := ioutil.TempDir("", "zipapi-fs-store-")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	str := fs.New(fs.Options{Root: root})
+	require.NoError(t, str.Init())
+	archive := saveTestArchive(t, str)
+	job := storetest.NewJob(t, str, storetest.File{
+		Name:     "bar.txt",
+		Contents: "bar bar bar",
+	})
+	require.NoError(t, str.SaveJob(context.Background(), job))
+
+	// Simulate a crash before the archive record was written
+	uncommitted := storetest.SaveFile(t, str, storetest.File{
+		Name:     "uncommitted.txt",
+		Contents: "x",
+	})
+
+	// Simulate a crash before the temporary file was renamed
+	tmp := filepath.Join(root, "tmp", "write-123")
+	require.NoError(t, ioutil.WriteFile(tmp, []byte("x"), 0640))
+
+	// The lock is released once the crashed process exits
+	require.NoError(t, str.Close())
+
+	reopened := fs.New(fs.Options{Root: root})
+	require.NoError(t, reopened.Init())
+
+	_, err = reopened.OpenFile(context.Background(), uncommitted.ID)
+	require.Equal(t, store.ErrNotFound, err)
+	_, err = os.Stat(tmp)
+	require.True(t, os.IsNotExist(err))
+
+	saved, err := reopened.Archive(context.Background(), archive.ID)
+	require.NoError(t, err)
+	storetest.RequireEqualArchive(t, archive, saved)
+
+	jobs, err := reopened.UnfinishedJobs(context.Background())
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	storetest.RequireEqualJob(t, job, jobs[0])
+	require.Equal(
+		t,
+		"bar bar bar",
+		storetest.ReadFile(t, reopened, job.Files[0].ID),
+	)
+}
+
+// TestInitCorrupted tests whether Init detects missing file contents
+// of committed archives
+func TestInitCorrupted(t *testing.T) {
+	root, err := ioutil.TempDir("", "zipapi-fs-store-")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	str := fs.New(fs.Options{Root: root})
+	require.NoError(t, str.Init())
+	archive := saveTestArchive(t, str)
+
+	require.NoError(t, str.Close())
+
+	// Remove the contents of a committed file
+	require.NoError(t, os.Remove(
+		filepath.Join(root, "files", archive.Files[0].ID),
+	))
+
+	require.Error(t, fs.New(fs.Options{Root: root}).Init())
+}
+
+// TestInitLocked tests whether Init refuses to use the store directory
+// of another instance keeping its pending files
+func TestInitLocked(t *testing.T) {
+	root, err := ioutil.TempDir("", "zipapi-fs-store-")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	str := fs.New(fs.Options{Root: root})
+	require.NoError(t, str.Init())
+	pending := storetest.SaveFile(t, str, storetest.File{
+		Name:     "pending.txt",
+		Contents: "pending",
+	})
+
+	second := fs.New(fs.Options{Root: root})
+	require.Equal(t, fs.ErrLocked, second.Init())
+	require.Equal(t, "pending", storetest.ReadFile(t, str, pending.ID))
+
+	require.NoError(t, str.Close())
+	require.NoError(t, second.Init())
+	require.NoError(t, second.Close())
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.Store, func()) {
+		root, err := ioutil.TempDir("", "zipapi-fs-store-")
+		require.NoError(t, err)
+
+		str := fs.New(fs.Options{Root: root})
+		require.NoError(t, str.Init())
+
+		return str, func() {
+			require.NoError(t, str.Close())
+			require.NoError(t, os.RemoveAll(root))
+		}
+	})
+}
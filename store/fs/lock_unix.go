@@ -0,0 +1,23 @@
+//go:build unix
+
+package fs
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// lockFile locks the given file exclusively without blocking.
+// Returns ErrLocked if it's locked already
+func lockFile(fl *os.File) error {
+	err := syscall.Flock(int(fl.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	switch err {
+	case nil:
+		return nil
+	case syscall.EWOULDBLOCK:
+		return ErrLocked
+	}
+	return errors.Wrap(err, "locking store")
+}
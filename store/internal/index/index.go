@@ -0,0 +1,158 @@
+// Package index provides an in-memory archive index
+// for store implementations keeping their records in memory
+package index
+
+import (
+	"sort"
+	"time"
+
+	"github.com/romshark/zipapi/store"
+)
+
+type key struct {
+	created time.Time
+	id      string
+}
+
+func (k key) less(other key) bool {
+	if k.created.Equal(other.created) {
+		return k.id < other.id
+	}
+	return k.created.Before(other.created)
+}
+
+// Index represents an in-memory index of archive records
+// ordered by their creation time and ID.
+// Index is not thread-safe
+type Index struct {
+	keys    []key
+	records map[string]store.Archive
+
+	// files maps the IDs of the archived files
+	// to the IDs of their archives
+	files map[string]string
+}
+
+// New creates a new empty index
+func New() *Index {
+	return &Index{
+		keys:    make([]key, 0),
+		records: make(map[string]store.Archive),
+		files:   make(map[string]string),
+	}
+}
+
+// search returns the position of the first key not less than k
+func (idx *Index) search(k key) int {
+	return sort.Search(len(idx.keys), func(i int) bool {
+		return !idx.keys[i].less(k)
+	})
+}
+
+// Insert adds the given record to the index.
+// Returns false if the ID of the record is already taken
+func (idx *Index) Insert(record store.Archive) bool {
+	if _, taken := idx.records[record.ID]; taken {
+		return false
+	}
+	k := key{created: record.Created, id: record.ID}
+	pos := idx.search(k)
+	idx.keys = append(idx.keys, key{})
+	copy(idx.keys[pos+1:], idx.keys[pos:])
+	idx.keys[pos] = k
+	idx.records[record.ID] = record
+	for _, file := range record.Files {
+		idx.files[file.ID] = record.ID
+	}
+	return true
+}
+
+// Remove removes the record identified by the given ID from the index.
+// Returns false if there's no such record
+func (idx *Index) Remove(id string) bool {
+	record, exists := idx.records[id]
+	if !exists {
+		return false
+	}
+	pos := idx.search(key{created: record.Created, id: record.ID})
+	idx.keys = append(idx.keys[:pos], idx.keys[pos+1:]...)
+	delete(idx.records, id)
+	for _, file := range record.Files {
+		delete(idx.files, file.ID)
+	}
+	return true
+}
+
+// Get returns the record identified by the given ID
+func (idx *Index) Get(id string) (store.Archive, bool) {
+	record, exists := idx.records[id]
+	return record, exists
+}
+
+// FileArchive returns the record of the archive
+// referencing the archived file identified by the given ID
+func (idx *Index) FileArchive(fileID string) (store.Archive, bool) {
+	id, exists := idx.files[fileID]
+	if !exists {
+		return store.Archive{}, false
+	}
+	return idx.records[id], true
+}
+
+// Len returns the number of indexed records
+func (idx *Index) Len() int { return len(idx.keys) }
+
+// All returns all records ordered by creation time, oldest first
+func (idx *Index) All() []store.Archive {
+	all := make([]store.Archive, len(idx.keys))
+	for i, k := range idx.keys {
+		all[i] = idx.records[k.id]
+	}
+	return all
+}
+
+// Query implements the store.Store query semantics
+func (idx *Index) Query(query store.ArchiveQuery) (store.ArchivePage, error) {
+	// Determine the position to start scanning backwards from
+	start := len(idx.keys)
+	if query.Cursor != "" {
+		created, id, err := store.DecodeCursor(query.Cursor)
+		if err != nil {
+			return store.ArchivePage{}, err
+		}
+		start = idx.search(key{created: created, id: id})
+	}
+	if !query.Until.IsZero() {
+		if until := idx.search(key{created: query.Until}); until < start {
+			start = until
+		}
+	}
+
+	page := store.ArchivePage{Archives: make([]store.Archive, 0)}
+	for i := start - 1; i >= 0; i-- {
+		k := idx.keys[i]
+		if !query.Since.IsZero() && k.created.Before(query.Since) {
+			break
+		}
+		record := idx.records[k.id]
+		if !query.Match(record) {
+			continue
+		}
+		if query.Limit > 0 && len(page.Archives) >= query.Limit {
+			last := page.Archives[len(page.Archives)-1]
+			page.Cursor = store.EncodeCursor(last.Created, last.ID)
+			break
+		}
+		page.Archives = append(page.Archives, Copy(record))
+	}
+	return page, nil
+}
+
+// Copy returns a copy of the given record
+// not sharing its list of files
+func Copy(record store.Archive) store.Archive {
+	files := make([]store.File, len(record.Files))
+	copy(files, record.Files)
+	record.Files = files
+	return record
+}
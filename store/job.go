@@ -0,0 +1,97 @@
+package store
+
+import (
+	"sort"
+	"time"
+)
+
+// JobStatus represents the status of an asynchronous archive job
+type JobStatus string
+
+const (
+	// JobQueued is the status of a job waiting for a worker
+	JobQueued JobStatus = "queued"
+
+	// JobRunning is the status of a job being archived
+	JobRunning JobStatus = "running"
+
+	// JobDone is the status of a job whose archive was saved
+	JobDone JobStatus = "done"
+
+	// JobFailed is the status of a job which couldn't be archived
+	JobFailed JobStatus = "failed"
+)
+
+// Finished returns true if the job is either done or failed
+func (s JobStatus) Finished() bool {
+	return s == JobDone || s == JobFailed
+}
+
+// JobOptions represents the archive options of a job
+type JobOptions struct {
+	// Format defines the archive format (zip, tar, tar.gz or tar.zst)
+	Format string
+
+	// Compression and Level define the compression method and level
+	Compression string
+	Level       int
+
+	// Checksums defines the checksums entry written
+	// at the end of the archive, none if empty
+	Checksums string
+
+	// Deterministic enables the deterministic mode
+	// using ModTime as the default modification time
+	Deterministic bool
+	ModTime       time.Time
+}
+
+// Job represents an asynchronous archive job
+type Job struct {
+	// ID uniquely identifies the job
+	ID string
+
+	// Created defines the time the files were uploaded at
+	Created time.Time
+
+	// ClientAgent defines the user agent of the client
+	// the job was created for
+	ClientAgent string
+
+	Status  JobStatus
+	Options JobOptions
+
+	// Files lists the uploaded files named by their archive paths
+	// in the order of archivation. The files are committed by the job
+	// and must no longer be referenced once it's finished
+	Files []File
+
+	// Directories lists the explicit directories of the archive
+	Directories []string
+
+	// Comment defines the archive comment
+	Comment string
+
+	// Size defines the total size of the uploaded files in bytes
+	Size int64
+
+	// ArchiveID identifies the created archive once the job is done
+	ArchiveID string
+
+	// Error describes why the job failed
+	Error string
+
+	// Finished defines the time the job finished at,
+	// it's zero until the job is finished
+	Finished time.Time
+}
+
+// SortJobs sorts the jobs by their creation time, oldest first
+func SortJobs(jobs []Job) {
+	sort.SliceStable(jobs, func(i, j int) bool {
+		if jobs[i].Created.Equal(jobs[j].Created) {
+			return jobs[i].ID < jobs[j].ID
+		}
+		return jobs[i].Created.Before(jobs[j].Created)
+	})
+}
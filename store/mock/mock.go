@@ -1,43 +1,334 @@
 package mock
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"sync"
+	"time"
 
 	"github.com/romshark/zipapi/store"
+	"github.com/romshark/zipapi/store/internal/index"
 )
 
+func init() {
+	store.Register("mock", func(store.OptionsDecoder) (store.Store, error) {
+		return new(Store), nil
+	})
+}
+
+type file struct {
+	contents  []byte
+	committed bool
+}
+
 // Store represents an in-memory store mock-implementation
 type Store struct {
-	lock       *sync.RWMutex
-	savedFiles []store.File
+	lock     *sync.RWMutex
+	files    map[string]*file
+	archives *index.Index
+	jobs     map[string]store.Job
 }
 
-// SavedFiles returns copies of all stored files
-func (str *Store) SavedFiles() []store.File {
+type readCloser struct{ *bytes.Reader }
+
+func (readCloser) Close() error { return nil }
+
+// SavedArchives returns copies of all stored archive records
+// ordered by their creation time
+func (str *Store) SavedArchives() []store.Archive {
 	str.lock.RLock()
 	defer str.lock.RUnlock()
 
-	cp := make([]store.File, len(str.savedFiles))
-	for ix, fl := range str.savedFiles {
-		flc := fl
-		copy(flc.Contents, fl.Contents)
-		cp[ix] = flc
+	cp := str.archives.All()
+	for ix, arch := range cp {
+		cp[ix] = index.Copy(arch)
 	}
 	return cp
 }
 
+// SavedFiles returns all stored files of all stored archives
+func (str *Store) SavedFiles() []store.File {
+	archives := str.SavedArchives()
+	files := make([]store.File, 0, len(archives))
+	for _, arch := range archives {
+		files = append(files, arch.Files...)
+	}
+	return files
+}
+
+// UncommittedFiles returns the number of saved files
+// not yet referenced by any archive or job
+func (str *Store) UncommittedFiles() int {
+	str.lock.RLock()
+	defer str.lock.RUnlock()
+
+	count := 0
+	for _, fl := range str.files {
+		if !fl.committed {
+			count++
+		}
+	}
+	return count
+}
+
 // Init implements the Store interface
 func (str *Store) Init() error {
 	str.lock = &sync.RWMutex{}
-	str.savedFiles = make([]store.File, 0)
+	str.files = make(map[string]*file)
+	str.archives = index.New()
+	str.jobs = make(map[string]store.Job)
+
+	return nil
+}
+
+// Close implements the Store interface
+func (str *Store) Close() error { return nil }
+
+// SaveFile implements the Store interface
+func (str *Store) SaveFile(
+	ctx context.Context,
+	fl store.File,
+	contents io.Reader,
+) (store.File, error) {
+	b, err := ioutil.ReadAll(store.ContextReader(ctx, contents))
+	if err != nil {
+		return store.File{}, err
+	}
+	id, err := store.NewID()
+	if err != nil {
+		return store.File{}, err
+	}
+	fl.ID = id
+	fl.Size = int64(len(b))
+
+	str.lock.Lock()
+	defer str.lock.Unlock()
+
+	str.files[id] = &file{contents: b}
+	return fl, nil
+}
+
+// OpenFile implements the Store interface
+func (str *Store) OpenFile(
+	ctx context.Context,
+	id string,
+) (io.ReadSeekCloser, error) {
+	str.lock.RLock()
+	defer str.lock.RUnlock()
+
+	fl, exists := str.files[id]
+	if !exists {
+		return nil, store.ErrNotFound
+	}
+	return readCloser{bytes.NewReader(fl.contents)}, nil
+}
+
+// DeleteFile implements the Store interface
+func (str *Store) DeleteFile(ctx context.Context, id string) error {
+	str.lock.Lock()
+	defer str.lock.Unlock()
+
+	fl, exists := str.files[id]
+	if !exists || fl.committed {
+		return store.ErrNotFound
+	}
+	delete(str.files, id)
+	return nil
+}
+
+// SaveArchive implements the Store interface
+func (str *Store) SaveArchive(
+	ctx context.Context,
+	archive store.Archive,
+) error {
+	archive = index.Copy(archive)
+
+	str.lock.Lock()
+	defer str.lock.Unlock()
+
+	if _, taken := str.archives.Get(archive.ID); taken {
+		return fmt.Errorf("duplicate archive ID: '%s'", archive.ID)
+	}
+	ids := make([]string, 0, len(archive.Files)+1)
+	for _, fl := range archive.Files {
+		ids = append(ids, fl.ID)
+	}
+	ids = append(ids, archive.ContentsID)
+	for _, id := range ids {
+		fl, exists := str.files[id]
+		if !exists {
+			return fmt.Errorf("referenced file not found: '%s'", id)
+		}
+		if fl.committed {
+			return fmt.Errorf("referenced file already committed: '%s'", id)
+		}
+	}
+	for _, id := range ids {
+		str.files[id].committed = true
+	}
+	str.archives.Insert(archive)
+	return nil
+}
+
+// Archive implements the Store interface
+func (str *Store) Archive(
+	ctx context.Context,
+	id string,
+) (store.Archive, error) {
+	str.lock.RLock()
+	defer str.lock.RUnlock()
+
+	arch, exists := str.archives.Get(id)
+	if !exists {
+		return store.Archive{}, store.ErrNotFound
+	}
+	return index.Copy(arch), nil
+}
+
+// FileArchive implements the Store interface
+func (str *Store) FileArchive(
+	ctx context.Context,
+	fileID string,
+) (store.Archive, error) {
+	str.lock.RLock()
+	defer str.lock.RUnlock()
+
+	arch, exists := str.archives.FileArchive(fileID)
+	if !exists {
+		return store.Archive{}, store.ErrNotFound
+	}
+	return index.Copy(arch), nil
+}
+
+// QueryArchives implements the Store interface
+func (str *Store) QueryArchives(
+	ctx context.Context,
+	query store.ArchiveQuery,
+) (store.ArchivePage, error) {
+	str.lock.RLock()
+	defer str.lock.RUnlock()
 
+	return str.archives.Query(query)
+}
+
+// DeleteArchive implements the Store interface
+func (str *Store) DeleteArchive(ctx context.Context, id string) error {
+	str.lock.Lock()
+	defer str.lock.Unlock()
+
+	arch, exists := str.archives.Get(id)
+	if !exists {
+		return store.ErrNotFound
+	}
+	str.archives.Remove(id)
+	for _, fl := range arch.Files {
+		delete(str.files, fl.ID)
+	}
+	delete(str.files, arch.ContentsID)
+	return nil
+}
+
+// SaveJob implements the Store interface
+func (str *Store) SaveJob(ctx context.Context, job store.Job) error {
+	job = copyJob(job)
+
+	str.lock.Lock()
+	defer str.lock.Unlock()
+
+	previous := make(map[string]struct{})
+	for _, fl := range str.jobs[job.ID].Files {
+		previous[fl.ID] = struct{}{}
+	}
+	for _, fl := range job.Files {
+		if _, ok := previous[fl.ID]; ok {
+			continue
+		}
+		saved, exists := str.files[fl.ID]
+		if !exists {
+			return fmt.Errorf("referenced file not found: '%s'", fl.ID)
+		}
+		if saved.committed {
+			return fmt.Errorf("referenced file already committed: '%s'", fl.ID)
+		}
+	}
+	for _, fl := range job.Files {
+		str.files[fl.ID].committed = true
+		delete(previous, fl.ID)
+	}
+	for id := range previous {
+		delete(str.files, id)
+	}
+	str.jobs[job.ID] = job
 	return nil
 }
 
-// SaveFiles implements the Store interface
-func (str *Store) SaveFiles(files ...store.File) error {
+// Job implements the Store interface
+func (str *Store) Job(ctx context.Context, id string) (store.Job, error) {
+	str.lock.RLock()
+	defer str.lock.RUnlock()
+
+	job, exists := str.jobs[id]
+	if !exists {
+		return store.Job{}, store.ErrNotFound
+	}
+	return copyJob(job), nil
+}
+
+// UnfinishedJobs implements the Store interface
+func (str *Store) UnfinishedJobs(ctx context.Context) ([]store.Job, error) {
+	str.lock.RLock()
+	defer str.lock.RUnlock()
+
+	jobs := make([]store.Job, 0)
+	for _, job := range str.jobs {
+		if !job.Status.Finished() {
+			jobs = append(jobs, copyJob(job))
+		}
+	}
+	store.SortJobs(jobs)
+	return jobs, nil
+}
+
+// FinishedJobs implements the Store interface
+func (str *Store) FinishedJobs(
+	ctx context.Context,
+	before time.Time,
+) ([]store.Job, error) {
+	str.lock.RLock()
+	defer str.lock.RUnlock()
+
+	jobs := make([]store.Job, 0)
+	for _, job := range str.jobs {
+		if job.Status.Finished() && job.Finished.Before(before) {
+			jobs = append(jobs, copyJob(job))
+		}
+	}
+	store.SortJobs(jobs)
+	return jobs, nil
+}
+
+// DeleteJob implements the Store interface
+func (str *Store) DeleteJob(ctx context.Context, id string) error {
 	str.lock.Lock()
-	str.savedFiles = append(str.savedFiles, files...)
-	str.lock.Unlock()
+	defer str.lock.Unlock()
+
+	job, exists := str.jobs[id]
+	if !exists {
+		return store.ErrNotFound
+	}
+	delete(str.jobs, id)
+	for _, fl := range job.Files {
+		delete(str.files, fl.ID)
+	}
 	return nil
 }
+
+// copyJob returns a deep copy of the given job
+func copyJob(job store.Job) store.Job {
+	job.Files = append([]store.File(nil), job.Files...)
+	job.Directories = append([]string(nil), job.Directories...)
+	return job
+}
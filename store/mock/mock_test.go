@@ -0,0 +1,21 @@
+package mock_test
+
+import (
+	"testing"
+
+	"github.com/romshark/zipapi/store"
+	"github.com/romshark/zipapi/store/mock"
+	"github.com/romshark/zipapi/store/storetest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.Store, func()) {
+		str := new(mock.Store)
+		require.NoError(t, str.Init())
+		return str, func() {
+			require.NoError(t, str.Close())
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ArchiveQuery defines the filters and the page of an archive query.
+// Zero values don't filter
+type ArchiveQuery struct {
+	// Since excludes archives created before the given time
+	Since time.Time
+
+	// Until excludes archives created at or after the given time
+	Until time.Time
+
+	// ClientAgent excludes archives of client agents
+	// not containing the given substring
+	ClientAgent string
+
+	// FileName excludes archives containing no file
+	// with a name containing the given substring
+	FileName string
+
+	// MinSize excludes archives smaller than the given size in bytes
+	MinSize int64
+
+	// MaxSize excludes archives bigger than the given size in bytes
+	MaxSize int64
+
+	// Cursor continues the query after the last archive of a previous page
+	Cursor string
+
+	// Limit defines the maximum number of archives per page,
+	// the number is unlimited if it's zero
+	Limit int
+}
+
+// Match returns true if the given archive matches the query filters
+func (q ArchiveQuery) Match(archive Archive) bool {
+	if !q.Since.IsZero() && archive.Created.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !archive.Created.Before(q.Until) {
+		return false
+	}
+	if !strings.Contains(archive.ClientAgent, q.ClientAgent) {
+		return false
+	}
+	if q.MinSize != 0 && archive.Size < q.MinSize {
+		return false
+	}
+	if q.MaxSize != 0 && archive.Size > q.MaxSize {
+		return false
+	}
+	if q.FileName != "" {
+		for _, fl := range archive.Files {
+			if strings.Contains(fl.Name, q.FileName) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// ArchivePage represents a page of archive query results
+type ArchivePage struct {
+	// Archives lists the archives of the page
+	Archives []Archive
+
+	// Cursor points to the next page,
+	// it's empty if there are no more archives to be expected
+	Cursor string
+}
+
+// ErrInvalidCursor is returned when a query cursor is malformed
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// EncodeCursor encodes a query cursor pointing to the archive
+// identified by the given creation time and ID
+func EncodeCursor(created time.Time, id string) string {
+	b := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(b, uint64(created.UnixNano()))
+	return base64.RawURLEncoding.EncodeToString(append(b, id...))
+}
+
+// DecodeCursor decodes a query cursor returning the creation time and ID
+// of the archive it points to
+func DecodeCursor(cursor string) (created time.Time, id string, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(b) < 9 {
+		err = ErrInvalidCursor
+		return
+	}
+	created = time.Unix(0, int64(binary.BigEndian.Uint64(b[:8])))
+	id = string(b[8:])
+	return
+}
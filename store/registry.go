@@ -0,0 +1,71 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// OptionsDecoder decodes the backend-specific options into v
+type OptionsDecoder func(v interface{}) error
+
+// Factory creates a new uninitialized store instance
+// reading its backend-specific options through the given decoder
+type Factory func(decodeOptions OptionsDecoder) (Store, error)
+
+var (
+	registryLock = &sync.RWMutex{}
+	registry     = map[string]Factory{}
+)
+
+// Register makes a store backend available under the given name.
+// Backend implementations are expected to register themselves
+// in their package's init function.
+// Register panics if the name is already taken or the factory is nil
+func Register(name string, factory Factory) {
+	if factory == nil {
+		panic(fmt.Errorf("store backend '%s': nil factory", name))
+	}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, taken := registry[name]; taken {
+		panic(fmt.Errorf("store backend '%s' registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// New creates a new uninitialized store instance of the given backend
+func New(backend string, decodeOptions OptionsDecoder) (Store, error) {
+	registryLock.RLock()
+	factory, registered := registry[backend]
+	registryLock.RUnlock()
+
+	if !registered {
+		return nil, fmt.Errorf(
+			"unknown store backend: '%s' (available: %v)",
+			backend,
+			Backends(),
+		)
+	}
+
+	if decodeOptions == nil {
+		decodeOptions = func(interface{}) error { return nil }
+	}
+
+	return factory(decodeOptions)
+}
+
+// Backends returns the sorted names of all registered store backends
+func Backends() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
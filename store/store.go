@@ -1,6 +1,15 @@
 package store
 
-import "time"
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
 
 // UploadInfo represents information about an uploader of a file
 type UploadInfo struct {
@@ -8,21 +17,178 @@ type UploadInfo struct {
 	ClientAgent string
 }
 
-// File represents an uploaded file
+// File represents a stored file
 type File struct {
-	Upload   UploadInfo
-	Name     string
-	Contents []byte
+	// ID uniquely identifies the file, it's assigned by the store
+	ID string
+
+	Upload UploadInfo
+	Name   string
+
+	// Size defines the size of the file in bytes,
+	// it's determined by the store
+	Size int64
+
+	// ModTime defines the modification time supplied by the client,
+	// it's zero if the client didn't supply any
+	ModTime time.Time
+
+	// Mode defines the Unix permission bits supplied by the client,
+	// it's zero if the client didn't supply any
+	Mode os.FileMode
+
+	// Comment defines the entry comment supplied by the client
+	Comment string
+
+	// Checksum defines the hex encoded SHA-256 checksum
+	// of the uploaded contents
+	Checksum string
 }
 
-// Store represents an abstract store
+// Archive represents a generated archive and the files it was made of
+type Archive struct {
+	// ID uniquely identifies the archive
+	ID string
+
+	// Created defines the time the archive was created at
+	Created time.Time
+
+	// ClientAgent defines the user agent of the client
+	// the archive was created for
+	ClientAgent string
+
+	// Files lists the archived files in the order of archivation
+	Files []File
+
+	// ContentsID identifies the stored file
+	// holding the compressed archive
+	ContentsID string
+
+	// Size defines the size of the compressed archive in bytes
+	Size int64
+
+	// Checksum defines the hex encoded SHA-256 checksum
+	// of the compressed archive
+	Checksum string
+
+	// Format defines the archive format (zip, tar, tar.gz or tar.zst),
+	// archives without a format are zip archives
+	Format string
+
+	// Encrypted is true if the archive is password protected.
+	// The files of encrypted archives are neither stored nor listed
+	Encrypted bool
+
+	// Comment defines the archive comment supplied by the client
+	Comment string
+}
+
+// Store represents an abstract store.
+//
+// File contents are written and read as streams and never need to fit
+// into memory entirely. A saved file remains uncommitted until
+// it's referenced by a saved archive record, either as one of the
+// archived files or as the compressed archive itself, or by a saved
+// job record. Uncommitted files are removed by the store
+// when it's initialized.
+//
+// All methods except Init and Close are thread-safe
+// and can safely be used by multiple goroutines concurrently
 type Store interface {
 	// Init initializes the store
 	Init() error
 
-	// SaveFiles saves the given files to the store
-	//
-	// This method is thread-safe and can safely be used by
-	// multiple goroutines concurrently
-	SaveFiles(files ...File) error
+	// Close releases all resources held by the store
+	Close() error
+
+	// SaveFile saves a new uncommitted file reading its contents
+	// from the given reader until EOF.
+	// Returns the saved file with its ID and size assigned
+	SaveFile(ctx context.Context, file File, contents io.Reader) (File, error)
+
+	// OpenFile opens the contents of the file identified by the given ID
+	// for reading. Returns ErrNotFound if there's no such file
+	OpenFile(ctx context.Context, id string) (io.ReadSeekCloser, error)
+
+	// DeleteFile removes the uncommitted file identified by the given ID.
+	// Returns ErrNotFound if there's no such uncommitted file
+	DeleteFile(ctx context.Context, id string) error
+
+	// SaveArchive saves the given archive record committing all files
+	// it references. Either the entire archive is saved or nothing at all
+	SaveArchive(ctx context.Context, archive Archive) error
+
+	// Archive returns the archive record identified by the given ID.
+	// Returns ErrNotFound if there's no such archive
+	Archive(ctx context.Context, id string) (Archive, error)
+
+	// FileArchive returns the record of the archive
+	// referencing the archived file identified by the given ID.
+	// Returns ErrNotFound if no archive references such a file
+	FileArchive(ctx context.Context, fileID string) (Archive, error)
+
+	// QueryArchives returns a page of the archive records matching the query.
+	// Archives are ordered by their creation time, newest first.
+	// Returns ErrInvalidCursor if the query cursor is malformed
+	QueryArchives(ctx context.Context, query ArchiveQuery) (ArchivePage, error)
+
+	// DeleteArchive removes the archive identified by the given ID
+	// including all files it references from the store.
+	// Returns ErrNotFound if there's no such archive
+	DeleteArchive(ctx context.Context, id string) error
+
+	// SaveJob saves the given job record replacing the previous record
+	// of the job, if any, committing all files it references.
+	// Files referenced by the previous record but not by the given one
+	// are removed from the store
+	SaveJob(ctx context.Context, job Job) error
+
+	// Job returns the job record identified by the given ID.
+	// Returns ErrNotFound if there's no such job
+	Job(ctx context.Context, id string) (Job, error)
+
+	// UnfinishedJobs returns the records of all jobs which are
+	// neither done nor failed ordered by their creation time, oldest first
+	UnfinishedJobs(ctx context.Context) ([]Job, error)
+
+	// FinishedJobs returns the records of all jobs which
+	// finished before the given time ordered by their creation time,
+	// oldest first
+	FinishedJobs(ctx context.Context, before time.Time) ([]Job, error)
+
+	// DeleteJob removes the job record identified by the given ID
+	// including all files it references from the store.
+	// Returns ErrNotFound if there's no such job
+	DeleteJob(ctx context.Context, id string) error
+}
+
+// ErrNotFound is returned when a requested record doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// NewID generates a new random unique identifier
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "generating ID")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// contextReader fails reading once the context is canceled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// ContextReader returns a reader reading from r
+// which fails once the given context is canceled
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return contextReader{ctx: ctx, r: r}
 }
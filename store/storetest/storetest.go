@@ -0,0 +1,788 @@
+// Package storetest provides the behavior tests
+// every store.Store implementation must pass
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/romshark/zipapi/store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Setup creates a new initialized store instance for an individual test
+// and a teardown function which closes the store and removes its data
+type Setup func(t *testing.T) (str store.Store, teardown func())
+
+var (
+	testTime       = time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC)
+	testTimeOffset time.Duration
+	testTimeLock   = &sync.Mutex{}
+)
+
+// File represents the name and contents of a test file
+type File struct {
+	Name     string
+	Contents string
+}
+
+// SaveFile saves a test file and returns the saved file
+func SaveFile(t require.TestingT, str store.Store, fl File) store.File {
+	saved, err := str.SaveFile(context.Background(), store.File{
+		Upload: store.UploadInfo{
+			Time:        testTime,
+			ClientAgent: "storetest",
+		},
+		Name: fl.Name,
+	}, strings.NewReader(fl.Contents))
+	require.NoError(t, err)
+	require.NotEmpty(t, saved.ID)
+	require.Equal(t, fl.Name, saved.Name)
+	require.Equal(t, int64(len(fl.Contents)), saved.Size)
+	return saved
+}
+
+// ReadFile reads the contents of the file identified by id
+func ReadFile(t require.TestingT, str store.Store, id string) string {
+	fl, err := str.OpenFile(context.Background(), id)
+	require.NoError(t, err)
+	defer fl.Close()
+	contents, err := ioutil.ReadAll(fl)
+	require.NoError(t, err)
+	return string(contents)
+}
+
+// NewArchive saves the given test files and the compressed archive
+// returning an archive record referencing them which is not yet saved.
+// Each subsequently created archive is one minute younger
+func NewArchive(
+	t require.TestingT,
+	str store.Store,
+	files ...File,
+) store.Archive {
+	id, err := store.NewID()
+	require.NoError(t, err)
+
+	testTimeLock.Lock()
+	created := testTime.Add(testTimeOffset)
+	testTimeOffset += time.Minute
+	testTimeLock.Unlock()
+
+	archive := store.Archive{
+		ID:          id,
+		Created:     created,
+		ClientAgent: "storetest",
+		Files:       make([]store.File, len(files)),
+		Checksum:    "c0ffee",
+		Format:      "zip",
+	}
+	for i, fl := range files {
+		archive.Files[i] = SaveFile(t, str, fl)
+	}
+	contents := SaveFile(t, str, File{
+		Name:     id + ".zip",
+		Contents: "archive " + id,
+	})
+	archive.ContentsID = contents.ID
+	archive.Size = contents.Size
+	return archive
+}
+
+// RequireEqualArchive compares the archive records
+func RequireEqualArchive(t require.TestingT, expected, actual store.Archive) {
+	require.Equal(t, expected.ID, actual.ID)
+	require.True(t, expected.Created.Equal(actual.Created))
+	require.Equal(t, expected.ClientAgent, actual.ClientAgent)
+	require.Equal(t, expected.ContentsID, actual.ContentsID)
+	require.Equal(t, expected.Size, actual.Size)
+	require.Equal(t, expected.Checksum, actual.Checksum)
+	require.Equal(t, expected.Format, actual.Format)
+	require.Equal(t, expected.Encrypted, actual.Encrypted)
+	require.Equal(t, expected.Comment, actual.Comment)
+	require.Len(t, actual.Files, len(expected.Files))
+	for i, expected := range expected.Files {
+		actual := actual.Files[i]
+		require.Equal(t, expected.ID, actual.ID)
+		require.Equal(t, expected.Name, actual.Name)
+		require.Equal(t, expected.Size, actual.Size)
+		require.True(t, expected.Upload.Time.Equal(actual.Upload.Time))
+		require.True(t, expected.ModTime.Equal(actual.ModTime))
+		require.Equal(t, expected.Mode, actual.Mode)
+		require.Equal(t, expected.Comment, actual.Comment)
+		require.Equal(t, expected.Checksum, actual.Checksum)
+		require.Equal(
+			t,
+			expected.Upload.ClientAgent,
+			actual.Upload.ClientAgent,
+		)
+	}
+}
+
+// NewJob saves the given test files returning a queued job record
+// referencing them which is not yet saved.
+// Each subsequently created job is one minute younger
+func NewJob(t require.TestingT, str store.Store, files ...File) store.Job {
+	id, err := store.NewID()
+	require.NoError(t, err)
+
+	testTimeLock.Lock()
+	created := testTime.Add(testTimeOffset)
+	testTimeOffset += time.Minute
+	testTimeLock.Unlock()
+
+	job := store.Job{
+		ID:          id,
+		Created:     created,
+		ClientAgent: "storetest",
+		Status:      store.JobQueued,
+		Options: store.JobOptions{
+			Format:        "tar.gz",
+			Compression:   "deflate",
+			Level:         6,
+			Checksums:     "manifest",
+			Deterministic: true,
+			ModTime:       testTime,
+		},
+		Files:       make([]store.File, len(files)),
+		Directories: []string{"empty"},
+		Comment:     "job comment",
+	}
+	for i, fl := range files {
+		job.Files[i] = SaveFile(t, str, fl)
+		job.Size += job.Files[i].Size
+	}
+	return job
+}
+
+// RequireEqualJob compares the job records
+func RequireEqualJob(t require.TestingT, expected, actual store.Job) {
+	require.Equal(t, expected.ID, actual.ID)
+	require.True(t, expected.Created.Equal(actual.Created))
+	require.Equal(t, expected.ClientAgent, actual.ClientAgent)
+	require.Equal(t, expected.Status, actual.Status)
+	require.Equal(t, expected.Options.Format, actual.Options.Format)
+	require.Equal(t, expected.Options.Compression, actual.Options.Compression)
+	require.Equal(t, expected.Options.Level, actual.Options.Level)
+	require.Equal(t, expected.Options.Checksums, actual.Options.Checksums)
+	require.Equal(
+		t,
+		expected.Options.Deterministic,
+		actual.Options.Deterministic,
+	)
+	require.True(t, expected.Options.ModTime.Equal(actual.Options.ModTime))
+	require.Equal(t, len(expected.Directories), len(actual.Directories))
+	for i, dir := range expected.Directories {
+		require.Equal(t, dir, actual.Directories[i])
+	}
+	require.Equal(t, expected.Comment, actual.Comment)
+	require.Equal(t, expected.Size, actual.Size)
+	require.Equal(t, expected.ArchiveID, actual.ArchiveID)
+	require.Equal(t, expected.Error, actual.Error)
+	require.True(t, expected.Finished.Equal(actual.Finished))
+	require.Len(t, actual.Files, len(expected.Files))
+	for i, expected := range expected.Files {
+		actual := actual.Files[i]
+		require.Equal(t, expected.ID, actual.ID)
+		require.Equal(t, expected.Name, actual.Name)
+		require.Equal(t, expected.Size, actual.Size)
+		require.True(t, expected.ModTime.Equal(actual.ModTime))
+		require.Equal(t, expected.Mode, actual.Mode)
+		require.Equal(t, expected.Comment, actual.Comment)
+	}
+}
+
+// savedArchives returns all saved archive records, newest first
+func savedArchives(t *testing.T, str store.Store) []store.Archive {
+	page, err := str.QueryArchives(
+		context.Background(),
+		store.ArchiveQuery{},
+	)
+	require.NoError(t, err)
+	require.Empty(t, page.Cursor)
+	return page.Archives
+}
+
+// Run runs the store behavior tests
+func Run(t *testing.T, setup Setup) {
+	ctx := context.Background()
+
+	// Empty tests whether a new store is empty
+	t.Run("Empty", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		require.Len(t, savedArchives(t, str), 0)
+	})
+
+	// SaveFile tests saving and reading files
+	t.Run("SaveFile", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		// Large enough to span multiple chunks or buffers
+		large := make([]byte, 1024*1024+3)
+		for i := range large {
+			large[i] = byte(i % 251)
+		}
+
+		files := []File{
+			{Name: "foo.txt", Contents: "foo foo foo"},
+			{Name: "empty.txt", Contents: ""},
+			{Name: "large.bin", Contents: string(large)},
+		}
+		saved := make([]store.File, len(files))
+		for i, fl := range files {
+			saved[i] = SaveFile(t, str, fl)
+		}
+		for i, fl := range files {
+			require.Equal(t, fl.Contents, ReadFile(t, str, saved[i].ID))
+		}
+
+		// Seek
+		rd, err := str.OpenFile(ctx, saved[2].ID)
+		require.NoError(t, err)
+		defer rd.Close()
+		pos, err := rd.Seek(512*1024-2, io.SeekStart)
+		require.NoError(t, err)
+		require.Equal(t, int64(512*1024-2), pos)
+		part := make([]byte, 4)
+		_, err = io.ReadFull(rd, part)
+		require.NoError(t, err)
+		require.Equal(t, large[pos:pos+4], part)
+
+		_, err = str.OpenFile(ctx, "inexistent")
+		require.Equal(t, store.ErrNotFound, err)
+	})
+
+	// SaveFileCanceled tests saving a file with a canceled context
+	t.Run("SaveFileCanceled", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := str.SaveFile(
+			canceled,
+			store.File{Name: "foo.txt"},
+			bytes.NewReader([]byte("foo")),
+		)
+		require.Error(t, err)
+	})
+
+	// DeleteFile tests deleting uncommitted files
+	t.Run("DeleteFile", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		fl := SaveFile(t, str, File{Name: "foo.txt", Contents: "foo"})
+		require.NoError(t, str.DeleteFile(ctx, fl.ID))
+
+		_, err := str.OpenFile(ctx, fl.ID)
+		require.Equal(t, store.ErrNotFound, err)
+		require.Equal(t, store.ErrNotFound, str.DeleteFile(ctx, fl.ID))
+	})
+
+	// SaveArchive tests saving archives
+	t.Run("SaveArchive", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		archives := []store.Archive{
+			NewArchive(
+				t,
+				str,
+				File{Name: "foo.txt", Contents: "foo foo foo"},
+				File{Name: "bar.txt", Contents: "bar bar bar bar"},
+				File{Name: "empty.txt", Contents: ""},
+			),
+			NewArchive(t, str, File{Name: "baz.txt", Contents: "baz"}),
+		}
+		for _, archive := range archives {
+			require.NoError(t, str.SaveArchive(ctx, archive))
+		}
+
+		saved := savedArchives(t, str)
+		require.Len(t, saved, len(archives))
+		RequireEqualArchive(t, archives[1], saved[0])
+		RequireEqualArchive(t, archives[0], saved[1])
+
+		require.Equal(
+			t,
+			"archive "+archives[0].ID,
+			ReadFile(t, str, archives[0].ContentsID),
+		)
+		require.Equal(
+			t,
+			"bar bar bar bar",
+			ReadFile(t, str, archives[0].Files[1].ID),
+		)
+
+		// Committed files can only be deleted with their archive
+		require.Equal(
+			t,
+			store.ErrNotFound,
+			str.DeleteFile(ctx, archives[0].Files[0].ID),
+		)
+		require.Equal(
+			t,
+			"foo foo foo",
+			ReadFile(t, str, archives[0].Files[0].ID),
+		)
+	})
+
+	// SaveArchiveUnknownFile tests saving an archive
+	// referencing files that weren't saved
+	t.Run("SaveArchiveUnknownFile", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		archive := NewArchive(t, str, File{Name: "foo.txt", Contents: "foo"})
+		archive.Files = append(archive.Files, store.File{
+			ID:   "inexistent",
+			Name: "bar.txt",
+		})
+		require.Error(t, str.SaveArchive(ctx, archive))
+
+		_, err := str.Archive(ctx, archive.ID)
+		require.Equal(t, store.ErrNotFound, err)
+		require.Len(t, savedArchives(t, str), 0)
+
+		// The saved files must remain uncommitted
+		require.NoError(t, str.DeleteFile(ctx, archive.Files[0].ID))
+	})
+
+	// SaveArchiveDuplicateID tests saving an archive with a taken ID
+	t.Run("SaveArchiveDuplicateID", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		archive := NewArchive(t, str, File{Name: "foo.txt", Contents: "foo"})
+		require.NoError(t, str.SaveArchive(ctx, archive))
+
+		duplicate := NewArchive(t, str, File{Name: "bar.txt", Contents: "bar"})
+		duplicate.ID = archive.ID
+		duplicate.Created = archive.Created
+		require.Error(t, str.SaveArchive(ctx, duplicate))
+
+		saved := savedArchives(t, str)
+		require.Len(t, saved, 1)
+		RequireEqualArchive(t, archive, saved[0])
+	})
+
+	// Archive tests reading archives by ID
+	t.Run("Archive", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		archives := []store.Archive{
+			NewArchive(t, str, File{Name: "foo.txt", Contents: "foo"}),
+			NewArchive(t, str, File{Name: "bar.txt", Contents: "bar"}),
+		}
+		archives[0].Encrypted = true
+		archives[1].Format = "tar.gz"
+		archives[1].Comment = "bar archive"
+		archives[1].Files[0].ModTime = testTime.Add(-time.Hour)
+		archives[1].Files[0].Mode = 0755
+		archives[1].Files[0].Comment = "bar file"
+		archives[1].Files[0].Checksum = "fcde2b2e"
+		for _, archive := range archives {
+			require.NoError(t, str.SaveArchive(ctx, archive))
+		}
+
+		for _, expected := range archives {
+			actual, err := str.Archive(ctx, expected.ID)
+			require.NoError(t, err)
+			RequireEqualArchive(t, expected, actual)
+		}
+
+		_, err := str.Archive(ctx, "inexistent")
+		require.Equal(t, store.ErrNotFound, err)
+	})
+
+	// FileArchive tests looking up archives by their archived files
+	t.Run("FileArchive", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		archives := []store.Archive{
+			NewArchive(
+				t,
+				str,
+				File{Name: "foo.txt", Contents: "foo"},
+				File{Name: "bar.txt", Contents: "bar"},
+			),
+			NewArchive(t, str, File{Name: "baz.txt", Contents: "baz"}),
+		}
+		for _, archive := range archives {
+			require.NoError(t, str.SaveArchive(ctx, archive))
+		}
+
+		for _, expected := range archives {
+			for _, fl := range expected.Files {
+				actual, err := str.FileArchive(ctx, fl.ID)
+				require.NoError(t, err)
+				RequireEqualArchive(t, expected, actual)
+			}
+		}
+
+		// Only archived files are indexed
+		for _, id := range []string{"inexistent", archives[0].ContentsID} {
+			_, err := str.FileArchive(ctx, id)
+			require.Equal(t, store.ErrNotFound, err)
+		}
+
+		require.NoError(t, str.DeleteArchive(ctx, archives[0].ID))
+		for _, fl := range archives[0].Files {
+			_, err := str.FileArchive(ctx, fl.ID)
+			require.Equal(t, store.ErrNotFound, err)
+		}
+		actual, err := str.FileArchive(ctx, archives[1].Files[0].ID)
+		require.NoError(t, err)
+		RequireEqualArchive(t, archives[1], actual)
+	})
+
+	// QueryArchives tests querying archives
+	t.Run("QueryArchives", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		archives := make([]store.Archive, 5)
+		for i := range archives {
+			archives[i] = NewArchive(t, str, File{
+				Name:     fmt.Sprintf("file_%d.txt", i),
+				Contents: "contents",
+			})
+			archives[i].ClientAgent = fmt.Sprintf("agent/%d", i%2)
+			archives[i].Size = int64(100 * (i + 1))
+			require.NoError(t, str.SaveArchive(ctx, archives[i]))
+		}
+
+		query := func(query store.ArchiveQuery, expected ...int) {
+			page, err := str.QueryArchives(ctx, query)
+			require.NoError(t, err)
+			require.Empty(t, page.Cursor)
+			require.Len(t, page.Archives, len(expected))
+			for i, ix := range expected {
+				RequireEqualArchive(t, archives[ix], page.Archives[i])
+			}
+		}
+
+		// All, newest first
+		query(store.ArchiveQuery{}, 4, 3, 2, 1, 0)
+
+		// Time range
+		query(store.ArchiveQuery{
+			Since: archives[1].Created,
+			Until: archives[3].Created,
+		}, 2, 1)
+
+		// Client agent
+		query(store.ArchiveQuery{ClientAgent: "agent/1"}, 3, 1)
+
+		// File name
+		query(store.ArchiveQuery{FileName: "_2."}, 2)
+		query(store.ArchiveQuery{FileName: "inexistent"})
+
+		// Size
+		query(store.ArchiveQuery{MinSize: 200, MaxSize: 400}, 3, 2, 1)
+
+		// Combined
+		query(store.ArchiveQuery{
+			Since:       archives[1].Created,
+			ClientAgent: "agent/0",
+			MaxSize:     400,
+		}, 2)
+	})
+
+	// QueryArchivesPagination tests paging through archives
+	t.Run("QueryArchivesPagination", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		archives := make([]store.Archive, 5)
+		for i := range archives {
+			archives[i] = NewArchive(t, str, File{
+				Name:     "foo.txt",
+				Contents: "foo",
+			})
+			require.NoError(t, str.SaveArchive(ctx, archives[i]))
+		}
+
+		var actual []string
+		query := store.ArchiveQuery{Limit: 2}
+		for pages := 0; ; pages++ {
+			require.True(t, pages < 3, "too many pages")
+			page, err := str.QueryArchives(ctx, query)
+			require.NoError(t, err)
+			require.True(t, len(page.Archives) <= query.Limit)
+			for _, archive := range page.Archives {
+				actual = append(actual, archive.ID)
+			}
+			if page.Cursor == "" {
+				break
+			}
+			query.Cursor = page.Cursor
+		}
+
+		expected := make([]string, len(archives))
+		for i, archive := range archives {
+			expected[len(archives)-1-i] = archive.ID
+		}
+		require.Equal(t, expected, actual)
+
+		// Invalid cursor
+		_, err := str.QueryArchives(ctx, store.ArchiveQuery{Cursor: "!"})
+		require.Equal(t, store.ErrInvalidCursor, err)
+	})
+
+	// DeleteArchive tests deleting archives including their files
+	t.Run("DeleteArchive", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		archives := []store.Archive{
+			NewArchive(t, str, File{Name: "foo.txt", Contents: "foo"}),
+			NewArchive(t, str, File{Name: "bar.txt", Contents: "bar"}),
+			NewArchive(t, str, File{Name: "baz.txt", Contents: "baz"}),
+		}
+		for _, archive := range archives {
+			require.NoError(t, str.SaveArchive(ctx, archive))
+		}
+
+		deleted := archives[1]
+		require.NoError(t, str.DeleteArchive(ctx, deleted.ID))
+
+		_, err := str.Archive(ctx, deleted.ID)
+		require.Equal(t, store.ErrNotFound, err)
+		require.Equal(
+			t,
+			store.ErrNotFound,
+			str.DeleteArchive(ctx, deleted.ID),
+		)
+		for _, id := range []string{deleted.ContentsID, deleted.Files[0].ID} {
+			_, err := str.OpenFile(ctx, id)
+			require.Equal(t, store.ErrNotFound, err)
+		}
+
+		saved := savedArchives(t, str)
+		require.Len(t, saved, 2)
+		RequireEqualArchive(t, archives[2], saved[0])
+		RequireEqualArchive(t, archives[0], saved[1])
+		require.Equal(t, "baz", ReadFile(t, str, archives[2].Files[0].ID))
+	})
+
+	// SaveJob tests saving and replacing job records
+	t.Run("SaveJob", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		job := NewJob(
+			t,
+			str,
+			File{Name: "foo.txt", Contents: "foo foo foo"},
+			File{Name: "bar.txt", Contents: "bar"},
+		)
+		job.Files[0].ModTime = testTime.Add(-time.Hour)
+		job.Files[0].Mode = 0755
+		job.Files[0].Comment = "foo file"
+		require.NoError(t, str.SaveJob(ctx, job))
+
+		actual, err := str.Job(ctx, job.ID)
+		require.NoError(t, err)
+		RequireEqualJob(t, job, actual)
+
+		// Committed files can only be deleted by releasing them
+		require.Equal(
+			t,
+			store.ErrNotFound,
+			str.DeleteFile(ctx, job.Files[0].ID),
+		)
+		require.Equal(t, "bar", ReadFile(t, str, job.Files[1].ID))
+
+		// Replace the record
+		job.Status = store.JobRunning
+		require.NoError(t, str.SaveJob(ctx, job))
+		actual, err = str.Job(ctx, job.ID)
+		require.NoError(t, err)
+		RequireEqualJob(t, job, actual)
+
+		_, err = str.Job(ctx, "inexistent")
+		require.Equal(t, store.ErrNotFound, err)
+	})
+
+	// SaveJobReleaseFiles tests removing the files
+	// no longer referenced by a job record
+	t.Run("SaveJobReleaseFiles", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		job := NewJob(
+			t,
+			str,
+			File{Name: "foo.txt", Contents: "foo"},
+			File{Name: "bar.txt", Contents: "bar"},
+		)
+		require.NoError(t, str.SaveJob(ctx, job))
+
+		released := job.Files
+		job.Status = store.JobDone
+		job.ArchiveID = "c0ffee"
+		job.Finished = testTime.Add(time.Hour)
+		job.Files = nil
+		require.NoError(t, str.SaveJob(ctx, job))
+
+		for _, fl := range released {
+			_, err := str.OpenFile(ctx, fl.ID)
+			require.Equal(t, store.ErrNotFound, err)
+		}
+		actual, err := str.Job(ctx, job.ID)
+		require.NoError(t, err)
+		RequireEqualJob(t, job, actual)
+	})
+
+	// SaveJobUnknownFile tests saving a job
+	// referencing files that weren't saved
+	t.Run("SaveJobUnknownFile", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		job := NewJob(t, str, File{Name: "foo.txt", Contents: "foo"})
+		job.Files = append(job.Files, store.File{
+			ID:   "inexistent",
+			Name: "bar.txt",
+		})
+		require.Error(t, str.SaveJob(ctx, job))
+
+		_, err := str.Job(ctx, job.ID)
+		require.Equal(t, store.ErrNotFound, err)
+
+		// The saved files must remain uncommitted
+		require.NoError(t, str.DeleteFile(ctx, job.Files[0].ID))
+	})
+
+	// UnfinishedJobs tests listing the jobs which aren't finished
+	t.Run("UnfinishedJobs", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		jobs := make([]store.Job, 4)
+		for i := range jobs {
+			jobs[i] = NewJob(t, str, File{Name: "foo.txt", Contents: "foo"})
+		}
+		jobs[1].Status = store.JobRunning
+		jobs[2].Status = store.JobFailed
+		jobs[2].Error = "failed"
+		jobs[2].Files = nil
+
+		// Save in reverse order to make sure they're sorted
+		for i := len(jobs) - 1; i >= 0; i-- {
+			require.NoError(t, str.SaveJob(ctx, jobs[i]))
+		}
+
+		unfinished, err := str.UnfinishedJobs(ctx)
+		require.NoError(t, err)
+		require.Len(t, unfinished, 3)
+		RequireEqualJob(t, jobs[0], unfinished[0])
+		RequireEqualJob(t, jobs[1], unfinished[1])
+		RequireEqualJob(t, jobs[3], unfinished[2])
+	})
+
+	// FinishedJobs tests listing the jobs finished before a given time
+	t.Run("FinishedJobs", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		jobs := make([]store.Job, 4)
+		for i := range jobs {
+			jobs[i] = NewJob(t, str, File{Name: "foo.txt", Contents: "foo"})
+		}
+		jobs[0].Status = store.JobDone
+		jobs[0].ArchiveID = "c0ffee"
+		jobs[0].Finished = testTime.Add(time.Hour)
+		jobs[0].Files = nil
+		jobs[1].Status = store.JobRunning
+		jobs[2].Status = store.JobFailed
+		jobs[2].Error = "failed"
+		jobs[2].Finished = testTime.Add(2 * time.Hour)
+		jobs[2].Files = nil
+		jobs[3].Status = store.JobDone
+		jobs[3].ArchiveID = "f00d"
+		jobs[3].Finished = testTime.Add(3 * time.Hour)
+		jobs[3].Files = nil
+
+		// Save in reverse order to make sure they're sorted
+		for i := len(jobs) - 1; i >= 0; i-- {
+			require.NoError(t, str.SaveJob(ctx, jobs[i]))
+		}
+
+		finished, err := str.FinishedJobs(ctx, testTime.Add(3*time.Hour))
+		require.NoError(t, err)
+		require.Len(t, finished, 2)
+		RequireEqualJob(t, jobs[0], finished[0])
+		RequireEqualJob(t, jobs[2], finished[1])
+
+		finished, err = str.FinishedJobs(ctx, testTime)
+		require.NoError(t, err)
+		require.Len(t, finished, 0)
+	})
+
+	// DeleteJob tests deleting job records
+	// including the files they reference
+	t.Run("DeleteJob", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		jobs := make([]store.Job, 2)
+		for i := range jobs {
+			jobs[i] = NewJob(t, str, File{Name: "foo.txt", Contents: "foo"})
+			require.NoError(t, str.SaveJob(ctx, jobs[i]))
+		}
+
+		deleted := jobs[0]
+		require.NoError(t, str.DeleteJob(ctx, deleted.ID))
+
+		_, err := str.Job(ctx, deleted.ID)
+		require.Equal(t, store.ErrNotFound, err)
+		require.Equal(t, store.ErrNotFound, str.DeleteJob(ctx, deleted.ID))
+		_, err = str.OpenFile(ctx, deleted.Files[0].ID)
+		require.Equal(t, store.ErrNotFound, err)
+
+		actual, err := str.Job(ctx, jobs[1].ID)
+		require.NoError(t, err)
+		RequireEqualJob(t, jobs[1], actual)
+		require.Equal(t, "foo", ReadFile(t, str, jobs[1].Files[0].ID))
+	})
+
+	// SaveArchiveConcurrent tests saving archives from multiple goroutines
+	t.Run("SaveArchiveConcurrent", func(t *testing.T) {
+		str, teardown := setup(t)
+		defer teardown()
+
+		wg := sync.WaitGroup{}
+		wg.Add(8)
+		for i := 0; i < 8; i++ {
+			go func(i int) {
+				defer wg.Done()
+				archive := NewArchive(
+					t,
+					str,
+					File{Name: fmt.Sprintf("%d_a.txt", i), Contents: "a"},
+					File{Name: fmt.Sprintf("%d_b.txt", i), Contents: "b"},
+				)
+				assert.NoError(t, str.SaveArchive(ctx, archive))
+			}(i)
+		}
+		wg.Wait()
+
+		require.Len(t, savedArchives(t, str), 8)
+	})
+}